@@ -0,0 +1,379 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/jacobbrewer1/uhttp"
+	"github.com/serialx/hashring"
+	corev1 "k8s.io/api/core/v1"
+	kubeerrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+
+	"github.com/jacobbrewer1/web/k8s"
+	"github.com/jacobbrewer1/web/logging"
+)
+
+const (
+	// adminReadHeaderTimeout is the time allowed to read the headers of an admin API request.
+	adminReadHeaderTimeout = 10 * time.Second
+
+	// bearerPrefix prefixes the token in the Authorization header.
+	bearerPrefix = "Bearer "
+
+	// serviceNameLabel is the label selecting the EndpointSlices of the reloader service, as used by the hash ring.
+	serviceNameLabel = "app.kubernetes.io/name"
+)
+
+var (
+	// ErrAdminToken is returned when the admin API is enabled without a token.
+	ErrAdminToken = errors.New("admin API requires a token")
+
+	// errNoReplicas is returned when the hash ring has no replicas.
+	errNoReplicas = errors.New("no reloader replicas found")
+
+	// errUnknownGraphFormat is returned when the dependency graph is requested in an unknown format.
+	errUnknownGraphFormat = errors.New("unknown graph format")
+)
+
+type (
+	// dependency is an object and the pods depending on it.
+	dependency struct {
+		// Object is the key of the object.
+		Object string `json:"object"`
+
+		// Kind is the API kind of the object.
+		Kind string `json:"kind"`
+
+		// Namespace is the namespace of the object.
+		Namespace string `json:"namespace"`
+
+		// Name is the name of the object.
+		Name string `json:"name"`
+
+		// Pods are the names of the pods depending on the object.
+		Pods []string `json:"pods"`
+
+		// Workloads are the workloads owning the pods. Only set when a single object is requested.
+		Workloads []string `json:"workloads,omitempty"`
+	}
+
+	// ringOwner describes the replica owning a key in the hash ring.
+	ringOwner struct {
+		// Key is the key looked up, the name of the object.
+		Key string `json:"key"`
+
+		// Owner is the replica handling the key.
+		Owner string `json:"owner"`
+
+		// Self is the replica that answered the request.
+		Self string `json:"self"`
+
+		// Replicas are all the replicas in the hash ring.
+		Replicas []string `json:"replicas"`
+	}
+
+	// reloadsStatus is the state of the reloads known to this replica.
+	reloadsStatus struct {
+		// Pending are the reloads held by a pause or the circuit breaker.
+		Pending []*reloadRecord `json:"pending"`
+
+		// Queued are the reloads in progress, including those waiting for the restart budget.
+		Queued []*reloadRecord `json:"queued"`
+
+		// Failed are the most recent failed reloads.
+		Failed []*reloadRecord `json:"failed"`
+	}
+
+	// adminAPI serves the authenticated admin HTTP API used to inspect reloader and trigger reloads.
+	adminAPI struct {
+		// ctx is the context of manually triggered reloads, which outlive the request.
+		ctx context.Context
+
+		// l is the logger.
+		l *slog.Logger
+
+		// token is the bearer token required by every request.
+		token string
+
+		// namespace is the namespace reloader is deployed to.
+		namespace string
+
+		// kubeClient is used to read the hash ring replicas.
+		kubeClient kubernetes.Interface
+
+		// reloader performs manually triggered reloads.
+		reloader *reloader
+
+		// graph builds the dependency graph.
+		graph *graphBuilder
+	}
+)
+
+// loadAdminToken reads the admin API token. The admin API is never served without a token.
+func loadAdminToken(addr, path string) (string, error) {
+	if addr == "" {
+		return "", nil
+	} else if path == "" {
+		return "", ErrAdminToken
+	}
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to read admin token: %w", err)
+	}
+
+	token := strings.TrimSpace(string(b))
+	if token == "" {
+		return "", ErrAdminToken
+	}
+	return token, nil
+}
+
+// newAdminAPI creates a new adminAPI.
+func newAdminAPI(
+	ctx context.Context,
+	l *slog.Logger,
+	token string,
+	namespace string,
+	kubeClient kubernetes.Interface,
+	r *reloader,
+	graph *graphBuilder,
+) *adminAPI {
+	return &adminAPI{
+		ctx:        ctx,
+		l:          l,
+		token:      token,
+		namespace:  namespace,
+		kubeClient: kubeClient,
+		reloader:   r,
+		graph:      graph,
+	}
+}
+
+// handler returns the HTTP handler of the admin API.
+func (a *adminAPI) handler() http.Handler {
+	r := mux.NewRouter()
+	r.Use(a.authenticate)
+
+	r.HandleFunc("/v1/dependencies", a.listDependencies).Methods(http.MethodGet)
+	r.HandleFunc("/v1/dependencies/{namespace}/{kind}/{name}", a.getDependency).Methods(http.MethodGet)
+	r.HandleFunc("/v1/graph", a.getGraph).Methods(http.MethodGet)
+	r.HandleFunc("/v1/ring/{key}", a.getRingOwner).Methods(http.MethodGet)
+	r.HandleFunc("/v1/reloads", a.listReloads).Methods(http.MethodGet)
+	r.HandleFunc("/v1/reloads/{namespace}/{kind}/{name}", a.triggerReload).Methods(http.MethodPost)
+
+	return r
+}
+
+// authenticate rejects requests without the admin bearer token.
+func (a *adminAPI) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), bearerPrefix)
+		if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(a.token)) != 1 {
+			uhttp.UnauthorizedHandler()(w, r)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// listDependencies lists the tracked objects and the pods depending on them, optionally filtered by the namespace
+// query parameter.
+func (a *adminAPI) listDependencies(w http.ResponseWriter, r *http.Request) {
+	namespace := r.URL.Query().Get("namespace")
+
+	keys := a.reloader.podIndexer.ListIndexFuncValues(indexDependencies)
+	sort.Strings(keys)
+
+	deps := make([]*dependency, 0, len(keys))
+	for _, key := range keys {
+		parts := strings.SplitN(key, "/", 3)
+		if len(parts) != 3 || (namespace != "" && parts[0] != namespace) {
+			continue
+		}
+
+		kind, err := apiKind(parts[1])
+		if err != nil {
+			continue
+		}
+
+		pods, err := indexedPods(a.reloader.podIndexer, key)
+		if err != nil {
+			uhttp.MustEncode(w, http.StatusInternalServerError, uhttp.NewHTTPError(http.StatusInternalServerError, err))
+			return
+		} else if len(pods) == 0 {
+			continue
+		}
+
+		dep := &dependency{
+			Object:    key,
+			Kind:      kind,
+			Namespace: parts[0],
+			Name:      parts[2],
+			Pods:      make([]string, 0, len(pods)),
+		}
+		for _, pod := range pods {
+			dep.Pods = append(dep.Pods, pod.Name)
+		}
+		deps = append(deps, dep)
+	}
+
+	uhttp.MustEncode(w, http.StatusOK, deps)
+}
+
+// getDependency returns the pods and workloads depending on a single object.
+func (a *adminAPI) getDependency(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	kind, err := apiKind(vars["kind"])
+	if err != nil {
+		uhttp.GenericErrorHandler(w, r, err)
+		return
+	}
+
+	pods, err := a.reloader.dependents(&corev1.ObjectReference{Kind: kind, Namespace: vars["namespace"], Name: vars["name"]})
+	if err != nil {
+		uhttp.MustEncode(w, http.StatusInternalServerError, uhttp.NewHTTPError(http.StatusInternalServerError, err))
+		return
+	}
+
+	dep := &dependency{
+		Object:    objectKey(strings.ToLower(kind), vars["namespace"], vars["name"]),
+		Kind:      kind,
+		Namespace: vars["namespace"],
+		Name:      vars["name"],
+		Pods:      make([]string, 0, len(pods)),
+		Workloads: podWorkloads(r.Context(), a.kubeClient, pods),
+	}
+	for _, pod := range pods {
+		dep.Pods = append(dep.Pods, pod.Name)
+	}
+
+	uhttp.MustEncode(w, http.StatusOK, dep)
+}
+
+// getGraph returns the dependency graph, optionally filtered by the namespace query parameter. The format query
+// parameter selects json, the default, or dot.
+func (a *adminAPI) getGraph(w http.ResponseWriter, r *http.Request) {
+	format := r.URL.Query().Get("format")
+	if format != "" && format != graphFormatJSON && format != graphFormatDOT {
+		uhttp.GenericErrorHandler(w, r, fmt.Errorf("%w: %s", errUnknownGraphFormat, format))
+		return
+	}
+
+	graph, err := a.graph.build(r.Context(), r.URL.Query().Get("namespace"))
+	if err != nil {
+		uhttp.MustEncode(w, http.StatusInternalServerError, uhttp.NewHTTPError(http.StatusInternalServerError, err))
+		return
+	}
+
+	if format != graphFormatDOT {
+		uhttp.MustEncode(w, http.StatusOK, graph)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/vnd.graphviz")
+	if err := graph.writeDOT(w); err != nil {
+		a.l.Error("failed to write graph", slog.String(logging.KeyError, err.Error()))
+	}
+}
+
+// getRingOwner returns the replica owning a key in the hash ring. The key is the name of an object.
+func (a *adminAPI) getRingOwner(w http.ResponseWriter, r *http.Request) {
+	key := mux.Vars(r)["key"]
+
+	replicas, err := a.replicas(r.Context())
+	if err != nil {
+		uhttp.MustEncode(w, http.StatusInternalServerError, uhttp.NewHTTPError(http.StatusInternalServerError, err))
+		return
+	} else if len(replicas) == 0 {
+		uhttp.MustEncode(w, http.StatusServiceUnavailable, uhttp.NewHTTPError(http.StatusServiceUnavailable, errNoReplicas))
+		return
+	}
+
+	owner, _ := hashring.New(replicas).GetNode(key)
+	uhttp.MustEncode(w, http.StatusOK, &ringOwner{
+		Key:      key,
+		Owner:    owner,
+		Self:     k8s.PodName(),
+		Replicas: replicas,
+	})
+}
+
+// replicas returns the sorted pod names of the reloader replicas, read from the same EndpointSlices as the hash
+// ring.
+func (a *adminAPI) replicas(ctx context.Context) ([]string, error) {
+	slices, err := a.kubeClient.DiscoveryV1().EndpointSlices(a.namespace).List(ctx, metav1.ListOptions{
+		LabelSelector: serviceNameLabel + "=" + appName,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list endpoint slices: %w", err)
+	}
+
+	seen := make(map[string]bool)
+	replicas := make([]string, 0)
+	for i := range slices.Items {
+		for _, endpoint := range slices.Items[i].Endpoints {
+			if endpoint.TargetRef == nil || endpoint.TargetRef.Kind != "Pod" || seen[endpoint.TargetRef.Name] {
+				continue
+			}
+			seen[endpoint.TargetRef.Name] = true
+			replicas = append(replicas, endpoint.TargetRef.Name)
+		}
+	}
+	sort.Strings(replicas)
+	return replicas, nil
+}
+
+// listReloads returns the pending, queued and failed reloads of this replica.
+func (a *adminAPI) listReloads(w http.ResponseWriter, _ *http.Request) {
+	uhttp.MustEncode(w, http.StatusOK, &reloadsStatus{
+		Pending: append(a.reloader.pause.pendingReloads(), a.reloader.breaker.pendingReloads()...),
+		Queued:  a.reloader.tracker.queuedReloads(),
+		Failed:  a.reloader.tracker.failedReloads(),
+	})
+}
+
+// triggerReload reloads the pods depending on an object, whatever replica owns it. Pauses, the circuit breaker, strict
+// mode and content validation still apply. The reload runs in the background, so the request returns once it is
+// accepted.
+func (a *adminAPI) triggerReload(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	obj, err := a.reloader.resolveTrigger(r.Context(), a.l, vars["namespace"], vars["kind"], vars["name"])
+	switch {
+	case kubeerrors.IsNotFound(err):
+		uhttp.MustEncode(w, http.StatusNotFound, uhttp.NewHTTPError(http.StatusNotFound, err))
+		return
+	case errors.Is(err, errTriggerInvalid), errors.Is(err, errTriggerIgnored):
+		uhttp.MustEncode(w, http.StatusUnprocessableEntity, uhttp.NewHTTPError(http.StatusUnprocessableEntity, err))
+		return
+	case err != nil:
+		uhttp.GenericErrorHandler(w, r, err)
+		return
+	}
+
+	a.l.Info("manual reload triggered", slog.String(logKeyObject, referenceKey(obj.ref)))
+	go a.reloader.reload(a.ctx, a.l, obj.ref, obj.keys, obj.hash)
+
+	uhttp.MustSendMessageWithStatus(w, http.StatusAccepted, "reload triggered for "+referenceKey(obj.ref))
+}
+
+// server returns the HTTP server of the admin API listening on the given address.
+func (a *adminAPI) server(addr string) *http.Server {
+	return &http.Server{
+		Addr:              addr,
+		Handler:           a.handler(),
+		ReadHeaderTimeout: adminReadHeaderTimeout,
+	}
+}
@@ -0,0 +1,305 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes/fake"
+
+	"github.com/jacobbrewer1/web/cache"
+)
+
+const testableAdminToken = "secret-token"
+
+func testableAdminAPI(t *testing.T, objects ...*corev1.Pod) (*adminAPI, *fake.Clientset) {
+	t.Helper()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	kubeClient := fake.NewClientset()
+	for _, pod := range objects {
+		_, err := kubeClient.CoreV1().Pods(pod.Namespace).Create(ctx, pod, metav1.CreateOptions{})
+		require.NoError(t, err)
+	}
+
+	informerFactory := informers.NewSharedInformerFactory(kubeClient, 0)
+	rel := testableReloader(t, cache.NewFixedHashBucket(1), kubeClient, informerFactory)
+	api := newAdminAPI(
+		ctx,
+		slog.New(slog.DiscardHandler),
+		testableAdminToken,
+		"reloader",
+		kubeClient,
+		rel,
+		newGraphBuilder(
+			kubeClient,
+			informerFactory.Core().V1().Pods().Lister(),
+			informerFactory.Core().V1().ConfigMaps().Lister(),
+			informerFactory.Core().V1().Secrets().Lister(),
+		),
+	)
+	informerFactory.Start(ctx.Done())
+	informerFactory.WaitForCacheSync(ctx.Done())
+
+	return api, kubeClient
+}
+
+func testableDependentPod(t *testing.T, name, namespace, kind, object string) *corev1.Pod {
+	t.Helper()
+	return &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: namespace,
+			Labels:    map[string]string{dependencyLabel(kind): object},
+		},
+		Status: corev1.PodStatus{
+			Phase: corev1.PodRunning,
+		},
+	}
+}
+
+func adminRequest(t *testing.T, api *adminAPI, method, path string) *httptest.ResponseRecorder {
+	t.Helper()
+
+	req := httptest.NewRequest(method, path, http.NoBody)
+	req.Header.Set("Authorization", bearerPrefix+testableAdminToken)
+
+	rec := httptest.NewRecorder()
+	api.handler().ServeHTTP(rec, req)
+	return rec
+}
+
+func Test_LoadAdminToken(t *testing.T) {
+	t.Parallel()
+
+	t.Run("disabled", func(t *testing.T) {
+		t.Parallel()
+
+		token, err := loadAdminToken("", "")
+		require.NoError(t, err)
+		require.Empty(t, token)
+	})
+
+	t.Run("missing token", func(t *testing.T) {
+		t.Parallel()
+
+		_, err := loadAdminToken(":8081", "")
+		require.ErrorIs(t, err, ErrAdminToken)
+	})
+
+	t.Run("token file", func(t *testing.T) {
+		t.Parallel()
+
+		path := filepath.Join(t.TempDir(), "token")
+		require.NoError(t, os.WriteFile(path, []byte(testableAdminToken+"\n"), 0o600))
+
+		token, err := loadAdminToken(":8081", path)
+		require.NoError(t, err)
+		require.Equal(t, testableAdminToken, token)
+	})
+}
+
+func Test_AdminAPIAuthentication(t *testing.T) {
+	t.Parallel()
+
+	api, _ := testableAdminAPI(t)
+
+	for name, header := range map[string]string{
+		"missing":   "",
+		"wrong":     bearerPrefix + "wrong",
+		"no bearer": testableAdminToken,
+	} {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			req := httptest.NewRequest(http.MethodGet, "/v1/reloads", http.NoBody)
+			if header != "" {
+				req.Header.Set("Authorization", header)
+			}
+
+			rec := httptest.NewRecorder()
+			api.handler().ServeHTTP(rec, req)
+			require.Equal(t, http.StatusUnauthorized, rec.Code)
+		})
+	}
+}
+
+func Test_AdminAPIDependencies(t *testing.T) {
+	t.Parallel()
+
+	api, _ := testableAdminAPI(t,
+		testableDependentPod(t, "api-b", "team-a", "Secret", "db"),
+		testableDependentPod(t, "api-a", "team-a", "Secret", "db"),
+		testableDependentPod(t, "web", "team-a", "ConfigMap", "web"),
+		testableDependentPod(t, "other", "team-b", "Secret", "db"),
+	)
+
+	t.Run("list", func(t *testing.T) {
+		t.Parallel()
+
+		rec := adminRequest(t, api, http.MethodGet, "/v1/dependencies?namespace=team-a")
+		require.Equal(t, http.StatusOK, rec.Code)
+
+		deps := make([]*dependency, 0)
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &deps))
+		require.Equal(t, []*dependency{
+			{Object: "team-a/configmap/web", Kind: "ConfigMap", Namespace: "team-a", Name: "web", Pods: []string{"web"}},
+			{Object: "team-a/secret/db", Kind: "Secret", Namespace: "team-a", Name: "db", Pods: []string{"api-a", "api-b"}},
+		}, deps)
+	})
+
+	t.Run("object", func(t *testing.T) {
+		t.Parallel()
+
+		rec := adminRequest(t, api, http.MethodGet, "/v1/dependencies/team-a/secret/db")
+		require.Equal(t, http.StatusOK, rec.Code)
+
+		dep := new(dependency)
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), dep))
+		require.Equal(t, []string{"api-a", "api-b"}, dep.Pods)
+		require.ElementsMatch(t, []string{"Pod/api-a", "Pod/api-b"}, dep.Workloads)
+	})
+
+	t.Run("unknown kind", func(t *testing.T) {
+		t.Parallel()
+
+		rec := adminRequest(t, api, http.MethodGet, "/v1/dependencies/team-a/deployment/db")
+		require.Equal(t, http.StatusBadRequest, rec.Code)
+	})
+}
+
+func Test_AdminAPIRingOwner(t *testing.T) {
+	t.Parallel()
+
+	t.Run("no replicas", func(t *testing.T) {
+		t.Parallel()
+
+		api, _ := testableAdminAPI(t)
+
+		rec := adminRequest(t, api, http.MethodGet, "/v1/ring/db")
+		require.Equal(t, http.StatusServiceUnavailable, rec.Code)
+	})
+
+	t.Run("owner", func(t *testing.T) {
+		t.Parallel()
+
+		api, kubeClient := testableAdminAPI(t)
+
+		slice := &discoveryv1.EndpointSlice{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      "reloader-abc",
+				Namespace: "reloader",
+				Labels:    map[string]string{serviceNameLabel: appName},
+			},
+			Endpoints: []discoveryv1.Endpoint{
+				{TargetRef: &corev1.ObjectReference{Kind: "Pod", Name: "reloader-1"}},
+				{TargetRef: &corev1.ObjectReference{Kind: "Pod", Name: "reloader-0"}},
+			},
+		}
+		_, err := kubeClient.DiscoveryV1().EndpointSlices("reloader").Create(context.Background(), slice, metav1.CreateOptions{})
+		require.NoError(t, err)
+
+		rec := adminRequest(t, api, http.MethodGet, "/v1/ring/db")
+		require.Equal(t, http.StatusOK, rec.Code)
+
+		owner := new(ringOwner)
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), owner))
+		require.Equal(t, "db", owner.Key)
+		require.Equal(t, []string{"reloader-0", "reloader-1"}, owner.Replicas)
+		require.Contains(t, owner.Replicas, owner.Owner)
+	})
+}
+
+func Test_AdminAPIReloads(t *testing.T) {
+	t.Parallel()
+
+	pod := testableDependentPod(t, "api", "default", "ConfigMap", "app")
+	api, kubeClient := testableAdminAPI(t, pod)
+
+	ctx := context.Background()
+	configMap := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "default"},
+		Data:       map[string]string{"key": "value"},
+	}
+	_, err := kubeClient.CoreV1().ConfigMaps("default").Create(ctx, configMap, metav1.CreateOptions{})
+	require.NoError(t, err)
+
+	require.Eventually(t, func() bool {
+		_, err := api.reloader.configMapLister.ConfigMaps("default").Get("app")
+		return err == nil
+	}, 5*time.Second, 10*time.Millisecond)
+
+	t.Run("not found", func(t *testing.T) {
+		t.Parallel()
+
+		rec := adminRequest(t, api, http.MethodPost, "/v1/reloads/default/configmap/missing")
+		require.Equal(t, http.StatusNotFound, rec.Code)
+	})
+
+	t.Run("trigger", func(t *testing.T) {
+		t.Parallel()
+
+		rec := adminRequest(t, api, http.MethodPost, "/v1/reloads/default/configmap/app")
+		require.Equal(t, http.StatusAccepted, rec.Code)
+
+		require.Eventually(t, func() bool {
+			_, err := kubeClient.CoreV1().Pods("default").Get(ctx, pod.Name, metav1.GetOptions{})
+			return k8serrors.IsNotFound(err)
+		}, 5*time.Second, 10*time.Millisecond)
+	})
+}
+
+func Test_AdminAPIReloadsStatus(t *testing.T) {
+	t.Parallel()
+
+	pod := testableDependentPod(t, "api", "default", "ConfigMap", "app")
+	api, _ := testableAdminAPI(t)
+
+	ref := &corev1.ObjectReference{Kind: "Secret", Namespace: "default", Name: "db"}
+	api.reloader.tracker.start(ref, []string{"password"}, []*corev1.Pod{pod})
+	api.reloader.tracker.finish(api.reloader.tracker.start(ref, nil, []*corev1.Pod{pod}), errors.New("boom"))
+
+	rec := adminRequest(t, api, http.MethodGet, "/v1/reloads")
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	status := new(reloadsStatus)
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), status))
+	require.Empty(t, status.Pending)
+	require.Len(t, status.Queued, 1)
+	require.Equal(t, "default/secret/db", status.Queued[0].Object)
+	require.Equal(t, []string{"password"}, status.Queued[0].ChangedKeys)
+	require.Len(t, status.Failed, 1)
+	require.Equal(t, "boom", status.Failed[0].Reason)
+}
+
+func Test_ReloadTrackerFailedHistory(t *testing.T) {
+	t.Parallel()
+
+	tracker := newReloadTracker(2)
+	ref := &corev1.ObjectReference{Kind: "Secret", Namespace: "default", Name: "db"}
+	for _, reason := range []string{"first", "second", "third"} {
+		tracker.finish(tracker.start(ref, nil, nil), errors.New(reason))
+	}
+	tracker.finish(tracker.start(ref, nil, nil), nil)
+
+	failed := tracker.failedReloads()
+	require.Len(t, failed, 2)
+	require.Equal(t, "second", failed[0].Reason)
+	require.Equal(t, "third", failed[1].Reason)
+	require.Empty(t, tracker.queuedReloads())
+}
@@ -0,0 +1,311 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/jacobbrewer1/uhttp"
+	admissionv1 "k8s.io/api/admission/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	listersv1 "k8s.io/client-go/listers/core/v1"
+
+	"github.com/jacobbrewer1/web/logging"
+)
+
+const (
+	// enforcementDeny rejects objects failing admission checks.
+	enforcementDeny enforcementLevel = "deny"
+
+	// enforcementWarn admits objects failing admission checks with warnings.
+	enforcementWarn enforcementLevel = "warn"
+
+	// admissionReadHeaderTimeout is the time allowed to read the headers of an admission request.
+	admissionReadHeaderTimeout = 10 * time.Second
+
+	// admissionShutdownTimeout is the time allowed for admission requests in flight to finish on shutdown.
+	admissionShutdownTimeout = 10 * time.Second
+
+	// admissionMaxBodyBytes bounds the size of an admission review, well above the largest object the API server
+	// accepts.
+	admissionMaxBodyBytes = 8 << 20
+
+	// admissionMessagePrefix prefixes admission warnings and denials, so that users know where they come from.
+	admissionMessagePrefix = "reloader: "
+)
+
+var (
+	// ErrInvalidEnforcement is returned when the admission enforcement level is unknown.
+	ErrInvalidEnforcement = errors.New("invalid admission enforcement level")
+
+	// ErrAdmissionTLS is returned when the admission webhook is enabled without a certificate.
+	ErrAdmissionTLS = errors.New("admission webhook requires a TLS certificate and key")
+
+	// errNoAdmissionRequest is returned for admission reviews without a request.
+	errNoAdmissionRequest = errors.New("admission review has no request")
+)
+
+// enforcementLevel is how admission checks are enforced.
+type enforcementLevel string
+
+// parseEnforcementLevel parses the configured admission enforcement level.
+func parseEnforcementLevel(s string) (enforcementLevel, error) {
+	switch level := enforcementLevel(s); level {
+	case enforcementDeny, enforcementWarn:
+		return level, nil
+	default:
+		return "", fmt.Errorf("%w: %q", ErrInvalidEnforcement, s)
+	}
+}
+
+type (
+	// certificateLoader serves a TLS certificate from files, reloading it when the certificate file changes so that
+	// rotated certificates are picked up without a restart.
+	certificateLoader struct {
+		// mut guards the loaded certificate.
+		mut *sync.Mutex
+
+		// certFile is the path of the PEM encoded certificate chain.
+		certFile string
+
+		// keyFile is the path of the PEM encoded private key.
+		keyFile string
+
+		// cert is the loaded certificate.
+		cert *tls.Certificate
+
+		// modTime is the modification time of the certificate file when it was loaded.
+		modTime time.Time
+	}
+
+	// admissionServer serves the admission webhooks.
+	admissionServer struct {
+		// l is the logger.
+		l *slog.Logger
+
+		// enforcement is how failed checks are enforced.
+		enforcement enforcementLevel
+
+		// reviewTimeout is the time allowed to answer a review reading the cluster before the object is admitted
+		// unchanged.
+		reviewTimeout time.Duration
+
+		// kubeClient is used to look up the objects missing from the listers.
+		kubeClient kubernetes.Interface
+
+		// reloader plans the reloads caused by object updates.
+		reloader *reloader
+
+		// configMapLister is used to check that referenced ConfigMaps exist.
+		configMapLister listersv1.ConfigMapLister
+
+		// secretLister is used to check that referenced Secrets exist.
+		secretLister listersv1.SecretLister
+	}
+)
+
+// newCertificateLoader creates a new certificateLoader. The certificate is loaded once, so that a broken certificate
+// is reported at startup.
+func newCertificateLoader(certFile, keyFile string) (*certificateLoader, error) {
+	if certFile == "" || keyFile == "" {
+		return nil, ErrAdmissionTLS
+	}
+
+	c := &certificateLoader{
+		mut:      new(sync.Mutex),
+		certFile: certFile,
+		keyFile:  keyFile,
+	}
+	if _, err := c.getCertificate(nil); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// getCertificate returns the certificate, reloading it if the certificate file changed. It is used as the
+// tls.Config GetCertificate callback.
+func (c *certificateLoader) getCertificate(_ *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	info, err := os.Stat(c.certFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to stat certificate: %w", err)
+	}
+
+	c.mut.Lock()
+	defer c.mut.Unlock()
+
+	if c.cert != nil && info.ModTime().Equal(c.modTime) {
+		return c.cert, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		if c.cert != nil {
+			// The key may not have been written yet, keep serving the previous certificate until it has.
+			return c.cert, nil
+		}
+		return nil, fmt.Errorf("failed to load certificate: %w", err)
+	}
+
+	c.cert, c.modTime = &cert, info.ModTime()
+	return c.cert, nil
+}
+
+// newAdmissionServer creates a new admissionServer.
+func newAdmissionServer(
+	l *slog.Logger,
+	enforcement enforcementLevel,
+	reviewTimeout time.Duration,
+	kubeClient kubernetes.Interface,
+	r *reloader,
+	configMapLister listersv1.ConfigMapLister,
+	secretLister listersv1.SecretLister,
+) *admissionServer {
+	return &admissionServer{
+		l:               l,
+		enforcement:     enforcement,
+		reviewTimeout:   reviewTimeout,
+		kubeClient:      kubeClient,
+		reloader:        r,
+		configMapLister: configMapLister,
+		secretLister:    secretLister,
+	}
+}
+
+// handler returns the HTTP handler of the admission webhooks.
+func (s *admissionServer) handler() http.Handler {
+	r := mux.NewRouter()
+	r.HandleFunc("/validate/labels", s.serveReview(webhookLabels, s.reviewLabels)).Methods(http.MethodPost)
+	r.HandleFunc("/mutate/dependencies", s.serveReview(webhookDependencies, s.reviewDependencies)).Methods(http.MethodPost)
+	r.HandleFunc("/validate/impact", s.serveReview(webhookImpact, s.reviewImpact)).Methods(http.MethodPost)
+	return r
+}
+
+// server returns the HTTPS server of the admission webhooks listening on the given address.
+func (s *admissionServer) server(addr string, certificates *certificateLoader) *http.Server {
+	return &http.Server{
+		Addr:              addr,
+		Handler:           s.handler(),
+		ReadHeaderTimeout: admissionReadHeaderTimeout,
+		TLSConfig: &tls.Config{
+			MinVersion:     tls.VersionTLS12,
+			GetCertificate: certificates.getCertificate,
+		},
+	}
+}
+
+// serveReview returns a handler decoding an AdmissionReview, answering its request with review and encoding the
+// response.
+func (s *admissionServer) serveReview(
+	webhook string,
+	review func(*admissionv1.AdmissionRequest) *admissionv1.AdmissionResponse,
+) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		in := new(admissionv1.AdmissionReview)
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, admissionMaxBodyBytes)).Decode(in); err != nil {
+			uhttp.GenericErrorHandler(w, r, fmt.Errorf("failed to decode admission review: %w", err))
+			return
+		} else if in.Request == nil {
+			uhttp.GenericErrorHandler(w, r, errNoAdmissionRequest)
+			return
+		}
+
+		resp := review(in.Request)
+		resp.UID = in.Request.UID
+
+		result := "allowed"
+		switch {
+		case !resp.Allowed:
+			result = "denied"
+		case len(resp.Warnings) > 0:
+			result = "warned"
+		case resp.Patch != nil:
+			result = "mutated"
+		}
+		admissionReviews.WithLabelValues(webhook, result).Inc()
+
+		uhttp.MustEncode(w, http.StatusOK, &admissionv1.AdmissionReview{
+			TypeMeta: in.TypeMeta,
+			Response: resp,
+		})
+	}
+}
+
+// bounded answers a review with the given function, admitting the object unchanged if it takes longer than the review
+// timeout. The function is given a context cancelled once the timeout is reached.
+func (s *admissionServer) bounded(
+	webhook string,
+	review func(context.Context) *admissionv1.AdmissionResponse,
+) *admissionv1.AdmissionResponse {
+	ctx, cancel := context.WithTimeout(context.Background(), s.reviewTimeout)
+	defer cancel()
+
+	done := make(chan *admissionv1.AdmissionResponse, 1)
+	go func() {
+		done <- review(ctx)
+	}()
+
+	select {
+	case resp := <-done:
+		return resp
+	case <-ctx.Done():
+		s.l.Warn("admission review timed out", slog.String(logKeyWebhook, webhook))
+		return &admissionv1.AdmissionResponse{Allowed: true}
+	}
+}
+
+// enforce answers an admission request failing the given checks according to the enforcement level.
+func (s *admissionServer) enforce(problems []string) *admissionv1.AdmissionResponse {
+	if len(problems) == 0 {
+		return &admissionv1.AdmissionResponse{Allowed: true}
+	}
+
+	messages := make([]string, 0, len(problems))
+	for _, problem := range problems {
+		messages = append(messages, admissionMessagePrefix+problem)
+	}
+
+	if s.enforcement == enforcementWarn {
+		return &admissionv1.AdmissionResponse{Allowed: true, Warnings: messages}
+	}
+
+	return &admissionv1.AdmissionResponse{
+		Allowed: false,
+		Result: &metav1.Status{
+			Status:  metav1.StatusFailure,
+			Code:    http.StatusForbidden,
+			Reason:  metav1.StatusReasonForbidden,
+			Message: admissionMessagePrefix + strings.Join(problems, "; "),
+		},
+	}
+}
+
+// serveAdmission serves the admission webhooks over HTTPS until the context is done.
+func (a *App) serveAdmission(ctx context.Context) {
+	l := logging.LoggerWithComponent(a.base.Logger(), "admission")
+	srv := a.admission.server(a.config.AdmissionAddr, a.certificates)
+
+	go func() {
+		<-ctx.Done()
+
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), admissionShutdownTimeout)
+		defer cancel()
+		if err := srv.Shutdown(shutdownCtx); err != nil {
+			l.Error("failed to shut down admission server", slog.String(logging.KeyError, err.Error()))
+		}
+	}()
+
+	l.Info("admission server listening")
+	if err := srv.ListenAndServeTLS("", ""); !errors.Is(err, http.ErrServerClosed) {
+		l.Error("admission server closed", slog.String(logging.KeyError, err.Error()))
+	}
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"log/slog"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	admissionv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func testableAdmissionServer(t *testing.T, enforcement enforcementLevel, objects ...runtime.Object) *admissionServer {
+	t.Helper()
+
+	stop := make(chan struct{})
+	t.Cleanup(func() {
+		close(stop)
+	})
+
+	kubeClient := fake.NewClientset(objects...)
+	informerFactory := informers.NewSharedInformerFactory(kubeClient, 0)
+	s := newAdmissionServer(
+		slog.New(slog.DiscardHandler),
+		enforcement,
+		time.Second,
+		kubeClient,
+		new(reloader),
+		informerFactory.Core().V1().ConfigMaps().Lister(),
+		informerFactory.Core().V1().Secrets().Lister(),
+	)
+	informerFactory.Start(stop)
+	informerFactory.WaitForCacheSync(stop)
+
+	return s
+}
+
+// testableCertificate writes a self-signed certificate for the given common name and returns the paths of the
+// certificate and key files.
+func testableCertificate(t *testing.T, dir, commonName string) (certFile, keyFile string) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+
+	certFile = filepath.Join(dir, "tls.crt")
+	keyFile = filepath.Join(dir, "tls.key")
+	require.NoError(t, os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600))
+	require.NoError(t, os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600))
+	return certFile, keyFile
+}
+
+func admissionRequest(t *testing.T, s *admissionServer, review *admissionv1.AdmissionReview) *admissionv1.AdmissionResponse {
+	t.Helper()
+
+	body, err := json.Marshal(review)
+	require.NoError(t, err)
+
+	rec := httptest.NewRecorder()
+	s.handler().ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/validate/labels", bytes.NewReader(body)))
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	out := new(admissionv1.AdmissionReview)
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), out))
+	require.NotNil(t, out.Response)
+	return out.Response
+}
+
+func Test_ParseEnforcementLevel(t *testing.T) {
+	t.Parallel()
+
+	level, err := parseEnforcementLevel("deny")
+	require.NoError(t, err)
+	require.Equal(t, enforcementDeny, level)
+
+	_, err = parseEnforcementLevel("audit")
+	require.ErrorIs(t, err, ErrInvalidEnforcement)
+}
+
+func Test_AdmissionServerEnforce(t *testing.T) {
+	t.Parallel()
+
+	problems := []string{"unknown label reloader/confgmap", "unknown annotation reloader/pause"}
+
+	t.Run("no problems", func(t *testing.T) {
+		t.Parallel()
+
+		resp := testableAdmissionServer(t, enforcementDeny).enforce(nil)
+		require.True(t, resp.Allowed)
+		require.Empty(t, resp.Warnings)
+	})
+
+	t.Run("warn", func(t *testing.T) {
+		t.Parallel()
+
+		resp := testableAdmissionServer(t, enforcementWarn).enforce(problems)
+		require.True(t, resp.Allowed)
+		require.Equal(t, []string{
+			"reloader: unknown label reloader/confgmap",
+			"reloader: unknown annotation reloader/pause",
+		}, resp.Warnings)
+	})
+
+	t.Run("deny", func(t *testing.T) {
+		t.Parallel()
+
+		resp := testableAdmissionServer(t, enforcementDeny).enforce(problems)
+		require.False(t, resp.Allowed)
+		require.Equal(t, int32(http.StatusForbidden), resp.Result.Code)
+		require.Equal(t,
+			"reloader: unknown label reloader/confgmap; unknown annotation reloader/pause",
+			resp.Result.Message,
+		)
+	})
+}
+
+func Test_AdmissionServerReview(t *testing.T) {
+	t.Parallel()
+
+	s := testableAdmissionServer(t, enforcementDeny,
+		&corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "default"}},
+	)
+
+	review := func(t *testing.T, configMap string) *admissionv1.AdmissionReview {
+		t.Helper()
+
+		raw, err := json.Marshal(testableDependentPod(t, "api", "default", "ConfigMap", configMap))
+		require.NoError(t, err)
+
+		return &admissionv1.AdmissionReview{
+			TypeMeta: metav1.TypeMeta{APIVersion: "admission.k8s.io/v1", Kind: "AdmissionReview"},
+			Request: &admissionv1.AdmissionRequest{
+				UID:       "uid-1",
+				Kind:      metav1.GroupVersionKind{Version: "v1", Kind: "Pod"},
+				Namespace: "default",
+				Operation: admissionv1.Create,
+				Object:    runtime.RawExtension{Raw: raw},
+			},
+		}
+	}
+
+	t.Run("allowed", func(t *testing.T) {
+		t.Parallel()
+
+		resp := admissionRequest(t, s, review(t, "app"))
+		require.Equal(t, "uid-1", string(resp.UID))
+		require.True(t, resp.Allowed)
+	})
+
+	t.Run("denied", func(t *testing.T) {
+		t.Parallel()
+
+		resp := admissionRequest(t, s, review(t, "missing"))
+		require.Equal(t, "uid-1", string(resp.UID))
+		require.False(t, resp.Allowed)
+		require.Contains(t, resp.Result.Message, "names ConfigMap missing, which does not exist")
+	})
+
+	t.Run("no request", func(t *testing.T) {
+		t.Parallel()
+
+		body, err := json.Marshal(&admissionv1.AdmissionReview{})
+		require.NoError(t, err)
+
+		rec := httptest.NewRecorder()
+		s.handler().ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/validate/labels", bytes.NewReader(body)))
+		require.NotEqual(t, http.StatusOK, rec.Code)
+	})
+}
+
+func Test_CertificateLoader(t *testing.T) {
+	t.Parallel()
+
+	t.Run("missing files", func(t *testing.T) {
+		t.Parallel()
+
+		_, err := newCertificateLoader("", "")
+		require.ErrorIs(t, err, ErrAdmissionTLS)
+
+		_, err = newCertificateLoader(filepath.Join(t.TempDir(), "tls.crt"), filepath.Join(t.TempDir(), "tls.key"))
+		require.Error(t, err)
+	})
+
+	t.Run("reload", func(t *testing.T) {
+		t.Parallel()
+
+		dir := t.TempDir()
+		certFile, keyFile := testableCertificate(t, dir, "first")
+
+		certificates, err := newCertificateLoader(certFile, keyFile)
+		require.NoError(t, err)
+
+		cert, err := certificates.getCertificate(nil)
+		require.NoError(t, err)
+		require.Equal(t, "first", cert.Leaf.Subject.CommonName)
+
+		testableCertificate(t, dir, "second")
+		later := time.Now().Add(time.Minute)
+		require.NoError(t, os.Chtimes(certFile, later, later))
+
+		cert, err = certificates.getCertificate(nil)
+		require.NoError(t, err)
+		require.Equal(t, "second", cert.Leaf.Subject.CommonName)
+	})
+}
+
+func Test_AdmissionServerBounded(t *testing.T) {
+	t.Parallel()
+
+	s := testableAdmissionServer(t, enforcementDeny)
+	s.reviewTimeout = 10 * time.Millisecond
+
+	resp := s.bounded(webhookImpact, func(ctx context.Context) *admissionv1.AdmissionResponse {
+		<-ctx.Done()
+		return &admissionv1.AdmissionResponse{Allowed: true, Warnings: []string{"too late"}}
+	})
+	require.True(t, resp.Allowed)
+	require.Empty(t, resp.Warnings)
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/informers"
+	coreinformers "k8s.io/client-go/informers/core/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/metadata"
+	"k8s.io/client-go/metadata/metadatainformer"
+	"k8s.io/client-go/metadata/metadatalister"
+	kubecache "k8s.io/client-go/tools/cache"
+
+	"github.com/jacobbrewer1/web"
+)
+
+var (
+	// ErrDiscoveryDisabled is returned when a feature reading pod specs is enabled without DISCOVER_REFERENCES, as the
+	// specs are then not cached.
+	ErrDiscoveryDisabled = errors.New("pod specs are not cached, set DISCOVER_REFERENCES")
+
+	// ErrInvalidSelector is returned when an informer selector cannot be parsed.
+	ErrInvalidSelector = errors.New("invalid selector")
+)
+
+// objectSelectors restricts the objects an informer lists and watches, so that objects which are never reload
+// triggers are neither cached nor dispatched to the event handlers.
+type objectSelectors struct {
+	// field is the field selector.
+	field string
+
+	// label is the label selector.
+	label string
+}
+
+const (
+	// internalAnnotationPrefix is the prefix of the annotations reloader sets on its cached copies of objects. They
+	// are never written to the cluster, and are dropped from the objects received from it.
+	internalAnnotationPrefix = "internal.reloader/"
+
+	// annotationCachedHash is set on the cached copy of a Secret to its content hash once its values have been
+	// replaced by their digests.
+	annotationCachedHash = internalAnnotationPrefix + "content-hash"
+)
+
+// cacheTransform returns the transform applied to the objects of the shared informers before they are cached. It
+// drops the fields reloader never reads, so that caching every pod and Secret of a large cluster stays cheap:
+//   - managedFields of every object;
+//   - the status of pods, except for their phase, addresses and start time;
+//   - the spec of pods, unless keepPodSpecs is set for the dependency graph and lint to discover references in it;
+//   - the values of Secrets, which are replaced by their digests once the content is hashed and the validity of TLS
+//     certificates is recorded.
+func cacheTransform(keepPodSpecs bool) kubecache.TransformFunc {
+	return func(obj any) (any, error) {
+		if accessor, err := meta.Accessor(obj); err == nil {
+			accessor.SetManagedFields(nil)
+		}
+
+		switch obj := obj.(type) {
+		case *corev1.Pod:
+			transformPod(obj, keepPodSpecs)
+		case *corev1.Secret:
+			transformSecret(obj)
+		}
+		return obj, nil
+	}
+}
+
+// transformPod strips the pod down to the fields reloader reads. The Ready condition is kept for batched restarts.
+func transformPod(pod *corev1.Pod, keepSpec bool) {
+	conditions := pod.Status.Conditions
+	pod.Status = corev1.PodStatus{
+		Phase:     pod.Status.Phase,
+		PodIP:     pod.Status.PodIP,
+		PodIPs:    pod.Status.PodIPs,
+		StartTime: pod.Status.StartTime,
+	}
+	for _, condition := range conditions {
+		if condition.Type == corev1.PodReady {
+			pod.Status.Conditions = []corev1.PodCondition{condition}
+		}
+	}
+	if !keepSpec {
+		pod.Spec = corev1.PodSpec{}
+	}
+}
+
+// transformSecret replaces the values of the Secret by their SHA-256 digests, which is enough to tell which keys
+// changed, and records the content hash of the original values. Secrets with a validation annotation keep their
+// values, as they are parsed before every reload. Internal annotations set by users are dropped first, so that they
+// can neither skip the transform nor stand in for the recorded hash. The informers transform each object received
+// from the cluster once, and never the cached ones.
+func transformSecret(secret *corev1.Secret) {
+	for key := range secret.Annotations {
+		if strings.HasPrefix(key, internalAnnotationPrefix) {
+			delete(secret.Annotations, key)
+		}
+	}
+
+	if _, ok := secret.Annotations[annotationValidate]; ok {
+		return
+	}
+
+	recordCertificateValidity(secret)
+
+	hash := secretHash(secret)
+	for key, value := range secret.Data {
+		digest := sha256.Sum256(value)
+		secret.Data[key] = digest[:]
+	}
+
+	if secret.Annotations == nil {
+		secret.Annotations = make(map[string]string, 1)
+	}
+	secret.Annotations[annotationCachedHash] = hash
+}
+
+// newObjectSelectors parses the field and label selectors of an informer. Empty selectors match every object.
+func newObjectSelectors(field, label string) (*objectSelectors, error) {
+	if _, err := fields.ParseSelector(field); err != nil {
+		return nil, fmt.Errorf("%w: field selector %q: %w", ErrInvalidSelector, field, err)
+	} else if _, err := labels.Parse(label); err != nil {
+		return nil, fmt.Errorf("%w: label selector %q: %w", ErrInvalidSelector, label, err)
+	}
+	return &objectSelectors{field: field, label: label}, nil
+}
+
+// strictSelector returns the label selector of an informer, restricted in strict mode to the objects enabled for
+// reloads.
+func strictSelector(label string, strict bool) string {
+	if !strict {
+		return label
+	} else if label == "" {
+		return labelEnabled + "=true"
+	}
+	return label + "," + labelEnabled + "=true"
+}
+
+// tweak applies the selectors to the list and watch requests of an informer.
+func (s *objectSelectors) tweak(options *metav1.ListOptions) {
+	options.FieldSelector = s.field
+	options.LabelSelector = s.label
+}
+
+// registerFilteredInformers registers the Secret and ConfigMap informers of the factory with the given selectors.
+// The factory keeps a single informer per type, so the informers later requested through it are the filtered ones.
+func registerFilteredInformers(factory informers.SharedInformerFactory, secrets, configMaps *objectSelectors) {
+	indexers := kubecache.Indexers{kubecache.NamespaceIndex: kubecache.MetaNamespaceIndexFunc}
+
+	factory.InformerFor(&corev1.Secret{}, func(client kubernetes.Interface, resync time.Duration) kubecache.SharedIndexInformer {
+		return coreinformers.NewFilteredSecretInformer(client, metav1.NamespaceAll, resync, indexers, secrets.tweak)
+	})
+	factory.InformerFor(&corev1.ConfigMap{}, func(client kubernetes.Interface, resync time.Duration) kubecache.SharedIndexInformer {
+		return coreinformers.NewFilteredConfigMapInformer(client, metav1.NamespaceAll, resync, indexers, configMaps.tweak)
+	})
+}
+
+// withFilteredInformers registers the filtered Secret and ConfigMap informers on the informer factory of the base app.
+// It must come after the first informer option, which creates the factory, and before the Secret and ConfigMap
+// informer options.
+func withFilteredInformers(secrets, configMaps *objectSelectors) web.StartOption {
+	return func(app *web.App) error {
+		registerFilteredInformers(app.KubernetesInformerFactory(), secrets, configMaps)
+		return nil
+	}
+}
+
+// newNamespaceLister starts a metadata-only informer for namespaces, of which only the annotations are read, and
+// returns its lister once the cache is synced.
+func newNamespaceLister(ctx context.Context, metadataClient metadata.Interface) (metadatalister.Lister, error) {
+	gvr := corev1.SchemeGroupVersion.WithResource("namespaces")
+
+	factory := metadatainformer.NewSharedInformerFactoryWithOptions(
+		metadataClient,
+		0,
+		metadatainformer.WithTransform(cacheTransform(false)),
+	)
+	informer := factory.ForResource(gvr)
+	lister := metadatalister.New(informer.Informer().GetIndexer(), gvr)
+
+	factory.Start(ctx.Done())
+	for resource, synced := range factory.WaitForCacheSync(ctx.Done()) {
+		if !synced {
+			return nil, fmt.Errorf("failed to sync informer cache for %v", resource)
+		}
+	}
+	return lister, nil
+}
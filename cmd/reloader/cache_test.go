@@ -0,0 +1,414 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	goruntime "runtime"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/metadata"
+	metadatafake "k8s.io/client-go/metadata/fake"
+	"k8s.io/client-go/metadata/metadatalister"
+	k8stesting "k8s.io/client-go/testing"
+	kubecache "k8s.io/client-go/tools/cache"
+)
+
+// testableNamespaceLister returns a metadata lister holding the namespaces known to the kube client when it is called.
+func testableNamespaceLister(t *testing.T, kubeClient kubernetes.Interface) metadatalister.Lister {
+	t.Helper()
+
+	namespaces, err := kubeClient.CoreV1().Namespaces().List(context.Background(), metav1.ListOptions{})
+	require.NoError(t, err)
+
+	indexer := kubecache.NewIndexer(kubecache.MetaNamespaceKeyFunc, kubecache.Indexers{})
+	for i := range namespaces.Items {
+		require.NoError(t, indexer.Add(meta.AsPartialObjectMetadata(&namespaces.Items[i])))
+	}
+	return metadatalister.New(indexer, corev1.SchemeGroupVersion.WithResource("namespaces"))
+}
+
+// testableMetadataClient returns a fake metadata client serving the given objects.
+func testableMetadataClient(t *testing.T, objects ...runtime.Object) metadata.Interface {
+	t.Helper()
+
+	scheme := metadatafake.NewTestScheme()
+	require.NoError(t, metav1.AddMetaToScheme(scheme))
+	return metadatafake.NewSimpleMetadataClient(scheme, objects...)
+}
+
+// benchmarkPod returns a pod shaped like a typical workload pod, with managed fields, a sidecar and a full status.
+func benchmarkPod(i int) *corev1.Pod {
+	name := "api-7d9c5b6f4-" + strconv.Itoa(i)
+	container := func(name string) corev1.Container {
+		return corev1.Container{
+			Name:    name,
+			Image:   "registry.example.com/team/" + name + ":v1.2.3",
+			Command: []string{"/bin/" + name, "--config", "/etc/" + name + "/config.yaml", "--log-level", "info"},
+			Env: []corev1.EnvVar{
+				{Name: "POD_NAME", ValueFrom: &corev1.EnvVarSource{FieldRef: &corev1.ObjectFieldSelector{FieldPath: "metadata.name"}}},
+				{Name: "DB_PASSWORD", ValueFrom: &corev1.EnvVarSource{SecretKeyRef: &corev1.SecretKeySelector{
+					LocalObjectReference: corev1.LocalObjectReference{Name: "db"},
+					Key:                  "password",
+				}}},
+				{Name: "LOG_FORMAT", Value: "json"},
+			},
+			EnvFrom: []corev1.EnvFromSource{{ConfigMapRef: &corev1.ConfigMapEnvSource{
+				LocalObjectReference: corev1.LocalObjectReference{Name: "api"},
+			}}},
+			Ports: []corev1.ContainerPort{{Name: "http", ContainerPort: 8080}, {Name: "metrics", ContainerPort: 9090}},
+			VolumeMounts: []corev1.VolumeMount{
+				{Name: "config", MountPath: "/etc/" + name},
+				{Name: "kube-api-access", MountPath: "/var/run/secrets/kubernetes.io/serviceaccount", ReadOnly: true},
+			},
+			ReadinessProbe: &corev1.Probe{ProbeHandler: corev1.ProbeHandler{HTTPGet: &corev1.HTTPGetAction{Path: "/readyz"}}},
+			LivenessProbe:  &corev1.Probe{ProbeHandler: corev1.ProbeHandler{HTTPGet: &corev1.HTTPGetAction{Path: "/livez"}}},
+		}
+	}
+	status := func(name string) corev1.ContainerStatus {
+		return corev1.ContainerStatus{
+			Name:        name,
+			Ready:       true,
+			Image:       "registry.example.com/team/" + name + ":v1.2.3",
+			ImageID:     "registry.example.com/team/" + name + "@sha256:" + strings.Repeat("a", 64),
+			ContainerID: "containerd://" + strings.Repeat("b", 64),
+			State:       corev1.ContainerState{Running: &corev1.ContainerStateRunning{StartedAt: metav1.Now()}},
+		}
+	}
+
+	return &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: "default",
+			Labels:    map[string]string{"app": "api", "pod-template-hash": "7d9c5b6f4", "reloader/configmap": "api"},
+			ManagedFields: []metav1.ManagedFieldsEntry{
+				{Manager: "kube-controller-manager", Operation: metav1.ManagedFieldsOperationUpdate,
+					FieldsV1: &metav1.FieldsV1{Raw: []byte(strings.Repeat(`{"f:spec":{}}`, 200))}},
+				{Manager: "kubelet", Operation: metav1.ManagedFieldsOperationUpdate, Subresource: "status",
+					FieldsV1: &metav1.FieldsV1{Raw: []byte(strings.Repeat(`{"f:status":{}}`, 100))}},
+			},
+		},
+		Spec: corev1.PodSpec{
+			Containers: []corev1.Container{container("api"), container("proxy")},
+			Volumes: []corev1.Volume{
+				{Name: "config", VolumeSource: corev1.VolumeSource{ConfigMap: &corev1.ConfigMapVolumeSource{
+					LocalObjectReference: corev1.LocalObjectReference{Name: "api"},
+				}}},
+				{Name: "kube-api-access", VolumeSource: corev1.VolumeSource{Projected: &corev1.ProjectedVolumeSource{}}},
+			},
+			NodeName:           "node-" + strconv.Itoa(i%50),
+			ServiceAccountName: "api",
+		},
+		Status: corev1.PodStatus{
+			Phase:             corev1.PodRunning,
+			PodIP:             "10.0.0.1",
+			PodIPs:            []corev1.PodIP{{IP: "10.0.0.1"}},
+			HostIP:            "192.168.0.1",
+			StartTime:         &metav1.Time{Time: time.Now()},
+			Conditions:        []corev1.PodCondition{{Type: corev1.PodReady, Status: corev1.ConditionTrue}},
+			ContainerStatuses: []corev1.ContainerStatus{status("api"), status("proxy")},
+		},
+	}
+}
+
+// benchmarkSecret returns a TLS Secret of a few kilobytes, with managed fields.
+func benchmarkSecret(i int) *corev1.Secret {
+	return &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "tls-" + strconv.Itoa(i),
+			Namespace: "default",
+			ManagedFields: []metav1.ManagedFieldsEntry{{
+				Manager:   "cert-manager",
+				Operation: metav1.ManagedFieldsOperationUpdate,
+				FieldsV1:  &metav1.FieldsV1{Raw: []byte(strings.Repeat(`{"f:data":{}}`, 50))},
+			}},
+		},
+		Type: corev1.SecretTypeTLS,
+		Data: map[string][]byte{
+			corev1.TLSCertKey:       []byte(strings.Repeat("c", 4096)),
+			corev1.TLSPrivateKeyKey: []byte(strings.Repeat("k", 1700)),
+			"ca.crt":                []byte(strings.Repeat("a", 2048)),
+		},
+	}
+}
+
+func Test_CacheTransform(t *testing.T) {
+	t.Parallel()
+
+	t.Run("pod", func(t *testing.T) {
+		t.Parallel()
+
+		pod := benchmarkPod(0)
+		status := pod.Status
+
+		got, err := cacheTransform(false)(pod)
+		require.NoError(t, err)
+		require.Same(t, pod, got)
+
+		require.Nil(t, pod.ManagedFields)
+		require.Equal(t, corev1.PodSpec{}, pod.Spec)
+		require.Equal(t, corev1.PodStatus{
+			Phase:      status.Phase,
+			PodIP:      status.PodIP,
+			PodIPs:     status.PodIPs,
+			StartTime:  status.StartTime,
+			Conditions: status.Conditions,
+		}, pod.Status)
+		require.Equal(t, "api", pod.Labels["reloader/configmap"])
+	})
+
+	t.Run("pod with discovery", func(t *testing.T) {
+		t.Parallel()
+
+		pod := benchmarkPod(0)
+		refs := podReferences(pod)
+
+		_, err := cacheTransform(true)(pod)
+		require.NoError(t, err)
+		require.Nil(t, pod.ManagedFields)
+		require.Equal(t, refs, podReferences(pod))
+	})
+
+	t.Run("secret", func(t *testing.T) {
+		t.Parallel()
+
+		secret := benchmarkSecret(0)
+		hash := secretHash(secret)
+		certDigest := sha256.Sum256(secret.Data[corev1.TLSCertKey])
+
+		_, err := cacheTransform(false)(secret)
+		require.NoError(t, err)
+		require.Nil(t, secret.ManagedFields)
+		require.Equal(t, hash, secretHash(secret))
+		require.Equal(t, certDigest[:], secret.Data[corev1.TLSCertKey])
+		require.Equal(t, []string{"ca.crt", corev1.TLSCertKey, corev1.TLSPrivateKeyKey}, dataKeys(secret.Data))
+
+		// Digests still tell which keys changed.
+		updated := benchmarkSecret(0)
+		updated.Data["ca.crt"] = []byte("rotated")
+		_, err = cacheTransform(false)(updated)
+		require.NoError(t, err)
+		require.Equal(t, []string{"ca.crt"}, changedKeys(secret.Data, updated.Data))
+		require.NotEqual(t, hash, secretHash(updated))
+	})
+
+	t.Run("secret with internal annotations", func(t *testing.T) {
+		t.Parallel()
+
+		secret := benchmarkSecret(0)
+		hash := secretHash(secret)
+		certDigest := sha256.Sum256(secret.Data[corev1.TLSCertKey])
+		secret.Annotations = map[string]string{
+			annotationCachedHash:     "spoofed",
+			annotationCachedNotAfter: "spoofed",
+		}
+
+		_, err := cacheTransform(false)(secret)
+		require.NoError(t, err)
+		require.Equal(t, hash, secretHash(secret))
+		require.Equal(t, certDigest[:], secret.Data[corev1.TLSCertKey])
+		require.NotEqual(t, "spoofed", secret.Annotations[annotationCachedNotAfter])
+	})
+
+	t.Run("validated secret with internal annotations", func(t *testing.T) {
+		t.Parallel()
+
+		secret := &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Annotations: map[string]string{
+				annotationValidate:   "*=json",
+				annotationCachedHash: "spoofed",
+			}},
+			Data: map[string][]byte{"config.json": []byte(`{}`)},
+		}
+
+		_, err := cacheTransform(false)(secret)
+		require.NoError(t, err)
+		require.NotContains(t, secret.Annotations, annotationCachedHash)
+	})
+
+	t.Run("validated secret", func(t *testing.T) {
+		t.Parallel()
+
+		secret := &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Annotations: map[string]string{annotationValidate: "*=json"}},
+			Data:       map[string][]byte{"config.json": []byte(`{}`)},
+		}
+
+		_, err := cacheTransform(false)(secret)
+		require.NoError(t, err)
+		require.Equal(t, []byte(`{}`), secret.Data["config.json"])
+		require.NotContains(t, secret.Annotations, annotationCachedHash)
+	})
+
+	t.Run("configmap", func(t *testing.T) {
+		t.Parallel()
+
+		configMap := &corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{ManagedFields: []metav1.ManagedFieldsEntry{{Manager: "kubectl"}}},
+			Data:       map[string]string{"config.yaml": "level: info"},
+		}
+
+		_, err := cacheTransform(false)(configMap)
+		require.NoError(t, err)
+		require.Nil(t, configMap.ManagedFields)
+		require.Equal(t, map[string]string{"config.yaml": "level: info"}, configMap.Data)
+	})
+}
+
+func Test_NewNamespaceLister(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	namespace := &metav1.PartialObjectMetadata{
+		TypeMeta: metav1.TypeMeta{APIVersion: "v1", Kind: "Namespace"},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:          "team-a",
+			Annotations:   map[string]string{annotationPaused: "true"},
+			ManagedFields: []metav1.ManagedFieldsEntry{{Manager: "kubectl"}},
+		},
+	}
+
+	lister, err := newNamespaceLister(ctx, testableMetadataClient(t, namespace))
+	require.NoError(t, err)
+
+	got, err := lister.Get("team-a")
+	require.NoError(t, err)
+	require.Equal(t, "true", got.Annotations[annotationPaused])
+	require.Nil(t, got.ManagedFields)
+}
+
+func Test_NewObjectSelectors(t *testing.T) {
+	t.Parallel()
+
+	selectors, err := newObjectSelectors("type!=helm.sh/release.v1,type!=kubernetes.io/service-account-token", "owner!=helm")
+	require.NoError(t, err)
+
+	options := new(metav1.ListOptions)
+	selectors.tweak(options)
+	require.Equal(t, "type!=helm.sh/release.v1,type!=kubernetes.io/service-account-token", options.FieldSelector)
+	require.Equal(t, "owner!=helm", options.LabelSelector)
+
+	_, err = newObjectSelectors("", "")
+	require.NoError(t, err)
+
+	_, err = newObjectSelectors("type", "")
+	require.ErrorIs(t, err, ErrInvalidSelector)
+
+	_, err = newObjectSelectors("", "owner in helm")
+	require.ErrorIs(t, err, ErrInvalidSelector)
+}
+
+func Test_StrictSelector(t *testing.T) {
+	t.Parallel()
+
+	require.Equal(t, "owner!=helm", strictSelector("owner!=helm", false))
+	require.Equal(t, "reloader/enabled=true", strictSelector("", true))
+	require.Equal(t, "owner!=helm,reloader/enabled=true", strictSelector("owner!=helm", true))
+
+	_, err := newObjectSelectors("", strictSelector("owner!=helm", true))
+	require.NoError(t, err)
+}
+
+func Test_RegisterFilteredInformers(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	kubeClient := fake.NewClientset(
+		&corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "default"}},
+		&corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{
+			Name:      "sh.helm.release.v1.app.v1",
+			Namespace: "default",
+			Labels:    map[string]string{"owner": "helm"},
+		}},
+	)
+	factory := informers.NewSharedInformerFactory(kubeClient, 0)
+
+	var lists []metav1.ListOptions
+	kubeClient.PrependReactor("list", "secrets", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		lists = append(lists, action.(k8stesting.ListActionImpl).ListOptions)
+		return false, nil, nil
+	})
+
+	secrets, err := newObjectSelectors("type!=helm.sh/release.v1", "")
+	require.NoError(t, err)
+	configMaps, err := newObjectSelectors("", "owner!=helm")
+	require.NoError(t, err)
+
+	registerFilteredInformers(factory, secrets, configMaps)
+	configMapLister := factory.Core().V1().ConfigMaps().Lister()
+	factory.Core().V1().Secrets().Informer()
+	factory.Start(ctx.Done())
+	factory.WaitForCacheSync(ctx.Done())
+
+	got, err := configMapLister.List(labels.Everything())
+	require.NoError(t, err)
+	require.Len(t, got, 1)
+	require.Equal(t, "app", got[0].Name)
+
+	require.NotEmpty(t, lists)
+	require.Equal(t, "type!=helm.sh/release.v1", lists[0].FieldSelector)
+}
+
+// BenchmarkCacheMemory reports the heap held by the informer cache per object, before and after the cache transform.
+func BenchmarkCacheMemory(b *testing.B) {
+	const objects = 1000
+
+	benchmarks := []struct {
+		name      string
+		object    func(i int) any
+		transform kubecache.TransformFunc
+	}{
+		{name: "pods/raw", object: func(i int) any { return benchmarkPod(i) }},
+		{name: "pods/transformed", object: func(i int) any { return benchmarkPod(i) }, transform: cacheTransform(false)},
+		{name: "pods/discovery", object: func(i int) any { return benchmarkPod(i) }, transform: cacheTransform(true)},
+		{name: "secrets/raw", object: func(i int) any { return benchmarkSecret(i) }},
+		{name: "secrets/transformed", object: func(i int) any { return benchmarkSecret(i) }, transform: cacheTransform(false)},
+	}
+
+	for _, bm := range benchmarks {
+		b.Run(bm.name, func(b *testing.B) {
+			var perObject float64
+			for b.Loop() {
+				stats := new(goruntime.MemStats)
+				goruntime.GC()
+				goruntime.ReadMemStats(stats)
+				before := stats.HeapAlloc
+
+				store := kubecache.NewStore(kubecache.MetaNamespaceKeyFunc)
+				for i := range objects {
+					obj := bm.object(i)
+					if bm.transform != nil {
+						var err error
+						if obj, err = bm.transform(obj); err != nil {
+							b.Fatal(err)
+						}
+					}
+					if err := store.Add(obj); err != nil {
+						b.Fatal(err)
+					}
+				}
+
+				goruntime.GC()
+				goruntime.ReadMemStats(stats)
+				perObject = float64(stats.HeapAlloc-before) / objects
+				goruntime.KeepAlive(store)
+			}
+			b.ReportMetric(perObject, "heap-B/object")
+		})
+	}
+}
@@ -0,0 +1,293 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	kubeerrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	listersv1 "k8s.io/client-go/listers/core/v1"
+
+	"github.com/jacobbrewer1/web/logging"
+)
+
+const (
+	// breakerStateTripped marks a reload held by the circuit breaker in the circuit breaker ConfigMap.
+	breakerStateTripped = "tripped"
+
+	// breakerStateConfirmed is set by an operator in the circuit breaker ConfigMap to release a held reload.
+	breakerStateConfirmed = "confirmed"
+
+	// breakerStateDismissed is set by an operator in the circuit breaker ConfigMap to discard a held reload.
+	breakerStateDismissed = "dismissed"
+
+	// reasonCircuitOpen is the event reason used when a reload is held by the circuit breaker.
+	reasonCircuitOpen = "ReloadCircuitOpen"
+)
+
+// trippedReload is a reload held by the circuit breaker until it is confirmed.
+type trippedReload struct {
+	// ref is the object whose change triggered the reload.
+	ref *corev1.ObjectReference
+
+	// keys are the changed keys of the object.
+	keys []string
+
+	// hash is the content hash of the object, set when its pods may be reloaded in place.
+	hash string
+
+	// pods are the pods to restart once confirmed.
+	pods []*corev1.Pod
+
+	// since is when the circuit breaker tripped.
+	since time.Time
+}
+
+// circuitBreaker holds reloads whose blast radius exceeds a threshold until an operator confirms them in the
+// circuit breaker ConfigMap.
+type circuitBreaker struct {
+	// mut guards the tripped reloads.
+	mut *sync.Mutex
+
+	// threshold is the maximum number of pods a single change may restart without confirmation. Zero disables the
+	// circuit breaker.
+	threshold int
+
+	// namespace is the namespace of the circuit breaker ConfigMap.
+	namespace string
+
+	// configMapName is the name of the circuit breaker ConfigMap.
+	configMapName string
+
+	// kubeClient is used to record events and maintain the circuit breaker ConfigMap.
+	kubeClient kubernetes.Interface
+
+	// configMapLister is used to read confirmations from the circuit breaker ConfigMap.
+	configMapLister listersv1.ConfigMapLister
+
+	// tripped holds the reloads waiting for confirmation, keyed by their circuit breaker ConfigMap key.
+	tripped map[string]*trippedReload
+}
+
+// newCircuitBreaker creates a new circuitBreaker.
+func newCircuitBreaker(
+	threshold int,
+	namespace, configMapName string,
+	kubeClient kubernetes.Interface,
+	configMapLister listersv1.ConfigMapLister,
+) *circuitBreaker {
+	return &circuitBreaker{
+		mut:             new(sync.Mutex),
+		threshold:       threshold,
+		namespace:       namespace,
+		configMapName:   configMapName,
+		kubeClient:      kubeClient,
+		configMapLister: configMapLister,
+		tripped:         make(map[string]*trippedReload),
+	}
+}
+
+// breakerKey returns the key of the given object in the circuit breaker ConfigMap. ConfigMap keys cannot contain
+// slashes, and Kubernetes names cannot contain underscores, so the slashes of the object key are replaced.
+func breakerKey(ref *corev1.ObjectReference) string {
+	return strings.ReplaceAll(referenceKey(ref), "/", "_")
+}
+
+// exceeds reports whether restarting the given pods would trip the circuit breaker.
+func (b *circuitBreaker) exceeds(pods []*corev1.Pod) bool {
+	return b.threshold > 0 && len(pods) > b.threshold
+}
+
+// allow returns the pods that may be restarted for a change of the given object. If the change would restart more
+// pods than the threshold, the circuit breaker trips and nothing is restarted until the change is confirmed.
+func (b *circuitBreaker) allow(
+	ctx context.Context,
+	l *slog.Logger,
+	ref *corev1.ObjectReference,
+	keys []string,
+	hash string,
+	pods []*corev1.Pod,
+) []*corev1.Pod {
+	if !b.exceeds(pods) {
+		return pods
+	}
+
+	key := breakerKey(ref)
+
+	b.mut.Lock()
+	existing, alreadyTripped := b.tripped[key]
+	since := time.Now()
+	if alreadyTripped {
+		since = existing.since
+	}
+	b.tripped[key] = &trippedReload{
+		ref:   ref,
+		keys:  keys,
+		hash:  hash,
+		pods:  pods,
+		since: since,
+	}
+	breakerOpen.Set(float64(len(b.tripped)))
+	b.mut.Unlock()
+
+	// Repeated notifications of the same change, such as informer resyncs, do not need to be reported again.
+	if alreadyTripped && existing.ref.ResourceVersion == ref.ResourceVersion {
+		return nil
+	}
+
+	l.Warn("circuit breaker tripped",
+		slog.String(logKeyObject, referenceKey(ref)),
+		slog.Int(logKeyPods, len(pods)),
+	)
+	breakerTrips.Inc()
+
+	message := fmt.Sprintf(
+		"Reload would restart %d pods, above the blast radius threshold of %d. Set key %q to %q in ConfigMap %s/%s to proceed.",
+		len(pods), b.threshold, key, breakerStateConfirmed, b.namespace, b.configMapName,
+	)
+	if err := recordWarning(ctx, b.kubeClient, ref, reasonCircuitOpen, message); err != nil {
+		l.Error("failed to record event", slog.String(logging.KeyError, err.Error()))
+	}
+
+	if err := b.setState(ctx, key, breakerStateTripped); err != nil {
+		l.Error("failed to update circuit breaker configmap", slog.String(logging.KeyError, err.Error()))
+	}
+
+	return nil
+}
+
+// pendingReloads returns the reloads held by the circuit breaker.
+func (b *circuitBreaker) pendingReloads() []*reloadRecord {
+	b.mut.Lock()
+	defer b.mut.Unlock()
+
+	records := make([]*reloadRecord, 0, len(b.tripped))
+	for _, key := range sortedKeys(b.tripped) {
+		tripped := b.tripped[key]
+		record := newReloadRecord(referenceKey(tripped.ref), tripped.keys, tripped.pods, "circuit breaker tripped")
+		record.Started = tripped.since
+		records = append(records, record)
+	}
+	return records
+}
+
+// setState sets the state of the given key in the circuit breaker ConfigMap, creating the ConfigMap if needed. An
+// empty state removes the key.
+func (b *circuitBreaker) setState(ctx context.Context, key, state string) error {
+	client := b.kubeClient.CoreV1().ConfigMaps(b.namespace)
+
+	cm, err := client.Get(ctx, b.configMapName, metav1.GetOptions{})
+	if kubeerrors.IsNotFound(err) {
+		if state == "" {
+			return nil
+		}
+
+		_, err = client.Create(ctx, &corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      b.configMapName,
+				Namespace: b.namespace,
+			},
+			Data: map[string]string{key: state},
+		}, metav1.CreateOptions{})
+		return err
+	} else if err != nil {
+		return err
+	}
+
+	if cm.Data == nil {
+		cm.Data = make(map[string]string)
+	}
+	if state == "" {
+		delete(cm.Data, key)
+	} else {
+		cm.Data[key] = state
+	}
+
+	_, err = client.Update(ctx, cm, metav1.UpdateOptions{})
+	return err
+}
+
+// resumeConfirmed restarts the pods of tripped reloads that have been confirmed, and forgets those that have been
+// dismissed. Pods that have since been deleted or replaced are skipped, and the pods paused since the reload tripped
+// go through the pause switch like the pods of a reload.
+func (b *circuitBreaker) resumeConfirmed(
+	ctx context.Context,
+	l *slog.Logger,
+	r *reloader,
+	podLister listersv1.PodLister,
+) {
+	cm, err := b.configMapLister.ConfigMaps(b.namespace).Get(b.configMapName)
+	if kubeerrors.IsNotFound(err) {
+		return
+	} else if err != nil {
+		l.Error("failed to get circuit breaker configmap", slog.String(logging.KeyError, err.Error()))
+		return
+	}
+
+	released := make(map[string]*trippedReload)
+	b.mut.Lock()
+	for key, reload := range b.tripped {
+		switch cm.Data[key] {
+		case breakerStateConfirmed:
+			released[key] = reload
+			delete(b.tripped, key)
+		case breakerStateDismissed:
+			l.Info("circuit breaker reload dismissed", slog.String(logKeyObject, referenceKey(reload.ref)))
+			released[key] = nil
+			delete(b.tripped, key)
+		}
+	}
+	breakerOpen.Set(float64(len(b.tripped)))
+	b.mut.Unlock()
+
+	for key, reload := range released {
+		if err := b.setState(ctx, key, ""); err != nil {
+			l.Error("failed to update circuit breaker configmap", slog.String(logging.KeyError, err.Error()))
+		}
+
+		if reload == nil {
+			continue
+		}
+
+		pods := make([]*corev1.Pod, 0, len(reload.pods))
+		for _, pod := range reload.pods {
+			if current, err := podLister.Pods(pod.Namespace).Get(pod.Name); err == nil && current.UID == pod.UID {
+				pods = append(pods, current)
+			}
+		}
+
+		l.Info("circuit breaker reload confirmed",
+			slog.String(logKeyObject, referenceKey(reload.ref)),
+			slog.Int(logKeyPods, len(pods)),
+		)
+
+		allowed := r.pause.filter(ctx, l, reload.ref, reload.keys, reload.hash, pods)
+		if len(allowed) < len(pods) {
+			r.notifySkipped(ctx, l, reload.ref, reload.keys, podsExcept(pods, allowed), "paused")
+		}
+		r.resume(ctx, l, reload.ref, reload.keys, reload.hash, allowed)
+	}
+}
+
+// watchCircuitBreaker periodically releases confirmed reloads held by the circuit breaker.
+func (a *App) watchCircuitBreaker(ctx context.Context) {
+	l := logging.LoggerWithComponent(a.base.Logger(), "circuit-breaker")
+
+	ticker := time.NewTicker(a.config.CircuitBreakerResyncInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			a.breaker.resumeConfirmed(ctx, l, a.reloader, a.base.PodLister())
+		}
+	}
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/fake"
+
+	"github.com/jacobbrewer1/web/cache"
+)
+
+func testableCircuitBreaker(
+	t *testing.T,
+	threshold int,
+	kubeClient kubernetes.Interface,
+	informerFactory informers.SharedInformerFactory,
+) *circuitBreaker {
+	t.Helper()
+	return newCircuitBreaker(
+		threshold,
+		"reloader",
+		"reloader-circuit-breaker",
+		kubeClient,
+		informerFactory.Core().V1().ConfigMaps().Lister(),
+	)
+}
+
+func Test_CircuitBreaker(t *testing.T) {
+	t.Parallel()
+
+	ref := &corev1.ObjectReference{
+		Kind:            "Secret",
+		APIVersion:      "v1",
+		Namespace:       "default",
+		Name:            "wildcard-tls",
+		ResourceVersion: "1",
+	}
+
+	t.Run("below threshold", func(t *testing.T) {
+		t.Parallel()
+
+		kubeClient := fake.NewClientset()
+		informerFactory := informers.NewSharedInformerFactory(kubeClient, 0)
+		breaker := testableCircuitBreaker(t, 2, kubeClient, informerFactory)
+
+		pods := testablePausedPods(t)
+		got := breaker.allow(context.Background(), slog.New(slog.DiscardHandler), ref, nil, "", pods)
+		require.Equal(t, pods, got)
+		require.Empty(t, breaker.tripped)
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		t.Parallel()
+
+		kubeClient := fake.NewClientset()
+		informerFactory := informers.NewSharedInformerFactory(kubeClient, 0)
+		breaker := testableCircuitBreaker(t, 0, kubeClient, informerFactory)
+
+		pods := testablePausedPods(t)
+		got := breaker.allow(context.Background(), slog.New(slog.DiscardHandler), ref, nil, "", pods)
+		require.Equal(t, pods, got)
+	})
+
+	t.Run("trip and confirm", func(t *testing.T) {
+		t.Parallel()
+
+		ctx, cancel := context.WithCancel(context.Background())
+		t.Cleanup(cancel)
+
+		pods := testablePausedPods(t)
+		kubeClient := fake.NewClientset(pods[0], pods[1])
+		informerFactory := informers.NewSharedInformerFactory(kubeClient, 0)
+		podLister := informerFactory.Core().V1().Pods().Lister()
+		configMapInformer := informerFactory.Core().V1().ConfigMaps().Informer()
+		breaker := testableCircuitBreaker(t, 1, kubeClient, informerFactory)
+		rel := testableReloader(t, cache.NewFixedHashBucket(1), kubeClient, informerFactory)
+		hook, err := newWebhook(&webhookConfig{Name: "test", URL: "http://example.com"})
+		require.NoError(t, err)
+		rel.notifier = newNotifier(kubeClient, []*webhook{hook}, 10, 0)
+		informerFactory.Start(ctx.Done())
+		informerFactory.WaitForCacheSync(ctx.Done())
+
+		logger := slog.New(slog.DiscardHandler)
+		keys := []string{"tls.crt"}
+		got := breaker.allow(ctx, logger, ref, keys, "", pods)
+		require.Empty(t, got)
+		require.Len(t, breaker.tripped, 1)
+
+		// A resync of the same change does not record another event.
+		got = breaker.allow(ctx, logger, ref, keys, "", pods)
+		require.Empty(t, got)
+
+		events, err := kubeClient.CoreV1().Events("default").List(ctx, metav1.ListOptions{})
+		require.NoError(t, err)
+		require.Len(t, events.Items, 1)
+		require.Equal(t, corev1.EventTypeWarning, events.Items[0].Type)
+		require.Equal(t, reasonCircuitOpen, events.Items[0].Reason)
+		require.Equal(t, "wildcard-tls", events.Items[0].InvolvedObject.Name)
+
+		cm, err := kubeClient.CoreV1().ConfigMaps("reloader").Get(ctx, "reloader-circuit-breaker", metav1.GetOptions{})
+		require.NoError(t, err)
+		require.Equal(t, breakerStateTripped, cm.Data["default_secret_wildcard-tls"])
+
+		// Not yet confirmed, nothing is restarted.
+		require.NoError(t, configMapInformer.GetStore().Add(cm.DeepCopy()))
+		breaker.resumeConfirmed(ctx, logger, rel, podLister)
+		require.Len(t, breaker.tripped, 1)
+
+		cm.Data["default_secret_wildcard-tls"] = breakerStateConfirmed
+		_, err = kubeClient.CoreV1().ConfigMaps("reloader").Update(ctx, cm, metav1.UpdateOptions{})
+		require.NoError(t, err)
+		require.NoError(t, configMapInformer.GetStore().Update(cm.DeepCopy()))
+
+		breaker.resumeConfirmed(ctx, logger, rel, podLister)
+		require.Empty(t, breaker.tripped)
+
+		for _, pod := range pods {
+			_, err := kubeClient.CoreV1().Pods(pod.Namespace).Get(ctx, pod.Name, metav1.GetOptions{})
+			require.EqualError(t, err, "pods \""+pod.Name+"\" not found")
+		}
+
+		// The confirmed reload is notified like any other reload.
+		require.Len(t, rel.notifier.queues[0].events, 2)
+		event := <-rel.notifier.queues[0].events
+		require.Equal(t, eventStarted, event.Type)
+		require.Equal(t, keys, event.ChangedKeys)
+		require.Empty(t, rel.tracker.failedReloads())
+
+		cm, err = kubeClient.CoreV1().ConfigMaps("reloader").Get(ctx, "reloader-circuit-breaker", metav1.GetOptions{})
+		require.NoError(t, err)
+		require.NotContains(t, cm.Data, "default_secret_wildcard-tls")
+	})
+
+	t.Run("trip and dismiss", func(t *testing.T) {
+		t.Parallel()
+
+		ctx, cancel := context.WithCancel(context.Background())
+		t.Cleanup(cancel)
+
+		pods := testablePausedPods(t)
+		kubeClient := fake.NewClientset(pods[0], pods[1])
+		informerFactory := informers.NewSharedInformerFactory(kubeClient, 0)
+		podLister := informerFactory.Core().V1().Pods().Lister()
+		configMapInformer := informerFactory.Core().V1().ConfigMaps().Informer()
+		breaker := testableCircuitBreaker(t, 1, kubeClient, informerFactory)
+		rel := testableReloader(t, cache.NewFixedHashBucket(1), kubeClient, informerFactory)
+		informerFactory.Start(ctx.Done())
+		informerFactory.WaitForCacheSync(ctx.Done())
+
+		logger := slog.New(slog.DiscardHandler)
+		require.Empty(t, breaker.allow(ctx, logger, ref, nil, "", pods))
+
+		cm, err := kubeClient.CoreV1().ConfigMaps("reloader").Get(ctx, "reloader-circuit-breaker", metav1.GetOptions{})
+		require.NoError(t, err)
+		cm.Data["default_secret_wildcard-tls"] = breakerStateDismissed
+		require.NoError(t, configMapInformer.GetStore().Add(cm))
+
+		breaker.resumeConfirmed(ctx, logger, rel, podLister)
+		require.Empty(t, breaker.tripped)
+
+		for _, pod := range pods {
+			_, err := kubeClient.CoreV1().Pods(pod.Namespace).Get(ctx, pod.Name, metav1.GetOptions{})
+			require.NoError(t, err)
+		}
+	})
+
+	t.Run("confirm while paused", func(t *testing.T) {
+		t.Parallel()
+
+		ctx, cancel := context.WithCancel(context.Background())
+		t.Cleanup(cancel)
+
+		pods := testablePausedPods(t)
+		pauseConfigMap := &corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Name: "reloader-pause", Namespace: "reloader"},
+			Data:       map[string]string{pauseConfigMapKey: "true"},
+		}
+		kubeClient := fake.NewClientset(pods[0], pods[1], pauseConfigMap)
+		informerFactory := informers.NewSharedInformerFactory(kubeClient, 0)
+		podLister := informerFactory.Core().V1().Pods().Lister()
+		configMapInformer := informerFactory.Core().V1().ConfigMaps().Informer()
+		breaker := testableCircuitBreaker(t, 1, kubeClient, informerFactory)
+		rel := testableReloader(t, cache.NewFixedHashBucket(1), kubeClient, informerFactory)
+		informerFactory.Start(ctx.Done())
+		informerFactory.WaitForCacheSync(ctx.Done())
+
+		logger := slog.New(slog.DiscardHandler)
+		require.Empty(t, breaker.allow(ctx, logger, ref, nil, "", pods))
+
+		cm, err := kubeClient.CoreV1().ConfigMaps("reloader").Get(ctx, "reloader-circuit-breaker", metav1.GetOptions{})
+		require.NoError(t, err)
+		cm.Data["default_secret_wildcard-tls"] = breakerStateConfirmed
+		require.NoError(t, configMapInformer.GetStore().Add(cm))
+
+		// Reloads are paused since the circuit breaker tripped, so the confirmed reload is dropped.
+		breaker.resumeConfirmed(ctx, logger, rel, podLister)
+		require.Empty(t, breaker.tripped)
+
+		for _, pod := range pods {
+			_, err := kubeClient.CoreV1().Pods(pod.Namespace).Get(ctx, pod.Name, metav1.GetOptions{})
+			require.NoError(t, err)
+		}
+	})
+}
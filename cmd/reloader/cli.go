@@ -0,0 +1,507 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/caarlos0/env/v10"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/metadata"
+	"k8s.io/client-go/tools/clientcmd"
+
+	"github.com/jacobbrewer1/web/logging"
+	"github.com/jacobbrewer1/web/version"
+	"github.com/jacobbrewer1/workerpool"
+)
+
+const (
+	// commandRun runs the controller. It is the default when no command is given.
+	commandRun = "run"
+
+	// commandTrigger reloads the pods depending on an object from a workstation.
+	commandTrigger = "trigger"
+
+	// commandExplain prints what a reload of an object would do.
+	commandExplain = "explain"
+
+	// commandLint audits the reloader labels of pods.
+	commandLint = "lint"
+
+	// commandVersion prints the build information.
+	commandVersion = "version"
+
+	// commandHelp prints the usage.
+	commandHelp = "help"
+
+	// outputText prints human readable tables.
+	outputText = "text"
+
+	// outputJSON prints JSON.
+	outputJSON = "json"
+
+	// defaultReloaderNamespace is the namespace reloader is assumed to be deployed to when run from a workstation.
+	defaultReloaderNamespace = "reloader"
+)
+
+var (
+	// errUnknownCommand is returned for an unknown command.
+	errUnknownCommand = errors.New("unknown command")
+
+	// errInvalidObjectKey is returned when an object is not given as <namespace>/<kind>/<name>.
+	errInvalidObjectKey = errors.New("object must be given as <namespace>/<kind>/<name>")
+
+	// errUnknownOutput is returned for an unknown output format.
+	errUnknownOutput = errors.New("unknown output format")
+
+	// errBlastRadius is returned when a triggered reload would trip the circuit breaker.
+	errBlastRadius = errors.New("reload exceeds the blast radius threshold, run again with -confirm to proceed")
+
+	// errReloadFailed is returned when a triggered reload fails.
+	errReloadFailed = errors.New("reload failed")
+)
+
+// usage is the help text of the reloader binary.
+const usage = `Usage: reloader <command> [flags]
+
+Commands:
+  run                                Run the controller. This is the default.
+  trigger <namespace>/<kind>/<name>  Reload the pods depending on a ConfigMap or Secret.
+  explain <namespace>/<kind>/<name>  Print the pods and workloads a reload would affect, and how.
+  lint                               Report reloader labels that do not match what pods use.
+  version                            Print the build information.
+
+The trigger and explain commands read the controller configuration from the same environment variables as the
+controller, so that they behave like it. Run "reloader <command> -h" for the flags of a command.
+`
+
+// clusterFlags are the flags of the commands talking to a cluster from a workstation.
+type clusterFlags struct {
+	// kubeconfig is the path of the kubeconfig file. Empty uses the default loading rules.
+	kubeconfig string
+
+	// context is the kubeconfig context to use. Empty uses the current context.
+	context string
+
+	// namespace is the namespace reloader is deployed to, holding the pause and circuit breaker ConfigMaps.
+	namespace string
+}
+
+// register registers the flags in the flag set.
+func (f *clusterFlags) register(fs *flag.FlagSet) {
+	fs.StringVar(&f.kubeconfig, "kubeconfig", "", "path of the kubeconfig file, defaults to $KUBECONFIG or ~/.kube/config")
+	fs.StringVar(&f.context, "context", "", "kubeconfig context to use, defaults to the current context")
+	fs.StringVar(&f.namespace, "reloader-namespace", defaultReloaderNamespace, "namespace reloader is deployed to")
+}
+
+// execute runs the command given in the arguments, the controller if none is given.
+func execute(ctx context.Context, args []string, stdout io.Writer) error {
+	command := commandRun
+	if len(args) > 0 {
+		command, args = args[0], args[1:]
+	}
+
+	var err error
+	switch command {
+	case commandRun:
+		err = runController()
+	case commandTrigger:
+		err = runTrigger(ctx, args, stdout)
+	case commandExplain:
+		err = runExplain(ctx, args, stdout)
+	case commandLint:
+		err = runLint(ctx, args, stdout)
+	case commandVersion:
+		err = printVersion(stdout)
+	case commandHelp, "-h", "--help":
+		_, err = io.WriteString(stdout, usage)
+	default:
+		err = fmt.Errorf("%w %q, run \"reloader help\" for usage", errUnknownCommand, command)
+	}
+
+	if errors.Is(err, flag.ErrHelp) {
+		return nil
+	}
+	return err
+}
+
+// runController runs the controller until it is stopped.
+func runController() error {
+	l := logging.NewLogger(
+		logging.WithAppName(appName),
+	)
+
+	app, err := NewApp(l)
+	if err != nil {
+		l.Error("failed to create app", slog.String(logging.KeyError, err.Error()))
+		return err
+	}
+
+	if err := app.Start(); err != nil {
+		l.Error("failed to start app", slog.String(logging.KeyError, err.Error()))
+		return err
+	}
+
+	app.WaitForEnd()
+	return nil
+}
+
+// printVersion prints the build information.
+func printVersion(w io.Writer) error {
+	commit := version.GitCommit()
+	if commit == "" {
+		commit = "unknown"
+	}
+
+	committed := "unknown"
+	if ts := version.CommitTimestamp(); !ts.IsZero() {
+		committed = ts.Format(time.RFC3339)
+	}
+
+	if _, err := fmt.Fprintf(w, "commit: %s\ncommitted: %s\nmodified: %t\n", commit, committed, version.IsModified()); err != nil {
+		return fmt.Errorf("failed to write version: %w", err)
+	}
+	return nil
+}
+
+// runTrigger reloads the pods depending on an object. The reload goes through the same pauses, circuit breaker and
+// content validation as in the controller, and is reported as it goes. Pods reloaded in place must be reachable from
+// the workstation; like in the controller, pods that cannot be reloaded in place are restarted instead.
+func runTrigger(ctx context.Context, args []string, stdout io.Writer) error {
+	fs := flag.NewFlagSet(commandTrigger, flag.ContinueOnError)
+	cluster := new(clusterFlags)
+	cluster.register(fs)
+	confirm := fs.Bool("confirm", false, "proceed even if the reload exceeds the blast radius threshold")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	namespace, kind, name, err := parseObjectKey(fs.Args())
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+
+	l := logging.NewLoggerWithWriter(os.Stderr, logging.WithAppName(appName))
+	r, err := newClusterReloader(ctx, cluster, namespace)
+	if err != nil {
+		return err
+	}
+
+	obj, err := r.resolveTrigger(ctx, l, namespace, kind, name)
+	if err != nil {
+		return err
+	}
+
+	if *confirm {
+		r.breaker.threshold = 0
+	}
+
+	plan, err := r.plan(ctx, l, obj)
+	if err != nil {
+		return err
+	}
+	if err := plan.writeText(stdout); err != nil {
+		return err
+	}
+	if plan.skipped(skipCircuitBreaker) > 0 {
+		return errBlastRadius
+	}
+
+	r.reload(ctx, l, obj.ref, obj.keys, obj.hash)
+	if failed := r.tracker.failedReloads(); len(failed) > 0 {
+		return fmt.Errorf("%w: %s", errReloadFailed, failed[len(failed)-1].Reason)
+	}
+
+	if _, err := fmt.Fprintf(stdout, "\nReload of %s finished.\n", plan.Object); err != nil {
+		return fmt.Errorf("failed to write result: %w", err)
+	}
+	return nil
+}
+
+// runExplain prints the pods and workloads depending on an object and how a reload would treat them, without
+// changing anything.
+func runExplain(ctx context.Context, args []string, stdout io.Writer) error {
+	fs := flag.NewFlagSet(commandExplain, flag.ContinueOnError)
+	cluster := new(clusterFlags)
+	cluster.register(fs)
+	output := registerOutputFlag(fs)
+	if err := fs.Parse(args); err != nil {
+		return err
+	} else if err := checkOutput(*output); err != nil {
+		return err
+	}
+
+	namespace, kind, name, err := parseObjectKey(fs.Args())
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+
+	r, err := newClusterReloader(ctx, cluster, namespace)
+	if err != nil {
+		return err
+	}
+
+	return explain(ctx, logging.NewLoggerWithWriter(os.Stderr, logging.WithAppName(appName)), r, namespace, kind, name, *output, stdout)
+}
+
+// explain writes the reload plan of an object in the given output format.
+func explain(
+	ctx context.Context,
+	l *slog.Logger,
+	r *reloader,
+	namespace, kind, name, output string,
+	w io.Writer,
+) error {
+	obj, err := r.resolve(namespace, kind, name)
+	if err != nil {
+		return err
+	}
+
+	plan, err := r.plan(ctx, l, obj)
+	if err != nil {
+		return err
+	}
+
+	if output == outputJSON {
+		return writeJSON(w, plan)
+	}
+	return plan.writeText(w)
+}
+
+// runLint reports the pods whose reloader labels do not match the ConfigMaps and Secrets they use, and fails if any
+// problem is found.
+func runLint(ctx context.Context, args []string, stdout io.Writer) error {
+	fs := flag.NewFlagSet(commandLint, flag.ContinueOnError)
+	cluster := new(clusterFlags)
+	cluster.register(fs)
+	namespace := fs.String("namespace", "", "namespace to lint, defaults to all namespaces")
+	output := registerOutputFlag(fs)
+	if err := fs.Parse(args); err != nil {
+		return err
+	} else if err := checkOutput(*output); err != nil {
+		return err
+	}
+
+	ctx, cancel := signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+
+	kubeClient, _, err := newKubeClient(cluster)
+	if err != nil {
+		return err
+	}
+
+	factory := informers.NewSharedInformerFactoryWithOptions(kubeClient, 0, informers.WithNamespace(*namespace))
+	lint := newLinter(
+		kubeClient,
+		factory.Core().V1().Pods().Lister(),
+		factory.Core().V1().ConfigMaps().Lister(),
+		factory.Core().V1().Secrets().Lister(),
+	)
+	if err := startInformerFactories(ctx, factory); err != nil {
+		return err
+	}
+
+	findings, err := lint.lint(ctx, *namespace)
+	if err != nil {
+		return err
+	}
+
+	if *output == outputJSON {
+		err = writeJSON(stdout, findings)
+	} else {
+		err = writeLintFindings(stdout, findings)
+	}
+	if err != nil {
+		return err
+	} else if len(findings) > 0 {
+		return fmt.Errorf("%w: %d found", errLintFindings, len(findings))
+	}
+	return nil
+}
+
+// registerOutputFlag registers the output format flag in the flag set.
+func registerOutputFlag(fs *flag.FlagSet) *string {
+	return fs.String("output", outputText, "output format, text or json")
+}
+
+// checkOutput checks that the output format is known.
+func checkOutput(output string) error {
+	if output != outputText && output != outputJSON {
+		return fmt.Errorf("%w %q", errUnknownOutput, output)
+	}
+	return nil
+}
+
+// writeJSON writes v as indented JSON.
+func writeJSON(w io.Writer, v any) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(v); err != nil {
+		return fmt.Errorf("failed to write JSON: %w", err)
+	}
+	return nil
+}
+
+// parseObjectKey parses the single <namespace>/<kind>/<name> argument of a command.
+func parseObjectKey(args []string) (namespace, kind, name string, err error) {
+	if len(args) != 1 {
+		return "", "", "", errInvalidObjectKey
+	}
+
+	parts := strings.Split(args[0], "/")
+	if len(parts) != 3 || parts[0] == "" || parts[1] == "" || parts[2] == "" {
+		return "", "", "", fmt.Errorf("%w: %q", errInvalidObjectKey, args[0])
+	}
+
+	if _, err := apiKind(parts[1]); err != nil {
+		return "", "", "", err
+	}
+	return parts[0], parts[1], parts[2], nil
+}
+
+// newClusterReloader builds a reloader for the objects of a namespace, talking to the cluster of the kubeconfig.
+func newClusterReloader(ctx context.Context, cluster *clusterFlags, namespace string) (*reloader, error) {
+	cfg := new(AppConfig)
+	if err := env.Parse(cfg); err != nil {
+		return nil, fmt.Errorf("failed to parse env vars: %w", err)
+	}
+
+	kubeClient, metadataClient, err := newKubeClient(cluster)
+	if err != nil {
+		return nil, err
+	}
+
+	return newLocalReloader(ctx, cfg, kubeClient, metadataClient, cluster.namespace, namespace)
+}
+
+// newKubeClient creates a kube client and a metadata client for the cluster of the kubeconfig.
+func newKubeClient(cluster *clusterFlags) (kubernetes.Interface, metadata.Interface, error) {
+	rules := clientcmd.NewDefaultClientConfigLoadingRules()
+	rules.ExplicitPath = cluster.kubeconfig
+	restConfig, err := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(
+		rules,
+		&clientcmd.ConfigOverrides{CurrentContext: cluster.context},
+	).ClientConfig()
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to load kubeconfig: %w", err)
+	}
+
+	kubeClient, err := kubernetes.NewForConfig(restConfig)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create kube client: %w", err)
+	}
+
+	metadataClient, err := metadata.NewForConfig(restConfig)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create metadata client: %w", err)
+	}
+	return kubeClient, metadataClient, nil
+}
+
+// newLocalReloader builds a reloader for the objects of a namespace outside of the controller, configured like the
+// controller. Only the given namespace and the pause and circuit breaker ConfigMaps of the reloader namespace are
+// cached. Paused reloads are always dropped, as there is no controller to resume them, and no webhooks are notified.
+func newLocalReloader(
+	ctx context.Context,
+	cfg *AppConfig,
+	kubeClient kubernetes.Interface,
+	metadataClient metadata.Interface,
+	reloaderNamespace, namespace string,
+) (*reloader, error) {
+	namespaceLister, err := newNamespaceLister(ctx, metadataClient)
+	if err != nil {
+		return nil, err
+	}
+
+	defaultStrategy, err := parseStrategy(cfg.DefaultStrategy)
+	if err != nil {
+		return nil, err
+	}
+
+	objects := informers.NewSharedInformerFactoryWithOptions(kubeClient, 0, informers.WithNamespace(namespace))
+	settings := informers.NewSharedInformerFactoryWithOptions(kubeClient, 0, informers.WithNamespace(reloaderNamespace))
+
+	podIndexer, err := addDependencyIndex(objects.Core().V1().Pods().Informer(), cfg.ReloadSpecReferences, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	httpReloader := newHTTPReloader(
+		cfg.HTTPReloadTimeout,
+		cfg.HTTPReloadRetries,
+		cfg.HTTPReloadRetryBackoff,
+		workerpool.New(workerpool.WithTotalWorkers(cfg.HTTPReloadConcurrency), workerpool.WithDelayedStart()),
+	)
+
+	r := &reloader{
+		kubeClient:      kubeClient,
+		podLister:       objects.Core().V1().Pods().Lister(),
+		podIndexer:      podIndexer,
+		configMapLister: objects.Core().V1().ConfigMaps().Lister(),
+		secretLister:    objects.Core().V1().Secrets().Lister(),
+		pause: newPauser(
+			pauseModeDrop,
+			reloaderNamespace,
+			cfg.PauseConfigMap,
+			kubeClient,
+			settings.Core().V1().ConfigMaps().Lister(),
+			namespaceLister,
+		),
+		breaker: newCircuitBreaker(
+			cfg.BlastRadiusThreshold,
+			reloaderNamespace,
+			cfg.CircuitBreakerConfigMap,
+			kubeClient,
+			settings.Core().V1().ConfigMaps().Lister(),
+		),
+		killer: newPodKiller(
+			kubeClient,
+			newRestartLimiter(cfg.RestartBudgetGlobal, cfg.RestartBudgetNamespace),
+			workerpool.New(workerpool.WithDelayedStart()),
+			cfg.RestartConcurrencyGlobal,
+			cfg.RestartConcurrencyNamespace,
+		),
+		notifier:        newNotifier(kubeClient, nil, cfg.NotificationsQueueSize, cfg.NotificationsRetryBackoff),
+		http:            httpReloader,
+		validator:       newContentValidator(kubeClient, objects.Core().V1().ConfigMaps().Lister()),
+		tracker:         newReloadTracker(cfg.FailedReloadsHistory),
+		strict:          cfg.StrictMode,
+		namespaceLister: namespaceLister,
+		defaultStrategy: defaultStrategy,
+		batchTimeout:    cfg.StrategyBatchTimeout,
+	}
+
+	if err := startInformerFactories(ctx, objects, settings); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// startInformerFactories starts the informer factories and waits for their caches to sync.
+func startInformerFactories(ctx context.Context, factories ...informers.SharedInformerFactory) error {
+	for _, factory := range factories {
+		factory.Start(ctx.Done())
+		for informer, synced := range factory.WaitForCacheSync(ctx.Done()) {
+			if !synced {
+				return fmt.Errorf("failed to sync informer cache for %v", informer)
+			}
+		}
+	}
+	return nil
+}
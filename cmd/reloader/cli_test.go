@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func Test_ParseObjectKey(t *testing.T) {
+	t.Parallel()
+
+	t.Run("valid", func(t *testing.T) {
+		t.Parallel()
+
+		namespace, kind, name, err := parseObjectKey([]string{"default/secret/db"})
+		require.NoError(t, err)
+		require.Equal(t, "default", namespace)
+		require.Equal(t, "secret", kind)
+		require.Equal(t, "db", name)
+	})
+
+	for name, args := range map[string][]string{
+		"missing":       nil,
+		"too many":      {"default/secret/db", "default/secret/tls"},
+		"missing kind":  {"default/db"},
+		"empty name":    {"default/secret/"},
+		"extra segment": {"default/secret/db/key"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			_, _, _, err := parseObjectKey(args)
+			require.ErrorIs(t, err, errInvalidObjectKey)
+		})
+	}
+
+	t.Run("unknown kind", func(t *testing.T) {
+		t.Parallel()
+
+		_, _, _, err := parseObjectKey([]string{"default/deployment/api"})
+		require.ErrorIs(t, err, errUnknownKind)
+	})
+}
+
+func Test_Execute(t *testing.T) {
+	t.Parallel()
+
+	t.Run("version", func(t *testing.T) {
+		t.Parallel()
+
+		buf := new(bytes.Buffer)
+		require.NoError(t, execute(context.Background(), []string{commandVersion}, buf))
+		require.Contains(t, buf.String(), "commit: ")
+		require.Contains(t, buf.String(), "modified: ")
+	})
+
+	t.Run("help", func(t *testing.T) {
+		t.Parallel()
+
+		buf := new(bytes.Buffer)
+		require.NoError(t, execute(context.Background(), []string{commandHelp}, buf))
+		require.Equal(t, usage, buf.String())
+	})
+
+	t.Run("command help", func(t *testing.T) {
+		t.Parallel()
+
+		require.NoError(t, execute(context.Background(), []string{commandExplain, "-h"}, new(bytes.Buffer)))
+	})
+
+	t.Run("unknown command", func(t *testing.T) {
+		t.Parallel()
+
+		err := execute(context.Background(), []string{"reload"}, new(bytes.Buffer))
+		require.ErrorIs(t, err, errUnknownCommand)
+	})
+
+	t.Run("unknown output", func(t *testing.T) {
+		t.Parallel()
+
+		err := execute(context.Background(), []string{commandExplain, "-output", "yaml", "default/secret/db"}, new(bytes.Buffer))
+		require.ErrorIs(t, err, errUnknownOutput)
+	})
+}
+
+func Test_Explain(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	kubeClient := fake.NewClientset(
+		&corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: "db", Namespace: "default"},
+			Data:       map[string][]byte{"password": []byte("hunter2")},
+		},
+		testableDependentPod(t, "api", "default", "Secret", "db"),
+		testableDependentPod(t, "other", "team-b", "Secret", "db"),
+	)
+
+	r, err := newLocalReloader(
+		ctx,
+		testableAppConfig(t),
+		kubeClient,
+		testableMetadataClient(t),
+		"reloader",
+		"default",
+	)
+	require.NoError(t, err)
+
+	l := slog.New(slog.DiscardHandler)
+
+	t.Run("text", func(t *testing.T) {
+		t.Parallel()
+
+		buf := new(bytes.Buffer)
+		require.NoError(t, explain(ctx, l, r, "default", "secret", "db", outputText, buf))
+		require.Contains(t, buf.String(), "Object:        default/secret/db")
+		require.Contains(t, buf.String(), "Changed keys:  password")
+		require.Contains(t, buf.String(), "api  delete    -")
+		require.NotContains(t, buf.String(), "other")
+	})
+
+	t.Run("json", func(t *testing.T) {
+		t.Parallel()
+
+		buf := new(bytes.Buffer)
+		require.NoError(t, explain(ctx, l, r, "default", "secret", "db", outputJSON, buf))
+
+		plan := new(reloadPlan)
+		require.NoError(t, json.Unmarshal(buf.Bytes(), plan))
+		require.Equal(t, []*plannedPod{{Name: "api", Strategy: strategyDelete}}, plan.Pods)
+		require.Equal(t, []string{"Pod/api"}, plan.Workloads)
+	})
+
+	t.Run("not found", func(t *testing.T) {
+		t.Parallel()
+
+		err := explain(ctx, l, r, "default", "configmap", "missing", outputText, new(bytes.Buffer))
+		require.Error(t, err)
+	})
+}
+
+func testableAppConfig(t *testing.T) *AppConfig {
+	t.Helper()
+	return &AppConfig{
+		PauseConfigMap:          "reloader-pause",
+		CircuitBreakerConfigMap: "reloader-circuit-breaker",
+		NotificationsQueueSize:  10,
+		FailedReloadsHistory:    10,
+		DefaultStrategy:         strategyDelete,
+	}
+}
@@ -0,0 +1,352 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sort"
+
+	corev1 "k8s.io/api/core/v1"
+	kubeerrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/util/retry"
+
+	"github.com/jacobbrewer1/web/logging"
+)
+
+// labelFamily groups ConfigMaps that are versions of the same configuration, such as the ConfigMaps a kustomize
+// configMapGenerator creates with a hash suffix. The newest member of a family replaces the others in the pod templates
+// of the workloads using them.
+const labelFamily = "reloader/family"
+
+// familyMembers returns the ConfigMaps of the family in the namespace, oldest first. Members created in the same
+// second are ordered by name.
+func (r *reloader) familyMembers(namespace, family string) ([]*corev1.ConfigMap, error) {
+	selector := labels.SelectorFromSet(labels.Set{labelFamily: family})
+	members, err := r.configMapLister.ConfigMaps(namespace).List(selector)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list members of family %s: %w", family, err)
+	}
+
+	sort.Slice(members, func(i, j int) bool {
+		ti, tj := members[i].CreationTimestamp, members[j].CreationTimestamp
+		if !ti.Equal(&tj) {
+			return ti.Before(&tj)
+		}
+		return members[i].Name < members[j].Name
+	})
+	return members, nil
+}
+
+// repointTemplate replaces the superseded ConfigMaps used by the pod template, through its reloader label, volumes
+// and container environments, by the given ConfigMap. It reports whether the template changed.
+func repointTemplate(template *corev1.PodTemplateSpec, superseded map[string]bool, name string) bool {
+	changed := false
+	repoint := func(ref *string) {
+		if superseded[*ref] {
+			*ref = name
+			changed = true
+		}
+	}
+
+	if value, ok := template.Labels[dependencyLabel("ConfigMap")]; ok && superseded[value] {
+		template.Labels[dependencyLabel("ConfigMap")] = name
+		changed = true
+	}
+
+	for i := range template.Spec.Volumes {
+		volume := &template.Spec.Volumes[i]
+		if volume.ConfigMap != nil {
+			repoint(&volume.ConfigMap.Name)
+		}
+		if volume.Projected != nil {
+			for j := range volume.Projected.Sources {
+				if source := volume.Projected.Sources[j].ConfigMap; source != nil {
+					repoint(&source.Name)
+				}
+			}
+		}
+	}
+
+	for _, containers := range [][]corev1.Container{template.Spec.InitContainers, template.Spec.Containers} {
+		for i := range containers {
+			for j := range containers[i].EnvFrom {
+				if ref := containers[i].EnvFrom[j].ConfigMapRef; ref != nil {
+					repoint(&ref.Name)
+				}
+			}
+			for j := range containers[i].Env {
+				if from := containers[i].Env[j].ValueFrom; from != nil && from.ConfigMapKeyRef != nil {
+					repoint(&from.ConfigMapKeyRef.Name)
+				}
+			}
+		}
+	}
+
+	return changed
+}
+
+// repointWorkloads updates the pod templates of the Deployments, StatefulSets and DaemonSets in the namespace that use
+// a superseded ConfigMap to use the given one instead, which rolls the workloads out through their own update
+// strategies. Workloads the allow function rejects are left alone. It returns the updated workloads, such as
+// "Deployment/api". Updates that conflict with another writer are retried against the latest version of the
+// workloads.
+func repointWorkloads(
+	ctx context.Context,
+	kubeClient kubernetes.Interface,
+	namespace string,
+	superseded map[string]bool,
+	name string,
+	allow func(kind string, workload metav1.Object) bool,
+) ([]string, error) {
+	apps := kubeClient.AppsV1()
+	repointed := make([]string, 0)
+
+	if err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		deployments, err := apps.Deployments(namespace).List(ctx, metav1.ListOptions{})
+		if err != nil {
+			return fmt.Errorf("failed to list deployments: %w", err)
+		}
+		for i := range deployments.Items {
+			deployment := &deployments.Items[i]
+			if !repointTemplate(&deployment.Spec.Template, superseded, name) || !allow("Deployment", deployment) {
+				continue
+			}
+			if _, err := apps.Deployments(namespace).Update(ctx, deployment, metav1.UpdateOptions{}); err != nil {
+				return fmt.Errorf("failed to update deployment %s: %w", deployment.Name, err)
+			}
+			repointed = append(repointed, "Deployment/"+deployment.Name)
+		}
+		return nil
+	}); err != nil {
+		return repointed, err
+	}
+
+	if err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		statefulSets, err := apps.StatefulSets(namespace).List(ctx, metav1.ListOptions{})
+		if err != nil {
+			return fmt.Errorf("failed to list statefulsets: %w", err)
+		}
+		for i := range statefulSets.Items {
+			statefulSet := &statefulSets.Items[i]
+			if !repointTemplate(&statefulSet.Spec.Template, superseded, name) || !allow("StatefulSet", statefulSet) {
+				continue
+			}
+			if _, err := apps.StatefulSets(namespace).Update(ctx, statefulSet, metav1.UpdateOptions{}); err != nil {
+				return fmt.Errorf("failed to update statefulset %s: %w", statefulSet.Name, err)
+			}
+			repointed = append(repointed, "StatefulSet/"+statefulSet.Name)
+		}
+		return nil
+	}); err != nil {
+		return repointed, err
+	}
+
+	if err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		daemonSets, err := apps.DaemonSets(namespace).List(ctx, metav1.ListOptions{})
+		if err != nil {
+			return fmt.Errorf("failed to list daemonsets: %w", err)
+		}
+		for i := range daemonSets.Items {
+			daemonSet := &daemonSets.Items[i]
+			if !repointTemplate(&daemonSet.Spec.Template, superseded, name) || !allow("DaemonSet", daemonSet) {
+				continue
+			}
+			if _, err := apps.DaemonSets(namespace).Update(ctx, daemonSet, metav1.UpdateOptions{}); err != nil {
+				return fmt.Errorf("failed to update daemonset %s: %w", daemonSet.Name, err)
+			}
+			repointed = append(repointed, "DaemonSet/"+daemonSet.Name)
+		}
+		return nil
+	}); err != nil {
+		return repointed, err
+	}
+
+	return repointed, nil
+}
+
+// repointFilter returns the function telling which workloads using the superseded members of a family may be
+// repointed to the newest member, which rolls them out. The pods using the superseded members go through the pause
+// switch and the circuit breaker like the pods of a reload: workloads with paused pods are left alone, and nothing is
+// repointed while the namespace is paused or the circuit breaker holds the newest member. Workloads themselves paused,
+// ignored or, in strict mode, not enabled for reloads are left alone too. It returns nil when nothing may be
+// repointed.
+func (r *reloader) repointFilter(
+	ctx context.Context,
+	l *slog.Logger,
+	ref *corev1.ObjectReference,
+	superseded map[string]bool,
+) (func(kind string, workload metav1.Object) bool, error) {
+	paused, err := r.pause.globalPaused()
+	if err == nil && !paused {
+		paused, err = r.pause.namespacePaused(ref.Namespace)
+	}
+	if err != nil {
+		return nil, err
+	} else if paused {
+		l.Info("not repointing workloads while paused", slog.String(logKeyObject, referenceKey(ref)))
+		return nil, nil
+	}
+
+	pods, err := r.podLister.Pods(ref.Namespace).List(labels.Everything())
+	if err != nil {
+		return nil, fmt.Errorf("failed to list pods: %w", err)
+	}
+
+	users := make([]*corev1.Pod, 0)
+	for _, pod := range pods {
+		for _, podRef := range podReferences(pod) {
+			if podRef.kind == "ConfigMap" && superseded[podRef.name] {
+				users = append(users, pod)
+				break
+			}
+		}
+	}
+
+	allowed, held := r.pause.split(ctx, l, ref.Namespace, users)
+	if len(allowed) > 0 && len(r.breaker.allow(ctx, l, ref, nil, "", allowed)) == 0 {
+		return nil, nil
+	}
+
+	workloads := make(map[types.UID]metav1.Object)
+	heldWorkloads := make(map[types.UID]bool)
+	for _, pod := range held {
+		if workload := r.podWorkload(ctx, pod, workloads); workload != nil {
+			heldWorkloads[workload.GetUID()] = true
+		}
+	}
+
+	return func(kind string, workload metav1.Object) bool {
+		if heldWorkloads[workload.GetUID()] || workload.GetAnnotations()[annotationPaused] == "true" {
+			l.Info("not repointing paused workload",
+				slog.String(logKeyObject, referenceKey(ref)),
+				slog.String(logKeyWorkload, kind+"/"+workload.GetName()),
+			)
+			return false
+		}
+		return r.triggers(workload.GetLabels(), workload.GetAnnotations())
+	}, nil
+}
+
+// collectFamily deletes the superseded members of a family, oldest first, beyond the newest familyRetention of them,
+// which are kept for rollbacks. Members still used by a pod are kept until the next member appears, so that pods of a
+// rollout in progress keep their configuration. Nothing is deleted unless familyGC is set, which requires
+// DISCOVER_REFERENCES to keep the pod specs cached so that the members used through them are seen. A negative
+// retention keeps every member.
+func (r *reloader) collectFamily(ctx context.Context, l *slog.Logger, members []*corev1.ConfigMap) error {
+	superseded := members[:len(members)-1]
+	if !r.familyGC || r.familyRetention < 0 || len(superseded) <= r.familyRetention {
+		return nil
+	}
+
+	namespace := members[0].Namespace
+	pods, err := r.podLister.Pods(namespace).List(labels.Everything())
+	if err != nil {
+		return fmt.Errorf("failed to list pods: %w", err)
+	}
+
+	used := make(map[string]bool)
+	for _, pod := range pods {
+		for _, ref := range podReferences(pod) {
+			if ref.kind == "ConfigMap" {
+				used[ref.name] = true
+			}
+		}
+	}
+
+	for _, member := range superseded[:len(superseded)-r.familyRetention] {
+		ref := objectReference("ConfigMap", member)
+		if used[member.Name] {
+			l.Info("keeping superseded family member still in use", slog.String(logKeyObject, referenceKey(ref)))
+			continue
+		}
+
+		err := r.kubeClient.CoreV1().ConfigMaps(namespace).Delete(ctx, member.Name, metav1.DeleteOptions{
+			Preconditions: &metav1.Preconditions{UID: &member.UID},
+		})
+		if err != nil && !kubeerrors.IsNotFound(err) {
+			return fmt.Errorf("failed to delete %s: %w", referenceKey(ref), err)
+		}
+		l.Info("deleted superseded family member", slog.String(logKeyObject, referenceKey(ref)))
+	}
+	return nil
+}
+
+// onFamilyMemberAdd is called when a ConfigMap is added. When it is the newest member of its family, the workloads
+// using older members are repointed to it, as far as repointFilter allows, and the expired members are deleted. The informer replays every ConfigMap as
+// added when it starts, which catches up on members created while reloader was down.
+func onFamilyMemberAdd(
+	ctx context.Context,
+	l *slog.Logger,
+	r *reloader,
+) func(any) {
+	return func(obj any) {
+		configMap, ok := obj.(*corev1.ConfigMap)
+		if !ok {
+			return
+		}
+
+		family, ok := configMap.Labels[labelFamily]
+		if !ok || !r.bucket.InBucket(family) {
+			return
+		}
+
+		if !r.triggers(configMap.Labels, configMap.Annotations) {
+			return
+		}
+
+		ref := objectReference("ConfigMap", configMap)
+		members, err := r.familyMembers(configMap.Namespace, family)
+		if err != nil {
+			l.Error("failed to list family members",
+				slog.String(logKeyObject, referenceKey(ref)),
+				slog.String(logging.KeyError, err.Error()),
+			)
+			return
+		} else if len(members) == 0 || members[len(members)-1].UID != configMap.UID {
+			// Older members are replayed when the informer starts, and the newest one does the work.
+			return
+		}
+
+		superseded := make(map[string]bool, len(members)-1)
+		for _, member := range members[:len(members)-1] {
+			superseded[member.Name] = true
+		}
+
+		allow, err := r.repointFilter(ctx, l, ref, superseded)
+		if err != nil {
+			l.Error("failed to check workloads to repoint",
+				slog.String(logKeyObject, referenceKey(ref)),
+				slog.String(logging.KeyError, err.Error()),
+			)
+			return
+		} else if allow == nil {
+			return
+		}
+
+		workloads, err := repointWorkloads(ctx, r.kubeClient, configMap.Namespace, superseded, configMap.Name, allow)
+		for _, workload := range workloads {
+			l.Info("repointed workload to new family member",
+				slog.String(logKeyObject, referenceKey(ref)),
+				slog.String(logKeyWorkload, workload),
+			)
+		}
+		if err != nil {
+			l.Error("failed to repoint workloads",
+				slog.String(logKeyObject, referenceKey(ref)),
+				slog.String(logging.KeyError, err.Error()),
+			)
+			return
+		}
+
+		if err := r.collectFamily(ctx, l, members); err != nil {
+			l.Error("failed to collect superseded family members",
+				slog.String(logKeyObject, referenceKey(ref)),
+				slog.String(logging.KeyError, err.Error()),
+			)
+		}
+	}
+}
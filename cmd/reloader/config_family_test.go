@@ -0,0 +1,274 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes/fake"
+
+	"github.com/jacobbrewer1/web/cache"
+)
+
+// testableFamilyMember returns a member of the app-config family created at the given offset from a fixed time.
+func testableFamilyMember(t *testing.T, name string, offset time.Duration) *corev1.ConfigMap {
+	t.Helper()
+
+	return &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:              name,
+			Namespace:         "default",
+			UID:               types.UID(name),
+			Labels:            map[string]string{labelFamily: "app-config"},
+			CreationTimestamp: metav1.NewTime(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC).Add(offset)),
+		},
+	}
+}
+
+// testableFamilyTemplate returns a pod template mounting the given ConfigMap.
+func testableFamilyTemplate(t *testing.T, configMap string) corev1.PodTemplateSpec {
+	t.Helper()
+
+	return corev1.PodTemplateSpec{
+		Spec: corev1.PodSpec{
+			Volumes: []corev1.Volume{{
+				Name: "config",
+				VolumeSource: corev1.VolumeSource{
+					ConfigMap: &corev1.ConfigMapVolumeSource{
+						LocalObjectReference: corev1.LocalObjectReference{Name: configMap},
+					},
+				},
+			}},
+		},
+	}
+}
+
+func Test_RepointTemplate(t *testing.T) {
+	t.Parallel()
+
+	template := &corev1.PodTemplateSpec{
+		ObjectMeta: metav1.ObjectMeta{
+			Labels: map[string]string{dependencyLabel("ConfigMap"): "app-config-1"},
+		},
+		Spec: corev1.PodSpec{
+			Volumes: []corev1.Volume{
+				{
+					Name: "projected",
+					VolumeSource: corev1.VolumeSource{
+						Projected: &corev1.ProjectedVolumeSource{
+							Sources: []corev1.VolumeProjection{{
+								ConfigMap: &corev1.ConfigMapProjection{
+									LocalObjectReference: corev1.LocalObjectReference{Name: "app-config-2"},
+								},
+							}},
+						},
+					},
+				},
+				{
+					Name: "other",
+					VolumeSource: corev1.VolumeSource{
+						ConfigMap: &corev1.ConfigMapVolumeSource{
+							LocalObjectReference: corev1.LocalObjectReference{Name: "other"},
+						},
+					},
+				},
+			},
+			InitContainers: []corev1.Container{{
+				EnvFrom: []corev1.EnvFromSource{{
+					ConfigMapRef: &corev1.ConfigMapEnvSource{
+						LocalObjectReference: corev1.LocalObjectReference{Name: "app-config-1"},
+					},
+				}},
+			}},
+			Containers: []corev1.Container{{
+				Env: []corev1.EnvVar{{
+					Name: "LEVEL",
+					ValueFrom: &corev1.EnvVarSource{
+						ConfigMapKeyRef: &corev1.ConfigMapKeySelector{
+							LocalObjectReference: corev1.LocalObjectReference{Name: "app-config-2"},
+							Key:                  "level",
+						},
+					},
+				}},
+			}},
+		},
+	}
+
+	superseded := map[string]bool{"app-config-1": true, "app-config-2": true}
+	require.True(t, repointTemplate(template, superseded, "app-config-3"))
+
+	require.Equal(t, "app-config-3", template.Labels[dependencyLabel("ConfigMap")])
+	require.Equal(t, "app-config-3", template.Spec.Volumes[0].Projected.Sources[0].ConfigMap.Name)
+	require.Equal(t, "other", template.Spec.Volumes[1].ConfigMap.Name)
+	require.Equal(t, "app-config-3", template.Spec.InitContainers[0].EnvFrom[0].ConfigMapRef.Name)
+	require.Equal(t, "app-config-3", template.Spec.Containers[0].Env[0].ValueFrom.ConfigMapKeyRef.Name)
+
+	require.False(t, repointTemplate(template, superseded, "app-config-3"))
+}
+
+func Test_OnFamilyMemberAdd(t *testing.T) {
+	t.Parallel()
+
+	// setup returns a reloader caching four members of a family, a Deployment and a StatefulSet using the second
+	// member, a pod still using it and the given objects.
+	setup := func(t *testing.T, objects ...runtime.Object) (*reloader, *fake.Clientset) {
+		t.Helper()
+
+		ctx, cancel := context.WithCancel(context.Background())
+		t.Cleanup(cancel)
+
+		pod := testablePod(t)
+		pod.Namespace = "default"
+		pod.Spec = testableFamilyTemplate(t, "app-config-2").Spec
+
+		kubeClient := fake.NewClientset(append([]runtime.Object{
+			testableFamilyMember(t, "app-config-1", 0),
+			testableFamilyMember(t, "app-config-2", time.Minute),
+			testableFamilyMember(t, "app-config-3", 2*time.Minute),
+			testableFamilyMember(t, "app-config-4", 3*time.Minute),
+			&appsv1.Deployment{
+				ObjectMeta: metav1.ObjectMeta{Name: "api", Namespace: "default"},
+				Spec:       appsv1.DeploymentSpec{Template: testableFamilyTemplate(t, "app-config-2")},
+			},
+			&appsv1.StatefulSet{
+				ObjectMeta: metav1.ObjectMeta{Name: "db", Namespace: "default"},
+				Spec:       appsv1.StatefulSetSpec{Template: testableFamilyTemplate(t, "other")},
+			},
+			pod,
+		}, objects...)...)
+		informerFactory := informers.NewSharedInformerFactory(kubeClient, 0)
+		r := testableReloader(t, cache.NewFixedHashBucket(1), kubeClient, informerFactory)
+		informerFactory.Start(ctx.Done())
+		informerFactory.WaitForCacheSync(ctx.Done())
+
+		return r, kubeClient
+	}
+
+	templateConfigMap := func(t *testing.T, kubeClient *fake.Clientset) string {
+		t.Helper()
+
+		deployment, err := kubeClient.AppsV1().Deployments("default").Get(context.Background(), "api", metav1.GetOptions{})
+		require.NoError(t, err)
+		return deployment.Spec.Template.Spec.Volumes[0].ConfigMap.Name
+	}
+
+	members := func(t *testing.T, kubeClient *fake.Clientset) []string {
+		t.Helper()
+
+		list, err := kubeClient.CoreV1().ConfigMaps("default").List(context.Background(), metav1.ListOptions{})
+		require.NoError(t, err)
+
+		names := make([]string, 0, len(list.Items))
+		for i := range list.Items {
+			names = append(names, list.Items[i].Name)
+		}
+		return names
+	}
+
+	t.Run("newest member", func(t *testing.T) {
+		t.Parallel()
+
+		r, kubeClient := setup(t)
+		r.familyRetention = 1
+		r.familyGC = true
+		add := onFamilyMemberAdd(context.Background(), slog.New(slog.DiscardHandler), r)
+		add(testableFamilyMember(t, "app-config-4", 3*time.Minute))
+
+		require.Equal(t, "app-config-4", templateConfigMap(t, kubeClient))
+
+		statefulSet, err := kubeClient.AppsV1().StatefulSets("default").Get(context.Background(), "db", metav1.GetOptions{})
+		require.NoError(t, err)
+		require.Equal(t, "other", statefulSet.Spec.Template.Spec.Volumes[0].ConfigMap.Name)
+
+		// The oldest member expired, the second is still used by a pod and the third is retained.
+		require.Equal(t, []string{"app-config-2", "app-config-3", "app-config-4"}, members(t, kubeClient))
+	})
+
+	t.Run("older member", func(t *testing.T) {
+		t.Parallel()
+
+		r, kubeClient := setup(t)
+		add := onFamilyMemberAdd(context.Background(), slog.New(slog.DiscardHandler), r)
+		add(testableFamilyMember(t, "app-config-3", 2*time.Minute))
+
+		require.Equal(t, "app-config-2", templateConfigMap(t, kubeClient))
+		require.Len(t, members(t, kubeClient), 4)
+	})
+
+	t.Run("keep every member", func(t *testing.T) {
+		t.Parallel()
+
+		r, kubeClient := setup(t)
+		r.familyRetention = -1
+		r.familyGC = true
+		add := onFamilyMemberAdd(context.Background(), slog.New(slog.DiscardHandler), r)
+		add(testableFamilyMember(t, "app-config-4", 3*time.Minute))
+
+		require.Equal(t, "app-config-4", templateConfigMap(t, kubeClient))
+		require.Len(t, members(t, kubeClient), 4)
+	})
+
+	t.Run("garbage collection disabled", func(t *testing.T) {
+		t.Parallel()
+
+		r, kubeClient := setup(t)
+		r.familyRetention = 0
+		add := onFamilyMemberAdd(context.Background(), slog.New(slog.DiscardHandler), r)
+		add(testableFamilyMember(t, "app-config-4", 3*time.Minute))
+
+		require.Equal(t, "app-config-4", templateConfigMap(t, kubeClient))
+		require.Len(t, members(t, kubeClient), 4)
+	})
+
+	t.Run("paused", func(t *testing.T) {
+		t.Parallel()
+
+		r, kubeClient := setup(t, &corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Name: "reloader-pause", Namespace: "reloader"},
+			Data:       map[string]string{pauseConfigMapKey: "true"},
+		})
+		add := onFamilyMemberAdd(context.Background(), slog.New(slog.DiscardHandler), r)
+		add(testableFamilyMember(t, "app-config-4", 3*time.Minute))
+
+		require.Equal(t, "app-config-2", templateConfigMap(t, kubeClient))
+	})
+
+	t.Run("circuit breaker tripped", func(t *testing.T) {
+		t.Parallel()
+
+		other := testablePod(t)
+		other.Name = "other-pod"
+		other.Namespace = "default"
+		other.Labels = map[string]string{dependencyLabel("ConfigMap"): "app-config-3"}
+
+		r, kubeClient := setup(t, other)
+		r.breaker.threshold = 1
+		add := onFamilyMemberAdd(context.Background(), slog.New(slog.DiscardHandler), r)
+		add(testableFamilyMember(t, "app-config-4", 3*time.Minute))
+
+		require.Equal(t, "app-config-2", templateConfigMap(t, kubeClient))
+		require.Len(t, r.breaker.pendingReloads(), 1)
+	})
+
+	t.Run("strict mode", func(t *testing.T) {
+		t.Parallel()
+
+		r, kubeClient := setup(t)
+		r.strict = true
+		member := testableFamilyMember(t, "app-config-4", 3*time.Minute)
+		member.Labels[labelEnabled] = "true"
+		add := onFamilyMemberAdd(context.Background(), slog.New(slog.DiscardHandler), r)
+		add(member)
+
+		// The Deployment is not enabled for reloads.
+		require.Equal(t, "app-config-2", templateConfigMap(t, kubeClient))
+	})
+}
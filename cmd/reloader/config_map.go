@@ -5,37 +5,31 @@ import (
 	"log/slog"
 
 	corev1 "k8s.io/api/core/v1"
-	"k8s.io/apimachinery/pkg/labels"
-	"k8s.io/client-go/kubernetes"
-	listersv1 "k8s.io/client-go/listers/core/v1"
 	kubecache "k8s.io/client-go/tools/cache"
 
-	"github.com/jacobbrewer1/web/cache"
 	"github.com/jacobbrewer1/web/logging"
 )
 
-// watchConfigMaps starts watching for configMap updates and deletes.
+// watchConfigMaps starts watching for configMap creations, updates and deletes.
 func (a *App) watchConfigMaps(ctx context.Context) {
 	informer := a.base.ConfigMapInformer()
 
 	handler := kubecache.ResourceEventHandlerFuncs{
+		AddFunc: onConfigMapAdd(
+			ctx,
+			logging.LoggerWithComponent(a.base.Logger(), "configmaps"),
+			a.reloader,
+		),
 		UpdateFunc: onConfigMapUpdate(
 			ctx,
 			logging.LoggerWithComponent(a.base.Logger(), "configmaps"),
-			a.base.ServiceEndpointHashBucket(),
-			a.base.KubeClient(),
-			a.base.PodLister(),
+			a.reloader,
 		),
-	}
-
-	if a.config.KillOnDelete {
-		handler.DeleteFunc = onConfigMapDelete(
+		DeleteFunc: onConfigMapDelete(
 			ctx,
 			logging.LoggerWithComponent(a.base.Logger(), "configmaps"),
-			a.base.ServiceEndpointHashBucket(),
-			a.base.KubeClient(),
-			a.base.PodLister(),
-		)
+			a.reloader,
+		),
 	}
 
 	_, err := informer.AddEventHandler(handler)
@@ -48,13 +42,62 @@ func (a *App) watchConfigMaps(ctx context.Context) {
 	<-ctx.Done()
 }
 
+// onConfigMapAdd is called when a configMap is added. A configMap recreated within the delete grace period is handled as
+// an update, otherwise the dependent pods that started before the configMap was created are restarted. Workloads are
+// also repointed to it when it is the newest member of its family. The informer replays every configMap as added when
+// it starts, which catches up on configMaps created while reloader was down.
+func onConfigMapAdd(
+	ctx context.Context,
+	l *slog.Logger,
+	r *reloader,
+) func(any) {
+	onFamily := onFamilyMemberAdd(ctx, l, r)
+	return func(obj any) {
+		onFamily(obj)
+
+		configMap, ok := obj.(*corev1.ConfigMap)
+		if !ok {
+			return
+		}
+
+		if !r.bucket.InBucket(configMap.Name) {
+			return
+		}
+
+		if !r.triggers(configMap.Labels, configMap.Annotations) {
+			return
+		}
+
+		ref := objectReference("ConfigMap", configMap)
+		if keys, ok := r.recreated(l, ref, configMapContent(configMap)); ok {
+			if len(keys) == 0 || !r.validator.allow(ctx, l, ref, configMap.Annotations, configMapContent(configMap)) {
+				return
+			}
+			r.reload(ctx, l, ref, keys, configMapHash(configMap))
+			return
+		}
+
+		stale, err := r.createdDependents(ref, configMap.CreationTimestamp.Time)
+		if err != nil {
+			l.Error("failed to list pods", slog.String(logging.KeyError, err.Error()))
+			return
+		} else if len(stale) == 0 {
+			return
+		}
+
+		if !r.validator.allow(ctx, l, ref, configMap.Annotations, configMapContent(configMap)) {
+			return
+		}
+
+		r.reloadCreated(ctx, l, ref, configMapKeys(configMap), stale)
+	}
+}
+
 // onConfigMapUpdate is called when a configMap is updated. It checks if the configMap is in the
 func onConfigMapUpdate(
 	ctx context.Context,
 	l *slog.Logger,
-	bucket cache.HashBucket,
-	kubeClient kubernetes.Interface,
-	podLister listersv1.PodLister,
+	r *reloader,
 ) func(any, any) {
 	return func(oldObj, newObj any) {
 		configMap, ok := newObj.(*corev1.ConfigMap)
@@ -62,24 +105,31 @@ func onConfigMapUpdate(
 			return
 		}
 
-		if !bucket.InBucket(configMap.Name) {
+		// Informer resyncs deliver updates for unchanged objects, which must not restart anything.
+		old, ok := oldObj.(*corev1.ConfigMap)
+		if ok && old.ResourceVersion == configMap.ResourceVersion {
 			return
 		}
 
-		// Get all pods that use this configMap. This is specified with the label
-		// "reloader/configmap": "<configmap-name>".
-		pods, err := podLister.Pods(configMap.Namespace).List(labels.SelectorFromSet(map[string]string{
-			"reloader/configmap": configMap.Name,
-		}))
-		if err != nil {
-			l.Error("failed to list pods", slog.String(logging.KeyError, err.Error()))
+		if !r.bucket.InBucket(configMap.Name) {
+			return
+		}
+
+		if !r.triggers(configMap.Labels, configMap.Annotations) {
 			return
 		}
 
-		if err := killPods(ctx, kubeClient, pods); err != nil { // nolint:revive // Traditional error handling
-			l.Error("failed to kill pods", slog.String(logging.KeyError, err.Error()))
+		keys := configMapKeys(configMap)
+		if ok {
+			keys = append(changedKeys(old.Data, configMap.Data), changedKeys(old.BinaryData, configMap.BinaryData)...)
+		}
+
+		ref := objectReference("ConfigMap", configMap)
+		if !r.validator.allow(ctx, l, ref, configMap.Annotations, configMapContent(configMap)) {
 			return
 		}
+
+		r.reload(ctx, l, ref, keys, configMapHash(configMap))
 	}
 }
 
@@ -87,9 +137,7 @@ func onConfigMapUpdate(
 func onConfigMapDelete(
 	ctx context.Context,
 	l *slog.Logger,
-	bucket cache.HashBucket,
-	kubeClient kubernetes.Interface,
-	podLister listersv1.PodLister,
+	r *reloader,
 ) func(any) {
 	return func(obj any) {
 		configMap, ok := obj.(*corev1.ConfigMap)
@@ -97,23 +145,25 @@ func onConfigMapDelete(
 			return
 		}
 
-		if !bucket.InBucket(configMap.Name) {
+		if !r.bucket.InBucket(configMap.Name) {
 			return
 		}
 
-		// Get all pods that use this configMap. This is specified with the label
-		// "reloader/configmap": "<configmap-name>".
-		pods, err := podLister.Pods(configMap.Namespace).List(labels.SelectorFromSet(map[string]string{
-			"reloader/configmap": configMap.Name,
-		}))
-		if err != nil {
-			l.Error("failed to list pods", slog.String(logging.KeyError, err.Error()))
+		if !r.triggers(configMap.Labels, configMap.Annotations) {
 			return
 		}
 
-		if err := killPods(ctx, kubeClient, pods); err != nil { // nolint:revive // Traditional error handling
-			l.Error("failed to kill pods", slog.String(logging.KeyError, err.Error()))
+		ref := objectReference("ConfigMap", configMap)
+		if !r.deleted(ctx, ref) {
+			l.Info("object no longer watched, skipping reload", slog.String(logKeyObject, referenceKey(ref)))
 			return
 		}
+
+		r.reloadDeleted(ctx, l, ref, configMapKeys(configMap), configMapContent(configMap), configMap.Annotations)
 	}
 }
+
+// configMapKeys returns all the keys of the given configMap.
+func configMapKeys(configMap *corev1.ConfigMap) []string {
+	return append(dataKeys(configMap.Data), dataKeys(configMap.BinaryData)...)
+}
@@ -5,9 +5,11 @@ import (
 	"fmt"
 	"log/slog"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
 	corev1 "k8s.io/api/core/v1"
+	kubeerrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/client-go/informers"
 	"k8s.io/client-go/kubernetes/fake"
@@ -65,7 +67,7 @@ func Test_OnConfigMapUpdate(t *testing.T) {
 		}
 
 		informerFactory := informers.NewSharedInformerFactory(kubeClient, 0)
-		podLister := informerFactory.Core().V1().Pods().Lister()
+		rel := testableReloader(t, bucket, kubeClient, informerFactory)
 		informerFactory.Start(ctx.Done())
 		informerFactory.WaitForCacheSync(ctx.Done())
 
@@ -80,7 +82,7 @@ func Test_OnConfigMapUpdate(t *testing.T) {
 		_, err := kubeClient.CoreV1().ConfigMaps("default").Create(ctx, cm, metav1.CreateOptions{})
 		require.NoError(t, err)
 
-		handler := onConfigMapUpdate(ctx, logger, bucket, kubeClient, podLister)
+		handler := onConfigMapUpdate(ctx, logger, rel)
 		handler(nil, cm)
 
 		// Check that the pods were killed
@@ -141,11 +143,11 @@ func Test_OnConfigMapUpdate(t *testing.T) {
 		}
 
 		informerFactory := informers.NewSharedInformerFactory(kubeClient, 0)
-		podLister := informerFactory.Core().V1().Pods().Lister()
+		rel := testableReloader(t, bucket, kubeClient, informerFactory)
 		informerFactory.Start(ctx.Done())
 		informerFactory.WaitForCacheSync(ctx.Done())
 
-		handler := onConfigMapUpdate(ctx, logger, bucket, kubeClient, podLister)
+		handler := onConfigMapUpdate(ctx, logger, rel)
 		handler(nil, testablePod(t))
 
 		for _, pod := range pods {
@@ -203,7 +205,7 @@ func Test_OnConfigMapUpdate(t *testing.T) {
 		}
 
 		informerFactory := informers.NewSharedInformerFactory(kubeClient, 0)
-		podLister := informerFactory.Core().V1().Pods().Lister()
+		rel := testableReloader(t, bucket, kubeClient, informerFactory)
 		informerFactory.Start(ctx.Done())
 		informerFactory.WaitForCacheSync(ctx.Done())
 
@@ -215,7 +217,7 @@ func Test_OnConfigMapUpdate(t *testing.T) {
 			Data: map[string]string{"key": "value"},
 		}
 
-		handler := onConfigMapUpdate(ctx, logger, bucket, kubeClient, podLister)
+		handler := onConfigMapUpdate(ctx, logger, rel)
 
 		handler(nil, cm)
 
@@ -225,6 +227,57 @@ func Test_OnConfigMapUpdate(t *testing.T) {
 			require.Equal(t, corev1.PodRunning, p.Status.Phase)
 		}
 	})
+
+	t.Run("resync", func(t *testing.T) {
+		t.Parallel()
+
+		ctx := context.Background()
+		logger := slog.New(slog.DiscardHandler)
+		bucket := cache.NewFixedHashBucket(1)
+
+		pods := []*corev1.Pod{
+			{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      "pod1",
+					Namespace: "default",
+					Labels:    map[string]string{"reloader/configmap": "in-bucket"},
+				},
+				Status: corev1.PodStatus{
+					Phase: corev1.PodRunning,
+				},
+			},
+		}
+
+		kubeClient := fake.NewClientset()
+		for _, pod := range pods {
+			_, err := kubeClient.CoreV1().Pods(pod.Namespace).Create(ctx, pod, metav1.CreateOptions{})
+			require.NoError(t, err)
+		}
+
+		informerFactory := informers.NewSharedInformerFactory(kubeClient, 0)
+		rel := testableReloader(t, bucket, kubeClient, informerFactory)
+		informerFactory.Start(ctx.Done())
+		informerFactory.WaitForCacheSync(ctx.Done())
+
+		cm := &corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:            "in-bucket",
+				Namespace:       "default",
+				ResourceVersion: "1",
+			},
+			Data: map[string]string{"key": "value"},
+		}
+
+		handler := onConfigMapUpdate(ctx, logger, rel)
+
+		handler(cm, cm)
+
+		for _, pod := range pods {
+			p, err := kubeClient.CoreV1().Pods(pod.Namespace).Get(ctx, pod.Name, metav1.GetOptions{})
+			require.NoError(t, err)
+			require.Equal(t, corev1.PodRunning, p.Status.Phase)
+		}
+	})
 }
 
 func Test_OnConfigMapDelete(t *testing.T) {
@@ -277,7 +330,7 @@ func Test_OnConfigMapDelete(t *testing.T) {
 		}
 
 		informerFactory := informers.NewSharedInformerFactory(kubeClient, 0)
-		podLister := informerFactory.Core().V1().Pods().Lister()
+		rel := testableReloader(t, bucket, kubeClient, informerFactory)
 		informerFactory.Start(ctx.Done())
 		informerFactory.WaitForCacheSync(ctx.Done())
 
@@ -291,8 +344,9 @@ func Test_OnConfigMapDelete(t *testing.T) {
 
 		_, err := kubeClient.CoreV1().ConfigMaps("default").Create(ctx, cm, metav1.CreateOptions{})
 		require.NoError(t, err)
+		require.NoError(t, kubeClient.CoreV1().ConfigMaps("default").Delete(ctx, cm.Name, metav1.DeleteOptions{}))
 
-		handler := onConfigMapDelete(ctx, logger, bucket, kubeClient, podLister)
+		handler := onConfigMapDelete(ctx, logger, rel)
 		handler(cm)
 
 		// Check that the pods were killed
@@ -353,11 +407,11 @@ func Test_OnConfigMapDelete(t *testing.T) {
 		}
 
 		informerFactory := informers.NewSharedInformerFactory(kubeClient, 0)
-		podLister := informerFactory.Core().V1().Pods().Lister()
+		rel := testableReloader(t, bucket, kubeClient, informerFactory)
 		informerFactory.Start(ctx.Done())
 		informerFactory.WaitForCacheSync(ctx.Done())
 
-		handler := onConfigMapDelete(ctx, logger, bucket, kubeClient, podLister)
+		handler := onConfigMapDelete(ctx, logger, rel)
 		handler(testablePod(t))
 
 		for _, pod := range pods {
@@ -415,7 +469,7 @@ func Test_OnConfigMapDelete(t *testing.T) {
 		}
 
 		informerFactory := informers.NewSharedInformerFactory(kubeClient, 0)
-		podLister := informerFactory.Core().V1().Pods().Lister()
+		rel := testableReloader(t, bucket, kubeClient, informerFactory)
 		informerFactory.Start(ctx.Done())
 		informerFactory.WaitForCacheSync(ctx.Done())
 
@@ -427,7 +481,7 @@ func Test_OnConfigMapDelete(t *testing.T) {
 			Data: map[string]string{"key": "value"},
 		}
 
-		handler := onConfigMapDelete(ctx, logger, bucket, kubeClient, podLister)
+		handler := onConfigMapDelete(ctx, logger, rel)
 
 		handler(cm)
 
@@ -437,4 +491,63 @@ func Test_OnConfigMapDelete(t *testing.T) {
 			require.Equal(t, corev1.PodRunning, p.Status.Phase)
 		}
 	})
+	t.Run("still-exists", func(t *testing.T) {
+		t.Parallel()
+
+		ctx := context.Background()
+		logger := slog.New(slog.DiscardHandler)
+
+		pod := testableDependentPod(t, "pod1", "default", "ConfigMap", "unselected")
+		cm := &corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      "unselected",
+				Namespace: "default",
+			},
+		}
+		kubeClient := fake.NewClientset(pod, cm)
+
+		informerFactory := informers.NewSharedInformerFactory(kubeClient, 0)
+		rel := testableReloader(t, cache.NewFixedHashBucket(1), kubeClient, informerFactory)
+		informerFactory.Start(ctx.Done())
+		informerFactory.WaitForCacheSync(ctx.Done())
+
+		// The informer reports objects that stop matching its selectors as deleted.
+		onConfigMapDelete(ctx, logger, rel)(cm)
+
+		_, err := kubeClient.CoreV1().Pods(pod.Namespace).Get(ctx, pod.Name, metav1.GetOptions{})
+		require.NoError(t, err)
+	})
+}
+
+func Test_OnConfigMapAdd(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	created := time.Now().Add(-time.Minute)
+	oldPod := testableDependentPod(t, "old", "default", "ConfigMap", "app")
+	oldPod.Status.StartTime = &metav1.Time{Time: created.Add(-time.Hour)}
+	newPod := testableDependentPod(t, "new", "default", "ConfigMap", "app")
+	newPod.Status.StartTime = &metav1.Time{Time: created.Add(time.Second)}
+
+	kubeClient := fake.NewClientset(oldPod, newPod)
+	informerFactory := informers.NewSharedInformerFactory(kubeClient, 0)
+	rel := testableReloader(t, cache.NewFixedHashBucket(1), kubeClient, informerFactory)
+	informerFactory.Start(ctx.Done())
+	informerFactory.WaitForCacheSync(ctx.Done())
+
+	configMap := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:              "app",
+			Namespace:         "default",
+			CreationTimestamp: metav1.NewTime(created),
+		},
+	}
+	onConfigMapAdd(ctx, slog.New(slog.DiscardHandler), rel)(configMap)
+
+	_, err := kubeClient.CoreV1().Pods("default").Get(ctx, "old", metav1.GetOptions{})
+	require.True(t, kubeerrors.IsNotFound(err))
+	_, err = kubeClient.CoreV1().Pods("default").Get(ctx, "new", metav1.GetOptions{})
+	require.NoError(t, err)
 }
@@ -0,0 +1,384 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic/dynamicinformer"
+	kubecache "k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/jsonpath"
+
+	"github.com/jacobbrewer1/web/logging"
+)
+
+// ErrInvalidCustomTrigger is returned when a custom trigger configuration is not valid.
+var ErrInvalidCustomTrigger = errors.New("invalid custom trigger")
+
+type (
+	// customTriggerConfig is the configuration of a custom resource whose changes reload the pods referencing it, as
+	// read from the custom triggers config file.
+	customTriggerConfig struct {
+		// Group is the API group of the custom resource.
+		Group string `json:"group"`
+
+		// Version is the API version of the custom resource.
+		Version string `json:"version"`
+
+		// Resource is the plural resource name of the custom resource, such as "externalsecrets".
+		Resource string `json:"resource"`
+
+		// Kind is the kind of the custom resource, used in dependency keys, logs, events and notifications.
+		Kind string `json:"kind"`
+
+		// Paths are the JSONPath templates selecting the fields whose changes trigger a reload, such as
+		// "{.status.conditions}". Changes to other fields are ignored.
+		Paths []string `json:"paths"`
+
+		// ReferenceKey is the pod label or annotation naming the custom resource the pod depends on. It defaults to
+		// "reloader/<kind>", like the ConfigMap and Secret dependency labels. Annotations allow names that are too long
+		// for a label value.
+		ReferenceKey string `json:"reference_key"`
+	}
+
+	// customTriggersConfig is the content of the custom triggers config file.
+	customTriggersConfig struct {
+		// Triggers are the custom resources to watch.
+		Triggers []*customTriggerConfig `json:"triggers"`
+	}
+
+	// customTrigger is a parsed custom trigger configuration.
+	customTrigger struct {
+		// config is the configuration of the trigger.
+		config *customTriggerConfig
+
+		// gvr is the resource watched by the dynamic informer.
+		gvr schema.GroupVersionResource
+
+		// referenceKey is the pod label or annotation naming the custom resource.
+		referenceKey string
+
+		// lister reads the custom resources from the cache of the dynamic informer, once registered.
+		lister kubecache.GenericLister
+	}
+)
+
+// newCustomTrigger validates the given configuration.
+func newCustomTrigger(cfg *customTriggerConfig) (*customTrigger, error) {
+	switch {
+	case cfg.Version == "" || cfg.Resource == "":
+		return nil, fmt.Errorf("%w: version and resource are required", ErrInvalidCustomTrigger)
+	case cfg.Kind == "":
+		return nil, fmt.Errorf("%w: %s: kind is required", ErrInvalidCustomTrigger, cfg.Resource)
+	case len(cfg.Paths) == 0:
+		return nil, fmt.Errorf("%w: %s: at least one path is required", ErrInvalidCustomTrigger, cfg.Resource)
+	}
+
+	if _, err := apiKind(cfg.Kind); err == nil {
+		return nil, fmt.Errorf("%w: %s: %s objects are always watched", ErrInvalidCustomTrigger, cfg.Resource, cfg.Kind)
+	}
+
+	for _, path := range cfg.Paths {
+		if _, err := parseJSONPath(path); err != nil {
+			return nil, fmt.Errorf("%w: %s: %w", ErrInvalidCustomTrigger, cfg.Resource, err)
+		}
+	}
+
+	trigger := &customTrigger{
+		config:       cfg,
+		gvr:          schema.GroupVersionResource{Group: cfg.Group, Version: cfg.Version, Resource: cfg.Resource},
+		referenceKey: cfg.ReferenceKey,
+	}
+	if trigger.referenceKey == "" {
+		trigger.referenceKey = dependencyLabel(cfg.Kind)
+	}
+	return trigger, nil
+}
+
+// loadCustomTriggers reads and validates the custom triggers from the config file at the given path. An empty path
+// means no custom triggers are configured.
+func loadCustomTriggers(path string) ([]*customTrigger, error) {
+	if path == "" {
+		return nil, nil
+	}
+
+	b, err := os.ReadFile(path) // nolint:gosec // The path is operator supplied configuration
+	if err != nil {
+		return nil, fmt.Errorf("failed to read custom triggers config: %w", err)
+	}
+
+	cfg := new(customTriggersConfig)
+	if err := json.Unmarshal(b, cfg); err != nil {
+		return nil, fmt.Errorf("failed to parse custom triggers config: %w", err)
+	}
+
+	triggers := make([]*customTrigger, 0, len(cfg.Triggers))
+	seen := make(map[string]bool, len(cfg.Triggers))
+	for _, tc := range cfg.Triggers {
+		trigger, err := newCustomTrigger(tc)
+		if err != nil {
+			return nil, err
+		}
+
+		kind := strings.ToLower(tc.Kind)
+		if seen[kind] {
+			return nil, fmt.Errorf("%w: %s: kind %s is configured twice", ErrInvalidCustomTrigger, tc.Resource, tc.Kind)
+		}
+		seen[kind] = true
+
+		triggers = append(triggers, trigger)
+	}
+	return triggers, nil
+}
+
+// parseJSONPath parses a JSONPath template. Missing fields render as nothing, as status fields are often absent
+// until a controller first reconciles the resource.
+func parseJSONPath(path string) (*jsonpath.JSONPath, error) {
+	j := jsonpath.New(path).AllowMissingKeys(true)
+	j.EnableJSONOutput(true)
+	if err := j.Parse(path); err != nil {
+		return nil, fmt.Errorf("invalid path %q: %w", path, err)
+	}
+	return j, nil
+}
+
+// values renders the watched fields of the custom resource, keyed by path. The paths are parsed for every call, as a
+// parsed JSONPath keeps state while executing.
+func (t *customTrigger) values(obj *unstructured.Unstructured) (map[string]string, error) {
+	values := make(map[string]string, len(t.config.Paths))
+	for _, path := range t.config.Paths {
+		j, err := parseJSONPath(path)
+		if err != nil {
+			return nil, err
+		}
+
+		buf := new(bytes.Buffer)
+		if err := j.Execute(buf, obj.Object); err != nil {
+			return nil, fmt.Errorf("failed to evaluate path %q: %w", path, err)
+		}
+		values[path] = buf.String()
+	}
+	return values, nil
+}
+
+// reference returns the reference to the custom resource.
+func (t *customTrigger) reference(obj *unstructured.Unstructured) *corev1.ObjectReference {
+	ref := objectReference(t.config.Kind, obj)
+	ref.APIVersion = t.gvr.GroupVersion().String()
+	return ref
+}
+
+// podReference returns the name of the custom resource the pod references, if any.
+func (t *customTrigger) podReference(pod *corev1.Pod) (string, bool) {
+	if name, ok := pod.Labels[t.referenceKey]; ok {
+		return name, true
+	}
+	name, ok := pod.Annotations[t.referenceKey]
+	return name, ok
+}
+
+// customTrigger returns the custom trigger of the given kind, or nil if there is none.
+func (r *reloader) customTrigger(kind string) *customTrigger {
+	for _, trigger := range r.customTriggers {
+		if trigger.config.Kind == kind {
+			return trigger
+		}
+	}
+	return nil
+}
+
+// customTriggerKey reports whether the pod label or annotation key is the reference key of a custom trigger.
+func (r *reloader) customTriggerKey(key string) bool {
+	for _, trigger := range r.customTriggers {
+		if trigger.referenceKey == key {
+			return true
+		}
+	}
+	return false
+}
+
+// registerCustomInformers registers the informers of the custom triggers on the dynamic informer factory. Only the
+// managed fields are dropped from the cache, as the watched paths may read any other field.
+func registerCustomInformers(factory dynamicinformer.DynamicSharedInformerFactory, triggers []*customTrigger) error {
+	for _, trigger := range triggers {
+		informer := factory.ForResource(trigger.gvr)
+		if err := informer.Informer().SetTransform(cacheTransform(false)); err != nil {
+			return fmt.Errorf("failed to set transform of %s informer: %w", trigger.gvr, err)
+		}
+		trigger.lister = informer.Lister()
+	}
+	return nil
+}
+
+// watchCustomTriggers starts watching for creations, updates and deletes of the custom trigger resources.
+func (a *App) watchCustomTriggers(ctx context.Context) {
+	l := logging.LoggerWithComponent(a.base.Logger(), "custom-triggers")
+
+	for _, trigger := range a.customTriggers {
+		handler := kubecache.ResourceEventHandlerFuncs{
+			AddFunc:    onCustomResourceAdd(ctx, l, a.reloader, trigger),
+			UpdateFunc: onCustomResourceUpdate(ctx, l, a.reloader, trigger),
+			DeleteFunc: onCustomResourceDelete(ctx, l, a.reloader, trigger),
+		}
+
+		if _, err := a.dynamicFactory.ForResource(trigger.gvr).Informer().AddEventHandler(handler); err != nil {
+			l.Error("failed to add event handler",
+				slog.String(logKeyKind, trigger.config.Kind),
+				slog.String(logging.KeyError, err.Error()),
+			)
+			return
+		}
+	}
+
+	l.Info("watching custom resources")
+	<-ctx.Done()
+}
+
+// onCustomResourceAdd is called when a custom resource is added. A custom resource recreated within the delete grace
+// period is handled as an update of the watched fields that changed since its deletion.
+func onCustomResourceAdd(
+	ctx context.Context,
+	l *slog.Logger,
+	r *reloader,
+	trigger *customTrigger,
+) func(any) {
+	return func(obj any) {
+		resource, ok := obj.(*unstructured.Unstructured)
+		if !ok {
+			return
+		}
+
+		if !r.bucket.InBucket(resource.GetName()) {
+			return
+		}
+
+		if !r.triggers(resource.GetLabels(), resource.GetAnnotations()) {
+			return
+		}
+
+		ref := trigger.reference(resource)
+		values, err := trigger.values(resource)
+		if err != nil {
+			l.Error("failed to read watched fields",
+				slog.String(logKeyObject, referenceKey(ref)),
+				slog.String(logging.KeyError, err.Error()),
+			)
+			return
+		}
+
+		if keys, ok := r.recreated(l, ref, customContent(values)); ok && len(keys) > 0 {
+			r.reload(ctx, l, ref, keys, dataHash(values))
+		}
+	}
+}
+
+// onCustomResourceUpdate is called when a custom resource is updated. The pods referencing it are reloaded when one
+// of the watched fields changed, with the changed paths reported as the changed keys.
+func onCustomResourceUpdate(
+	ctx context.Context,
+	l *slog.Logger,
+	r *reloader,
+	trigger *customTrigger,
+) func(any, any) {
+	return func(oldObj, newObj any) {
+		obj, ok := newObj.(*unstructured.Unstructured)
+		if !ok {
+			return
+		}
+
+		// Informer resyncs deliver updates for unchanged objects, which must not restart anything.
+		old, ok := oldObj.(*unstructured.Unstructured)
+		if ok && old.GetResourceVersion() == obj.GetResourceVersion() {
+			return
+		}
+
+		if !r.bucket.InBucket(obj.GetName()) {
+			return
+		}
+
+		if !r.triggers(obj.GetLabels(), obj.GetAnnotations()) {
+			return
+		}
+
+		ref := trigger.reference(obj)
+		values, err := trigger.values(obj)
+		if err != nil {
+			l.Error("failed to read watched fields",
+				slog.String(logKeyObject, referenceKey(ref)),
+				slog.String(logging.KeyError, err.Error()),
+			)
+			return
+		}
+
+		keys := dataKeys(values)
+		if ok {
+			oldValues, err := trigger.values(old)
+			if err != nil {
+				l.Error("failed to read watched fields",
+					slog.String(logKeyObject, referenceKey(ref)),
+					slog.String(logging.KeyError, err.Error()),
+				)
+				return
+			}
+			keys = changedKeys(oldValues, values)
+		}
+
+		if len(keys) == 0 {
+			return
+		}
+
+		r.reload(ctx, l, ref, keys, dataHash(values))
+	}
+}
+
+// onCustomResourceDelete is called when a custom resource is deleted. The delete policies are applied to the pods
+// referencing it, like for ConfigMaps and Secrets.
+func onCustomResourceDelete(
+	ctx context.Context,
+	l *slog.Logger,
+	r *reloader,
+	trigger *customTrigger,
+) func(any) {
+	return func(obj any) {
+		resource, ok := obj.(*unstructured.Unstructured)
+		if !ok {
+			return
+		}
+
+		if !r.bucket.InBucket(resource.GetName()) {
+			return
+		}
+
+		if !r.triggers(resource.GetLabels(), resource.GetAnnotations()) {
+			return
+		}
+
+		ref := trigger.reference(resource)
+		values, err := trigger.values(resource)
+		if err != nil {
+			l.Error("failed to read watched fields",
+				slog.String(logKeyObject, referenceKey(ref)),
+				slog.String(logging.KeyError, err.Error()),
+			)
+		}
+
+		r.reloadDeleted(ctx, l, ref, trigger.config.Paths, customContent(values), resource.GetAnnotations())
+	}
+}
+
+// customContent returns the rendered watched fields of a custom resource as content, keyed by path.
+func customContent(values map[string]string) map[string][]byte {
+	content := make(map[string][]byte, len(values))
+	for path, value := range values {
+		content[path] = []byte(value)
+	}
+	return content
+}
@@ -0,0 +1,351 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes/fake"
+	kubecache "k8s.io/client-go/tools/cache"
+
+	"github.com/jacobbrewer1/web/cache"
+)
+
+func testableCustomTrigger(t *testing.T) *customTrigger {
+	t.Helper()
+
+	trigger, err := newCustomTrigger(&customTriggerConfig{
+		Group:    "external-secrets.io",
+		Version:  "v1beta1",
+		Resource: "externalsecrets",
+		Kind:     "ExternalSecret",
+		Paths:    []string{"{.status.refreshTime}", "{.spec.data}"},
+	})
+	require.NoError(t, err)
+	return trigger
+}
+
+func testableCustomResource(t *testing.T, resourceVersion, refreshTime string) *unstructured.Unstructured {
+	t.Helper()
+
+	obj := &unstructured.Unstructured{Object: map[string]any{
+		"apiVersion": "external-secrets.io/v1beta1",
+		"kind":       "ExternalSecret",
+		"metadata": map[string]any{
+			"name":            "db",
+			"namespace":       "default",
+			"resourceVersion": resourceVersion,
+		},
+		"spec": map[string]any{
+			"data": []any{map[string]any{"secretKey": "password"}},
+		},
+	}}
+	if refreshTime != "" {
+		require.NoError(t, unstructured.SetNestedField(obj.Object, refreshTime, "status", "refreshTime"))
+	}
+	return obj
+}
+
+func Test_LoadCustomTriggers(t *testing.T) {
+	t.Parallel()
+
+	t.Run("no config", func(t *testing.T) {
+		t.Parallel()
+
+		triggers, err := loadCustomTriggers("")
+		require.NoError(t, err)
+		require.Empty(t, triggers)
+	})
+
+	t.Run("config file", func(t *testing.T) {
+		t.Parallel()
+
+		path := filepath.Join(t.TempDir(), "triggers.json")
+		require.NoError(t, os.WriteFile(path, []byte(`{
+			"triggers": [
+				{"group": "cert-manager.io", "version": "v1", "resource": "certificates", "kind": "Certificate",
+					"paths": ["{.status.revision}"]},
+				{"group": "bitnami.com", "version": "v1alpha1", "resource": "sealedsecrets", "kind": "SealedSecret",
+					"paths": ["{.spec.encryptedData}"], "reference_key": "example.com/sealed-secret"}
+			]
+		}`), 0o600))
+
+		triggers, err := loadCustomTriggers(path)
+		require.NoError(t, err)
+		require.Len(t, triggers, 2)
+		require.Equal(t, "cert-manager.io/v1, Resource=certificates", triggers[0].gvr.String())
+		require.Equal(t, "reloader/certificate", triggers[0].referenceKey)
+		require.Equal(t, "example.com/sealed-secret", triggers[1].referenceKey)
+	})
+
+	t.Run("duplicate kind", func(t *testing.T) {
+		t.Parallel()
+
+		path := filepath.Join(t.TempDir(), "triggers.json")
+		require.NoError(t, os.WriteFile(path, []byte(`{
+			"triggers": [
+				{"version": "v1", "resource": "certificates", "kind": "Certificate", "paths": ["{.status}"]},
+				{"version": "v1", "resource": "certificates", "kind": "certificate", "paths": ["{.spec}"]}
+			]
+		}`), 0o600))
+
+		_, err := loadCustomTriggers(path)
+		require.ErrorIs(t, err, ErrInvalidCustomTrigger)
+	})
+}
+
+func Test_NewCustomTrigger(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name string
+		cfg  *customTriggerConfig
+	}{
+		{
+			name: "missing resource",
+			cfg:  &customTriggerConfig{Version: "v1", Kind: "Certificate", Paths: []string{"{.status}"}},
+		},
+		{
+			name: "missing kind",
+			cfg:  &customTriggerConfig{Version: "v1", Resource: "certificates", Paths: []string{"{.status}"}},
+		},
+		{
+			name: "missing paths",
+			cfg:  &customTriggerConfig{Version: "v1", Resource: "certificates", Kind: "Certificate"},
+		},
+		{
+			name: "invalid path",
+			cfg: &customTriggerConfig{
+				Version: "v1", Resource: "certificates", Kind: "Certificate", Paths: []string{"{.status"},
+			},
+		},
+		{
+			name: "builtin kind",
+			cfg:  &customTriggerConfig{Version: "v1", Resource: "secrets", Kind: "Secret", Paths: []string{"{.data}"}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			_, err := newCustomTrigger(tt.cfg)
+			require.ErrorIs(t, err, ErrInvalidCustomTrigger)
+		})
+	}
+}
+
+func Test_CustomTriggerValues(t *testing.T) {
+	t.Parallel()
+
+	trigger := testableCustomTrigger(t)
+
+	values, err := trigger.values(testableCustomResource(t, "1", "2024-01-01T00:00:00Z"))
+	require.NoError(t, err)
+	require.Len(t, values, 2)
+	require.JSONEq(t, `[[{"secretKey": "password"}]]`, values["{.spec.data}"])
+	require.JSONEq(t, `["2024-01-01T00:00:00Z"]`, values["{.status.refreshTime}"])
+
+	// Status fields are absent until the resource is first reconciled.
+	values, err = trigger.values(testableCustomResource(t, "1", ""))
+	require.NoError(t, err)
+	require.JSONEq(t, "[]", values["{.status.refreshTime}"])
+}
+
+func Test_CustomTriggerPodReference(t *testing.T) {
+	t.Parallel()
+
+	trigger := testableCustomTrigger(t)
+
+	name, ok := trigger.podReference(testableDependentPod(t, "api", "default", "ExternalSecret", "db"))
+	require.True(t, ok)
+	require.Equal(t, "db", name)
+
+	pod := testablePod(t)
+	pod.Annotations = map[string]string{"reloader/externalsecret": "a-name-too-long-for-a-label-value"}
+	name, ok = trigger.podReference(pod)
+	require.True(t, ok)
+	require.Equal(t, "a-name-too-long-for-a-label-value", name)
+
+	_, ok = trigger.podReference(testablePod(t))
+	require.False(t, ok)
+}
+
+func Test_OnCustomResourceUpdate(t *testing.T) {
+	t.Parallel()
+
+	trigger := testableCustomTrigger(t)
+
+	// setup returns a reloader indexing pods by the custom trigger and a pod depending on the custom resource.
+	setup := func(t *testing.T) (*reloader, *fake.Clientset, *corev1.Pod) {
+		t.Helper()
+
+		ctx, cancel := context.WithCancel(context.Background())
+		t.Cleanup(cancel)
+
+		pod := testableDependentPod(t, "api", "default", "ExternalSecret", "db")
+		kubeClient := fake.NewClientset(pod)
+
+		informerFactory := informers.NewSharedInformerFactory(kubeClient, 0)
+		r := testableReloader(t, cache.NewFixedHashBucket(1), kubeClient, informerFactory)
+		informerFactory.Start(ctx.Done())
+		informerFactory.WaitForCacheSync(ctx.Done())
+
+		r.podIndexer = kubecache.NewIndexer(kubecache.MetaNamespaceKeyFunc, kubecache.Indexers{
+			indexDependencies: dependencyIndexFunc(false, []*customTrigger{trigger}),
+		})
+		require.NoError(t, r.podIndexer.Add(pod))
+
+		return r, kubeClient, pod
+	}
+
+	tests := []struct {
+		name     string
+		old      *unstructured.Unstructured
+		new      *unstructured.Unstructured
+		restarts bool
+	}{
+		{
+			name:     "watched field changed",
+			old:      testableCustomResource(t, "1", "2024-01-01T00:00:00Z"),
+			new:      testableCustomResource(t, "2", "2024-01-02T00:00:00Z"),
+			restarts: true,
+		},
+		{
+			name:     "status first reported",
+			old:      testableCustomResource(t, "1", ""),
+			new:      testableCustomResource(t, "2", "2024-01-01T00:00:00Z"),
+			restarts: true,
+		},
+		{
+			name: "other field changed",
+			old:  testableCustomResource(t, "1", "2024-01-01T00:00:00Z"),
+			new: func() *unstructured.Unstructured {
+				obj := testableCustomResource(t, "2", "2024-01-01T00:00:00Z")
+				obj.SetLabels(map[string]string{"team": "a"})
+				return obj
+			}(),
+		},
+		{
+			name: "resync",
+			old:  testableCustomResource(t, "1", "2024-01-01T00:00:00Z"),
+			new:  testableCustomResource(t, "1", "2024-01-02T00:00:00Z"),
+		},
+		{
+			name: "ignored",
+			old:  testableCustomResource(t, "1", "2024-01-01T00:00:00Z"),
+			new: func() *unstructured.Unstructured {
+				obj := testableCustomResource(t, "2", "2024-01-02T00:00:00Z")
+				obj.SetAnnotations(map[string]string{annotationIgnore: "true"})
+				return obj
+			}(),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			r, kubeClient, pod := setup(t)
+			onCustomResourceUpdate(context.Background(), slog.New(slog.DiscardHandler), r, trigger)(tt.old, tt.new)
+
+			_, err := kubeClient.CoreV1().Pods(pod.Namespace).Get(context.Background(), pod.Name, metav1.GetOptions{})
+			if tt.restarts {
+				require.Error(t, err)
+			} else {
+				require.NoError(t, err)
+			}
+		})
+	}
+}
+
+func Test_OnCustomResourceDelete(t *testing.T) {
+	t.Parallel()
+
+	trigger := testableCustomTrigger(t)
+
+	// setup returns a reloader indexing pods by the custom trigger and a pod depending on the custom resource.
+	setup := func(t *testing.T) (*reloader, *fake.Clientset, *corev1.Pod) {
+		t.Helper()
+
+		ctx, cancel := context.WithCancel(context.Background())
+		t.Cleanup(cancel)
+
+		pod := testableDependentPod(t, "api", "default", "ExternalSecret", "db")
+		kubeClient := fake.NewClientset(pod)
+
+		informerFactory := informers.NewSharedInformerFactory(kubeClient, 0)
+		r := testableReloader(t, cache.NewFixedHashBucket(1), kubeClient, informerFactory)
+		informerFactory.Start(ctx.Done())
+		informerFactory.WaitForCacheSync(ctx.Done())
+
+		r.podIndexer = kubecache.NewIndexer(kubecache.MetaNamespaceKeyFunc, kubecache.Indexers{
+			indexDependencies: dependencyIndexFunc(false, []*customTrigger{trigger}),
+		})
+		require.NoError(t, r.podIndexer.Add(pod))
+
+		return r, kubeClient, pod
+	}
+
+	podExists := func(t *testing.T, kubeClient *fake.Clientset, pod *corev1.Pod) bool {
+		t.Helper()
+		_, err := kubeClient.CoreV1().Pods(pod.Namespace).Get(context.Background(), pod.Name, metav1.GetOptions{})
+		return err == nil
+	}
+
+	t.Run("restart", func(t *testing.T) {
+		t.Parallel()
+
+		r, kubeClient, pod := setup(t)
+		onCustomResourceDelete(context.Background(), slog.New(slog.DiscardHandler), r, trigger)(
+			testableCustomResource(t, "1", ""))
+
+		require.False(t, podExists(t, kubeClient, pod))
+	})
+
+	t.Run("default policy", func(t *testing.T) {
+		t.Parallel()
+
+		r, kubeClient, pod := setup(t)
+		r.deletePolicy = deletePolicyIgnore
+		onCustomResourceDelete(context.Background(), slog.New(slog.DiscardHandler), r, trigger)(
+			testableCustomResource(t, "1", ""))
+
+		require.True(t, podExists(t, kubeClient, pod))
+	})
+
+	t.Run("object policy", func(t *testing.T) {
+		t.Parallel()
+
+		r, kubeClient, pod := setup(t)
+		r.deletePolicy = deletePolicyIgnore
+		resource := testableCustomResource(t, "1", "")
+		resource.SetAnnotations(map[string]string{annotationDeletePolicy: "restart"})
+		onCustomResourceDelete(context.Background(), slog.New(slog.DiscardHandler), r, trigger)(resource)
+
+		require.False(t, podExists(t, kubeClient, pod))
+	})
+
+	t.Run("recreated within grace period", func(t *testing.T) {
+		t.Parallel()
+
+		r, kubeClient, pod := setup(t)
+		r.grace = newDeleteGrace(time.Hour)
+		onCustomResourceDelete(context.Background(), slog.New(slog.DiscardHandler), r, trigger)(
+			testableCustomResource(t, "1", "2024-01-01T00:00:00Z"))
+		require.True(t, podExists(t, kubeClient, pod))
+
+		// The watched fields changed since the deletion, which reloads the pods like an update.
+		onCustomResourceAdd(context.Background(), slog.New(slog.DiscardHandler), r, trigger)(
+			testableCustomResource(t, "2", "2024-01-02T00:00:00Z"))
+		require.False(t, podExists(t, kubeClient, pod))
+	})
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// heldDelete is a deletion waiting out the grace period.
+type heldDelete struct {
+	// timer applies the deletion when the grace period ends.
+	timer *time.Timer
+
+	// content is the content of the deleted object, to tell which keys a recreation changed.
+	content map[string][]byte
+}
+
+// deleteGrace holds the deletions of ConfigMaps, Secrets and custom resources for a grace period before acting on
+// them. Tools such as Helm and Argo CD often delete and recreate objects during upgrades, and restarting the dependent
+// pods in between only leaves them failing to start without the object.
+type deleteGrace struct {
+	// period is how long a deletion is held. Zero applies deletions immediately.
+	period time.Duration
+
+	// mut protects held.
+	mut *sync.Mutex
+
+	// held are the deletions waiting out the grace period, keyed by object key.
+	held map[string]*heldDelete
+}
+
+// newDeleteGrace creates a new deleteGrace.
+func newDeleteGrace(period time.Duration) *deleteGrace {
+	return &deleteGrace{
+		period: period,
+		mut:    new(sync.Mutex),
+		held:   make(map[string]*heldDelete),
+	}
+}
+
+// hold holds the deletion of the referenced object for the grace period, and calls apply once it ends unless the
+// object is recreated first. A later deletion of the same object replaces the held one.
+func (g *deleteGrace) hold(ref *corev1.ObjectReference, content map[string][]byte, apply func()) {
+	key := referenceKey(ref)
+
+	g.mut.Lock()
+	defer g.mut.Unlock()
+
+	if held, ok := g.held[key]; ok {
+		held.timer.Stop()
+	}
+
+	held := &heldDelete{content: content}
+	held.timer = time.AfterFunc(g.period, func() {
+		g.mut.Lock()
+		if g.held[key] != held {
+			// Released or replaced while the timer fired.
+			g.mut.Unlock()
+			return
+		}
+		delete(g.held, key)
+		g.mut.Unlock()
+
+		apply()
+	})
+	g.held[key] = held
+}
+
+// release cancels the held deletion of the referenced object, and returns the content the object had when it was
+// deleted. It reports false if no deletion of the object is held.
+func (g *deleteGrace) release(ref *corev1.ObjectReference) (map[string][]byte, bool) {
+	key := referenceKey(ref)
+
+	g.mut.Lock()
+	defer g.mut.Unlock()
+
+	held, ok := g.held[key]
+	if !ok {
+		return nil, false
+	}
+	held.timer.Stop()
+	delete(g.held, key)
+	return held.content, true
+}
+
+// reloadDeleted applies the delete policies to the pods depending on a deleted object, once the grace period ends
+// without the object being recreated.
+func (r *reloader) reloadDeleted(
+	ctx context.Context,
+	l *slog.Logger,
+	ref *corev1.ObjectReference,
+	keys []string,
+	content map[string][]byte,
+	annotations map[string]string,
+) {
+	if r.grace == nil || r.grace.period == 0 {
+		r.applyDeletePolicy(ctx, l, ref, keys, annotations)
+		return
+	}
+
+	l.Info("holding deletion for the grace period", slog.String(logKeyObject, referenceKey(ref)))
+	r.grace.hold(ref, content, func() {
+		// The recreation may have gone to another replica while the hash ring changed.
+		if !r.deleted(ctx, ref) {
+			l.Info("object recreated, skipping reload", slog.String(logKeyObject, referenceKey(ref)))
+			return
+		}
+		r.applyDeletePolicy(ctx, l, ref, keys, annotations)
+	})
+}
+
+// recreated reports whether the deletion of a newly added object was held, in which case the addition is handled as
+// an update and the keys that changed since the deletion are returned.
+func (r *reloader) recreated(l *slog.Logger, ref *corev1.ObjectReference, content map[string][]byte) ([]string, bool) {
+	if r.grace == nil {
+		return nil, false
+	}
+
+	deleted, ok := r.grace.release(ref)
+	if !ok {
+		return nil, false
+	}
+
+	keys := changedKeys(deleted, content)
+	l.Info("object recreated within the grace period", slog.String(logKeyObject, referenceKey(ref)))
+	return keys, true
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes/fake"
+
+	"github.com/jacobbrewer1/web/cache"
+)
+
+func Test_DeleteGrace(t *testing.T) {
+	t.Parallel()
+
+	ref := &corev1.ObjectReference{Kind: "ConfigMap", Namespace: "default", Name: "app"}
+
+	t.Run("released", func(t *testing.T) {
+		t.Parallel()
+
+		g := newDeleteGrace(time.Hour)
+		g.hold(ref, map[string][]byte{"key": []byte("value")}, func() {
+			t.Error("released deletion applied")
+		})
+
+		content, ok := g.release(ref)
+		require.True(t, ok)
+		require.Equal(t, map[string][]byte{"key": []byte("value")}, content)
+
+		_, ok = g.release(ref)
+		require.False(t, ok)
+	})
+
+	t.Run("expired", func(t *testing.T) {
+		t.Parallel()
+
+		applied := make(chan string, 2)
+		g := newDeleteGrace(10 * time.Millisecond)
+		g.hold(ref, nil, func() { applied <- "first" })
+		g.hold(ref, nil, func() { applied <- "second" })
+
+		require.Equal(t, "second", <-applied)
+		_, ok := g.release(ref)
+		require.False(t, ok)
+		require.Empty(t, applied)
+	})
+}
+
+func Test_ConfigMapDeleteGrace(t *testing.T) {
+	t.Parallel()
+
+	// setup returns a reloader holding deletions for the given period and a pod depending on the app ConfigMap.
+	setup := func(t *testing.T, period time.Duration) (*reloader, *fake.Clientset) {
+		t.Helper()
+
+		ctx, cancel := context.WithCancel(context.Background())
+		t.Cleanup(cancel)
+
+		kubeClient := fake.NewClientset(testableDependentPod(t, "api", "default", "ConfigMap", "app"))
+		informerFactory := informers.NewSharedInformerFactory(kubeClient, 0)
+		r := testableReloader(t, cache.NewFixedHashBucket(1), kubeClient, informerFactory)
+		r.grace = newDeleteGrace(period)
+		informerFactory.Start(ctx.Done())
+		informerFactory.WaitForCacheSync(ctx.Done())
+
+		return r, kubeClient
+	}
+
+	podExists := func(t *testing.T, kubeClient *fake.Clientset) bool {
+		t.Helper()
+		_, err := kubeClient.CoreV1().Pods("default").Get(context.Background(), "api", metav1.GetOptions{})
+		return err == nil
+	}
+
+	configMap := func(value string) *corev1.ConfigMap {
+		return &corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "default"},
+			Data:       map[string]string{"key": value},
+		}
+	}
+
+	t.Run("recreated unchanged", func(t *testing.T) {
+		t.Parallel()
+
+		r, kubeClient := setup(t, time.Hour)
+		ctx := context.Background()
+		l := slog.New(slog.DiscardHandler)
+
+		onConfigMapDelete(ctx, l, r)(configMap("value"))
+		require.True(t, podExists(t, kubeClient))
+
+		onConfigMapAdd(ctx, l, r)(configMap("value"))
+		require.True(t, podExists(t, kubeClient))
+	})
+
+	t.Run("recreated changed", func(t *testing.T) {
+		t.Parallel()
+
+		r, kubeClient := setup(t, time.Hour)
+		ctx := context.Background()
+		l := slog.New(slog.DiscardHandler)
+
+		onConfigMapDelete(ctx, l, r)(configMap("value"))
+		onConfigMapAdd(ctx, l, r)(configMap("changed"))
+		require.False(t, podExists(t, kubeClient))
+	})
+
+	t.Run("not recreated", func(t *testing.T) {
+		t.Parallel()
+
+		r, kubeClient := setup(t, 10*time.Millisecond)
+
+		onConfigMapDelete(context.Background(), slog.New(slog.DiscardHandler), r)(configMap("value"))
+		require.Eventually(t, func() bool {
+			return !podExists(t, kubeClient)
+		}, time.Second, 10*time.Millisecond)
+	})
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+
+	corev1 "k8s.io/api/core/v1"
+	kubeerrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+
+	"github.com/jacobbrewer1/web/logging"
+)
+
+// annotationDeletePolicy selects what happens to the dependent pods when a ConfigMap, Secret or custom resource is
+// deleted. It is read from the pods, as set in the pod template of their workload, from their top level workload and
+// from the deleted object, in that order.
+const annotationDeletePolicy = "reloader/delete-policy"
+
+// reasonDependencyDeleted is the reason of the events recorded against pods whose dependency was deleted.
+const reasonDependencyDeleted = "ReloadDependencyDeleted"
+
+// deletePolicy decides what happens to the dependent pods of a deleted ConfigMap, Secret or custom resource.
+type deletePolicy string
+
+const (
+	// deletePolicyIgnore leaves the pods alone.
+	deletePolicyIgnore deletePolicy = "ignore"
+
+	// deletePolicyRestart restarts the pods, like a change of the object.
+	deletePolicyRestart deletePolicy = "restart"
+
+	// deletePolicyScaleDown scales the Deployments and StatefulSets owning the pods to zero replicas, so that they do
+	// not run without their configuration. Pods without a scalable owner are alerted on instead.
+	deletePolicyScaleDown deletePolicy = "scale-down"
+
+	// deletePolicyAlert records a Warning event against the pods and notifies the webhooks, without touching the pods.
+	deletePolicyAlert deletePolicy = "alert-only"
+)
+
+// errInvalidDeletePolicy is returned when a delete policy is not recognised.
+var errInvalidDeletePolicy = errors.New("invalid delete policy")
+
+// parseDeletePolicy parses the given string into a deletePolicy.
+func parseDeletePolicy(s string) (deletePolicy, error) {
+	switch policy := deletePolicy(s); policy {
+	case deletePolicyIgnore, deletePolicyRestart, deletePolicyScaleDown, deletePolicyAlert:
+		return policy, nil
+	default:
+		return "", fmt.Errorf("%w: %q", errInvalidDeletePolicy, s)
+	}
+}
+
+// defaultDeletePolicy returns the delete policy of objects and pods without a delete policy annotation, which is set
+// by KillOnDelete.
+func defaultDeletePolicy(killOnDelete bool) deletePolicy {
+	if killOnDelete {
+		return deletePolicyRestart
+	}
+	return deletePolicyIgnore
+}
+
+// annotatedDeletePolicy returns the delete policy of the given annotations, or the fallback if they have none. Invalid
+// policies are reported by the admission webhook, and fall back too.
+func annotatedDeletePolicy(l *slog.Logger, annotations map[string]string, fallback deletePolicy) deletePolicy {
+	value, ok := annotations[annotationDeletePolicy]
+	if !ok {
+		return fallback
+	}
+
+	policy, err := parseDeletePolicy(value)
+	if err != nil {
+		l.Warn("ignoring delete policy annotation", slog.String(logging.KeyError, err.Error()))
+		return fallback
+	}
+	return policy
+}
+
+// namespaceTerminating reports whether the namespace is being deleted. Objects deleted with their namespace are never
+// acted on, as their pods are going away too.
+func (r *reloader) namespaceTerminating(namespace string) (bool, error) {
+	ns, err := r.namespaceLister.Get(namespace)
+	if kubeerrors.IsNotFound(err) {
+		return false, nil
+	} else if err != nil {
+		return false, fmt.Errorf("failed to get namespace: %w", err)
+	}
+	return ns.DeletionTimestamp != nil, nil
+}
+
+// applyDeletePolicy acts on the deletion of the referenced object, applying to each dependent pod the delete policy of
+// the pod, of its top level workload, of the object or the default one, in that order.
+func (r *reloader) applyDeletePolicy(
+	ctx context.Context,
+	l *slog.Logger,
+	ref *corev1.ObjectReference,
+	keys []string,
+	annotations map[string]string,
+) {
+	terminating, err := r.namespaceTerminating(ref.Namespace)
+	if err != nil {
+		l.Error("failed to check namespace", slog.String(logging.KeyError, err.Error()))
+		return
+	} else if terminating {
+		l.Info("namespace terminating, ignoring deletion", slog.String(logKeyObject, referenceKey(ref)))
+		return
+	}
+
+	pods, err := r.dependents(ref)
+	if err != nil {
+		l.Error("failed to list pods", slog.String(logging.KeyError, err.Error()))
+		return
+	}
+
+	objectPolicy := annotatedDeletePolicy(l, annotations, r.deletePolicy)
+	byPolicy := make(map[deletePolicy][]*corev1.Pod)
+	workloads := make(map[types.UID]metav1.Object)
+	for _, pod := range pods {
+		policy := objectPolicy
+		if workload := r.podWorkload(ctx, pod, workloads); workload != nil {
+			policy = annotatedDeletePolicy(l, workload.GetAnnotations(), policy)
+		}
+		policy = annotatedDeletePolicy(l, pod.Annotations, policy)
+		byPolicy[policy] = append(byPolicy[policy], pod)
+	}
+
+	if len(byPolicy[deletePolicyIgnore]) > 0 {
+		l.Info("ignoring deletion",
+			slog.String(logKeyObject, referenceKey(ref)),
+			slog.Int(logKeyPods, len(byPolicy[deletePolicyIgnore])),
+		)
+	}
+
+	// The content is gone, so the pods cannot be reloaded in place.
+	r.reloadPods(ctx, l, ref, keys, "", byPolicy[deletePolicyRestart])
+
+	alert := byPolicy[deletePolicyAlert]
+	if scale := byPolicy[deletePolicyScaleDown]; len(scale) > 0 {
+		alert = append(alert, r.scaleDown(ctx, l, ref, keys, scale)...)
+	}
+	r.alertDeleted(ctx, l, ref, keys, alert)
+}
+
+// scaleDown scales the top level Deployments and StatefulSets owning the given pods to zero replicas. It returns the
+// pods without such an owner, and those whose owner could not be scaled. Paused pods are left alone, and the pods go
+// through the circuit breaker and the restart budget like the pods of a restart.
+func (r *reloader) scaleDown(
+	ctx context.Context,
+	l *slog.Logger,
+	ref *corev1.ObjectReference,
+	keys []string,
+	pods []*corev1.Pod,
+) []*corev1.Pod {
+	pods = r.pause.filter(ctx, l, ref, keys, "", pods)
+	if len(pods) == 0 {
+		return nil
+	}
+	pods = r.breaker.allow(ctx, l, ref, keys, "", pods)
+
+	unscaled := make([]*corev1.Pod, 0)
+	owners := make([]metav1.Object, 0)
+	byOwner := make(map[types.UID][]*corev1.Pod)
+	workloads := make(map[types.UID]metav1.Object)
+	for _, pod := range pods {
+		owner := r.podWorkload(ctx, pod, workloads)
+		switch ownerKind(owner) {
+		case "Deployment", "StatefulSet":
+		default:
+			unscaled = append(unscaled, pod)
+			continue
+		}
+
+		if _, ok := byOwner[owner.GetUID()]; !ok {
+			owners = append(owners, owner)
+		}
+		byOwner[owner.GetUID()] = append(byOwner[owner.GetUID()], pod)
+	}
+
+	patch := []byte(`{"spec":{"replicas":0}}`)
+	for _, owner := range owners {
+		scale := byOwner[owner.GetUID()]
+		kind := ownerKind(owner)
+
+		var err error
+		for range scale {
+			if err = r.killer.limiter.wait(ctx, owner.GetNamespace()); err != nil {
+				break
+			}
+		}
+
+		if err == nil {
+			switch kind {
+			case "Deployment":
+				_, err = r.kubeClient.AppsV1().Deployments(owner.GetNamespace()).Patch(
+					ctx, owner.GetName(), types.MergePatchType, patch, metav1.PatchOptions{})
+			case "StatefulSet":
+				_, err = r.kubeClient.AppsV1().StatefulSets(owner.GetNamespace()).Patch(
+					ctx, owner.GetName(), types.MergePatchType, patch, metav1.PatchOptions{})
+			}
+		}
+
+		if err != nil {
+			l.Error("failed to scale down workload",
+				slog.String(logKeyWorkload, kind+"/"+owner.GetName()),
+				slog.String(logging.KeyError, err.Error()),
+			)
+			unscaled = append(unscaled, scale...)
+			continue
+		}
+
+		l.Info("scaled down workload",
+			slog.String(logKeyObject, referenceKey(ref)),
+			slog.String(logKeyWorkload, kind+"/"+owner.GetName()),
+		)
+	}
+	return unscaled
+}
+
+// alertDeleted records a Warning event against each of the given pods and notifies the webhooks that they were left
+// running without the deleted object.
+func (r *reloader) alertDeleted(
+	ctx context.Context,
+	l *slog.Logger,
+	ref *corev1.ObjectReference,
+	keys []string,
+	pods []*corev1.Pod,
+) {
+	if len(pods) == 0 {
+		return
+	}
+
+	message := fmt.Sprintf("%s %s this pod depends on was deleted", ref.Kind, ref.Name)
+	for _, pod := range pods {
+		podRef := objectReference("Pod", pod)
+		if err := recordWarning(ctx, r.kubeClient, podRef, reasonDependencyDeleted, message); err != nil {
+			l.Error("failed to record event",
+				slog.String(logKeyPod, pod.Name),
+				slog.String(logging.KeyError, err.Error()),
+			)
+		}
+	}
+
+	event := r.notifier.newEvent(ctx, ref, keys, string(deletePolicyAlert), pods)
+	r.notifier.notify(event.with(eventSkipped, "dependency deleted"))
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes/fake"
+
+	"github.com/jacobbrewer1/web/cache"
+)
+
+func Test_ParseDeletePolicy(t *testing.T) {
+	t.Parallel()
+
+	for _, s := range []string{"ignore", "restart", "scale-down", "alert-only"} {
+		policy, err := parseDeletePolicy(s)
+		require.NoError(t, err)
+		require.Equal(t, deletePolicy(s), policy)
+	}
+
+	_, err := parseDeletePolicy("kill")
+	require.ErrorIs(t, err, errInvalidDeletePolicy)
+}
+
+func Test_DefaultDeletePolicy(t *testing.T) {
+	t.Parallel()
+
+	require.Equal(t, deletePolicyRestart, defaultDeletePolicy(true))
+	require.Equal(t, deletePolicyIgnore, defaultDeletePolicy(false))
+}
+
+func Test_ReloaderApplyDeletePolicy(t *testing.T) {
+	t.Parallel()
+
+	ref := &corev1.ObjectReference{Kind: "ConfigMap", Namespace: "default", Name: "app"}
+
+	// testablePolicyPod returns a pod depending on the app ConfigMap with the given delete policy annotation.
+	testablePolicyPod := func(t *testing.T, name, policy string) *corev1.Pod {
+		t.Helper()
+
+		pod := testableDependentPod(t, name, "default", "ConfigMap", "app")
+		if policy != "" {
+			pod.Annotations = map[string]string{annotationDeletePolicy: policy}
+		}
+		return pod
+	}
+
+	setup := func(t *testing.T, objects ...runtime.Object) (*reloader, *fake.Clientset) {
+		t.Helper()
+
+		ctx, cancel := context.WithCancel(context.Background())
+		t.Cleanup(cancel)
+
+		kubeClient := fake.NewClientset(objects...)
+		informerFactory := informers.NewSharedInformerFactory(kubeClient, 0)
+		r := testableReloader(t, cache.NewFixedHashBucket(1), kubeClient, informerFactory)
+		informerFactory.Start(ctx.Done())
+		informerFactory.WaitForCacheSync(ctx.Done())
+
+		return r, kubeClient
+	}
+
+	podExists := func(t *testing.T, kubeClient *fake.Clientset, name string) bool {
+		t.Helper()
+		_, err := kubeClient.CoreV1().Pods("default").Get(context.Background(), name, metav1.GetOptions{})
+		return err == nil
+	}
+
+	podWarnings := func(t *testing.T, kubeClient *fake.Clientset) []string {
+		t.Helper()
+
+		events, err := kubeClient.CoreV1().Events("default").List(context.Background(), metav1.ListOptions{})
+		require.NoError(t, err)
+
+		pods := make([]string, 0, len(events.Items))
+		for i := range events.Items {
+			require.Equal(t, reasonDependencyDeleted, events.Items[i].Reason)
+			pods = append(pods, events.Items[i].InvolvedObject.Name)
+		}
+		return pods
+	}
+
+	t.Run("pod policy first", func(t *testing.T) {
+		t.Parallel()
+
+		r, kubeClient := setup(t,
+			testablePolicyPod(t, "restarted", "restart"),
+			testablePolicyPod(t, "alerted", ""),
+			testablePolicyPod(t, "ignored", "ignore"),
+		)
+		annotations := map[string]string{annotationDeletePolicy: "alert-only"}
+		r.applyDeletePolicy(context.Background(), slog.New(slog.DiscardHandler), ref, []string{"key"}, annotations)
+
+		require.False(t, podExists(t, kubeClient, "restarted"))
+		require.True(t, podExists(t, kubeClient, "alerted"))
+		require.True(t, podExists(t, kubeClient, "ignored"))
+		require.Equal(t, []string{"alerted"}, podWarnings(t, kubeClient))
+	})
+
+	t.Run("default policy", func(t *testing.T) {
+		t.Parallel()
+
+		r, kubeClient := setup(t, testablePolicyPod(t, "api", ""))
+		r.deletePolicy = deletePolicyIgnore
+		r.applyDeletePolicy(context.Background(), slog.New(slog.DiscardHandler), ref, []string{"key"}, nil)
+
+		require.True(t, podExists(t, kubeClient, "api"))
+		require.Empty(t, podWarnings(t, kubeClient))
+	})
+
+	// testableWorkload returns a Deployment of three replicas with the given delete policy annotation, its ReplicaSet
+	// and a pod of it with the given delete policy annotation.
+	testableWorkload := func(t *testing.T, workloadPolicy, podPolicy string) []runtime.Object {
+		t.Helper()
+
+		replicas := int32(3)
+		deployment := &appsv1.Deployment{
+			ObjectMeta: metav1.ObjectMeta{Name: "api", Namespace: "default", UID: "deployment"},
+			Spec:       appsv1.DeploymentSpec{Replicas: &replicas},
+		}
+		if workloadPolicy != "" {
+			deployment.Annotations = map[string]string{annotationDeletePolicy: workloadPolicy}
+		}
+		replicaSet := &appsv1.ReplicaSet{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      "api-abc",
+				Namespace: "default",
+				UID:       "replicaset",
+				OwnerReferences: []metav1.OwnerReference{
+					*metav1.NewControllerRef(deployment, appsv1.SchemeGroupVersion.WithKind("Deployment")),
+				},
+			},
+		}
+		owned := testablePolicyPod(t, "api-abc-1", podPolicy)
+		owned.OwnerReferences = []metav1.OwnerReference{
+			*metav1.NewControllerRef(replicaSet, appsv1.SchemeGroupVersion.WithKind("ReplicaSet")),
+		}
+		return []runtime.Object{deployment, replicaSet, owned}
+	}
+
+	replicas := func(t *testing.T, kubeClient *fake.Clientset) int32 {
+		t.Helper()
+
+		got, err := kubeClient.AppsV1().Deployments("default").Get(context.Background(), "api", metav1.GetOptions{})
+		require.NoError(t, err)
+		return *got.Spec.Replicas
+	}
+
+	t.Run("workload policy", func(t *testing.T) {
+		t.Parallel()
+
+		r, kubeClient := setup(t, testableWorkload(t, "alert-only", "")...)
+		annotations := map[string]string{annotationDeletePolicy: "restart"}
+		r.applyDeletePolicy(context.Background(), slog.New(slog.DiscardHandler), ref, []string{"key"}, annotations)
+
+		require.True(t, podExists(t, kubeClient, "api-abc-1"))
+		require.Equal(t, []string{"api-abc-1"}, podWarnings(t, kubeClient))
+	})
+
+	t.Run("scale down", func(t *testing.T) {
+		t.Parallel()
+
+		objects := append(testableWorkload(t, "", "scale-down"), testablePolicyPod(t, "bare", "scale-down"))
+		r, kubeClient := setup(t, objects...)
+		r.applyDeletePolicy(context.Background(), slog.New(slog.DiscardHandler), ref, []string{"key"}, nil)
+
+		require.Equal(t, int32(0), replicas(t, kubeClient))
+
+		// Pods without a scalable owner are alerted on instead.
+		require.True(t, podExists(t, kubeClient, "bare"))
+		require.Equal(t, []string{"bare"}, podWarnings(t, kubeClient))
+	})
+
+	t.Run("scale down circuit breaker", func(t *testing.T) {
+		t.Parallel()
+
+		objects := append(testableWorkload(t, "scale-down", ""), testablePolicyPod(t, "bare", "scale-down"))
+		r, kubeClient := setup(t, objects...)
+		r.breaker.threshold = 1
+		r.applyDeletePolicy(context.Background(), slog.New(slog.DiscardHandler), ref, []string{"key"}, nil)
+
+		require.Equal(t, int32(3), replicas(t, kubeClient))
+		require.True(t, podExists(t, kubeClient, "bare"))
+		require.Len(t, r.breaker.pendingReloads(), 1)
+	})
+
+	t.Run("namespace terminating", func(t *testing.T) {
+		t.Parallel()
+
+		deleted := metav1.Now()
+		namespace := &corev1.Namespace{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:              "default",
+				DeletionTimestamp: &deleted,
+				Finalizers:        []string{"kubernetes"},
+			},
+		}
+		r, kubeClient := setup(t, namespace, testablePolicyPod(t, "api", "restart"))
+		r.applyDeletePolicy(context.Background(), slog.New(slog.DiscardHandler), ref, []string{"key"}, nil)
+
+		require.True(t, podExists(t, kubeClient, "api"))
+	})
+}
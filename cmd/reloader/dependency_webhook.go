@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"strings"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+
+	"github.com/jacobbrewer1/web/logging"
+)
+
+const (
+	// webhookDependencies is the name of the admission webhook labelling pods with their dependencies.
+	webhookDependencies = "dependencies"
+
+	// labelAuto opts a pod into having its reloader labels set from the ConfigMaps and Secrets it uses.
+	labelAuto = "reloader/auto"
+
+	// annotationContentHashes is set on auto-labelled pods to the JSON encoded content hashes of their dependencies
+	// at admission, keyed by "kind/name". The linter compares them with the current content to find the pods running
+	// with stale content.
+	annotationContentHashes = "reloader/content-hashes"
+)
+
+type (
+	// jsonPatchOperation is a JSON patch operation returned by mutating admission webhooks.
+	jsonPatchOperation struct {
+		// Op is the operation.
+		Op string `json:"op"`
+
+		// Path is the JSON pointer of the patched value.
+		Path string `json:"path"`
+
+		// Value is the new value.
+		Value any `json:"value"`
+	}
+
+	// dependencyMutation is the outcome of auto-labelling a pod.
+	dependencyMutation struct {
+		// labels are the reloader labels to set.
+		labels map[string]string
+
+		// hashes are the content hashes of the dependencies, keyed by "kind/name".
+		hashes map[string]string
+
+		// warnings are the dependencies that could not be labelled.
+		warnings []string
+	}
+)
+
+// reviewDependencies labels an opted-in pod with the ConfigMaps and Secrets it uses and annotates it with their
+// content hashes. The webhook fails open: pods are admitted unchanged if they cannot be read or if labelling them
+// takes longer than the configured timeout, so that reloader never blocks pod creation.
+func (s *admissionServer) reviewDependencies(req *admissionv1.AdmissionRequest) *admissionv1.AdmissionResponse {
+	if req.Operation != admissionv1.Create || req.Kind.Kind != "Pod" {
+		return &admissionv1.AdmissionResponse{Allowed: true}
+	}
+
+	pod := new(corev1.Pod)
+	if err := json.Unmarshal(req.Object.Raw, pod); err != nil {
+		s.l.Warn("failed to decode admitted pod", slog.String(logging.KeyError, err.Error()))
+		return &admissionv1.AdmissionResponse{Allowed: true}
+	} else if pod.Labels[labelAuto] != "true" {
+		return &admissionv1.AdmissionResponse{Allowed: true}
+	}
+
+	// The namespace of pods being created is only set on the request.
+	pod.Namespace = req.Namespace
+
+	return s.bounded(webhookDependencies, func(context.Context) *admissionv1.AdmissionResponse {
+		return s.mutateDependencies(pod)
+	})
+}
+
+// mutateDependencies returns the admission response patching the labels and annotations of the pod.
+func (s *admissionServer) mutateDependencies(pod *corev1.Pod) *admissionv1.AdmissionResponse {
+	mutation, err := s.dependencyMutation(pod)
+	if err != nil {
+		s.l.Error("failed to label pod dependencies", slog.String(logging.KeyError, err.Error()))
+		return &admissionv1.AdmissionResponse{Allowed: true}
+	}
+
+	podLabels := make(map[string]string, len(pod.Labels)+len(mutation.labels))
+	for k, v := range pod.Labels {
+		podLabels[k] = v
+	}
+	for k, v := range mutation.labels {
+		podLabels[k] = v
+	}
+
+	hashes, err := json.Marshal(mutation.hashes)
+	if err != nil {
+		s.l.Error("failed to encode content hashes", slog.String(logging.KeyError, err.Error()))
+		return &admissionv1.AdmissionResponse{Allowed: true}
+	}
+
+	annotations := make(map[string]string, len(pod.Annotations)+1)
+	for k, v := range pod.Annotations {
+		annotations[k] = v
+	}
+	annotations[annotationContentHashes] = string(hashes)
+
+	// Adding a member that already exists replaces it, so the whole maps are set whether or not the pod had any.
+	patch, err := json.Marshal([]jsonPatchOperation{
+		{Op: "add", Path: "/metadata/labels", Value: podLabels},
+		{Op: "add", Path: "/metadata/annotations", Value: annotations},
+	})
+	if err != nil {
+		s.l.Error("failed to encode patch", slog.String(logging.KeyError, err.Error()))
+		return &admissionv1.AdmissionResponse{Allowed: true}
+	}
+
+	messages := make([]string, 0, len(mutation.warnings))
+	for _, warning := range mutation.warnings {
+		messages = append(messages, admissionMessagePrefix+warning)
+	}
+
+	patchType := admissionv1.PatchTypeJSONPatch
+	return &admissionv1.AdmissionResponse{
+		Allowed:   true,
+		Patch:     patch,
+		PatchType: &patchType,
+		Warnings:  messages,
+	}
+}
+
+// dependencyMutation works out the reloader labels and content hashes of the pod. A reloader label names a single
+// object, so a kind is only labelled when the pod uses exactly one object of that kind, and labels already set on the
+// pod are kept.
+func (s *admissionServer) dependencyMutation(pod *corev1.Pod) (*dependencyMutation, error) {
+	used := make(map[string]map[string]bool)
+	for _, ref := range podReferences(pod) {
+		if ref.edge == edgeLabel {
+			continue
+		}
+		if used[ref.kind] == nil {
+			used[ref.kind] = make(map[string]bool)
+		}
+		used[ref.kind][ref.name] = true
+	}
+
+	mutation := &dependencyMutation{
+		labels:   make(map[string]string),
+		hashes:   make(map[string]string),
+		warnings: make([]string, 0),
+	}
+	for _, kind := range sortedKeys(used) {
+		names := sortedKeys(used[kind])
+		for _, name := range names {
+			hash, ok, err := contentHash(s.configMapLister, s.secretLister, kind, pod.Namespace, name)
+			if err != nil {
+				return nil, err
+			} else if ok {
+				mutation.hashes[strings.ToLower(kind)+"/"+name] = hash
+			}
+		}
+
+		label := dependencyLabel(kind)
+		if _, ok := pod.Labels[label]; ok {
+			continue
+		} else if len(names) > 1 {
+			mutation.warnings = append(mutation.warnings, fmt.Sprintf(
+				"pod uses %d %ss (%s) but label %s can only name one, so none of them are labelled",
+				len(names), kind, strings.Join(names, ", "), label))
+			continue
+		}
+		mutation.labels[label] = names[0]
+	}
+
+	return mutation, nil
+}
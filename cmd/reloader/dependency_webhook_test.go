@@ -0,0 +1,160 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	admissionv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+func testableDependenciesReview(t *testing.T, pod *corev1.Pod) *admissionv1.AdmissionRequest {
+	t.Helper()
+
+	raw, err := json.Marshal(pod)
+	require.NoError(t, err)
+
+	return &admissionv1.AdmissionRequest{
+		UID:       "uid-1",
+		Kind:      metav1.GroupVersionKind{Version: "v1", Kind: "Pod"},
+		Namespace: "default",
+		Operation: admissionv1.Create,
+		Object:    runtime.RawExtension{Raw: raw},
+	}
+}
+
+func Test_AdmissionServerReviewDependencies(t *testing.T) {
+	t.Parallel()
+
+	configMap := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "default"},
+		Data:       map[string]string{"key": "value"},
+	}
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "db", Namespace: "default"},
+		Data:       map[string][]byte{"password": []byte("hunter2")},
+	}
+	s := testableAdmissionServer(t, enforcementDeny, configMap, secret)
+
+	newPod := func(t *testing.T, podLabels map[string]string) *corev1.Pod {
+		t.Helper()
+		return &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: "api", Labels: podLabels},
+			Spec: corev1.PodSpec{
+				Volumes: []corev1.Volume{{
+					Name: "config",
+					VolumeSource: corev1.VolumeSource{
+						ConfigMap: &corev1.ConfigMapVolumeSource{LocalObjectReference: corev1.LocalObjectReference{Name: "app"}},
+					},
+				}},
+				Containers: []corev1.Container{{
+					Name: "api",
+					Env: []corev1.EnvVar{
+						{
+							Name: "PASSWORD",
+							ValueFrom: &corev1.EnvVarSource{SecretKeyRef: &corev1.SecretKeySelector{
+								LocalObjectReference: corev1.LocalObjectReference{Name: "db"},
+								Key:                  "password",
+							}},
+						},
+						{
+							Name: "TOKEN",
+							ValueFrom: &corev1.EnvVarSource{SecretKeyRef: &corev1.SecretKeySelector{
+								LocalObjectReference: corev1.LocalObjectReference{Name: "db"},
+								Key:                  "token",
+							}},
+						},
+					},
+				}},
+			},
+		}
+	}
+
+	t.Run("labelled", func(t *testing.T) {
+		t.Parallel()
+
+		resp := s.reviewDependencies(testableDependenciesReview(t, newPod(t, map[string]string{labelAuto: "true"})))
+		require.True(t, resp.Allowed)
+		require.Empty(t, resp.Warnings)
+		require.Equal(t, admissionv1.PatchTypeJSONPatch, *resp.PatchType)
+
+		patch := make([]jsonPatchOperation, 0)
+		require.NoError(t, json.Unmarshal(resp.Patch, &patch))
+		require.Len(t, patch, 2)
+		require.Equal(t, "/metadata/labels", patch[0].Path)
+		require.Equal(t, map[string]any{
+			labelAuto:            "true",
+			"reloader/configmap": "app",
+			"reloader/secret":    "db",
+		}, patch[0].Value)
+
+		hashes, err := json.Marshal(map[string]string{
+			"configmap/app": configMapHash(configMap),
+			"secret/db":     secretHash(secret),
+		})
+		require.NoError(t, err)
+		require.Equal(t, "/metadata/annotations", patch[1].Path)
+		require.Equal(t, map[string]any{annotationContentHashes: string(hashes)}, patch[1].Value)
+	})
+
+	t.Run("existing label", func(t *testing.T) {
+		t.Parallel()
+
+		pod := newPod(t, map[string]string{labelAuto: "true", "reloader/configmap": "flags"})
+		pod.Spec.Volumes = append(pod.Spec.Volumes, corev1.Volume{
+			Name: "flags",
+			VolumeSource: corev1.VolumeSource{
+				ConfigMap: &corev1.ConfigMapVolumeSource{LocalObjectReference: corev1.LocalObjectReference{Name: "flags"}},
+			},
+		})
+
+		pod.Namespace = "default"
+
+		mutation, err := s.dependencyMutation(pod)
+		require.NoError(t, err)
+		require.Equal(t, map[string]string{"reloader/secret": "db"}, mutation.labels)
+		require.Empty(t, mutation.warnings)
+		require.Contains(t, mutation.hashes, "configmap/app")
+		require.NotContains(t, mutation.hashes, "configmap/flags")
+	})
+
+	t.Run("several objects of a kind", func(t *testing.T) {
+		t.Parallel()
+
+		pod := newPod(t, map[string]string{labelAuto: "true"})
+		pod.Spec.Containers[0].EnvFrom = []corev1.EnvFromSource{{
+			ConfigMapRef: &corev1.ConfigMapEnvSource{LocalObjectReference: corev1.LocalObjectReference{Name: "flags"}},
+		}}
+
+		pod.Namespace = "default"
+
+		mutation, err := s.dependencyMutation(pod)
+		require.NoError(t, err)
+		require.Equal(t, map[string]string{"reloader/secret": "db"}, mutation.labels)
+		require.Equal(t, []string{
+			"pod uses 2 ConfigMaps (app, flags) but label reloader/configmap can only name one, so none of them are labelled",
+		}, mutation.warnings)
+	})
+
+	t.Run("not opted in", func(t *testing.T) {
+		t.Parallel()
+
+		resp := s.reviewDependencies(testableDependenciesReview(t, newPod(t, nil)))
+		require.True(t, resp.Allowed)
+		require.Nil(t, resp.Patch)
+	})
+
+	t.Run("invalid object", func(t *testing.T) {
+		t.Parallel()
+
+		req := testableDependenciesReview(t, newPod(t, nil))
+		req.Object.Raw = []byte("{")
+
+		resp := s.reviewDependencies(req)
+		require.True(t, resp.Allowed)
+		require.Nil(t, resp.Patch)
+	})
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// objectReference returns a reference to the given object of the given API kind, such as "ConfigMap".
+func objectReference(kind string, obj metav1.Object) *corev1.ObjectReference {
+	return &corev1.ObjectReference{
+		Kind:            kind,
+		APIVersion:      "v1",
+		Namespace:       obj.GetNamespace(),
+		Name:            obj.GetName(),
+		UID:             obj.GetUID(),
+		ResourceVersion: obj.GetResourceVersion(),
+	}
+}
+
+// referenceKey returns the object key of the given reference.
+func referenceKey(ref *corev1.ObjectReference) string {
+	return objectKey(strings.ToLower(ref.Kind), ref.Namespace, ref.Name)
+}
+
+// recordWarning creates a Warning event against the given object.
+func recordWarning(
+	ctx context.Context,
+	kubeClient kubernetes.Interface,
+	ref *corev1.ObjectReference,
+	reason, message string,
+) error {
+	now := metav1.NewTime(time.Now())
+	event := &corev1.Event{
+		ObjectMeta: metav1.ObjectMeta{
+			// Vault secret paths contain slashes, which event names must not.
+			Name:      fmt.Sprintf("%v.%x", strings.ReplaceAll(ref.Name, "/", "."), now.UnixNano()),
+			Namespace: ref.Namespace,
+		},
+		InvolvedObject: *ref,
+		Reason:         reason,
+		Message:        message,
+		Type:           corev1.EventTypeWarning,
+		Source: corev1.EventSource{
+			Component: appName,
+		},
+		FirstTimestamp: now,
+		LastTimestamp:  now,
+		Count:          1,
+	}
+
+	if _, err := kubeClient.CoreV1().Events(ref.Namespace).Create(ctx, event, metav1.CreateOptions{}); err != nil {
+		return fmt.Errorf("failed to create event: %w", err)
+	}
+	return nil
+}
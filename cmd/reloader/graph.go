@@ -0,0 +1,359 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+	listersv1 "k8s.io/client-go/listers/core/v1"
+)
+
+const (
+	// nodeTypeObject is the type of ConfigMap and Secret nodes.
+	nodeTypeObject = "object"
+
+	// nodeTypePod is the type of pod nodes.
+	nodeTypePod = "pod"
+
+	// nodeTypeWorkload is the type of the nodes of workloads owning pods.
+	nodeTypeWorkload = "workload"
+
+	// edgeLabel is a dependency declared with the reloader/<kind> pod label.
+	edgeLabel = "label"
+
+	// edgeVolume is a dependency through a pod volume, including projected volumes.
+	edgeVolume = "volume"
+
+	// edgeEnvFrom is a dependency through the envFrom of a container.
+	edgeEnvFrom = "envFrom"
+
+	// edgeEnv is a dependency through a single environment variable of a container.
+	edgeEnv = "env"
+
+	// edgeOwner links a pod to the workload owning it.
+	edgeOwner = "owner"
+
+	// graphFormatJSON is the JSON export format of the dependency graph.
+	graphFormatJSON = "json"
+
+	// graphFormatDOT is the Graphviz DOT export format of the dependency graph.
+	graphFormatDOT = "dot"
+)
+
+type (
+	// graphNode is a node of the dependency graph.
+	graphNode struct {
+		// ID is the object key of the node, in the form "namespace/kind/name".
+		ID string `json:"id"`
+
+		// Type is the type of the node, one of object, pod or workload.
+		Type string `json:"type"`
+
+		// Kind is the API kind of the node.
+		Kind string `json:"kind"`
+
+		// Namespace is the namespace of the node.
+		Namespace string `json:"namespace"`
+
+		// Name is the name of the node.
+		Name string `json:"name"`
+
+		// Missing is set for objects that are referenced but do not exist.
+		Missing bool `json:"missing,omitempty"`
+
+		// Unwatched is set for objects that exist but are not watched by reloader, as they are filtered out or their
+		// kind is not enabled. Their changes do not reload the pods using them.
+		Unwatched bool `json:"unwatched,omitempty"`
+	}
+
+	// graphEdge is an edge of the dependency graph, from an object to a pod or from a pod to its workload.
+	graphEdge struct {
+		// From is the ID of the source node.
+		From string `json:"from"`
+
+		// To is the ID of the target node.
+		To string `json:"to"`
+
+		// Type is the type of reference, one of label, volume, envFrom, env or owner.
+		Type string `json:"type"`
+	}
+
+	// dependencyGraph is the graph of the ConfigMaps and Secrets used by pods and their workloads.
+	dependencyGraph struct {
+		// Nodes are the nodes of the graph, sorted by ID.
+		Nodes []*graphNode `json:"nodes"`
+
+		// Edges are the edges of the graph, sorted by source, target and type.
+		Edges []*graphEdge `json:"edges"`
+	}
+
+	// graphBuilder builds dependency graphs from the informer caches.
+	graphBuilder struct {
+		// kubeClient is used to resolve the workloads owning pods, and to look up the objects missing from the
+		// listers.
+		kubeClient kubernetes.Interface
+
+		// podLister is used to list pods.
+		podLister listersv1.PodLister
+
+		// configMapLister is used to check that referenced ConfigMaps exist.
+		configMapLister listersv1.ConfigMapLister
+
+		// secretLister is used to check that referenced Secrets exist.
+		secretLister listersv1.SecretLister
+	}
+)
+
+// newGraphBuilder creates a new graphBuilder.
+func newGraphBuilder(
+	kubeClient kubernetes.Interface,
+	podLister listersv1.PodLister,
+	configMapLister listersv1.ConfigMapLister,
+	secretLister listersv1.SecretLister,
+) *graphBuilder {
+	return &graphBuilder{
+		kubeClient:      kubeClient,
+		podLister:       podLister,
+		configMapLister: configMapLister,
+		secretLister:    secretLister,
+	}
+}
+
+// build builds the dependency graph of the given namespace, or of all namespaces if empty. Pods without any
+// ConfigMap or Secret reference are left out.
+func (b *graphBuilder) build(ctx context.Context, namespace string) (*dependencyGraph, error) {
+	list := b.podLister.List
+	if namespace != "" {
+		list = b.podLister.Pods(namespace).List
+	}
+
+	pods, err := list(labels.Everything())
+	if err != nil {
+		return nil, fmt.Errorf("failed to list pods: %w", err)
+	}
+
+	nodes := make(map[string]*graphNode)
+	edges := make(map[graphEdge]bool)
+	workloads := make(map[types.UID]*graphNode)
+
+	for _, pod := range pods {
+		refs := podReferences(pod)
+		if len(refs) == 0 {
+			continue
+		}
+
+		podNode := &graphNode{
+			ID:        objectKey(nodeTypePod, pod.Namespace, pod.Name),
+			Type:      nodeTypePod,
+			Kind:      "Pod",
+			Namespace: pod.Namespace,
+			Name:      pod.Name,
+		}
+		nodes[podNode.ID] = podNode
+
+		for _, ref := range refs {
+			objectNode, ok := nodes[objectKey(strings.ToLower(ref.kind), pod.Namespace, ref.name)]
+			if !ok {
+				objectNode, err = b.objectNode(ctx, ref.kind, pod.Namespace, ref.name)
+				if err != nil {
+					return nil, err
+				}
+				nodes[objectNode.ID] = objectNode
+			}
+			edges[graphEdge{From: objectNode.ID, To: podNode.ID, Type: ref.edge}] = true
+		}
+
+		if workload := b.workloadNode(ctx, pod, workloads); workload != nil {
+			nodes[workload.ID] = workload
+			edges[graphEdge{From: podNode.ID, To: workload.ID, Type: edgeOwner}] = true
+		}
+	}
+
+	graph := &dependencyGraph{
+		Nodes: make([]*graphNode, 0, len(nodes)),
+		Edges: make([]*graphEdge, 0, len(edges)),
+	}
+	for _, id := range sortedKeys(nodes) {
+		graph.Nodes = append(graph.Nodes, nodes[id])
+	}
+	for edge := range edges {
+		graph.Edges = append(graph.Edges, &edge)
+	}
+	sort.Slice(graph.Edges, func(i, j int) bool {
+		a, b := graph.Edges[i], graph.Edges[j]
+		if a.From != b.From {
+			return a.From < b.From
+		} else if a.To != b.To {
+			return a.To < b.To
+		}
+		return a.Type < b.Type
+	})
+
+	return graph, nil
+}
+
+// objectNode returns the node of the given ConfigMap or Secret, marking it as missing if it does not exist and as
+// unwatched if reloader does not watch it.
+func (b *graphBuilder) objectNode(ctx context.Context, kind, namespace, name string) (*graphNode, error) {
+	presence, err := lookupObject(ctx, b.kubeClient, b.configMapLister, b.secretLister, kind, namespace, name)
+	if err != nil {
+		return nil, err
+	}
+
+	return &graphNode{
+		ID:        objectKey(strings.ToLower(kind), namespace, name),
+		Type:      nodeTypeObject,
+		Kind:      kind,
+		Namespace: namespace,
+		Name:      name,
+		Missing:   presence == objectMissing,
+		Unwatched: presence == objectUnwatched,
+	}, nil
+}
+
+// workloadNode returns the node of the top level workload owning the pod, or nil for pods without a supported
+// controller. Workloads that cannot be resolved are left out rather than failing the whole graph, like in reload
+// notifications. Workloads are cached by the UID of the pod controller, as pods of a workload share their controller.
+func (b *graphBuilder) workloadNode(
+	ctx context.Context,
+	pod *corev1.Pod,
+	cache map[types.UID]*graphNode,
+) *graphNode {
+	controller := metav1.GetControllerOf(pod)
+	if controller == nil {
+		return nil
+	}
+
+	if node, ok := cache[controller.UID]; ok {
+		return node
+	}
+
+	var node *graphNode
+	if owners, err := podOwners(ctx, b.kubeClient, pod); err == nil && len(owners) > 0 {
+		owner := owners[len(owners)-1]
+		kind := ownerKind(owner)
+		node = &graphNode{
+			ID:        objectKey(strings.ToLower(kind), owner.GetNamespace(), owner.GetName()),
+			Type:      nodeTypeWorkload,
+			Kind:      kind,
+			Namespace: owner.GetNamespace(),
+			Name:      owner.GetName(),
+		}
+	}
+
+	cache[controller.UID] = node
+	return node
+}
+
+// podReference is a reference from a pod to a ConfigMap or Secret.
+type podReference struct {
+	// kind is the API kind of the referenced object.
+	kind string
+
+	// name is the name of the referenced object.
+	name string
+
+	// edge is the type of reference.
+	edge string
+}
+
+// podReferences returns the ConfigMaps and Secrets referenced by the pod, through reloader labels, volumes and
+// container environments.
+func podReferences(pod *corev1.Pod) []podReference {
+	refs := make([]podReference, 0)
+	for _, kind := range []string{"ConfigMap", "Secret"} {
+		if name, ok := pod.Labels[dependencyLabel(kind)]; ok {
+			refs = append(refs, podReference{kind: kind, name: name, edge: edgeLabel})
+		}
+	}
+
+	for i := range pod.Spec.Volumes {
+		volume := &pod.Spec.Volumes[i]
+		if volume.ConfigMap != nil {
+			refs = append(refs, podReference{kind: "ConfigMap", name: volume.ConfigMap.Name, edge: edgeVolume})
+		}
+		if volume.Secret != nil {
+			refs = append(refs, podReference{kind: "Secret", name: volume.Secret.SecretName, edge: edgeVolume})
+		}
+		if volume.Projected != nil {
+			for _, source := range volume.Projected.Sources {
+				if source.ConfigMap != nil {
+					refs = append(refs, podReference{kind: "ConfigMap", name: source.ConfigMap.Name, edge: edgeVolume})
+				}
+				if source.Secret != nil {
+					refs = append(refs, podReference{kind: "Secret", name: source.Secret.Name, edge: edgeVolume})
+				}
+			}
+		}
+	}
+
+	containers := append(append([]corev1.Container(nil), pod.Spec.InitContainers...), pod.Spec.Containers...)
+	for i := range containers {
+		for _, envFrom := range containers[i].EnvFrom {
+			if envFrom.ConfigMapRef != nil {
+				refs = append(refs, podReference{kind: "ConfigMap", name: envFrom.ConfigMapRef.Name, edge: edgeEnvFrom})
+			}
+			if envFrom.SecretRef != nil {
+				refs = append(refs, podReference{kind: "Secret", name: envFrom.SecretRef.Name, edge: edgeEnvFrom})
+			}
+		}
+		for _, env := range containers[i].Env {
+			if env.ValueFrom == nil {
+				continue
+			}
+			if env.ValueFrom.ConfigMapKeyRef != nil {
+				refs = append(refs, podReference{kind: "ConfigMap", name: env.ValueFrom.ConfigMapKeyRef.Name, edge: edgeEnv})
+			}
+			if env.ValueFrom.SecretKeyRef != nil {
+				refs = append(refs, podReference{kind: "Secret", name: env.ValueFrom.SecretKeyRef.Name, edge: edgeEnv})
+			}
+		}
+	}
+
+	return refs
+}
+
+// writeDOT writes the graph in the Graphviz DOT format. Objects, pods and workloads are drawn with different shapes,
+// missing objects are dashed and unwatched ones dotted, and edges are labelled with their reference type.
+func (g *dependencyGraph) writeDOT(w io.Writer) error {
+	var sb strings.Builder
+	sb.WriteString("digraph reloader {\n")
+	sb.WriteString("\trankdir=LR;\n")
+
+	for _, node := range g.Nodes {
+		shape := "box"
+		switch node.Type {
+		case nodeTypeObject:
+			shape = "note"
+		case nodeTypePod:
+			shape = "ellipse"
+		}
+
+		style := ""
+		switch {
+		case node.Missing:
+			style = ", style=dashed"
+		case node.Unwatched:
+			style = ", style=dotted"
+		}
+		fmt.Fprintf(&sb, "\t%q [label=%q, shape=%s%s];\n", node.ID, node.Kind+"\n"+node.Namespace+"/"+node.Name, shape, style)
+	}
+
+	for _, edge := range g.Edges {
+		fmt.Fprintf(&sb, "\t%q -> %q [label=%q];\n", edge.From, edge.To, edge.Type)
+	}
+
+	sb.WriteString("}\n")
+
+	if _, err := io.WriteString(w, sb.String()); err != nil {
+		return fmt.Errorf("failed to write graph: %w", err)
+	}
+	return nil
+}
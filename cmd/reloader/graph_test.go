@@ -0,0 +1,218 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes/fake"
+	listersv1 "k8s.io/client-go/listers/core/v1"
+	kubecache "k8s.io/client-go/tools/cache"
+)
+
+func testableGraphPod(t *testing.T) *corev1.Pod {
+	t.Helper()
+
+	controller := true
+	return &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "api-123-a",
+			Namespace: "default",
+			Labels:    map[string]string{"reloader/secret": "db"},
+			OwnerReferences: []metav1.OwnerReference{{
+				Kind:       "ReplicaSet",
+				Name:       "api-123",
+				UID:        "replicaset-uid",
+				Controller: &controller,
+			}},
+		},
+		Spec: corev1.PodSpec{
+			Volumes: []corev1.Volume{
+				{Name: "config", VolumeSource: corev1.VolumeSource{
+					ConfigMap: &corev1.ConfigMapVolumeSource{LocalObjectReference: corev1.LocalObjectReference{Name: "app"}},
+				}},
+				{Name: "tls", VolumeSource: corev1.VolumeSource{
+					Projected: &corev1.ProjectedVolumeSource{Sources: []corev1.VolumeProjection{{
+						Secret: &corev1.SecretProjection{LocalObjectReference: corev1.LocalObjectReference{Name: "tls"}},
+					}}},
+				}},
+			},
+			Containers: []corev1.Container{{
+				Name: "api",
+				EnvFrom: []corev1.EnvFromSource{{
+					SecretRef: &corev1.SecretEnvSource{LocalObjectReference: corev1.LocalObjectReference{Name: "db"}},
+				}},
+			}},
+		},
+	}
+}
+
+func Test_PodReferences(t *testing.T) {
+	t.Parallel()
+
+	refs := podReferences(testableGraphPod(t))
+	require.ElementsMatch(t, []podReference{
+		{kind: "Secret", name: "db", edge: edgeLabel},
+		{kind: "ConfigMap", name: "app", edge: edgeVolume},
+		{kind: "Secret", name: "tls", edge: edgeVolume},
+		{kind: "Secret", name: "db", edge: edgeEnvFrom},
+	}, refs)
+}
+
+func Test_GraphBuilder(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	controller := true
+	deployment := &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{Name: "api", Namespace: "default", UID: "deployment-uid"},
+	}
+	replicaSet := &appsv1.ReplicaSet{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "api-123",
+			Namespace: "default",
+			UID:       "replicaset-uid",
+			OwnerReferences: []metav1.OwnerReference{{
+				Kind:       "Deployment",
+				Name:       deployment.Name,
+				UID:        deployment.UID,
+				Controller: &controller,
+			}},
+		},
+	}
+	other := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "unrelated", Namespace: "default"},
+	}
+
+	kubeClient := fake.NewClientset(
+		deployment,
+		replicaSet,
+		testableGraphPod(t),
+		other,
+		&corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: "db", Namespace: "default"}},
+		&corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "default"}},
+	)
+	informerFactory := informers.NewSharedInformerFactory(kubeClient, 0)
+	builder := newGraphBuilder(
+		kubeClient,
+		informerFactory.Core().V1().Pods().Lister(),
+		informerFactory.Core().V1().ConfigMaps().Lister(),
+		informerFactory.Core().V1().Secrets().Lister(),
+	)
+	informerFactory.Start(ctx.Done())
+	informerFactory.WaitForCacheSync(ctx.Done())
+
+	graph, err := builder.build(ctx, "default")
+	require.NoError(t, err)
+
+	require.Equal(t, []*graphNode{
+		{ID: "default/configmap/app", Type: nodeTypeObject, Kind: "ConfigMap", Namespace: "default", Name: "app"},
+		{ID: "default/deployment/api", Type: nodeTypeWorkload, Kind: "Deployment", Namespace: "default", Name: "api"},
+		{ID: "default/pod/api-123-a", Type: nodeTypePod, Kind: "Pod", Namespace: "default", Name: "api-123-a"},
+		{ID: "default/secret/db", Type: nodeTypeObject, Kind: "Secret", Namespace: "default", Name: "db"},
+		{ID: "default/secret/tls", Type: nodeTypeObject, Kind: "Secret", Namespace: "default", Name: "tls", Missing: true},
+	}, graph.Nodes)
+
+	require.Equal(t, []*graphEdge{
+		{From: "default/configmap/app", To: "default/pod/api-123-a", Type: edgeVolume},
+		{From: "default/pod/api-123-a", To: "default/deployment/api", Type: edgeOwner},
+		{From: "default/secret/db", To: "default/pod/api-123-a", Type: edgeEnvFrom},
+		{From: "default/secret/db", To: "default/pod/api-123-a", Type: edgeLabel},
+		{From: "default/secret/tls", To: "default/pod/api-123-a", Type: edgeVolume},
+	}, graph.Edges)
+
+	t.Run("other namespace", func(t *testing.T) {
+		t.Parallel()
+
+		graph, err := builder.build(ctx, "team-b")
+		require.NoError(t, err)
+		require.Empty(t, graph.Nodes)
+		require.Empty(t, graph.Edges)
+	})
+
+	t.Run("dot", func(t *testing.T) {
+		t.Parallel()
+
+		buf := new(bytes.Buffer)
+		require.NoError(t, graph.writeDOT(buf))
+		require.Contains(t, buf.String(), "digraph reloader {")
+		require.Contains(t, buf.String(), `"default/secret/db" -> "default/pod/api-123-a" [label="envFrom"];`)
+		require.Contains(t, buf.String(), `"default/secret/tls" [label="Secret\ndefault/tls", shape=note, style=dashed];`)
+	})
+}
+
+func Test_GraphBuilderUnwatched(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	kubeClient := fake.NewClientset(
+		testableDependentPod(t, "api", "default", "Secret", "db"),
+		&corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: "db", Namespace: "default"}},
+	)
+	informerFactory := informers.NewSharedInformerFactory(kubeClient, 0)
+
+	// The Secret is filtered out of the informer caches.
+	builder := newGraphBuilder(
+		kubeClient,
+		informerFactory.Core().V1().Pods().Lister(),
+		informerFactory.Core().V1().ConfigMaps().Lister(),
+		listersv1.NewSecretLister(kubecache.NewIndexer(kubecache.MetaNamespaceKeyFunc, kubecache.Indexers{})),
+	)
+	informerFactory.Start(ctx.Done())
+	informerFactory.WaitForCacheSync(ctx.Done())
+
+	graph, err := builder.build(ctx, "default")
+	require.NoError(t, err)
+	require.Contains(t, graph.Nodes, &graphNode{
+		ID:        "default/secret/db",
+		Type:      nodeTypeObject,
+		Kind:      "Secret",
+		Namespace: "default",
+		Name:      "db",
+		Unwatched: true,
+	})
+}
+
+func Test_AdminAPIGraph(t *testing.T) {
+	t.Parallel()
+
+	api, _ := testableAdminAPI(t, testableDependentPod(t, "api", "default", "Secret", "db"))
+
+	t.Run("json", func(t *testing.T) {
+		t.Parallel()
+
+		rec := adminRequest(t, api, http.MethodGet, "/v1/graph?namespace=default")
+		require.Equal(t, http.StatusOK, rec.Code)
+
+		graph := new(dependencyGraph)
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), graph))
+		require.Len(t, graph.Nodes, 2)
+		require.Len(t, graph.Edges, 1)
+	})
+
+	t.Run("dot", func(t *testing.T) {
+		t.Parallel()
+
+		rec := adminRequest(t, api, http.MethodGet, "/v1/graph?format=dot")
+		require.Equal(t, http.StatusOK, rec.Code)
+		require.Contains(t, rec.Body.String(), `"default/secret/db" -> "default/pod/api" [label="label"];`)
+	})
+
+	t.Run("unknown format", func(t *testing.T) {
+		t.Parallel()
+
+		rec := adminRequest(t, api, http.MethodGet, "/v1/graph?format=svg")
+		require.Equal(t, http.StatusBadRequest, rec.Code)
+	})
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"sort"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// dataHash returns a hex encoded SHA-256 hash of the given maps. Keys are hashed in sorted order, so that the hash
+// only depends on the content.
+func dataHash[V string | []byte](data ...map[string]V) string {
+	h := sha256.New()
+	for _, m := range data {
+		keys := make([]string, 0, len(m))
+		for k := range m {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+
+		for _, k := range keys {
+			// Separate keys and values with a NUL byte, which cannot appear in a key, to keep the encoding unambiguous.
+			h.Write([]byte(k))
+			h.Write([]byte{0})
+			h.Write([]byte(m[k]))
+			h.Write([]byte{0})
+		}
+		h.Write([]byte{0})
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// configMapHash returns the content hash of the given configMap.
+func configMapHash(configMap *corev1.ConfigMap) string {
+	binaryData := make(map[string]string, len(configMap.BinaryData))
+	for k, v := range configMap.BinaryData {
+		binaryData[k] = string(v)
+	}
+	return dataHash(configMap.Data, binaryData)
+}
+
+// secretHash returns the content hash of the given secret. Cached secrets only hold the digests of their values, so
+// the hash recorded when they were cached is returned for them.
+func secretHash(secret *corev1.Secret) string {
+	if hash, ok := secret.Annotations[annotationCachedHash]; ok {
+		return hash
+	}
+	return dataHash(secret.Data)
+}
@@ -0,0 +1,330 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+
+	"github.com/jacobbrewer1/web/logging"
+	"github.com/jacobbrewer1/workerpool"
+)
+
+const (
+	// strategyHTTP reloads pods in place by calling their reload endpoint.
+	strategyHTTP = "http"
+
+	// annotationReloadURL is the pod annotation naming the endpoint that reloads the pod in place. An empty host,
+	// such as in "http://:8080/-/reload", is replaced with the pod IP. Any other host must be one of the pod IPs, so
+	// that the annotation cannot point reloader at other endpoints it can reach.
+	annotationReloadURL = "reloader/reload-url"
+
+	// annotationReloadTimeout is the pod annotation overriding the timeout of a single reload request.
+	annotationReloadTimeout = "reloader/reload-timeout"
+
+	// annotationReloadRetries is the pod annotation overriding the number of times a failed reload request is retried.
+	annotationReloadRetries = "reloader/reload-retries"
+
+	// headerContentHash carries the hash of the new object content. The endpoint may echo the hash of the content it
+	// loaded in the same header, or respond with 409 Conflict, to report that its volume has not caught up yet.
+	headerContentHash = "X-Reloader-Content-Hash"
+
+	// headerObject carries the key of the changed object.
+	headerObject = "X-Reloader-Object"
+)
+
+var (
+	// errReloadStatus is returned when a reload endpoint responds with an unexpected status.
+	errReloadStatus = errors.New("unexpected reload endpoint status")
+
+	// errStaleContent is returned when a pod has not yet observed the new content of the object.
+	errStaleContent = errors.New("pod has not observed the new content")
+
+	// errNoPodIP is returned when the reload endpoint of a pod without an IP is needed.
+	errNoPodIP = errors.New("pod has no IP")
+
+	// errReloadURLScheme is returned when a reload endpoint is not an http or https URL.
+	errReloadURLScheme = errors.New("reload endpoint must be an http or https URL")
+
+	// errForeignHost is returned when the reload endpoint of a pod names a host other than the pod IPs.
+	errForeignHost = errors.New("reload endpoint host is not a pod IP")
+)
+
+// httpReloader reloads pods in place by calling the endpoint named by their annotationReloadURL annotation.
+type httpReloader struct {
+	// client sends the reload requests.
+	client *http.Client
+
+	// timeout is the default timeout of a single reload request.
+	timeout time.Duration
+
+	// retries is the default number of times a failed reload request is retried.
+	retries int
+
+	// retryBackoff is the delay before the first retry, doubled for every further retry.
+	retryBackoff time.Duration
+
+	// pool runs the reload requests, bounding how many are in flight.
+	pool workerpool.Pool
+
+	// stopOnce stops the pool once, as stopping it again panics.
+	stopOnce *sync.Once
+}
+
+// newHTTPReloader creates a new httpReloader.
+func newHTTPReloader(
+	timeout time.Duration,
+	retries int,
+	retryBackoff time.Duration,
+	pool workerpool.Pool,
+) *httpReloader {
+	return &httpReloader{
+		client: &http.Client{
+			// Redirects are not followed, as they could send the request away from the pod. A redirect is a failed
+			// reload, so that the pod is restarted instead.
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+		timeout:      timeout,
+		retries:      retries,
+		retryBackoff: retryBackoff,
+		pool:         pool,
+		stopOnce:     new(sync.Once),
+	}
+}
+
+// splitInPlace splits the pods into those declaring a reload endpoint and the rest.
+func splitInPlace(pods []*corev1.Pod) (inPlace, rest []*corev1.Pod) {
+	for _, pod := range pods {
+		if pod.Annotations[annotationReloadURL] != "" {
+			inPlace = append(inPlace, pod)
+			continue
+		}
+		rest = append(rest, pod)
+	}
+	return inPlace, rest
+}
+
+// reloadPods calls the reload endpoint of every pod on the worker pool. The pods that could not be reloaded in place
+// are returned, so that they can be restarted instead.
+func (h *httpReloader) reloadPods(
+	ctx context.Context,
+	l *slog.Logger,
+	ref *corev1.ObjectReference,
+	hash string,
+	pods []*corev1.Pod,
+) []*corev1.Pod {
+	mut := new(sync.Mutex)
+	failed := make([]*corev1.Pod, 0)
+	fail := func(pod *corev1.Pod, err error) {
+		l.Warn("failed to reload pod in place, falling back to restart",
+			slog.String(logKeyNamespace, pod.Namespace),
+			slog.String(logKeyPod, pod.Name),
+			slog.String(logging.KeyError, err.Error()),
+		)
+		httpReloads.WithLabelValues("fallback").Inc()
+
+		mut.Lock()
+		failed = append(failed, pod)
+		mut.Unlock()
+	}
+
+	wg := new(sync.WaitGroup)
+	for _, pod := range pods {
+		wg.Add(1)
+		err := h.pool.BlockingSchedule(runnableFunc(func() {
+			defer wg.Done()
+
+			if err := h.reloadPod(ctx, ref, hash, pod); err != nil {
+				fail(pod, err)
+				return
+			}
+			httpReloads.WithLabelValues("succeeded").Inc()
+		}))
+		if err != nil {
+			wg.Done()
+			fail(pod, err)
+		}
+	}
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		// Reloads left on a stopped pool never run, so stop waiting for them.
+	}
+
+	mut.Lock()
+	defer mut.Unlock()
+	return slices.Clone(failed)
+}
+
+// stop stops the worker pool running the reload requests.
+func (h *httpReloader) stop() {
+	h.stopOnce.Do(h.pool.Stop)
+}
+
+// reloadPod calls the reload endpoint of the pod, retrying with an exponential backoff. Retries give the kubelet time
+// to update the projected volume when the endpoint reports stale content.
+func (h *httpReloader) reloadPod(ctx context.Context, ref *corev1.ObjectReference, hash string, pod *corev1.Pod) error {
+	target, err := podReloadURL(pod)
+	if err != nil {
+		return err
+	}
+
+	timeout, retries, err := reloadSettings(pod.Annotations, h.timeout, h.retries)
+	if err != nil {
+		return err
+	}
+
+	backoff := h.retryBackoff
+	for attempt := 0; ; attempt++ {
+		err = h.call(ctx, target, referenceKey(ref), hash, timeout)
+		if err == nil || attempt >= retries {
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+// reloadSettings returns the reload request timeout and retries overridden by the annotations, falling back to the
+// given defaults.
+func reloadSettings(annotations map[string]string, timeout time.Duration, retries int) (time.Duration, int, error) {
+	var err error
+	if v, ok := annotations[annotationReloadTimeout]; ok {
+		timeout, err = time.ParseDuration(v)
+		if err != nil {
+			return 0, 0, fmt.Errorf("invalid %s annotation: %w", annotationReloadTimeout, err)
+		} else if timeout <= 0 {
+			return 0, 0, fmt.Errorf("invalid %s annotation: timeout must be positive", annotationReloadTimeout)
+		}
+	}
+
+	if v, ok := annotations[annotationReloadRetries]; ok {
+		retries, err = strconv.Atoi(v)
+		if err != nil {
+			return 0, 0, fmt.Errorf("invalid %s annotation: %w", annotationReloadRetries, err)
+		} else if retries < 0 {
+			return 0, 0, fmt.Errorf("invalid %s annotation: retries must not be negative", annotationReloadRetries)
+		}
+	}
+
+	return timeout, retries, nil
+}
+
+// call makes a single reload request.
+func (h *httpReloader) call(ctx context.Context, target *url.URL, key, hash string, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, target.String(), http.NoBody)
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+
+	req.Header.Set(headerObject, key)
+	if hash != "" {
+		req.Header.Set(headerContentHash, hash)
+	}
+
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to send request: %w", err)
+	}
+	defer resp.Body.Close() // nolint:errcheck // Nothing to do with the error
+
+	_, _ = io.Copy(io.Discard, resp.Body)
+	switch {
+	case resp.StatusCode == http.StatusConflict:
+		return errStaleContent
+	case resp.StatusCode < http.StatusOK || resp.StatusCode >= http.StatusMultipleChoices:
+		return fmt.Errorf("%w: %d", errReloadStatus, resp.StatusCode)
+	}
+
+	if loaded := resp.Header.Get(headerContentHash); hash != "" && loaded != "" && loaded != hash {
+		return errStaleContent
+	}
+	return nil
+}
+
+// podReloadURL returns the reload endpoint of the pod, with an empty host replaced by the pod IP. Hosts other than the
+// pod IPs are rejected.
+func podReloadURL(pod *corev1.Pod) (*url.URL, error) {
+	target, err := parseReloadURL(pod.Annotations[annotationReloadURL])
+	if err != nil {
+		return nil, err
+	}
+
+	if hostname := target.Hostname(); hostname != "" {
+		if !podHasIP(pod, hostname) {
+			return nil, fmt.Errorf("%w: %s", errForeignHost, hostname)
+		}
+		return target, nil
+	}
+
+	if pod.Status.PodIP == "" {
+		return nil, errNoPodIP
+	}
+
+	host := pod.Status.PodIP
+	if port := target.Port(); port != "" {
+		host = net.JoinHostPort(host, port)
+	} else if strings.Contains(host, ":") {
+		host = "[" + host + "]"
+	}
+	target.Host = host
+
+	return target, nil
+}
+
+// podHasIP reports whether the given host is one of the IPs of the pod. Host names never match.
+func podHasIP(pod *corev1.Pod, host string) bool {
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+
+	podIPs := []string{pod.Status.PodIP}
+	for _, podIP := range pod.Status.PodIPs {
+		podIPs = append(podIPs, podIP.IP)
+	}
+	for _, podIP := range podIPs {
+		if ip.Equal(net.ParseIP(podIP)) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseReloadURL parses the value of the reload endpoint annotation. The host may be left empty to target the pod IP.
+func parseReloadURL(value string) (*url.URL, error) {
+	target, err := url.Parse(value)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s annotation: %w", annotationReloadURL, err)
+	} else if target.Scheme != "http" && target.Scheme != "https" {
+		return nil, fmt.Errorf("invalid %s annotation: %w", annotationReloadURL, errReloadURLScheme)
+	}
+	return target, nil
+}
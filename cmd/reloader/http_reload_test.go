@@ -0,0 +1,230 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes/fake"
+
+	"github.com/jacobbrewer1/web/cache"
+	"github.com/jacobbrewer1/workerpool"
+)
+
+func testableInPlacePod(t *testing.T, name, reloadURL string) *corev1.Pod {
+	t.Helper()
+	return &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        name,
+			Namespace:   "default",
+			Labels:      map[string]string{"reloader/configmap": "app"},
+			Annotations: map[string]string{annotationReloadURL: reloadURL},
+		},
+		Status: corev1.PodStatus{
+			Phase:  corev1.PodRunning,
+			PodIP:  "127.0.0.1",
+			PodIPs: []corev1.PodIP{{IP: "127.0.0.1"}},
+		},
+	}
+}
+
+// testableHTTPReloader returns an httpReloader with the given settings, running its requests on a small pool.
+func testableHTTPReloader(t *testing.T, timeout time.Duration, retries int, retryBackoff time.Duration) *httpReloader {
+	t.Helper()
+
+	h := newHTTPReloader(timeout, retries, retryBackoff, workerpool.New(workerpool.WithTotalWorkers(4)))
+	t.Cleanup(h.stop)
+
+	return h
+}
+
+func Test_PodReloadURL(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name      string
+		reloadURL string
+		podIP     string
+		want      string
+		wantErr   error
+	}{
+		{name: "pod ip with port", reloadURL: "http://:8080/-/reload", podIP: "10.0.0.1", want: "http://10.0.0.1:8080/-/reload"},
+		{name: "pod ip without port", reloadURL: "http:///-/reload", podIP: "10.0.0.1", want: "http://10.0.0.1/-/reload"},
+		{name: "ipv6 pod ip", reloadURL: "http://:8080/-/reload", podIP: "fd00::1", want: "http://[fd00::1]:8080/-/reload"},
+		{name: "pod ip host", reloadURL: "http://10.0.0.1:9090/reload", podIP: "10.0.0.1", want: "http://10.0.0.1:9090/reload"},
+		{name: "foreign ip host", reloadURL: "http://169.254.169.254/latest", podIP: "10.0.0.1", wantErr: errForeignHost},
+		{name: "foreign name host", reloadURL: "http://kubernetes.default:443/", podIP: "10.0.0.1", wantErr: errForeignHost},
+		{name: "no pod ip", reloadURL: "http://:8080/-/reload", wantErr: errNoPodIP},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			pod := testableInPlacePod(t, "pod", tt.reloadURL)
+			pod.Status.PodIP = tt.podIP
+			pod.Status.PodIPs = nil
+			if tt.podIP != "" {
+				pod.Status.PodIPs = []corev1.PodIP{{IP: tt.podIP}}
+			}
+
+			got, err := podReloadURL(pod)
+			if tt.wantErr != nil {
+				require.ErrorIs(t, err, tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.want, got.String())
+		})
+	}
+}
+
+func Test_HTTPReloaderReloadPod(t *testing.T) {
+	t.Parallel()
+
+	ref := &corev1.ObjectReference{Kind: "ConfigMap", Namespace: "default", Name: "app"}
+
+	t.Run("success", func(t *testing.T) {
+		t.Parallel()
+
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			require.Equal(t, http.MethodPost, r.Method)
+			require.Equal(t, "hash", r.Header.Get(headerContentHash))
+			require.Equal(t, "default/configmap/app", r.Header.Get(headerObject))
+			w.Header().Set(headerContentHash, "hash")
+		}))
+		t.Cleanup(srv.Close)
+
+		h := testableHTTPReloader(t, time.Second, 0, time.Millisecond)
+		require.NoError(t, h.reloadPod(context.Background(), ref, "hash", testableInPlacePod(t, "pod", srv.URL)))
+	})
+
+	t.Run("waits for volume", func(t *testing.T) {
+		t.Parallel()
+
+		var calls atomic.Int32
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if calls.Add(1) < 3 {
+				w.Header().Set(headerContentHash, "stale")
+				return
+			}
+			w.Header().Set(headerContentHash, "hash")
+		}))
+		t.Cleanup(srv.Close)
+
+		h := testableHTTPReloader(t, time.Second, 3, time.Millisecond)
+		require.NoError(t, h.reloadPod(context.Background(), ref, "hash", testableInPlacePod(t, "pod", srv.URL)))
+		require.Equal(t, int32(3), calls.Load())
+	})
+
+	t.Run("stale content", func(t *testing.T) {
+		t.Parallel()
+
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusConflict)
+		}))
+		t.Cleanup(srv.Close)
+
+		h := testableHTTPReloader(t, time.Second, 1, time.Millisecond)
+		err := h.reloadPod(context.Background(), ref, "hash", testableInPlacePod(t, "pod", srv.URL))
+		require.ErrorIs(t, err, errStaleContent)
+	})
+
+	t.Run("redirect", func(t *testing.T) {
+		t.Parallel()
+
+		var followed atomic.Bool
+		target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			followed.Store(true)
+			w.Header().Set(headerContentHash, "hash")
+		}))
+		t.Cleanup(target.Close)
+
+		srv := httptest.NewServer(http.RedirectHandler(target.URL, http.StatusTemporaryRedirect))
+		t.Cleanup(srv.Close)
+
+		h := testableHTTPReloader(t, time.Second, 0, time.Millisecond)
+		err := h.reloadPod(context.Background(), ref, "hash", testableInPlacePod(t, "pod", srv.URL))
+		require.ErrorIs(t, err, errReloadStatus)
+		require.False(t, followed.Load())
+	})
+
+	t.Run("annotation overrides", func(t *testing.T) {
+		t.Parallel()
+
+		var calls atomic.Int32
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			calls.Add(1)
+			w.WriteHeader(http.StatusInternalServerError)
+		}))
+		t.Cleanup(srv.Close)
+
+		pod := testableInPlacePod(t, "pod", srv.URL)
+		pod.Annotations[annotationReloadRetries] = "2"
+		pod.Annotations[annotationReloadTimeout] = "1s"
+
+		h := testableHTTPReloader(t, time.Second, 0, time.Millisecond)
+		err := h.reloadPod(context.Background(), ref, "hash", pod)
+		require.ErrorIs(t, err, errReloadStatus)
+		require.Equal(t, int32(3), calls.Load())
+	})
+}
+
+func Test_ReloadInPlace(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+
+	ok := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	t.Cleanup(ok.Close)
+	broken := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	t.Cleanup(broken.Close)
+
+	reloaded := testableInPlacePod(t, "reloaded", ok.URL)
+	fallback := testableInPlacePod(t, "fallback", broken.URL)
+	restarted := testableInPlacePod(t, "restarted", "")
+
+	kubeClient := fake.NewClientset(reloaded, fallback, restarted)
+	informerFactory := informers.NewSharedInformerFactory(kubeClient, 0)
+	rel := testableReloader(t, cache.NewFixedHashBucket(1), kubeClient, informerFactory)
+	informerFactory.Start(ctx.Done())
+	informerFactory.WaitForCacheSync(ctx.Done())
+
+	configMap := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "default"},
+		Data:       map[string]string{"key": "value"},
+	}
+	rel.reload(ctx, slog.New(slog.DiscardHandler), objectReference("ConfigMap", configMap), []string{"key"}, configMapHash(configMap))
+
+	_, err := kubeClient.CoreV1().Pods("default").Get(ctx, reloaded.Name, metav1.GetOptions{})
+	require.NoError(t, err)
+
+	for _, pod := range []*corev1.Pod{fallback, restarted} {
+		_, err = kubeClient.CoreV1().Pods("default").Get(ctx, pod.Name, metav1.GetOptions{})
+		require.True(t, k8serrors.IsNotFound(err), pod.Name)
+	}
+}
+
+func Test_HTTPReloaderStop(t *testing.T) {
+	t.Parallel()
+
+	h := testableHTTPReloader(t, time.Second, 0, time.Millisecond)
+	h.stop()
+
+	// Reloads handed to a stopped pool fall back to a restart.
+	pods := []*corev1.Pod{testableInPlacePod(t, "pod", "http://:8080/-/reload")}
+	ref := &corev1.ObjectReference{Kind: "ConfigMap", Namespace: "default", Name: "app"}
+	failed := h.reloadPods(context.Background(), slog.New(slog.DiscardHandler), ref, "hash", pods)
+	require.Equal(t, pods, failed)
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"strings"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+
+	"github.com/jacobbrewer1/web/logging"
+)
+
+// webhookImpact is the name of the admission webhook warning about the reloads caused by ConfigMap and Secret updates.
+const webhookImpact = "impact"
+
+// reviewImpact warns about the pods an update of a ConfigMap or Secret would reload. It never denies: the warnings are
+// only shown to the user applying the change, and any failure to work out the impact admits the update silently.
+func (s *admissionServer) reviewImpact(req *admissionv1.AdmissionRequest) *admissionv1.AdmissionResponse {
+	if req.Operation != admissionv1.Update {
+		return &admissionv1.AdmissionResponse{Allowed: true}
+	}
+
+	obj, ok, err := updatedObject(req)
+	if err != nil {
+		s.l.Warn("failed to decode admitted object",
+			slog.String(logKeyKind, req.Kind.Kind),
+			slog.String(logging.KeyError, err.Error()),
+		)
+		return &admissionv1.AdmissionResponse{Allowed: true}
+	} else if !ok {
+		return &admissionv1.AdmissionResponse{Allowed: true}
+	}
+
+	return s.bounded(webhookImpact, func(ctx context.Context) *admissionv1.AdmissionResponse {
+		plan, err := s.reloader.plan(ctx, s.l, obj)
+		if err != nil {
+			s.l.Error("failed to plan reload", slog.String(logging.KeyError, err.Error()))
+			return &admissionv1.AdmissionResponse{Allowed: true}
+		}
+
+		warnings := s.impactWarnings(obj.ref, plan)
+		for i, warning := range warnings {
+			warnings[i] = admissionMessagePrefix + warning
+		}
+		return &admissionv1.AdmissionResponse{Allowed: true, Warnings: warnings}
+	})
+}
+
+// updatedObject returns the object a ConfigMap or Secret update would reload, with the keys changed by the update.
+// False is returned for other kinds.
+func updatedObject(req *admissionv1.AdmissionRequest) (*reloadObject, bool, error) {
+	decode := func(raw []byte, obj any) error {
+		if err := json.Unmarshal(raw, obj); err != nil {
+			return fmt.Errorf("failed to decode %s: %w", req.Kind.Kind, err)
+		}
+		return nil
+	}
+
+	switch req.Kind.Kind {
+	case "ConfigMap":
+		configMap, old := new(corev1.ConfigMap), new(corev1.ConfigMap)
+		if err := decode(req.Object.Raw, configMap); err != nil {
+			return nil, false, err
+		} else if err := decode(req.OldObject.Raw, old); err != nil {
+			return nil, false, err
+		}
+		configMap.Namespace = req.Namespace
+
+		return &reloadObject{
+			ref:         objectReference("ConfigMap", configMap),
+			keys:        append(changedKeys(old.Data, configMap.Data), changedKeys(old.BinaryData, configMap.BinaryData)...),
+			hash:        configMapHash(configMap),
+			labels:      configMap.Labels,
+			annotations: configMap.Annotations,
+			data:        configMapContent(configMap),
+		}, true, nil
+	case "Secret":
+		secret, old := new(corev1.Secret), new(corev1.Secret)
+		if err := decode(req.Object.Raw, secret); err != nil {
+			return nil, false, err
+		} else if err := decode(req.OldObject.Raw, old); err != nil {
+			return nil, false, err
+		}
+		secret.Namespace = req.Namespace
+
+		return &reloadObject{
+			ref:         objectReference("Secret", secret),
+			keys:        changedKeys(old.Data, secret.Data),
+			hash:        secretHash(secret),
+			labels:      secret.Labels,
+			annotations: secret.Annotations,
+			data:        secret.Data,
+		}, true, nil
+	default:
+		return nil, false, nil
+	}
+}
+
+// impactWarnings summarises the reload plan of an update. No warnings are returned when no pods depend on the object.
+func (s *admissionServer) impactWarnings(ref *corev1.ObjectReference, plan *reloadPlan) []string {
+	if len(plan.Pods) == 0 {
+		return make([]string, 0)
+	}
+
+	strategies := make(map[string]int)
+	for _, pod := range plan.Pods {
+		if pod.Strategy != "" {
+			strategies[pod.Strategy]++
+		}
+	}
+
+	object := ref.Kind + " " + ref.Namespace + "/" + ref.Name
+	warnings := make([]string, 0, 4)
+	if len(plan.Invalid) > 0 {
+		warnings = append(warnings, fmt.Sprintf("%s has invalid content in %s, so its %d dependent pods will not be reloaded",
+			object, strings.Join(sortedKeys(plan.Invalid), ", "), len(plan.Pods)))
+		return warnings
+	}
+
+	reloaded := 0
+	for _, count := range strategies {
+		reloaded += count
+	}
+	if reloaded > 0 {
+		counts := make([]string, 0, len(strategies))
+		for _, strategy := range sortedKeys(strategies) {
+			counts = append(counts, fmt.Sprintf("%d by %s", strategies[strategy], strategy))
+		}
+		warnings = append(warnings, fmt.Sprintf("updating %s reloads %d pods of %d workloads (%s)",
+			object, reloaded, len(plan.Workloads), strings.Join(counts, ", ")))
+	}
+
+	if paused := plan.skipped(skipPaused); paused > 0 {
+		action := "dropped"
+		if s.reloader.pause.mode == pauseModeDefer {
+			action = "deferred until the pause is lifted"
+		}
+		warnings = append(warnings, fmt.Sprintf("%d pods depending on %s are paused, so their reload will be %s",
+			paused, object, action))
+	}
+
+	if held := plan.skipped(skipCircuitBreaker); held > 0 {
+		warnings = append(warnings, fmt.Sprintf(
+			"updating %s would reload %d pods, more than the circuit breaker allows, so the reload will wait for "+
+				"confirmation", object, held))
+	}
+
+	return warnings
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	admissionv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+func testableImpactReview(t *testing.T, kind string, oldObj, newObj any) *admissionv1.AdmissionRequest {
+	t.Helper()
+
+	oldRaw, err := json.Marshal(oldObj)
+	require.NoError(t, err)
+	newRaw, err := json.Marshal(newObj)
+	require.NoError(t, err)
+
+	return &admissionv1.AdmissionRequest{
+		UID:       "uid-1",
+		Kind:      metav1.GroupVersionKind{Version: "v1", Kind: kind},
+		Namespace: "default",
+		Operation: admissionv1.Update,
+		Object:    runtime.RawExtension{Raw: newRaw},
+		OldObject: runtime.RawExtension{Raw: oldRaw},
+	}
+}
+
+func Test_AdmissionServerReviewImpact(t *testing.T) {
+	t.Parallel()
+
+	paused := testableDependentPod(t, "paused", "default", "ConfigMap", "app")
+	paused.Annotations = map[string]string{annotationPaused: "true"}
+
+	r, _ := testablePlanReloader(t,
+		testableDependentPod(t, "restart", "default", "ConfigMap", "app"),
+		testableInPlacePod(t, "in-place", "http://:8080/-/reload"),
+		paused,
+	)
+	s := newAdmissionServer(slog.New(slog.DiscardHandler), enforcementDeny, time.Second, r.kubeClient, r,
+		r.configMapLister, r.secretLister)
+
+	configMap := func(content string) *corev1.ConfigMap {
+		return &corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:        "app",
+				Annotations: map[string]string{annotationValidate: "config.json=json"},
+			},
+			Data: map[string]string{"config.json": content},
+		}
+	}
+
+	t.Run("update", func(t *testing.T) {
+		t.Parallel()
+
+		resp := s.reviewImpact(testableImpactReview(t, "ConfigMap", configMap(`{}`), configMap(`{"debug": true}`)))
+		require.True(t, resp.Allowed)
+		require.Equal(t, []string{
+			"reloader: updating ConfigMap default/app reloads 2 pods of 3 workloads (1 by delete, 1 by http)",
+			"reloader: 1 pods depending on ConfigMap default/app are paused, so their reload will be dropped",
+		}, resp.Warnings)
+	})
+
+	t.Run("invalid content", func(t *testing.T) {
+		t.Parallel()
+
+		resp := s.reviewImpact(testableImpactReview(t, "ConfigMap", configMap(`{}`), configMap(`{`)))
+		require.True(t, resp.Allowed)
+		require.Equal(t, []string{
+			"reloader: ConfigMap default/app has invalid content in config.json, so its 3 dependent pods will not be reloaded",
+		}, resp.Warnings)
+	})
+
+	t.Run("no dependents", func(t *testing.T) {
+		t.Parallel()
+
+		secret := &corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: "db"}}
+		resp := s.reviewImpact(testableImpactReview(t, "Secret", secret, secret))
+		require.True(t, resp.Allowed)
+		require.Empty(t, resp.Warnings)
+	})
+
+	t.Run("invalid object", func(t *testing.T) {
+		t.Parallel()
+
+		req := testableImpactReview(t, "ConfigMap", configMap(`{}`), configMap(`{}`))
+		req.Object.Raw = []byte("{")
+
+		resp := s.reviewImpact(req)
+		require.True(t, resp.Allowed)
+		require.Empty(t, resp.Warnings)
+	})
+}
+
+func Test_AdmissionServerImpactWarnings(t *testing.T) {
+	t.Parallel()
+
+	r, _ := testablePlanReloader(t)
+	r.pause.mode = pauseModeDefer
+	s := newAdmissionServer(slog.New(slog.DiscardHandler), enforcementDeny, time.Second, r.kubeClient, r,
+		r.configMapLister, r.secretLister)
+
+	ref := &corev1.ObjectReference{Kind: "Secret", Namespace: "default", Name: "db"}
+	warnings := s.impactWarnings(ref, &reloadPlan{
+		Workloads: []string{"Deployment/api"},
+		Pods: []*plannedPod{
+			{Name: "api-a", Skipped: skipCircuitBreaker},
+			{Name: "api-b", Skipped: skipCircuitBreaker},
+			{Name: "api-c", Skipped: skipPaused},
+		},
+	})
+	require.Equal(t, []string{
+		"1 pods depending on Secret default/db are paused, so their reload will be deferred until the pause is lifted",
+		"updating Secret default/db would reload 2 pods, more than the circuit breaker allows, so the reload will wait " +
+			"for confirmation",
+	}, warnings)
+}
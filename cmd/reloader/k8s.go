@@ -2,24 +2,138 @@ package main
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"strings"
 
-	"go.uber.org/multierr"
+	appsv1 "k8s.io/api/apps/v1"
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/client-go/kubernetes"
 )
 
-// killPods deletes the given pods from the cluster. It returns an error if any of the
-func killPods(
+const (
+	// kindConfigMap is the kind used to refer to ConfigMaps in object keys.
+	kindConfigMap = "configmap"
+
+	// kindSecret is the kind used to refer to Secrets in object keys.
+	kindSecret = "secret"
+)
+
+// errUnknownKind is returned when an object kind is not watched by reloader.
+var errUnknownKind = errors.New("unknown kind")
+
+// apiKind returns the API kind for a kind used in object keys, such as "ConfigMap" for "configmap".
+func apiKind(kind string) (string, error) {
+	switch strings.ToLower(kind) {
+	case kindConfigMap:
+		return "ConfigMap", nil
+	case kindSecret:
+		return "Secret", nil
+	default:
+		return "", fmt.Errorf("%w: %s", errUnknownKind, kind)
+	}
+}
+
+// objectKey returns the key used to refer to an object in logs and metrics, in the form "namespace/kind/name".
+func objectKey(kind, namespace, name string) string {
+	return namespace + "/" + kind + "/" + name
+}
+
+// podOwners returns the chain of controllers owning the given pod, nearest first. For a Deployment managed pod
+// this is the ReplicaSet followed by the Deployment. Owners of kinds that are not understood end the chain.
+func podOwners(
+	ctx context.Context,
+	kubeClient kubernetes.Interface,
+	pod *corev1.Pod,
+) ([]metav1.Object, error) {
+	owners := make([]metav1.Object, 0)
+
+	ref := metav1.GetControllerOf(pod)
+	for ref != nil {
+		owner, err := getOwner(ctx, kubeClient, pod.Namespace, ref)
+		if err != nil {
+			return nil, err
+		} else if owner == nil {
+			break
+		}
+
+		owners = append(owners, owner)
+		ref = metav1.GetControllerOf(owner)
+	}
+
+	return owners, nil
+}
+
+// podWorkloads returns the top level workloads owning the given pods, such as "Deployment/api". Pods without a
+// supported controller are reported as "Pod/<name>".
+func podWorkloads(
 	ctx context.Context,
 	kubeClient kubernetes.Interface,
 	pods []*corev1.Pod,
-) error {
-	var multiErr error
+) []string {
+	workloads := make([]string, 0)
+	seen := make(map[types.UID]bool)
 	for _, pod := range pods {
-		if err := kubeClient.CoreV1().Pods(pod.Namespace).Delete(ctx, pod.Name, metav1.DeleteOptions{}); err != nil {
-			multiErr = multierr.Append(multiErr, err)
+		workload := "Pod/" + pod.Name
+		if owners, err := podOwners(ctx, kubeClient, pod); err == nil && len(owners) > 0 {
+			owner := owners[len(owners)-1]
+			if seen[owner.GetUID()] {
+				continue
+			}
+			seen[owner.GetUID()] = true
+			workload = ownerKind(owner) + "/" + owner.GetName()
 		}
+		workloads = append(workloads, workload)
+	}
+	return workloads
+}
+
+// getOwner fetches the object referenced by the given owner reference. It returns nil if the kind is not supported.
+func getOwner(
+	ctx context.Context,
+	kubeClient kubernetes.Interface,
+	namespace string,
+	ref *metav1.OwnerReference,
+) (metav1.Object, error) {
+	var (
+		owner metav1.Object
+		err   error
+	)
+
+	switch ref.Kind {
+	case "ReplicaSet":
+		owner, err = kubeClient.AppsV1().ReplicaSets(namespace).Get(ctx, ref.Name, metav1.GetOptions{})
+	case "Deployment":
+		owner, err = kubeClient.AppsV1().Deployments(namespace).Get(ctx, ref.Name, metav1.GetOptions{})
+	case "StatefulSet":
+		owner, err = kubeClient.AppsV1().StatefulSets(namespace).Get(ctx, ref.Name, metav1.GetOptions{})
+	case "DaemonSet":
+		owner, err = kubeClient.AppsV1().DaemonSets(namespace).Get(ctx, ref.Name, metav1.GetOptions{})
+	default:
+		return nil, nil // nolint:nilnil // Unsupported owners end the chain
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get %s %s/%s: %w", ref.Kind, namespace, ref.Name, err)
+	}
+
+	return owner, nil
+}
+
+// ownerKind returns the kind of an owner returned by podOwners. Typed objects fetched from the API do not carry their
+// kind, so it is derived from the Go type.
+func ownerKind(owner metav1.Object) string {
+	switch owner.(type) {
+	case *appsv1.ReplicaSet:
+		return "ReplicaSet"
+	case *appsv1.Deployment:
+		return "Deployment"
+	case *appsv1.StatefulSet:
+		return "StatefulSet"
+	case *appsv1.DaemonSet:
+		return "DaemonSet"
+	default:
+		return ""
 	}
-	return multiErr
 }
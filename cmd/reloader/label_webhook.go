@@ -0,0 +1,262 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"strings"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+
+	"github.com/jacobbrewer1/web/logging"
+)
+
+const (
+	// webhookLabels is the name of the admission webhook validating reloader labels and annotations.
+	webhookLabels = "labels"
+
+	// reloaderPrefix prefixes every label and annotation read by reloader.
+	reloaderPrefix = "reloader/"
+)
+
+// reviewLabels checks the reloader labels and annotations of a pod, or of the pod template of a workload along with the
+// reloader annotations of the workload itself. Pods created
+// by a controller are not checked, as their template was checked when the workload was applied and denying them would
+// only stop the controller from replacing pods.
+func (s *admissionServer) reviewLabels(req *admissionv1.AdmissionRequest) *admissionv1.AdmissionResponse {
+	workload, meta, ok, err := podTemplateMeta(req)
+	if err != nil {
+		// Objects that cannot be read are left to the API server to reject.
+		s.l.Warn("failed to decode admitted object",
+			slog.String(logKeyKind, req.Kind.Kind),
+			slog.String(logging.KeyError, err.Error()),
+		)
+		return &admissionv1.AdmissionResponse{Allowed: true}
+	} else if !ok {
+		return &admissionv1.AdmissionResponse{Allowed: true}
+	}
+
+	return s.bounded(webhookLabels, func(ctx context.Context) *admissionv1.AdmissionResponse {
+		problems, warnings, err := s.labelProblems(ctx, req.Namespace, meta)
+		if err != nil {
+			s.l.Error("failed to check reloader labels", slog.String(logging.KeyError, err.Error()))
+			return &admissionv1.AdmissionResponse{Allowed: true}
+		}
+		if workload != nil {
+			problems = append(problems, workloadProblems(workload)...)
+		}
+
+		resp := s.enforce(problems)
+		for _, warning := range warnings {
+			resp.Warnings = append(resp.Warnings, admissionMessagePrefix+warning)
+		}
+		return resp
+	})
+}
+
+// labelProblems returns the problems with the reloader labels and annotations of the pod metadata, and the warnings
+// that are not worth a denial, such as labels naming objects reloader does not watch.
+func (s *admissionServer) labelProblems(
+	ctx context.Context,
+	namespace string,
+	meta *metav1.ObjectMeta,
+) (problems, warnings []string, err error) {
+	problems = make([]string, 0)
+	warnings = make([]string, 0)
+	for _, key := range sortedKeys(meta.Labels) {
+		if !strings.HasPrefix(key, reloaderPrefix) {
+			continue
+		}
+
+		value := meta.Labels[key]
+		if key == labelAuto {
+			if value != "true" && value != "false" {
+				problems = append(problems, fmt.Sprintf("invalid %s label: %q is neither true nor false", key, value))
+			}
+			continue
+		}
+
+		kind := ""
+		for _, k := range []string{"ConfigMap", "Secret"} {
+			if key == dependencyLabel(k) {
+				kind = k
+			}
+		}
+		if kind == "" {
+			if !s.reloader.customTriggerKey(key) {
+				problems = append(problems, "unknown label "+key)
+			}
+			continue
+		}
+
+		if errs := validation.IsDNS1123Subdomain(value); len(errs) > 0 {
+			problems = append(problems, fmt.Sprintf("label %s: %q is not a valid %s name: %s",
+				key, value, kind, strings.Join(errs, ", ")))
+			continue
+		}
+
+		presence, err := lookupObject(ctx, s.kubeClient, s.configMapLister, s.secretLister, kind, namespace, value)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		switch presence {
+		case objectMissing:
+			problems = append(problems, fmt.Sprintf("label %s names %s %s, which does not exist in namespace %s",
+				key, kind, value, namespace))
+		case objectUnwatched:
+			warnings = append(warnings, fmt.Sprintf(
+				"label %s names %s %s, which is not watched by reloader (filtered or not enabled)", key, kind, value))
+		}
+	}
+
+	for _, key := range sortedKeys(meta.Annotations) {
+		if !strings.HasPrefix(key, reloaderPrefix) {
+			continue
+		}
+
+		value := meta.Annotations[key]
+		switch key {
+		case annotationReloadURL:
+			if _, err := parseReloadURL(value); err != nil {
+				problems = append(problems, err.Error())
+			}
+		case annotationReloadTimeout, annotationReloadRetries:
+			if _, _, err := reloadSettings(map[string]string{key: value}, 0, 0); err != nil {
+				problems = append(problems, err.Error())
+			}
+		case annotationContentHashes:
+			hashes := make(map[string]string)
+			if err := json.Unmarshal([]byte(value), &hashes); err != nil {
+				problems = append(problems, fmt.Sprintf("invalid %s annotation: %s", key, err))
+			}
+		case annotationVaultPath:
+			for _, path := range strings.Split(value, ",") {
+				if _, _, err := parseVaultPath(strings.TrimSpace(path)); err != nil {
+					problems = append(problems, fmt.Sprintf("invalid %s annotation: %s", key, err))
+				}
+			}
+		case annotationDeletePolicy, annotationStrategy, annotationPaused:
+			if problem := workloadAnnotationProblem(key, value); problem != "" {
+				problems = append(problems, problem)
+			}
+		default:
+			if !s.reloader.customTriggerKey(key) {
+				problems = append(problems, "unknown annotation "+key)
+			}
+		}
+	}
+
+	return problems, warnings, nil
+}
+
+// workloadProblems returns the problems with the reloader annotations of a workload itself. Only the annotations read
+// from workloads for the pods that do not set them are checked, as the others are only read from pods.
+func workloadProblems(meta *metav1.ObjectMeta) []string {
+	problems := make([]string, 0)
+	for _, key := range []string{annotationDeletePolicy, annotationPaused, annotationStrategy} {
+		value, ok := meta.Annotations[key]
+		if !ok {
+			continue
+		}
+		if problem := workloadAnnotationProblem(key, value); problem != "" {
+			problems = append(problems, "workload "+problem)
+		}
+	}
+	return problems
+}
+
+// workloadAnnotationProblem returns the problem with an annotation that may be set on pods and on their workloads,
+// or an empty string if it is valid.
+func workloadAnnotationProblem(key, value string) string {
+	switch key {
+	case annotationDeletePolicy:
+		if _, err := parseDeletePolicy(value); err != nil {
+			return fmt.Sprintf("invalid %s annotation: %s", key, err)
+		}
+	case annotationStrategy:
+		if _, err := parseStrategy(value); err != nil {
+			return fmt.Sprintf("invalid %s annotation: %s", key, err)
+		}
+	case annotationPaused:
+		if value != "true" && value != "false" {
+			return fmt.Sprintf("invalid %s annotation: %q is neither true nor false", key, value)
+		}
+	}
+	return ""
+}
+
+// podTemplateMeta returns the metadata of the admitted pod, or of the pods created from the admitted workload along
+// with the metadata of the workload itself. The workload metadata is nil for pods. False is returned for objects that
+// are not checked: deletions, other kinds and pods created by a controller.
+func podTemplateMeta(req *admissionv1.AdmissionRequest) (workload, template *metav1.ObjectMeta, ok bool, err error) {
+	if req.Operation == admissionv1.Delete {
+		return nil, nil, false, nil
+	}
+
+	decode := func(obj any) error {
+		if err := json.Unmarshal(req.Object.Raw, obj); err != nil {
+			return fmt.Errorf("failed to decode %s: %w", req.Kind.Kind, err)
+		}
+		return nil
+	}
+
+	switch req.Kind.Kind {
+	case "Pod":
+		pod := new(corev1.Pod)
+		if err := decode(pod); err != nil {
+			return nil, nil, false, err
+		} else if metav1.GetControllerOf(pod) != nil {
+			return nil, nil, false, nil
+		}
+		return nil, &pod.ObjectMeta, true, nil
+	case "Deployment":
+		deployment := new(appsv1.Deployment)
+		if err := decode(deployment); err != nil {
+			return nil, nil, false, err
+		}
+		return &deployment.ObjectMeta, &deployment.Spec.Template.ObjectMeta, true, nil
+	case "StatefulSet":
+		statefulSet := new(appsv1.StatefulSet)
+		if err := decode(statefulSet); err != nil {
+			return nil, nil, false, err
+		}
+		return &statefulSet.ObjectMeta, &statefulSet.Spec.Template.ObjectMeta, true, nil
+	case "DaemonSet":
+		daemonSet := new(appsv1.DaemonSet)
+		if err := decode(daemonSet); err != nil {
+			return nil, nil, false, err
+		}
+		return &daemonSet.ObjectMeta, &daemonSet.Spec.Template.ObjectMeta, true, nil
+	case "ReplicaSet":
+		replicaSet := new(appsv1.ReplicaSet)
+		if err := decode(replicaSet); err != nil {
+			return nil, nil, false, err
+		} else if metav1.GetControllerOf(replicaSet) != nil {
+			return nil, nil, false, nil
+		}
+		return &replicaSet.ObjectMeta, &replicaSet.Spec.Template.ObjectMeta, true, nil
+	case "Job":
+		job := new(batchv1.Job)
+		if err := decode(job); err != nil {
+			return nil, nil, false, err
+		} else if metav1.GetControllerOf(job) != nil {
+			return nil, nil, false, nil
+		}
+		return &job.ObjectMeta, &job.Spec.Template.ObjectMeta, true, nil
+	case "CronJob":
+		cronJob := new(batchv1.CronJob)
+		if err := decode(cronJob); err != nil {
+			return nil, nil, false, err
+		}
+		return &cronJob.ObjectMeta, &cronJob.Spec.JobTemplate.Spec.Template.ObjectMeta, true, nil
+	default:
+		return nil, nil, false, nil
+	}
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	admissionv1 "k8s.io/api/admission/v1"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	listersv1 "k8s.io/client-go/listers/core/v1"
+	kubecache "k8s.io/client-go/tools/cache"
+)
+
+func Test_LabelProblems(t *testing.T) {
+	t.Parallel()
+
+	s := testableAdmissionServer(t, enforcementDeny,
+		&corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "default"}},
+		&corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: "db", Namespace: "default"}},
+	)
+	s.reloader.customTriggers = []*customTrigger{testableCustomTrigger(t)}
+
+	tests := []struct {
+		name     string
+		meta     *metav1.ObjectMeta
+		problems []string
+	}{
+		{
+			name: "valid",
+			meta: &metav1.ObjectMeta{
+				Labels: map[string]string{
+					"app":                     "api",
+					labelAuto:                 "true",
+					"reloader/configmap":      "app",
+					"reloader/secret":         "db",
+					"reloader/externalsecret": "db",
+				},
+				Annotations: map[string]string{
+					annotationReloadURL:     "http://:8080/-/reload",
+					annotationReloadTimeout: "3s",
+					annotationReloadRetries: "2",
+					annotationPaused:        "false",
+					annotationContentHashes: `{"configmap/app": "abc"}`,
+					annotationVaultPath:     "secret/data/app, kv/data/db",
+					annotationDeletePolicy:  "scale-down",
+					annotationStrategy:      "delete,batch-size=2,grace-period=10s",
+				},
+			},
+			problems: []string{},
+		},
+		{
+			name: "missing objects",
+			meta: &metav1.ObjectMeta{
+				Labels: map[string]string{
+					"reloader/configmap": "flags",
+					"reloader/secret":    "Not_A_Name",
+				},
+			},
+			problems: []string{
+				"label reloader/configmap names ConfigMap flags, which does not exist in namespace default",
+				`label reloader/secret: "Not_A_Name" is not a valid Secret name: a lowercase RFC 1123 subdomain must ` +
+					`consist of lower case alphanumeric characters, '-' or '.', and must start and end with an ` +
+					`alphanumeric character (e.g. 'example.com', regex used for validation is ` +
+					`'[a-z0-9]([-a-z0-9]*[a-z0-9])?(\.[a-z0-9]([-a-z0-9]*[a-z0-9])?)*')`,
+			},
+		},
+		{
+			name: "unknown keys",
+			meta: &metav1.ObjectMeta{
+				Labels:      map[string]string{"reloader/confgmap": "app"},
+				Annotations: map[string]string{"reloader/pause": "true"},
+			},
+			problems: []string{
+				"unknown label reloader/confgmap",
+				"unknown annotation reloader/pause",
+			},
+		},
+		{
+			name: "invalid annotations",
+			meta: &metav1.ObjectMeta{
+				Annotations: map[string]string{
+					annotationReloadURL:     "grpc://:8080",
+					annotationReloadTimeout: "soon",
+					annotationReloadRetries: "-1",
+					annotationPaused:        "yes",
+					annotationVaultPath:     "secret/data/app,secret/app",
+					annotationDeletePolicy:  "kill",
+					annotationStrategy:      "rollout,batch-size=2",
+				},
+			},
+			problems: []string{
+				`invalid reloader/delete-policy annotation: invalid delete policy: "kill"`,
+				"invalid reloader/paused annotation: \"yes\" is neither true nor false",
+				"invalid reloader/reload-retries annotation: retries must not be negative",
+				`invalid reloader/reload-timeout annotation: time: invalid duration "soon"`,
+				"invalid reloader/reload-url annotation: reload endpoint must be an http or https URL",
+				`invalid reloader/strategy annotation: invalid restart strategy: "rollout,batch-size=2": rollout takes no options`,
+				`invalid reloader/vault-path annotation: vault path must be a KV v2 data path, such as secret/data/app: "secret/app"`,
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			problems, warnings, err := s.labelProblems(context.Background(), "default", tt.meta)
+			require.NoError(t, err)
+			require.Equal(t, tt.problems, problems)
+			require.Empty(t, warnings)
+		})
+	}
+}
+
+func Test_LabelProblemsUnwatched(t *testing.T) {
+	t.Parallel()
+
+	s := testableAdmissionServer(t, enforcementDeny,
+		&corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "default"}},
+	)
+
+	// The ConfigMap is filtered out of the informer caches.
+	s.configMapLister = listersv1.NewConfigMapLister(kubecache.NewIndexer(kubecache.MetaNamespaceKeyFunc, kubecache.Indexers{}))
+
+	pod := &corev1.Pod{
+		TypeMeta: metav1.TypeMeta{APIVersion: "v1", Kind: "Pod"},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "api",
+			Namespace: "default",
+			Labels:    map[string]string{"reloader/configmap": "app"},
+		},
+	}
+	raw, err := json.Marshal(pod)
+	require.NoError(t, err)
+
+	resp := s.reviewLabels(&admissionv1.AdmissionRequest{
+		Kind:      metav1.GroupVersionKind{Version: "v1", Kind: "Pod"},
+		Namespace: "default",
+		Operation: admissionv1.Create,
+		Object:    runtime.RawExtension{Raw: raw},
+	})
+	require.True(t, resp.Allowed)
+	require.Equal(t, []string{
+		"reloader: label reloader/configmap names ConfigMap app, which is not watched by reloader (filtered or not enabled)",
+	}, resp.Warnings)
+}
+
+func Test_ReviewLabelsWorkload(t *testing.T) {
+	t.Parallel()
+
+	s := testableAdmissionServer(t, enforcementDeny)
+
+	deployment := &appsv1.Deployment{
+		TypeMeta: metav1.TypeMeta{APIVersion: "apps/v1", Kind: "Deployment"},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "api",
+			Namespace: "default",
+			Annotations: map[string]string{
+				annotationStrategy:     "rollout,batch-size=2",
+				annotationDeletePolicy: "kill",
+				annotationPaused:       "yes",
+				annotationReloadURL:    "grpc://:8080",
+			},
+		},
+	}
+	raw, err := json.Marshal(deployment)
+	require.NoError(t, err)
+
+	resp := s.reviewLabels(&admissionv1.AdmissionRequest{
+		Kind:      metav1.GroupVersionKind{Group: "apps", Version: "v1", Kind: "Deployment"},
+		Namespace: "default",
+		Operation: admissionv1.Create,
+		Object:    runtime.RawExtension{Raw: raw},
+	})
+	require.False(t, resp.Allowed)
+	require.Equal(t, "reloader: "+
+		`workload invalid reloader/delete-policy annotation: invalid delete policy: "kill"; `+
+		`workload invalid reloader/paused annotation: "yes" is neither true nor false; `+
+		`workload invalid reloader/strategy annotation: invalid restart strategy: "rollout,batch-size=2": rollout takes no options`,
+		resp.Result.Message)
+}
+
+func Test_PodTemplateMeta(t *testing.T) {
+	t.Parallel()
+
+	labels := map[string]string{"reloader/configmap": "app"}
+	isController := true
+
+	deployment := &appsv1.Deployment{}
+	deployment.Spec.Template.Labels = labels
+
+	ownedPod := testableDependentPod(t, "api-1", "default", "ConfigMap", "app")
+	ownedPod.OwnerReferences = []metav1.OwnerReference{{Kind: "ReplicaSet", Name: "api", Controller: &isController}}
+
+	tests := []struct {
+		name      string
+		kind      string
+		operation admissionv1.Operation
+		object    any
+		checked   bool
+	}{
+		{
+			name:      "pod",
+			kind:      "Pod",
+			operation: admissionv1.Create,
+			object:    testableDependentPod(t, "api", "default", "ConfigMap", "app"),
+			checked:   true,
+		},
+		{
+			name:      "deployment",
+			kind:      "Deployment",
+			operation: admissionv1.Update,
+			object:    deployment,
+			checked:   true,
+		},
+		{
+			name:      "controlled pod",
+			kind:      "Pod",
+			operation: admissionv1.Create,
+			object:    ownedPod,
+		},
+		{
+			name:      "delete",
+			kind:      "Deployment",
+			operation: admissionv1.Delete,
+			object:    deployment,
+		},
+		{
+			name:      "other kind",
+			kind:      "Service",
+			operation: admissionv1.Create,
+			object:    &corev1.Service{},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			raw, err := json.Marshal(tt.object)
+			require.NoError(t, err)
+
+			_, meta, ok, err := podTemplateMeta(&admissionv1.AdmissionRequest{
+				Kind:      metav1.GroupVersionKind{Kind: tt.kind},
+				Operation: tt.operation,
+				Object:    runtime.RawExtension{Raw: raw},
+			})
+			require.NoError(t, err)
+			require.Equal(t, tt.checked, ok)
+			if tt.checked {
+				require.Equal(t, labels, meta.Labels)
+			}
+		})
+	}
+
+	t.Run("invalid object", func(t *testing.T) {
+		t.Parallel()
+
+		_, _, _, err := podTemplateMeta(&admissionv1.AdmissionRequest{
+			Kind:      metav1.GroupVersionKind{Kind: "Pod"},
+			Operation: admissionv1.Create,
+			Object:    runtime.RawExtension{Raw: []byte("{")},
+		})
+		require.Error(t, err)
+	})
+}
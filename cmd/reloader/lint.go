@@ -0,0 +1,408 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	kubeerrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/kubernetes"
+	listersv1 "k8s.io/client-go/listers/core/v1"
+
+	"github.com/jacobbrewer1/web/logging"
+)
+
+const (
+	// lintMissingObject reports a reloader label naming an object that does not exist.
+	lintMissingObject = "missing-object"
+
+	// lintUnwatchedObject reports a reloader label naming an object that reloader does not watch, as it is filtered
+	// out or its kind is not enabled, so that its changes do not restart the pod.
+	lintUnwatchedObject = "unwatched-object"
+
+	// lintUnlabelledReference reports an object used by a pod without a reloader label naming it.
+	lintUnlabelledReference = "unlabelled-reference"
+
+	// lintUnreferencedLabel reports a reloader label naming an object the pod does not use.
+	lintUnreferencedLabel = "unreferenced-label"
+
+	// lintStaleContent reports a pod admitted with content hashes that no longer match its ConfigMaps and Secrets,
+	// so that it may still run with the content it started with.
+	lintStaleContent = "stale-content"
+
+	// lintBarePod reports a labelled pod without a controller, which would not come back once restarted.
+	lintBarePod = "bare-pod"
+)
+
+const (
+	// objectWatched is an object in the informer caches.
+	objectWatched objectPresence = iota
+
+	// objectUnwatched is an object that exists but is not in the informer caches, as it is filtered out or its kind
+	// is not watched by reloader.
+	objectUnwatched
+
+	// objectMissing is an object that does not exist.
+	objectMissing
+)
+
+// errLintFindings is returned by the lint command when problems are found.
+var errLintFindings = errors.New("lint found problems")
+
+type (
+	// objectPresence is whether a ConfigMap or Secret exists and is watched by reloader.
+	objectPresence int
+
+	// lintFinding is a labelling problem found by the linter.
+	lintFinding struct {
+		// Check is the check that found the problem.
+		Check string `json:"check"`
+
+		// Namespace is the namespace of the pods.
+		Namespace string `json:"namespace"`
+
+		// Owner is the controller of the pods, such as "ReplicaSet/api-5d8f", or the pod itself for bare pods.
+		Owner string `json:"owner"`
+
+		// Object is the key of the object concerned, if any.
+		Object string `json:"object,omitempty"`
+
+		// Message describes the problem.
+		Message string `json:"message"`
+	}
+
+	// linter audits the reloader labels of pods against what they actually use.
+	linter struct {
+		// kubeClient is used to look up the objects missing from the listers.
+		kubeClient kubernetes.Interface
+
+		// podLister is used to list pods.
+		podLister listersv1.PodLister
+
+		// configMapLister is used to check that labelled ConfigMaps exist.
+		configMapLister listersv1.ConfigMapLister
+
+		// secretLister is used to check that labelled Secrets exist.
+		secretLister listersv1.SecretLister
+	}
+)
+
+// newLinter creates a new linter.
+func newLinter(
+	kubeClient kubernetes.Interface,
+	podLister listersv1.PodLister,
+	configMapLister listersv1.ConfigMapLister,
+	secretLister listersv1.SecretLister,
+) *linter {
+	return &linter{
+		kubeClient:      kubeClient,
+		podLister:       podLister,
+		configMapLister: configMapLister,
+		secretLister:    secretLister,
+	}
+}
+
+// lint audits the pods of the given namespace, or of all namespaces if empty. Pods sharing a controller share their
+// findings, so each problem is reported once per workload.
+func (l *linter) lint(ctx context.Context, namespace string) ([]*lintFinding, error) {
+	list := l.podLister.List
+	if namespace != "" {
+		list = l.podLister.Pods(namespace).List
+	}
+
+	pods, err := list(labels.Everything())
+	if err != nil {
+		return nil, fmt.Errorf("failed to list pods: %w", err)
+	}
+
+	seen := make(map[lintFinding]bool)
+	findings := make([]*lintFinding, 0)
+	for _, pod := range pods {
+		podFindings, err := l.lintPod(ctx, pod)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, finding := range podFindings {
+			if seen[*finding] {
+				continue
+			}
+			seen[*finding] = true
+			findings = append(findings, finding)
+		}
+	}
+
+	sort.Slice(findings, func(i, j int) bool {
+		a, b := findings[i], findings[j]
+		if a.Namespace != b.Namespace {
+			return a.Namespace < b.Namespace
+		} else if a.Owner != b.Owner {
+			return a.Owner < b.Owner
+		} else if a.Check != b.Check {
+			return a.Check < b.Check
+		}
+		return a.Object < b.Object
+	})
+	return findings, nil
+}
+
+// lintPod audits a single pod.
+func (l *linter) lintPod(ctx context.Context, pod *corev1.Pod) ([]*lintFinding, error) {
+	owner := "Pod/" + pod.Name
+	controller := metav1.GetControllerOf(pod)
+	if controller != nil {
+		owner = controller.Kind + "/" + controller.Name
+	}
+
+	newFinding := func(check, kind, name, message string) *lintFinding {
+		finding := &lintFinding{
+			Check:     check,
+			Namespace: pod.Namespace,
+			Owner:     owner,
+			Message:   message,
+		}
+		if kind != "" {
+			finding.Object = objectKey(strings.ToLower(kind), pod.Namespace, name)
+		}
+		return finding
+	}
+
+	labelled := make(map[podReference]bool)
+	used := make(map[podReference]bool)
+	for _, ref := range podReferences(pod) {
+		key := podReference{kind: ref.kind, name: ref.name}
+		if ref.edge == edgeLabel {
+			labelled[key] = true
+		} else {
+			used[key] = true
+		}
+	}
+
+	findings := make([]*lintFinding, 0)
+	if len(labelled) > 0 && controller == nil {
+		findings = append(findings, newFinding(lintBarePod, "", "",
+			"pod has reloader labels but no controller, so it would not come back once restarted"))
+	}
+
+	for ref := range labelled {
+		presence, err := lookupObject(ctx, l.kubeClient, l.configMapLister, l.secretLister,
+			ref.kind, pod.Namespace, ref.name)
+		if err != nil {
+			return nil, err
+		}
+
+		label := dependencyLabel(ref.kind)
+		switch {
+		case presence == objectMissing:
+			findings = append(findings, newFinding(lintMissingObject, ref.kind, ref.name,
+				fmt.Sprintf("label %s names %s %s, which does not exist", label, ref.kind, ref.name)))
+		case presence == objectUnwatched:
+			findings = append(findings, newFinding(lintUnwatchedObject, ref.kind, ref.name,
+				fmt.Sprintf("label %s names %s %s, which is not watched by reloader (filtered or not enabled)",
+					label, ref.kind, ref.name)))
+		case !used[ref]:
+			findings = append(findings, newFinding(lintUnreferencedLabel, ref.kind, ref.name,
+				fmt.Sprintf("label %s names %s %s, which the pod does not use", label, ref.kind, ref.name)))
+		}
+	}
+
+	stale, err := l.staleContent(pod)
+	if err != nil {
+		return nil, err
+	}
+	for _, ref := range stale {
+		findings = append(findings, newFinding(lintStaleContent, ref.kind, ref.name,
+			fmt.Sprintf("%s %s changed since the pod was admitted, so the pod may run with stale content",
+				ref.kind, ref.name)))
+	}
+
+	for ref := range used {
+		if labelled[ref] {
+			continue
+		}
+		findings = append(findings, newFinding(lintUnlabelledReference, ref.kind, ref.name,
+			fmt.Sprintf("%s %s is used by the pod but not named by the %s label, so its changes do not restart it",
+				ref.kind, ref.name, dependencyLabel(ref.kind))))
+	}
+
+	return findings, nil
+}
+
+// staleContent returns the objects whose content hash recorded on the pod at admission differs from their current
+// one. Pods reloaded in place keep the hashes they were admitted with, so they are not checked, and neither are the
+// objects that are no longer watched.
+func (l *linter) staleContent(pod *corev1.Pod) ([]podReference, error) {
+	value, ok := pod.Annotations[annotationContentHashes]
+	if !ok || pod.Annotations[annotationReloadURL] != "" {
+		return nil, nil
+	}
+
+	hashes := make(map[string]string)
+	if err := json.Unmarshal([]byte(value), &hashes); err != nil {
+		// A malformed annotation is reported by the admission webhook.
+		return nil, nil
+	}
+
+	stale := make([]podReference, 0)
+	for _, key := range sortedKeys(hashes) {
+		lowerKind, name, ok := strings.Cut(key, "/")
+		if !ok {
+			continue
+		}
+		kind, err := apiKind(lowerKind)
+		if err != nil {
+			continue
+		}
+
+		hash, ok, err := contentHash(l.configMapLister, l.secretLister, kind, pod.Namespace, name)
+		if err != nil {
+			return nil, err
+		} else if ok && hash != hashes[key] {
+			stale = append(stale, podReference{kind: kind, name: name})
+		}
+	}
+	return stale, nil
+}
+
+// contentHash returns the content hash of the given ConfigMap or Secret in the informer caches, or false if it is
+// not there.
+func contentHash(
+	configMapLister listersv1.ConfigMapLister,
+	secretLister listersv1.SecretLister,
+	kind, namespace, name string,
+) (string, bool, error) {
+	var (
+		hash string
+		err  error
+	)
+	switch kind {
+	case "ConfigMap":
+		var configMap *corev1.ConfigMap
+		if configMap, err = configMapLister.ConfigMaps(namespace).Get(name); err == nil {
+			hash = configMapHash(configMap)
+		}
+	case "Secret":
+		var secret *corev1.Secret
+		if secret, err = secretLister.Secrets(namespace).Get(name); err == nil {
+			hash = secretHash(secret)
+		}
+	}
+	if kubeerrors.IsNotFound(err) {
+		return "", false, nil
+	} else if err != nil {
+		return "", false, fmt.Errorf("failed to get %s %s/%s: %w", kind, namespace, name, err)
+	}
+	return hash, true, nil
+}
+
+// objectExists reports whether the given ConfigMap or Secret exists in the informer caches.
+func objectExists(
+	configMapLister listersv1.ConfigMapLister,
+	secretLister listersv1.SecretLister,
+	kind, namespace, name string,
+) (bool, error) {
+	var err error
+	switch kind {
+	case "ConfigMap":
+		_, err = configMapLister.ConfigMaps(namespace).Get(name)
+	case "Secret":
+		_, err = secretLister.Secrets(namespace).Get(name)
+	}
+	if kubeerrors.IsNotFound(err) {
+		return false, nil
+	} else if err != nil {
+		return false, fmt.Errorf("failed to get %s %s/%s: %w", kind, namespace, name, err)
+	}
+	return true, nil
+}
+
+// lookupObject reports whether the given ConfigMap or Secret exists and is watched. The informer caches only hold the
+// objects reloader watches, so objects missing from them are looked up through the API before being reported missing.
+func lookupObject(
+	ctx context.Context,
+	kubeClient kubernetes.Interface,
+	configMapLister listersv1.ConfigMapLister,
+	secretLister listersv1.SecretLister,
+	kind, namespace, name string,
+) (objectPresence, error) {
+	exists, err := objectExists(configMapLister, secretLister, kind, namespace, name)
+	if err != nil {
+		return objectMissing, err
+	} else if exists {
+		return objectWatched, nil
+	}
+
+	switch kind {
+	case "ConfigMap":
+		_, err = kubeClient.CoreV1().ConfigMaps(namespace).Get(ctx, name, metav1.GetOptions{})
+	case "Secret":
+		_, err = kubeClient.CoreV1().Secrets(namespace).Get(ctx, name, metav1.GetOptions{})
+	}
+	if kubeerrors.IsNotFound(err) {
+		return objectMissing, nil
+	} else if err != nil {
+		return objectMissing, fmt.Errorf("failed to get %s %s/%s: %w", kind, namespace, name, err)
+	}
+	return objectUnwatched, nil
+}
+
+// writeLintFindings writes the findings as a human readable table.
+func writeLintFindings(w io.Writer, findings []*lintFinding) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	if len(findings) == 0 {
+		fmt.Fprintln(tw, "No problems found.")
+	} else {
+		fmt.Fprintln(tw, "NAMESPACE\tOWNER\tCHECK\tMESSAGE")
+		for _, finding := range findings {
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", finding.Namespace, finding.Owner, finding.Check, finding.Message)
+		}
+	}
+
+	if err := tw.Flush(); err != nil {
+		return fmt.Errorf("failed to write findings: %w", err)
+	}
+	return nil
+}
+
+// reportLintFindings exports the number of findings by check and namespace. The gauges are reset first, so that
+// fixed problems stop being reported.
+func reportLintFindings(findings []*lintFinding) {
+	lintFindings.Reset()
+	for _, finding := range findings {
+		lintFindings.WithLabelValues(finding.Check, finding.Namespace).Inc()
+	}
+}
+
+// watchLint periodically audits the labels of every pod and exports the findings as metrics.
+func (a *App) watchLint(ctx context.Context) {
+	l := logging.LoggerWithComponent(a.base.Logger(), "lint")
+
+	ticker := time.NewTicker(a.config.LintInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			findings, err := a.linter.lint(ctx, "")
+			if err != nil {
+				l.Error("failed to lint pods", slog.String(logging.KeyError, err.Error()))
+				continue
+			}
+
+			reportLintFindings(findings)
+			l.Debug("lint finished", slog.Int(logKeyFindings, len(findings)))
+		}
+	}
+}
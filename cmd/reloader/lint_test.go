@@ -0,0 +1,211 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes/fake"
+	listersv1 "k8s.io/client-go/listers/core/v1"
+	kubecache "k8s.io/client-go/tools/cache"
+)
+
+func testableLintPod(t *testing.T, name, controller string, labels map[string]string, configMaps ...string) *corev1.Pod {
+	t.Helper()
+
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: "default",
+			Labels:    labels,
+		},
+	}
+	if controller != "" {
+		isController := true
+		pod.OwnerReferences = []metav1.OwnerReference{{
+			Kind:       "ReplicaSet",
+			Name:       controller,
+			UID:        types.UID("uid-" + controller),
+			Controller: &isController,
+		}}
+	}
+	for _, configMap := range configMaps {
+		pod.Spec.Volumes = append(pod.Spec.Volumes, corev1.Volume{
+			Name: configMap,
+			VolumeSource: corev1.VolumeSource{
+				ConfigMap: &corev1.ConfigMapVolumeSource{LocalObjectReference: corev1.LocalObjectReference{Name: configMap}},
+			},
+		})
+	}
+	return pod
+}
+
+func testableLinter(t *testing.T, objects ...*corev1.Pod) *linter {
+	t.Helper()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	kubeClient := fake.NewClientset(
+		&corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "default"}},
+		&corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Name: "flags", Namespace: "default"}},
+	)
+	for _, pod := range objects {
+		_, err := kubeClient.CoreV1().Pods(pod.Namespace).Create(ctx, pod, metav1.CreateOptions{})
+		require.NoError(t, err)
+	}
+
+	informerFactory := informers.NewSharedInformerFactory(kubeClient, 0)
+	lint := newLinter(
+		kubeClient,
+		informerFactory.Core().V1().Pods().Lister(),
+		informerFactory.Core().V1().ConfigMaps().Lister(),
+		informerFactory.Core().V1().Secrets().Lister(),
+	)
+	informerFactory.Start(ctx.Done())
+	informerFactory.WaitForCacheSync(ctx.Done())
+
+	return lint
+}
+
+func Test_Linter(t *testing.T) {
+	t.Parallel()
+
+	t.Run("clean", func(t *testing.T) {
+		t.Parallel()
+
+		lint := testableLinter(t,
+			testableLintPod(t, "api-a", "api", map[string]string{"reloader/configmap": "app"}, "app"),
+			testableLintPod(t, "unrelated", "", nil),
+		)
+
+		findings, err := lint.lint(context.Background(), "")
+		require.NoError(t, err)
+		require.Empty(t, findings)
+	})
+
+	t.Run("problems", func(t *testing.T) {
+		t.Parallel()
+
+		lint := testableLinter(t,
+			testableLintPod(t, "api-a", "api", map[string]string{"reloader/configmap": "app"}, "flags"),
+			testableLintPod(t, "api-b", "api", map[string]string{"reloader/configmap": "app"}, "flags"),
+			testableLintPod(t, "typo", "web", map[string]string{"reloader/secret": "tsl"}),
+			testableLintPod(t, "bare", "", map[string]string{"reloader/configmap": "app"}, "app"),
+		)
+
+		findings, err := lint.lint(context.Background(), "default")
+		require.NoError(t, err)
+		require.Equal(t, []*lintFinding{
+			{
+				Check:     lintBarePod,
+				Namespace: "default",
+				Owner:     "Pod/bare",
+				Message:   "pod has reloader labels but no controller, so it would not come back once restarted",
+			},
+			{
+				Check:     lintUnlabelledReference,
+				Namespace: "default",
+				Owner:     "ReplicaSet/api",
+				Object:    "default/configmap/flags",
+				Message:   "ConfigMap flags is used by the pod but not named by the reloader/configmap label, so its changes do not restart it",
+			},
+			{
+				Check:     lintUnreferencedLabel,
+				Namespace: "default",
+				Owner:     "ReplicaSet/api",
+				Object:    "default/configmap/app",
+				Message:   "label reloader/configmap names ConfigMap app, which the pod does not use",
+			},
+			{
+				Check:     lintMissingObject,
+				Namespace: "default",
+				Owner:     "ReplicaSet/web",
+				Object:    "default/secret/tsl",
+				Message:   "label reloader/secret names Secret tsl, which does not exist",
+			},
+		}, findings)
+
+		buf := new(bytes.Buffer)
+		require.NoError(t, writeLintFindings(buf, findings))
+		require.Contains(t, buf.String(), "default    ReplicaSet/web  missing-object")
+	})
+
+	t.Run("stale content", func(t *testing.T) {
+		t.Parallel()
+
+		current := configMapHash(&corev1.ConfigMap{})
+		stale := testableLintPod(t, "api-a", "api", map[string]string{"reloader/configmap": "app"}, "app", "flags")
+		stale.Annotations = map[string]string{
+			annotationContentHashes: `{"configmap/app": "outdated", "configmap/flags": "` + current + `"}`,
+		}
+		inPlace := testableLintPod(t, "web-a", "web", map[string]string{"reloader/configmap": "app"}, "app")
+		inPlace.Annotations = map[string]string{
+			annotationContentHashes: `{"configmap/app": "outdated"}`,
+			annotationReloadURL:     "http://:8080/-/reload",
+		}
+
+		lint := testableLinter(t, stale, inPlace)
+
+		findings, err := lint.lint(context.Background(), "default")
+		require.NoError(t, err)
+		require.Equal(t, []*lintFinding{
+			{
+				Check:     lintStaleContent,
+				Namespace: "default",
+				Owner:     "ReplicaSet/api",
+				Object:    "default/configmap/app",
+				Message:   "ConfigMap app changed since the pod was admitted, so the pod may run with stale content",
+			},
+			{
+				Check:     lintUnlabelledReference,
+				Namespace: "default",
+				Owner:     "ReplicaSet/api",
+				Object:    "default/configmap/flags",
+				Message:   "ConfigMap flags is used by the pod but not named by the reloader/configmap label, so its changes do not restart it",
+			},
+		}, findings)
+	})
+
+	t.Run("unwatched", func(t *testing.T) {
+		t.Parallel()
+
+		lint := testableLinter(t, testableLintPod(t, "api-a", "api", map[string]string{"reloader/configmap": "app"}, "app"))
+
+		// The ConfigMap is filtered out of the informer caches.
+		lint.configMapLister = listersv1.NewConfigMapLister(kubecache.NewIndexer(kubecache.MetaNamespaceKeyFunc, kubecache.Indexers{}))
+
+		findings, err := lint.lint(context.Background(), "default")
+		require.NoError(t, err)
+		require.Equal(t, []*lintFinding{{
+			Check:     lintUnwatchedObject,
+			Namespace: "default",
+			Owner:     "ReplicaSet/api",
+			Object:    "default/configmap/app",
+			Message:   "label reloader/configmap names ConfigMap app, which is not watched by reloader (filtered or not enabled)",
+		}}, findings)
+	})
+
+	t.Run("other namespace", func(t *testing.T) {
+		t.Parallel()
+
+		lint := testableLinter(t, testableLintPod(t, "typo", "web", map[string]string{"reloader/secret": "tsl"}))
+
+		findings, err := lint.lint(context.Background(), "team-b")
+		require.NoError(t, err)
+		require.Empty(t, findings)
+	})
+}
+
+func Test_WriteLintFindingsEmpty(t *testing.T) {
+	t.Parallel()
+
+	buf := new(bytes.Buffer)
+	require.NoError(t, writeLintFindings(buf, nil))
+	require.Equal(t, "No problems found.\n", buf.String())
+}
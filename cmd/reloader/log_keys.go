@@ -0,0 +1,42 @@
+package main
+
+const (
+	// logKeyNamespace represents the key for a Kubernetes namespace.
+	logKeyNamespace = `namespace`
+
+	// logKeyObject represents the key for the object that triggered a reload.
+	logKeyObject = `object`
+
+	// logKeyKey represents the key for a data key of a ConfigMap or Secret.
+	logKeyKey = `key`
+
+	// logKeyPod represents the key for a pod name.
+	logKeyPod = `pod`
+
+	// logKeyPods represents the key for a number of pods.
+	logKeyPods = `pods`
+
+	// logKeyAction represents the key for the action taken on a reload.
+	logKeyAction = `action`
+
+	// logKeyPaused represents the key for a pause state.
+	logKeyPaused = `paused`
+
+	// logKeyFindings represents the key for a number of lint findings.
+	logKeyFindings = `findings`
+
+	// logKeyKind represents the key for a Kubernetes API kind.
+	logKeyKind = `kind`
+
+	// logKeyWebhook represents the key for the name of an admission webhook.
+	logKeyWebhook = `webhook`
+
+	// logKeyWorkload represents the key for a workload, such as "Deployment/api".
+	logKeyWorkload = `workload`
+
+	// logKeyVaultPath represents the key for the path of a Vault secret.
+	logKeyVaultPath = `vault_path`
+
+	// logKeyVersion represents the key for the version of a Vault secret.
+	logKeyVersion = `version`
+)
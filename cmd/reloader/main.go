@@ -1,13 +1,23 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"log/slog"
+	"os"
+	"time"
 
 	"github.com/caarlos0/env/v10"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/dynamic/dynamicinformer"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/metadata"
+	"k8s.io/client-go/rest"
 
 	"github.com/jacobbrewer1/web"
+	"github.com/jacobbrewer1/web/k8s"
 	"github.com/jacobbrewer1/web/logging"
+	"github.com/jacobbrewer1/workerpool"
 )
 
 const (
@@ -17,8 +27,165 @@ const (
 type (
 	// AppConfig is the configuration for the app.
 	AppConfig struct {
-		// KillOnDelete is the flag to kill the pods on dependent deletion.
+		// KillOnDelete makes restart, rather than ignore, the delete policy of ConfigMaps, Secrets, custom resources,
+		// workloads and pods without a delete policy annotation.
 		KillOnDelete bool `env:"KILL_ON_DELETE" envDefault:"false"`
+
+		// DeleteGracePeriod is how long the deletion of a ConfigMap or Secret is held before its delete policy is
+		// applied. An object recreated within it is handled as an update, restarting pods only if its content
+		// changed. Zero acts on deletions immediately.
+		DeleteGracePeriod time.Duration `env:"DELETE_GRACE_PERIOD" envDefault:"0"`
+
+		// PauseConfigMap is the name of the ConfigMap in the reloader namespace that pauses all reloads.
+		PauseConfigMap string `env:"PAUSE_CONFIG_MAP" envDefault:"reloader-pause"`
+
+		// PauseMode is the action taken on changes detected while paused, either "drop" or "defer".
+		PauseMode string `env:"PAUSE_MODE" envDefault:"drop"`
+
+		// PauseResyncInterval is how often the pause state is reported and deferred reloads are retried.
+		PauseResyncInterval time.Duration `env:"PAUSE_RESYNC_INTERVAL" envDefault:"30s"`
+
+		// RestartBudgetGlobal is the number of pods that may be restarted per minute cluster-wide. Zero is unlimited.
+		RestartBudgetGlobal int `env:"RESTART_BUDGET_GLOBAL" envDefault:"0"`
+
+		// RestartBudgetNamespace is the number of pods that may be restarted per minute in a namespace. Zero is unlimited.
+		RestartBudgetNamespace int `env:"RESTART_BUDGET_NAMESPACE" envDefault:"0"`
+
+		// RestartConcurrencyGlobal is the number of pods that may be deleted at once cluster-wide. Zero leaves the
+		// deletions bounded by the worker pool only, which runs one worker per CPU.
+		RestartConcurrencyGlobal int `env:"RESTART_CONCURRENCY_GLOBAL" envDefault:"0"`
+
+		// RestartConcurrencyNamespace is the number of pods that may be deleted at once in a namespace. Zero is unlimited.
+		RestartConcurrencyNamespace int `env:"RESTART_CONCURRENCY_NAMESPACE" envDefault:"0"`
+
+		// DefaultStrategy is the restart strategy of pods without a strategy annotation on them or their workload,
+		// either "delete" or "rollout", with the same options as the annotation.
+		DefaultStrategy string `env:"DEFAULT_STRATEGY" envDefault:"delete"`
+
+		// StrategyBatchTimeout is how long a batch of pods deleted by a strategy with a batch size is given to be
+		// replaced by ready pods before the rest of the restart is given up on.
+		StrategyBatchTimeout time.Duration `env:"STRATEGY_BATCH_TIMEOUT" envDefault:"5m"`
+
+		// BlastRadiusThreshold is the number of pods a single change may restart before the circuit breaker trips and
+		// requires confirmation. Zero disables the circuit breaker.
+		BlastRadiusThreshold int `env:"BLAST_RADIUS_THRESHOLD" envDefault:"0"`
+
+		// CircuitBreakerConfigMap is the name of the ConfigMap in the reloader namespace used to confirm reloads held by
+		// the circuit breaker.
+		CircuitBreakerConfigMap string `env:"CIRCUIT_BREAKER_CONFIG_MAP" envDefault:"reloader-circuit-breaker"`
+
+		// CircuitBreakerResyncInterval is how often confirmations in the circuit breaker ConfigMap are checked.
+		CircuitBreakerResyncInterval time.Duration `env:"CIRCUIT_BREAKER_RESYNC_INTERVAL" envDefault:"10s"`
+
+		// NotificationsConfig is the path of the JSON file configuring the reload activity webhooks. Empty disables
+		// notifications.
+		NotificationsConfig string `env:"NOTIFICATIONS_CONFIG" envDefault:""`
+
+		// NotificationsQueueSize is the number of notifications that may wait for delivery to a webhook before new ones
+		// for that webhook are dropped.
+		NotificationsQueueSize int `env:"NOTIFICATIONS_QUEUE_SIZE" envDefault:"1000"`
+
+		// NotificationsRetryBackoff is the delay before the first retry of a failed webhook notification.
+		NotificationsRetryBackoff time.Duration `env:"NOTIFICATIONS_RETRY_BACKOFF" envDefault:"1s"`
+
+		// HTTPReloadTimeout is the default timeout of a request to a pod reload endpoint.
+		HTTPReloadTimeout time.Duration `env:"HTTP_RELOAD_TIMEOUT" envDefault:"5s"`
+
+		// HTTPReloadRetries is the default number of times a failed request to a pod reload endpoint is retried before
+		// the pod is restarted instead.
+		HTTPReloadRetries int `env:"HTTP_RELOAD_RETRIES" envDefault:"5"`
+
+		// HTTPReloadRetryBackoff is the delay before the first retry of a failed request to a pod reload endpoint. It
+		// is doubled for every further retry, giving the kubelet time to update mounted volumes.
+		HTTPReloadRetryBackoff time.Duration `env:"HTTP_RELOAD_RETRY_BACKOFF" envDefault:"2s"`
+
+		// HTTPReloadConcurrency is the number of requests to pod reload endpoints that may be in flight at once.
+		HTTPReloadConcurrency int `env:"HTTP_RELOAD_CONCURRENCY" envDefault:"16"`
+
+		// AdminAddr is the address the admin API listens on. Empty disables the admin API.
+		AdminAddr string `env:"ADMIN_ADDR" envDefault:""`
+
+		// AdminTokenFile is the path of the file holding the bearer token required by the admin API.
+		AdminTokenFile string `env:"ADMIN_TOKEN_FILE" envDefault:""`
+
+		// FailedReloadsHistory is the number of failed reloads reported by the admin API.
+		FailedReloadsHistory int `env:"FAILED_RELOADS_HISTORY" envDefault:"100"`
+
+		// SecretFieldSelector restricts the Secrets watched and cached. The default leaves out Helm release storage and
+		// service account tokens, which change often and are never reload triggers.
+		SecretFieldSelector string `env:"SECRET_FIELD_SELECTOR" envDefault:"type!=helm.sh/release.v1,type!=kubernetes.io/service-account-token"`
+
+		// SecretLabelSelector restricts the Secrets watched and cached.
+		SecretLabelSelector string `env:"SECRET_LABEL_SELECTOR" envDefault:""`
+
+		// ConfigMapFieldSelector restricts the ConfigMaps watched and cached.
+		ConfigMapFieldSelector string `env:"CONFIG_MAP_FIELD_SELECTOR" envDefault:""`
+
+		// ConfigMapLabelSelector restricts the ConfigMaps watched and cached. The default leaves out the release storage
+		// of Helm's ConfigMap driver.
+		ConfigMapLabelSelector string `env:"CONFIG_MAP_LABEL_SELECTOR" envDefault:"owner!=helm"`
+
+		// CustomTriggersConfig is the path of the JSON file configuring the custom resources whose changes reload the
+		// pods referencing them. Empty disables custom triggers. Like ConfigMaps and Secrets, custom resources are
+		// subject to strict mode and the ignore annotation.
+		CustomTriggersConfig string `env:"CUSTOM_TRIGGERS_CONFIG" envDefault:""`
+
+		// VaultPollInterval is how often the versions of the Vault KV v2 secrets pods declare in their Vault path
+		// annotation are polled. Zero disables Vault polling.
+		VaultPollInterval time.Duration `env:"VAULT_POLL_INTERVAL" envDefault:"0"`
+
+		// VaultAddr is the address of the Vault server. Empty uses the in-cluster default.
+		VaultAddr string `env:"VAULT_ADDR" envDefault:""`
+
+		// ConfigFamilyRetention is the number of superseded members of a ConfigMap family kept for rollbacks once
+		// workloads are repointed to the newest member. Older members are deleted once no pod uses them when
+		// ConfigFamilyGC is set. A negative retention keeps every member.
+		ConfigFamilyRetention int `env:"CONFIG_FAMILY_RETENTION" envDefault:"2"`
+
+		// ConfigFamilyGC deletes the superseded members of ConfigMap families beyond ConfigFamilyRetention. It requires
+		// DiscoverReferences, so that the members pods use through their specs are kept.
+		ConfigFamilyGC bool `env:"CONFIG_FAMILY_GC" envDefault:"false"`
+
+		// StrictMode only lets ConfigMaps and Secrets labelled "reloader/enabled": "true" trigger reloads. Other objects
+		// are not cached, so the schema ConfigMaps of content validation must be labelled too.
+		StrictMode bool `env:"STRICT_MODE" envDefault:"false"`
+
+		// DiscoverReferences keeps pod specs in the cache, so that the dependency graph, lint and ReloadSpecReferences
+		// discover the ConfigMaps and Secrets pods use through volumes and environments. Without it only reloader
+		// labels are known, which saves memory on large clusters.
+		DiscoverReferences bool `env:"DISCOVER_REFERENCES" envDefault:"true"`
+
+		// ReloadSpecReferences also reloads pods that use an object through their volumes and environments without
+		// naming it in a reloader label. It requires DiscoverReferences.
+		ReloadSpecReferences bool `env:"RELOAD_SPEC_REFERENCES" envDefault:"false"`
+
+		// LintInterval is how often the labels of every pod are audited and the findings exported as metrics. Zero
+		// disables the periodic lint, which requires DiscoverReferences.
+		LintInterval time.Duration `env:"LINT_INTERVAL" envDefault:"0"`
+
+		// TLSCheckInterval is how often the certificates of the TLS Secrets pods depend on are checked. Their days to
+		// expiry are exported as metrics, and pods that started before the current certificate became valid are
+		// restarted. Zero disables the check.
+		TLSCheckInterval time.Duration `env:"TLS_CHECK_INTERVAL" envDefault:"0"`
+
+		// AdmissionAddr is the address the admission webhooks listen on over HTTPS. Empty disables the admission
+		// webhooks.
+		AdmissionAddr string `env:"ADMISSION_ADDR" envDefault:""`
+
+		// AdmissionTLSCertFile is the path of the PEM encoded certificate chain served by the admission webhooks. It is
+		// reloaded when the file changes.
+		AdmissionTLSCertFile string `env:"ADMISSION_TLS_CERT_FILE" envDefault:""`
+
+		// AdmissionTLSKeyFile is the path of the PEM encoded private key of the admission webhook certificate.
+		AdmissionTLSKeyFile string `env:"ADMISSION_TLS_KEY_FILE" envDefault:""`
+
+		// AdmissionEnforcement is how failed admission checks are enforced, either "deny" or "warn".
+		AdmissionEnforcement string `env:"ADMISSION_ENFORCEMENT" envDefault:"warn"`
+
+		// AdmissionReviewTimeout is the time allowed to label the dependencies of a pod or to work out the impact of an
+		// update before the object is admitted unchanged. It should be below the timeout of the webhook
+		// configurations, so that objects are not rejected.
+		AdmissionReviewTimeout time.Duration `env:"ADMISSION_REVIEW_TIMEOUT" envDefault:"2s"`
 	}
 
 	// App is the main application struct.
@@ -28,6 +195,57 @@ type (
 
 		// config is the application configuration.
 		config *AppConfig
+
+		// pause is the kill switch for reloads.
+		pause *pauser
+
+		// breaker holds reloads with a large blast radius until they are confirmed.
+		breaker *circuitBreaker
+
+		// killer restarts pods.
+		killer *podKiller
+
+		// webhooks are the configured reload activity webhooks.
+		webhooks []*webhook
+
+		// notifier sends reload activity to webhooks.
+		notifier *notifier
+
+		// adminToken is the bearer token required by the admin API.
+		adminToken string
+
+		// tracker keeps the reloads in progress and the recent failures.
+		tracker *reloadTracker
+
+		// reloader restarts the pods depending on changed objects.
+		reloader *reloader
+
+		// admin is the admin API.
+		admin *adminAPI
+
+		// linter audits the reloader labels of pods.
+		linter *linter
+
+		// secretSelectors restrict the Secrets watched and cached.
+		secretSelectors *objectSelectors
+
+		// configMapSelectors restrict the ConfigMaps watched and cached.
+		configMapSelectors *objectSelectors
+
+		// customTriggers are the custom resources whose changes reload the pods referencing them.
+		customTriggers []*customTrigger
+
+		// dynamicFactory is the informer factory of the custom trigger resources.
+		dynamicFactory dynamicinformer.DynamicSharedInformerFactory
+
+		// vault polls the versions of the Vault secrets pods depend on.
+		vault *vaultWatcher
+
+		// certificates serves the certificate of the admission webhooks.
+		certificates *certificateLoader
+
+		// admission serves the admission webhooks.
+		admission *admissionServer
 	}
 )
 
@@ -43,25 +261,295 @@ func NewApp(l *slog.Logger) (*App, error) {
 		return nil, fmt.Errorf("failed to parse env vars: %w", err)
 	}
 
+	if _, err := parsePauseMode(cfg.PauseMode); err != nil {
+		return nil, err
+	}
+
+	if _, err := parseStrategy(cfg.DefaultStrategy); err != nil {
+		return nil, err
+	}
+
+	if !cfg.DiscoverReferences {
+		if cfg.LintInterval > 0 {
+			return nil, fmt.Errorf("%w: required by LINT_INTERVAL", ErrDiscoveryDisabled)
+		} else if cfg.ReloadSpecReferences {
+			return nil, fmt.Errorf("%w: required by RELOAD_SPEC_REFERENCES", ErrDiscoveryDisabled)
+		} else if cfg.ConfigFamilyGC {
+			return nil, fmt.Errorf("%w: required by CONFIG_FAMILY_GC", ErrDiscoveryDisabled)
+		}
+	}
+
+	webhooks, err := loadWebhooks(cfg.NotificationsConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	adminToken, err := loadAdminToken(cfg.AdminAddr, cfg.AdminTokenFile)
+	if err != nil {
+		return nil, err
+	}
+
+	customTriggers, err := loadCustomTriggers(cfg.CustomTriggersConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	secretSelectors, err := newObjectSelectors(
+		cfg.SecretFieldSelector,
+		strictSelector(cfg.SecretLabelSelector, cfg.StrictMode),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	configMapSelectors, err := newObjectSelectors(
+		cfg.ConfigMapFieldSelector,
+		strictSelector(cfg.ConfigMapLabelSelector, cfg.StrictMode),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := parseEnforcementLevel(cfg.AdmissionEnforcement); err != nil {
+		return nil, err
+	}
+
+	var certificates *certificateLoader
+	if cfg.AdmissionAddr != "" {
+		certificates, err = newCertificateLoader(cfg.AdmissionTLSCertFile, cfg.AdmissionTLSKeyFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	return &App{
-		base:   base,
-		config: cfg,
+		base:               base,
+		config:             cfg,
+		webhooks:           webhooks,
+		adminToken:         adminToken,
+		tracker:            newReloadTracker(cfg.FailedReloadsHistory),
+		secretSelectors:    secretSelectors,
+		configMapSelectors: configMapSelectors,
+		customTriggers:     customTriggers,
+		certificates:       certificates,
 	}, nil
 }
 
 // Start starts the application.
 func (a *App) Start() error {
-	if err := a.base.Start(
+	// The informers share a factory, which takes its options from whichever informer is registered first.
+	transform := informers.WithTransform(cacheTransform(a.config.DiscoverReferences))
+
+	opts := []web.StartOption{
 		web.WithInClusterKubeClient(),
 		web.WithServiceEndpointHashBucket(appName),
-		web.WithKubernetesPodInformer(),
-		web.WithKubernetesConfigMapInformer(),
-		web.WithKubernetesSecretInformer(),
+		web.WithKubernetesPodInformer(transform),
+		withFilteredInformers(a.secretSelectors, a.configMapSelectors),
+		web.WithKubernetesConfigMapInformer(transform),
+		web.WithKubernetesSecretInformer(transform),
+		web.WithWorkerPool(),
+		web.WithDependencyBootstrap(a.startInformers),
 		web.WithIndefiniteAsyncTask("configmaps-reload", a.watchConfigMaps),
 		web.WithIndefiniteAsyncTask("secrets-reload", a.watchSecrets),
-	); err != nil {
+		web.WithIndefiniteAsyncTask("pause", a.watchPause),
+		web.WithIndefiniteAsyncTask("circuit-breaker", a.watchCircuitBreaker),
+		web.WithIndefiniteAsyncTask("notifications", a.watchNotifications),
+	}
+	if len(a.customTriggers) > 0 {
+		opts = append(opts, web.WithIndefiniteAsyncTask("custom-triggers-reload", a.watchCustomTriggers))
+	}
+	if a.config.VaultPollInterval > 0 {
+		opts = append(opts, web.WithIndefiniteAsyncTask("vault", a.watchVault))
+	}
+	if a.config.TLSCheckInterval > 0 {
+		opts = append(opts, web.WithIndefiniteAsyncTask("tls", a.watchCertificates))
+	}
+	if a.config.LintInterval > 0 {
+		opts = append(opts, web.WithIndefiniteAsyncTask("lint", a.watchLint))
+	}
+	if a.config.AdmissionAddr != "" {
+		// The admission webhooks are served over HTTPS, which the base app servers do not support.
+		opts = append(opts, web.WithIndefiniteAsyncTask("admission", a.serveAdmission))
+	}
+
+	if err := a.base.Start(opts...); err != nil {
 		return err
 	}
+
+	if a.config.AdminAddr != "" {
+		if err := a.base.StartServer("admin", a.admin.server(a.config.AdminAddr)); err != nil {
+			return fmt.Errorf("failed to start admin server: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// startInformers registers the informers owned by reloader, builds the components that read from them and starts
+// the informer factories.
+func (a *App) startInformers(ctx context.Context) error {
+	factory := a.base.KubernetesInformerFactory()
+
+	// The pause and circuit breaker ConfigMaps are read from their own informer, so that the selectors of the shared
+	// ConfigMap informer never hide them.
+	settings := informers.NewSharedInformerFactoryWithOptions(
+		a.base.KubeClient(),
+		0,
+		informers.WithNamespace(k8s.DeployedNamespace()),
+	)
+	settingsLister := settings.Core().V1().ConfigMaps().Lister()
+
+	mode, err := parsePauseMode(a.config.PauseMode)
+	if err != nil {
+		return err
+	}
+
+	defaultStrategy, err := parseStrategy(a.config.DefaultStrategy)
+	if err != nil {
+		return err
+	}
+
+	restConfig, err := rest.InClusterConfig()
+	if err != nil {
+		return fmt.Errorf("failed to get in-cluster config: %w", err)
+	}
+
+	metadataClient, err := metadata.NewForConfig(restConfig)
+	if err != nil {
+		return fmt.Errorf("failed to create metadata client: %w", err)
+	}
+
+	namespaceLister, err := newNamespaceLister(ctx, metadataClient)
+	if err != nil {
+		return err
+	}
+
+	dynamicClient, err := dynamic.NewForConfig(restConfig)
+	if err != nil {
+		return fmt.Errorf("failed to create dynamic client: %w", err)
+	}
+
+	a.dynamicFactory = dynamicinformer.NewDynamicSharedInformerFactory(dynamicClient, 0)
+	if err := registerCustomInformers(a.dynamicFactory, a.customTriggers); err != nil {
+		return err
+	}
+
+	a.pause = newPauser(
+		mode,
+		k8s.DeployedNamespace(),
+		a.config.PauseConfigMap,
+		a.base.KubeClient(),
+		settingsLister,
+		namespaceLister,
+	)
+
+	a.breaker = newCircuitBreaker(
+		a.config.BlastRadiusThreshold,
+		k8s.DeployedNamespace(),
+		a.config.CircuitBreakerConfigMap,
+		a.base.KubeClient(),
+		settingsLister,
+	)
+
+	a.notifier = newNotifier(
+		a.base.KubeClient(),
+		a.webhooks,
+		a.config.NotificationsQueueSize,
+		a.config.NotificationsRetryBackoff,
+	)
+
+	a.killer = newPodKiller(
+		a.base.KubeClient(),
+		newRestartLimiter(a.config.RestartBudgetGlobal, a.config.RestartBudgetNamespace),
+		a.base.WorkerPool(),
+		a.config.RestartConcurrencyGlobal,
+		a.config.RestartConcurrencyNamespace,
+	)
+
+	podIndexer, err := addDependencyIndex(a.base.PodInformer(), a.config.ReloadSpecReferences, a.customTriggers)
+	if err != nil {
+		return err
+	}
+
+	httpReloader := newHTTPReloader(
+		a.config.HTTPReloadTimeout,
+		a.config.HTTPReloadRetries,
+		a.config.HTTPReloadRetryBackoff,
+		workerpool.New(workerpool.WithTotalWorkers(a.config.HTTPReloadConcurrency)),
+	)
+
+	a.reloader = &reloader{
+		bucket:          a.base.ServiceEndpointHashBucket(),
+		kubeClient:      a.base.KubeClient(),
+		podLister:       a.base.PodLister(),
+		podIndexer:      podIndexer,
+		configMapLister: a.base.ConfigMapLister(),
+		secretLister:    a.base.SecretLister(),
+		pause:           a.pause,
+		breaker:         a.breaker,
+		killer:          a.killer,
+		notifier:        a.notifier,
+		http:            httpReloader,
+		validator:       newContentValidator(a.base.KubeClient(), a.base.ConfigMapLister()),
+		tracker:         a.tracker,
+		tasks:           newRestartTasks(),
+		customTriggers:  a.customTriggers,
+		strict:          a.config.StrictMode,
+		namespaceLister: namespaceLister,
+		deletePolicy:    defaultDeletePolicy(a.config.KillOnDelete),
+		grace:           newDeleteGrace(a.config.DeleteGracePeriod),
+		defaultStrategy: defaultStrategy,
+		batchTimeout:    a.config.StrategyBatchTimeout,
+		familyRetention: a.config.ConfigFamilyRetention,
+		familyGC:        a.config.ConfigFamilyGC,
+	}
+
+	if a.config.VaultPollInterval > 0 {
+		vaultClient, err := newVaultClient(ctx, logging.LoggerWithComponent(a.base.Logger(), "vault"), a.config.VaultAddr)
+		if err != nil {
+			return err
+		}
+		a.vault = newVaultWatcher(vaultClient, a.reloader)
+	}
+
+	a.admin = newAdminAPI(
+		ctx,
+		logging.LoggerWithComponent(a.base.Logger(), "admin"),
+		a.adminToken,
+		k8s.DeployedNamespace(),
+		a.base.KubeClient(),
+		a.reloader,
+		newGraphBuilder(a.base.KubeClient(), a.base.PodLister(), a.base.ConfigMapLister(), a.base.SecretLister()),
+	)
+
+	a.linter = newLinter(a.base.KubeClient(), a.base.PodLister(), a.base.ConfigMapLister(), a.base.SecretLister())
+
+	enforcement, err := parseEnforcementLevel(a.config.AdmissionEnforcement)
+	if err != nil {
+		return err
+	}
+
+	a.admission = newAdmissionServer(
+		logging.LoggerWithComponent(a.base.Logger(), "admission"),
+		enforcement,
+		a.config.AdmissionReviewTimeout,
+		a.base.KubeClient(),
+		a.reloader,
+		a.base.ConfigMapLister(),
+		a.base.SecretLister(),
+	)
+
+	if err := startInformerFactories(ctx, factory, settings); err != nil {
+		return err
+	}
+
+	a.dynamicFactory.Start(ctx.Done())
+	for resource, synced := range a.dynamicFactory.WaitForCacheSync(ctx.Done()) {
+		if !synced {
+			return fmt.Errorf("failed to sync informer cache for %v", resource)
+		}
+	}
+
 	return nil
 }
 
@@ -73,23 +561,15 @@ func (a *App) WaitForEnd() {
 // Shutdown shuts down the application.
 func (a *App) Shutdown() {
 	a.base.Shutdown()
-}
-
-func main() {
-	l := logging.NewLogger(
-		logging.WithAppName(appName),
-	)
 
-	app, err := NewApp(l)
-	if err != nil {
-		l.Error("failed to create app", slog.String(logging.KeyError, err.Error()))
-		panic(err)
+	if a.reloader != nil {
+		a.reloader.http.stop()
 	}
+}
 
-	if err := app.Start(); err != nil {
-		l.Error("failed to start app", slog.String(logging.KeyError, err.Error()))
-		panic(err)
+func main() {
+	if err := execute(context.Background(), os.Args[1:], os.Stdout); err != nil {
+		fmt.Fprintln(os.Stderr, "error:", err)
+		os.Exit(1)
 	}
-
-	app.WaitForEnd()
 }
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	// pausedGlobal reports whether reloads are paused cluster-wide.
+	pausedGlobal = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "reloader_paused_global",
+		Help: "Whether reloads are paused cluster-wide (1) or not (0)",
+	})
+
+	// pausedNamespaces is the number of namespaces annotated as paused.
+	pausedNamespaces = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "reloader_paused_namespaces",
+		Help: "Number of namespaces with reloads paused",
+	})
+
+	// pausedPods is the number of pod restarts held back by a pause, by the action taken.
+	pausedPods = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "reloader_paused_pods_total",
+		Help: "Number of pod restarts held back by a pause",
+	}, []string{"action"})
+
+	// deferredPods is the number of pod restarts waiting for a pause to be lifted.
+	deferredPods = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "reloader_deferred_pods",
+		Help: "Number of pod restarts deferred until unpause",
+	})
+
+	// podsRestarted is the number of pods restarted, by namespace.
+	podsRestarted = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "reloader_pods_restarted_total",
+		Help: "Number of pods restarted",
+	}, []string{"namespace"})
+
+	// restartThrottle is the time spent waiting for the restart budget before restarting a pod.
+	restartThrottle = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name: "reloader_restart_throttle_seconds",
+		Help: "Time spent waiting for the restart budget before restarting a pod",
+	})
+
+	// breakerTrips is the number of times the circuit breaker has tripped.
+	breakerTrips = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "reloader_circuit_breaker_trips_total",
+		Help: "Number of reloads held by the circuit breaker",
+	})
+
+	// breakerOpen is the number of reloads waiting for confirmation.
+	breakerOpen = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "reloader_circuit_breaker_open",
+		Help: "Number of reloads held by the circuit breaker waiting for confirmation",
+	})
+
+	// webhookDeliveries is the number of webhook notifications, by webhook and result.
+	webhookDeliveries = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "reloader_webhook_deliveries_total",
+		Help: "Number of webhook notifications by result",
+	}, []string{"webhook", "result"})
+
+	// httpReloads is the number of in-place pod reloads, by result.
+	httpReloads = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "reloader_http_reloads_total",
+		Help: "Number of in-place pod reloads by result",
+	}, []string{"result"})
+
+	// validationFailures is the number of reloads blocked by invalid content, by namespace, kind and failing key. Keys
+	// only matched by the wildcard rule are counted under it, so that the key label is bounded by the rules rather than
+	// by the data keys. The object is in the logs and events.
+	validationFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "reloader_validation_failures_total",
+		Help: "Number of reloads blocked by invalid content",
+	}, []string{"namespace", "kind", "key"})
+
+	// lintFindings is the number of labelling problems found by the last lint, by check and namespace.
+	lintFindings = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "reloader_lint_findings",
+		Help: "Number of labelling problems found by the last lint",
+	}, []string{"check", "namespace"})
+
+	// tlsExpiryDays is the number of days before the certificate of a TLS Secret with dependent pods expires.
+	tlsExpiryDays = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "reloader_tls_certificate_expiry_days",
+		Help: "Number of days before the certificate of a TLS Secret with dependent pods expires",
+	}, []string{"namespace", "secret"})
+
+	// admissionReviews is the number of admission reviews answered, by webhook and result.
+	admissionReviews = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "reloader_admission_reviews_total",
+		Help: "Number of admission reviews answered by result",
+	}, []string{"webhook", "result"})
+)
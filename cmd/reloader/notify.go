@@ -0,0 +1,423 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/kubernetes"
+
+	"github.com/jacobbrewer1/web/logging"
+)
+
+const (
+	// eventStarted is sent when pods are about to be restarted.
+	eventStarted = "started"
+
+	// eventSucceeded is sent when all pods were restarted.
+	eventSucceeded = "succeeded"
+
+	// eventFailed is sent when restarting the pods failed.
+	eventFailed = "failed"
+
+	// eventSkipped is sent when pods were not restarted, for example because reloads are paused.
+	eventSkipped = "skipped"
+
+	// defaultWebhookTimeout is the timeout of a webhook request when none is configured.
+	defaultWebhookTimeout = 10 * time.Second
+)
+
+var (
+	// ErrInvalidWebhook is returned when a webhook configuration is not valid.
+	ErrInvalidWebhook = errors.New("invalid webhook")
+
+	// errWebhookStatus is returned when a webhook responds with a non-2xx status.
+	errWebhookStatus = errors.New("unexpected webhook response status")
+)
+
+type (
+	// reloadEvent is the payload describing reload activity sent to webhooks. It is also the data passed to webhook
+	// body templates.
+	reloadEvent struct {
+		// Type is the type of the event, one of started, succeeded, failed or skipped.
+		Type string `json:"type"`
+
+		// Kind is the kind of the object that changed.
+		Kind string `json:"kind"`
+
+		// Namespace is the namespace of the object that changed.
+		Namespace string `json:"namespace"`
+
+		// Name is the name of the object that changed.
+		Name string `json:"name"`
+
+		// ChangedKeys are the keys of the object whose values changed.
+		ChangedKeys []string `json:"changed_keys"`
+
+		// Workloads are the workloads affected by the reload, in the form "Kind/name".
+		Workloads []string `json:"workloads"`
+
+		// Pods are the names of the pods affected by the reload.
+		Pods []string `json:"pods"`
+
+		// Strategy is the strategy used to reload the pods.
+		Strategy string `json:"strategy"`
+
+		// Result is the error of a failed reload or the reason of a skipped reload.
+		Result string `json:"result,omitempty"`
+
+		// Timestamp is the time the event happened.
+		Timestamp time.Time `json:"timestamp"`
+	}
+
+	// webhookConfig is the configuration of a single webhook, as read from the notifications config file.
+	webhookConfig struct {
+		// Name identifies the webhook in logs and metrics.
+		Name string `json:"name"`
+
+		// URL is the URL the events are posted to.
+		URL string `json:"url"`
+
+		// Events are the event types sent to the webhook. Empty means all.
+		Events []string `json:"events"`
+
+		// Namespaces are the namespaces whose events are sent to the webhook. Empty means all.
+		Namespaces []string `json:"namespaces"`
+
+		// Headers are added to every request.
+		Headers map[string]string `json:"headers"`
+
+		// Template is a text/template rendering the request body from the event. Empty sends the event as JSON.
+		Template string `json:"template"`
+
+		// MaxRetries is the number of times a failed request is retried.
+		MaxRetries int `json:"max_retries"`
+
+		// Timeout is the timeout of a single request, as a Go duration string.
+		Timeout string `json:"timeout"`
+	}
+
+	// notificationsConfig is the content of the notifications config file.
+	notificationsConfig struct {
+		// Webhooks are the webhooks to send reload activity to.
+		Webhooks []*webhookConfig `json:"webhooks"`
+	}
+
+	// webhook is a parsed webhook configuration.
+	webhook struct {
+		// config is the configuration of the webhook.
+		config *webhookConfig
+
+		// template renders the request body, or is nil to send the event as JSON.
+		template *template.Template
+
+		// timeout is the timeout of a single request.
+		timeout time.Duration
+	}
+
+	// webhookQueue holds the events waiting to be sent to a single webhook. Every webhook is delivered to by its own
+	// worker, so that a slow or retrying webhook only delays its own events.
+	webhookQueue struct {
+		// hook is the webhook to send the events to.
+		hook *webhook
+
+		// events are the events waiting to be sent.
+		events chan reloadEvent
+	}
+)
+
+// with returns a copy of the event with the given type and result.
+func (e reloadEvent) with(eventType, result string) reloadEvent {
+	e.Type = eventType
+	e.Result = result
+	e.Timestamp = time.Now()
+	return e
+}
+
+// templateFuncs are the functions available to webhook body templates.
+var templateFuncs = template.FuncMap{
+	"json": func(v any) (string, error) {
+		b, err := json.Marshal(v)
+		return string(b), err
+	},
+	"join": strings.Join,
+}
+
+// newWebhook validates the given configuration and parses its template.
+func newWebhook(cfg *webhookConfig) (*webhook, error) {
+	if cfg.Name == "" {
+		return nil, fmt.Errorf("%w: name is required", ErrInvalidWebhook)
+	} else if cfg.URL == "" {
+		return nil, fmt.Errorf("%w: %s: url is required", ErrInvalidWebhook, cfg.Name)
+	}
+
+	for _, e := range cfg.Events {
+		switch e {
+		case eventStarted, eventSucceeded, eventFailed, eventSkipped:
+		default:
+			return nil, fmt.Errorf("%w: %s: unknown event %q", ErrInvalidWebhook, cfg.Name, e)
+		}
+	}
+
+	hook := &webhook{
+		config:  cfg,
+		timeout: defaultWebhookTimeout,
+	}
+
+	if cfg.Timeout != "" {
+		timeout, err := time.ParseDuration(cfg.Timeout)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s: invalid timeout: %w", ErrInvalidWebhook, cfg.Name, err)
+		}
+		hook.timeout = timeout
+	}
+
+	if cfg.Template != "" {
+		tmpl, err := template.New(cfg.Name).Funcs(templateFuncs).Parse(cfg.Template)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s: invalid template: %w", ErrInvalidWebhook, cfg.Name, err)
+		}
+		hook.template = tmpl
+	}
+
+	return hook, nil
+}
+
+// loadWebhooks reads and validates the webhooks from the notifications config file at the given path. An empty path
+// means no webhooks are configured.
+func loadWebhooks(path string) ([]*webhook, error) {
+	if path == "" {
+		return nil, nil
+	}
+
+	b, err := os.ReadFile(path) // nolint:gosec // The path is operator supplied configuration
+	if err != nil {
+		return nil, fmt.Errorf("failed to read notifications config: %w", err)
+	}
+
+	cfg := new(notificationsConfig)
+	if err := json.Unmarshal(b, cfg); err != nil {
+		return nil, fmt.Errorf("failed to parse notifications config: %w", err)
+	}
+
+	hooks := make([]*webhook, 0, len(cfg.Webhooks))
+	for _, hc := range cfg.Webhooks {
+		hook, err := newWebhook(hc)
+		if err != nil {
+			return nil, err
+		}
+		hooks = append(hooks, hook)
+	}
+	return hooks, nil
+}
+
+// matches reports whether the given event should be sent to the webhook.
+func (w *webhook) matches(event *reloadEvent) bool {
+	if len(w.config.Events) > 0 && !slices.Contains(w.config.Events, event.Type) {
+		return false
+	}
+	if len(w.config.Namespaces) > 0 && !slices.Contains(w.config.Namespaces, event.Namespace) {
+		return false
+	}
+	return true
+}
+
+// body renders the request body for the given event.
+func (w *webhook) body(event *reloadEvent) ([]byte, error) {
+	if w.template == nil {
+		return json.Marshal(event)
+	}
+
+	buf := new(bytes.Buffer)
+	if err := w.template.Execute(buf, event); err != nil {
+		return nil, fmt.Errorf("failed to render template: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// notifier sends reload activity to webhooks. Events are queued per webhook and delivered in the background so that
+// slow webhooks never delay a reload, nor the other webhooks.
+type notifier struct {
+	// kubeClient is used to resolve the workloads owning the reloaded pods.
+	kubeClient kubernetes.Interface
+
+	// client sends the webhook requests.
+	client *http.Client
+
+	// queues hold the events waiting to be sent, one queue per configured webhook.
+	queues []*webhookQueue
+
+	// retryBackoff is the delay before the first retry of a failed delivery, doubled for every further retry.
+	retryBackoff time.Duration
+}
+
+// newNotifier creates a new notifier.
+func newNotifier(
+	kubeClient kubernetes.Interface,
+	webhooks []*webhook,
+	queueSize int,
+	retryBackoff time.Duration,
+) *notifier {
+	queues := make([]*webhookQueue, 0, len(webhooks))
+	for _, hook := range webhooks {
+		queues = append(queues, &webhookQueue{hook: hook, events: make(chan reloadEvent, queueSize)})
+	}
+
+	return &notifier{
+		kubeClient:   kubeClient,
+		client:       new(http.Client),
+		queues:       queues,
+		retryBackoff: retryBackoff,
+	}
+}
+
+// enabled reports whether any webhooks are configured.
+func (n *notifier) enabled() bool {
+	return len(n.queues) > 0
+}
+
+// newEvent builds the event describing a reload of the given pods. Resolving the affected workloads needs API calls,
+// so the event is only filled in when webhooks are configured.
+func (n *notifier) newEvent(
+	ctx context.Context,
+	ref *corev1.ObjectReference,
+	keys []string,
+	strategy string,
+	pods []*corev1.Pod,
+) reloadEvent {
+	event := reloadEvent{
+		Kind:        ref.Kind,
+		Namespace:   ref.Namespace,
+		Name:        ref.Name,
+		ChangedKeys: keys,
+		Strategy:    strategy,
+	}
+	if !n.enabled() {
+		return event
+	}
+
+	event.Pods = make([]string, 0, len(pods))
+	for _, pod := range pods {
+		event.Pods = append(event.Pods, pod.Name)
+	}
+	event.Workloads = podWorkloads(ctx, n.kubeClient, pods)
+
+	return event
+}
+
+// notify queues the event for every matching webhook. Events are dropped if the queue of a webhook is full.
+func (n *notifier) notify(event reloadEvent) {
+	for _, queue := range n.queues {
+		if !queue.hook.matches(&event) {
+			continue
+		}
+
+		select {
+		case queue.events <- event:
+		default:
+			webhookDeliveries.WithLabelValues(queue.hook.config.Name, "dropped").Inc()
+		}
+	}
+}
+
+// run delivers queued events, with a worker per webhook, until the context is done.
+func (n *notifier) run(ctx context.Context, l *slog.Logger) {
+	wg := new(sync.WaitGroup)
+	for _, queue := range n.queues {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			n.runQueue(ctx, l, queue)
+		}()
+	}
+	wg.Wait()
+}
+
+// runQueue delivers the queued events of a single webhook until the context is done.
+func (n *notifier) runQueue(ctx context.Context, l *slog.Logger, queue *webhookQueue) {
+	name := queue.hook.config.Name
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case event := <-queue.events:
+			if err := n.deliver(ctx, queue.hook, event); err != nil {
+				l.Error("failed to deliver webhook",
+					slog.String(logging.KeyName, name),
+					slog.String(logging.KeyError, err.Error()),
+				)
+				webhookDeliveries.WithLabelValues(name, "failed").Inc()
+				continue
+			}
+			webhookDeliveries.WithLabelValues(name, "succeeded").Inc()
+		}
+	}
+}
+
+// deliver sends the event to the webhook, retrying with an exponential backoff.
+func (n *notifier) deliver(ctx context.Context, hook *webhook, event reloadEvent) error {
+	body, err := hook.body(&event)
+	if err != nil {
+		return err
+	}
+
+	backoff := n.retryBackoff
+	for attempt := 0; ; attempt++ {
+		err = n.send(ctx, hook, body)
+		if err == nil || attempt >= hook.config.MaxRetries {
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+// send makes a single webhook request.
+func (n *notifier) send(ctx context.Context, hook *webhook, body []byte) error {
+	ctx, cancel := context.WithTimeout(ctx, hook.timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, hook.config.URL, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range hook.config.Headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to send request: %w", err)
+	}
+	defer resp.Body.Close() // nolint:errcheck // Nothing to do with the error
+
+	_, _ = io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode < http.StatusOK || resp.StatusCode >= http.StatusMultipleChoices {
+		return fmt.Errorf("%w: %d", errWebhookStatus, resp.StatusCode)
+	}
+	return nil
+}
+
+// watchNotifications delivers queued webhook notifications.
+func (a *App) watchNotifications(ctx context.Context) {
+	a.notifier.run(ctx, logging.LoggerWithComponent(a.base.Logger(), "notifications"))
+}
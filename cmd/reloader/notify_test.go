@@ -0,0 +1,305 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes/fake"
+
+	"github.com/jacobbrewer1/web/cache"
+)
+
+func Test_NewWebhook(t *testing.T) {
+	t.Parallel()
+
+	t.Run("valid", func(t *testing.T) {
+		t.Parallel()
+
+		hook, err := newWebhook(&webhookConfig{
+			Name:     "slack",
+			URL:      "http://example.com",
+			Events:   []string{eventSucceeded, eventFailed},
+			Template: `{"text": {{ printf "%s %s/%s" .Type .Namespace .Name | json }}}`,
+			Timeout:  "2s",
+		})
+		require.NoError(t, err)
+		require.Equal(t, 2*time.Second, hook.timeout)
+		require.NotNil(t, hook.template)
+	})
+
+	t.Run("missing url", func(t *testing.T) {
+		t.Parallel()
+
+		_, err := newWebhook(&webhookConfig{Name: "slack"})
+		require.ErrorIs(t, err, ErrInvalidWebhook)
+	})
+
+	t.Run("unknown event", func(t *testing.T) {
+		t.Parallel()
+
+		_, err := newWebhook(&webhookConfig{Name: "slack", URL: "http://example.com", Events: []string{"exploded"}})
+		require.ErrorIs(t, err, ErrInvalidWebhook)
+	})
+
+	t.Run("invalid template", func(t *testing.T) {
+		t.Parallel()
+
+		_, err := newWebhook(&webhookConfig{Name: "slack", URL: "http://example.com", Template: "{{ .Type "})
+		require.ErrorIs(t, err, ErrInvalidWebhook)
+	})
+}
+
+func Test_LoadWebhooks(t *testing.T) {
+	t.Parallel()
+
+	t.Run("no config", func(t *testing.T) {
+		t.Parallel()
+
+		hooks, err := loadWebhooks("")
+		require.NoError(t, err)
+		require.Empty(t, hooks)
+	})
+
+	t.Run("config file", func(t *testing.T) {
+		t.Parallel()
+
+		path := filepath.Join(t.TempDir(), "notifications.json")
+		require.NoError(t, os.WriteFile(path, []byte(`{
+			"webhooks": [
+				{"name": "team-a", "url": "http://example.com/a", "namespaces": ["team-a"], "max_retries": 3},
+				{"name": "all", "url": "http://example.com/all"}
+			]
+		}`), 0o600))
+
+		hooks, err := loadWebhooks(path)
+		require.NoError(t, err)
+		require.Len(t, hooks, 2)
+		require.Equal(t, 3, hooks[0].config.MaxRetries)
+	})
+}
+
+func Test_WebhookMatchesAndBody(t *testing.T) {
+	t.Parallel()
+
+	hook, err := newWebhook(&webhookConfig{
+		Name:       "slack",
+		URL:        "http://example.com",
+		Events:     []string{eventFailed},
+		Namespaces: []string{"team-a"},
+		Template:   `{"text": {{ printf "%s %s/%s: %s" .Type .Namespace .Name (join .Workloads ", ") | json }}}`,
+	})
+	require.NoError(t, err)
+
+	event := reloadEvent{
+		Type:      eventFailed,
+		Kind:      "Secret",
+		Namespace: "team-a",
+		Name:      "db",
+		Workloads: []string{"Deployment/api", "StatefulSet/db"},
+	}
+	require.True(t, hook.matches(&event))
+
+	other := event.with(eventSucceeded, "")
+	require.False(t, hook.matches(&other))
+
+	other = event
+	other.Namespace = "team-b"
+	require.False(t, hook.matches(&other))
+
+	body, err := hook.body(&event)
+	require.NoError(t, err)
+	require.JSONEq(t, `{"text": "failed team-a/db: Deployment/api, StatefulSet/db"}`, string(body))
+}
+
+func Test_NotifierDeliver(t *testing.T) {
+	t.Parallel()
+
+	t.Run("retries", func(t *testing.T) {
+		t.Parallel()
+
+		var calls atomic.Int32
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if calls.Add(1) < 3 {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		}))
+		t.Cleanup(srv.Close)
+
+		hook, err := newWebhook(&webhookConfig{Name: "test", URL: srv.URL, MaxRetries: 2})
+		require.NoError(t, err)
+
+		n := newNotifier(fake.NewClientset(), []*webhook{hook}, 10, time.Millisecond)
+		err = n.deliver(context.Background(), hook, reloadEvent{Type: eventStarted})
+		require.NoError(t, err)
+		require.Equal(t, int32(3), calls.Load())
+	})
+
+	t.Run("retries exhausted", func(t *testing.T) {
+		t.Parallel()
+
+		var calls atomic.Int32
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			calls.Add(1)
+			w.WriteHeader(http.StatusInternalServerError)
+		}))
+		t.Cleanup(srv.Close)
+
+		hook, err := newWebhook(&webhookConfig{Name: "test", URL: srv.URL, MaxRetries: 1})
+		require.NoError(t, err)
+
+		n := newNotifier(fake.NewClientset(), []*webhook{hook}, 10, time.Millisecond)
+		err = n.deliver(context.Background(), hook, reloadEvent{Type: eventStarted})
+		require.ErrorIs(t, err, errWebhookStatus)
+		require.Equal(t, int32(2), calls.Load())
+	})
+
+	t.Run("queue full", func(t *testing.T) {
+		t.Parallel()
+
+		hook, err := newWebhook(&webhookConfig{Name: "test", URL: "http://example.com"})
+		require.NoError(t, err)
+
+		n := newNotifier(fake.NewClientset(), []*webhook{hook}, 1, time.Millisecond)
+		n.notify(reloadEvent{Type: eventStarted})
+		n.notify(reloadEvent{Type: eventSucceeded})
+		require.Len(t, n.queues[0].events, 1)
+	})
+
+	t.Run("slow webhook", func(t *testing.T) {
+		t.Parallel()
+
+		ctx, cancel := context.WithCancel(context.Background())
+		t.Cleanup(cancel)
+
+		blocked := make(chan struct{})
+		slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			<-blocked
+		}))
+		t.Cleanup(slow.Close)
+		t.Cleanup(func() { close(blocked) })
+
+		var calls atomic.Int32
+		fast := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			calls.Add(1)
+		}))
+		t.Cleanup(fast.Close)
+
+		slowHook, err := newWebhook(&webhookConfig{Name: "slow", URL: slow.URL})
+		require.NoError(t, err)
+		fastHook, err := newWebhook(&webhookConfig{Name: "fast", URL: fast.URL})
+		require.NoError(t, err)
+
+		n := newNotifier(fake.NewClientset(), []*webhook{slowHook, fastHook}, 10, time.Millisecond)
+		go n.run(ctx, slog.New(slog.DiscardHandler))
+
+		n.notify(reloadEvent{Type: eventStarted})
+		n.notify(reloadEvent{Type: eventSucceeded})
+		require.Eventually(t, func() bool {
+			return calls.Load() == 2
+		}, 5*time.Second, 10*time.Millisecond)
+	})
+}
+
+func Test_ReloadNotifications(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	mut := new(sync.Mutex)
+	received := make([]reloadEvent, 0)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, err := io.ReadAll(r.Body)
+		require.NoError(t, err)
+
+		event := reloadEvent{}
+		require.NoError(t, json.Unmarshal(b, &event))
+
+		mut.Lock()
+		received = append(received, event)
+		mut.Unlock()
+	}))
+	t.Cleanup(srv.Close)
+
+	controller := true
+	deployment := &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{Name: "api", Namespace: "default", UID: "deployment-uid"},
+	}
+	replicaSet := &appsv1.ReplicaSet{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "api-123",
+			Namespace: "default",
+			UID:       "replicaset-uid",
+			OwnerReferences: []metav1.OwnerReference{{
+				Kind:       "Deployment",
+				Name:       deployment.Name,
+				UID:        deployment.UID,
+				Controller: &controller,
+			}},
+		},
+	}
+	pods := make([]*corev1.Pod, 0)
+	for _, name := range []string{"api-123-a", "api-123-b"} {
+		pods = append(pods, &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      name,
+				Namespace: "default",
+				Labels:    map[string]string{"reloader/secret": "db"},
+				OwnerReferences: []metav1.OwnerReference{{
+					Kind:       "ReplicaSet",
+					Name:       replicaSet.Name,
+					UID:        replicaSet.UID,
+					Controller: &controller,
+				}},
+			},
+		})
+	}
+
+	kubeClient := fake.NewClientset(deployment, replicaSet, pods[0], pods[1])
+	informerFactory := informers.NewSharedInformerFactory(kubeClient, 0)
+	rel := testableReloader(t, cache.NewFixedHashBucket(1), kubeClient, informerFactory)
+	informerFactory.Start(ctx.Done())
+	informerFactory.WaitForCacheSync(ctx.Done())
+
+	hook, err := newWebhook(&webhookConfig{Name: "test", URL: srv.URL})
+	require.NoError(t, err)
+	rel.notifier = newNotifier(kubeClient, []*webhook{hook}, 10, time.Millisecond)
+	go rel.notifier.run(ctx, slog.New(slog.DiscardHandler))
+
+	secret := &corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: "db", Namespace: "default"}}
+	rel.reload(ctx, slog.New(slog.DiscardHandler), objectReference("Secret", secret), []string{"password"}, secretHash(secret))
+
+	require.Eventually(t, func() bool {
+		mut.Lock()
+		defer mut.Unlock()
+		return len(received) == 2
+	}, 5*time.Second, 10*time.Millisecond)
+
+	mut.Lock()
+	defer mut.Unlock()
+	require.Equal(t, eventStarted, received[0].Type)
+	require.Equal(t, eventSucceeded, received[1].Type)
+	require.Equal(t, "Secret", received[1].Kind)
+	require.Equal(t, "db", received[1].Name)
+	require.Equal(t, []string{"password"}, received[1].ChangedKeys)
+	require.Equal(t, []string{"Deployment/api"}, received[1].Workloads)
+	require.ElementsMatch(t, []string{"api-123-a", "api-123-b"}, received[1].Pods)
+	require.Equal(t, strategyDelete, received[1].Strategy)
+}
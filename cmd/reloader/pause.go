@@ -0,0 +1,429 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sort"
+	"sync"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	kubeerrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+	listersv1 "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/metadata/metadatalister"
+
+	"github.com/jacobbrewer1/web/logging"
+)
+
+const (
+	// annotationPaused is the annotation that pauses reloads for a namespace, a workload or a pod.
+	annotationPaused = "reloader/paused"
+
+	// pauseConfigMapKey is the key in the pause ConfigMap that pauses reloads cluster-wide.
+	pauseConfigMapKey = "paused"
+)
+
+// pauseMode decides what happens to reloads that are detected while paused.
+type pauseMode string
+
+const (
+	// pauseModeDrop discards reloads detected while paused.
+	pauseModeDrop pauseMode = "drop"
+
+	// pauseModeDefer holds reloads detected while paused and applies them once the pause is lifted.
+	pauseModeDefer pauseMode = "defer"
+)
+
+// ErrInvalidPauseMode is returned when the configured pause mode is not recognised.
+var ErrInvalidPauseMode = errors.New("invalid pause mode")
+
+// parsePauseMode parses the given string into a pauseMode.
+func parsePauseMode(s string) (pauseMode, error) {
+	switch mode := pauseMode(s); mode {
+	case pauseModeDrop, pauseModeDefer:
+		return mode, nil
+	default:
+		return "", fmt.Errorf("%w: %q", ErrInvalidPauseMode, s)
+	}
+}
+
+// deferredPod is a pod restart held back until the pause covering it is lifted.
+type deferredPod struct {
+	// ref is the object whose change triggered the restart.
+	ref *corev1.ObjectReference
+
+	// keys are the changed keys of the object.
+	keys []string
+
+	// hash is the content hash of the object, set when the pod may be reloaded in place.
+	hash string
+
+	// pod is the pod to restart.
+	pod *corev1.Pod
+
+	// since is when the restart was deferred.
+	since time.Time
+}
+
+// pauser is the kill switch for reloads. The pause state is read live from the listers so that it takes effect
+// without redeploying reloader.
+type pauser struct {
+	// mut guards the deferred restarts.
+	mut *sync.Mutex
+
+	// mode is the action taken on reloads detected while paused.
+	mode pauseMode
+
+	// namespace is the namespace of the pause ConfigMap.
+	namespace string
+
+	// configMapName is the name of the ConfigMap that pauses reloads cluster-wide.
+	configMapName string
+
+	// kubeClient is used to look up the workloads owning a pod.
+	kubeClient kubernetes.Interface
+
+	// configMapLister is used to read the pause ConfigMap.
+	configMapLister listersv1.ConfigMapLister
+
+	// namespaceLister is used to read namespace annotations from a metadata-only cache.
+	namespaceLister metadatalister.Lister
+
+	// deferred is the set of pod restarts held back while paused, keyed by pod UID.
+	deferred map[types.UID]*deferredPod
+}
+
+// newPauser creates a new pauser.
+func newPauser(
+	mode pauseMode,
+	namespace, configMapName string,
+	kubeClient kubernetes.Interface,
+	configMapLister listersv1.ConfigMapLister,
+	namespaceLister metadatalister.Lister,
+) *pauser {
+	return &pauser{
+		mut:             new(sync.Mutex),
+		mode:            mode,
+		namespace:       namespace,
+		configMapName:   configMapName,
+		kubeClient:      kubeClient,
+		configMapLister: configMapLister,
+		namespaceLister: namespaceLister,
+		deferred:        make(map[types.UID]*deferredPod),
+	}
+}
+
+// globalPaused reports whether reloads are paused cluster-wide by the pause ConfigMap.
+func (p *pauser) globalPaused() (bool, error) {
+	cm, err := p.configMapLister.ConfigMaps(p.namespace).Get(p.configMapName)
+	if kubeerrors.IsNotFound(err) {
+		return false, nil
+	} else if err != nil {
+		return false, fmt.Errorf("failed to get pause configmap: %w", err)
+	}
+	return cm.Data[pauseConfigMapKey] == "true", nil
+}
+
+// namespacePaused reports whether reloads are paused for the given namespace.
+func (p *pauser) namespacePaused(namespace string) (bool, error) {
+	ns, err := p.namespaceLister.Get(namespace)
+	if kubeerrors.IsNotFound(err) {
+		return false, nil
+	} else if err != nil {
+		return false, fmt.Errorf("failed to get namespace: %w", err)
+	}
+	return ns.Annotations[annotationPaused] == "true", nil
+}
+
+// podPaused reports whether reloads are paused for the given pod, either on the pod itself or on any workload
+// owning it. Owner lookups are memoised in seen so that pods of the same workload are only resolved once.
+func (p *pauser) podPaused(ctx context.Context, pod *corev1.Pod, seen map[types.UID]bool) (bool, error) {
+	if pod.Annotations[annotationPaused] == "true" {
+		return true, nil
+	}
+
+	ref := metav1.GetControllerOf(pod)
+	if ref != nil {
+		if paused, ok := seen[ref.UID]; ok {
+			return paused, nil
+		}
+	}
+
+	owners, err := podOwners(ctx, p.kubeClient, pod)
+	if err != nil {
+		return false, err
+	}
+
+	paused := false
+	for _, owner := range owners {
+		if owner.GetAnnotations()[annotationPaused] == "true" {
+			paused = true
+			break
+		}
+	}
+
+	if ref != nil {
+		seen[ref.UID] = paused
+	}
+
+	return paused, nil
+}
+
+// filter returns the pods that may be restarted now. Pods covered by a pause are dropped or deferred depending on
+// the configured mode.
+func (p *pauser) filter(
+	ctx context.Context,
+	l *slog.Logger,
+	ref *corev1.ObjectReference,
+	keys []string,
+	hash string,
+	pods []*corev1.Pod,
+) []*corev1.Pod {
+	if len(pods) == 0 {
+		return pods
+	}
+
+	allowed, held := p.split(ctx, l, ref.Namespace, pods)
+	if len(held) == 0 {
+		return allowed
+	}
+
+	l.Info("reload paused",
+		slog.String(logKeyObject, referenceKey(ref)),
+		slog.String(logKeyNamespace, ref.Namespace),
+		slog.String(logKeyAction, string(p.mode)),
+		slog.Int(logKeyPods, len(held)),
+	)
+	pausedPods.WithLabelValues(string(p.mode)).Add(float64(len(held)))
+
+	if p.mode == pauseModeDefer {
+		p.mut.Lock()
+		for _, pod := range held {
+			p.deferred[pod.UID] = &deferredPod{
+				ref:   ref,
+				keys:  keys,
+				hash:  hash,
+				pod:   pod,
+				since: time.Now(),
+			}
+		}
+		deferredPods.Set(float64(len(p.deferred)))
+		p.mut.Unlock()
+	}
+
+	return allowed
+}
+
+// split divides the given pods of a namespace into those that may be restarted and those held by a pause. Errors
+// reading the pause state are treated as paused, so that an unreadable kill switch never restarts anything.
+func (p *pauser) split(
+	ctx context.Context,
+	l *slog.Logger,
+	namespace string,
+	pods []*corev1.Pod,
+) (allowed, held []*corev1.Pod) {
+	paused, err := p.globalPaused()
+	if err != nil {
+		l.Error("failed to read global pause state", slog.String(logging.KeyError, err.Error()))
+		return nil, pods
+	} else if paused {
+		return nil, pods
+	}
+
+	paused, err = p.namespacePaused(namespace)
+	if err != nil {
+		l.Error("failed to read namespace pause state", slog.String(logging.KeyError, err.Error()))
+		return nil, pods
+	} else if paused {
+		return nil, pods
+	}
+
+	allowed = make([]*corev1.Pod, 0, len(pods))
+	held = make([]*corev1.Pod, 0)
+	seen := make(map[types.UID]bool)
+	for _, pod := range pods {
+		paused, err := p.podPaused(ctx, pod, seen)
+		if err != nil {
+			l.Error("failed to read pod pause state",
+				slog.String(logKeyPod, pod.Name),
+				slog.String(logging.KeyError, err.Error()),
+			)
+			held = append(held, pod)
+			continue
+		}
+
+		if paused {
+			held = append(held, pod)
+		} else {
+			allowed = append(allowed, pod)
+		}
+	}
+	return allowed, held
+}
+
+// resumeDeferred restarts the deferred pods that are no longer paused, going through the circuit breaker for each
+// object like the reload they were deferred from. Pods that have since been deleted or replaced are forgotten, as they
+// already run with the latest configuration.
+func (p *pauser) resumeDeferred(
+	ctx context.Context,
+	l *slog.Logger,
+	r *reloader,
+	podLister listersv1.PodLister,
+) {
+	p.mut.Lock()
+	byNamespace := make(map[string][]*corev1.Pod)
+	deferred := make(map[types.UID]*deferredPod)
+	for uid, d := range p.deferred {
+		current, err := podLister.Pods(d.pod.Namespace).Get(d.pod.Name)
+		if err != nil || current.UID != uid {
+			delete(p.deferred, uid)
+			continue
+		}
+		byNamespace[current.Namespace] = append(byNamespace[current.Namespace], current)
+		deferred[uid] = d
+	}
+	p.mut.Unlock()
+
+	for namespace, pods := range byNamespace {
+		allowed, _ := p.split(ctx, l, namespace, pods)
+		if len(allowed) == 0 {
+			continue
+		}
+
+		l.Info("resuming deferred reloads",
+			slog.String(logKeyNamespace, namespace),
+			slog.Int(logKeyPods, len(allowed)),
+		)
+
+		p.mut.Lock()
+		for _, pod := range allowed {
+			delete(p.deferred, pod.UID)
+		}
+		p.mut.Unlock()
+
+		// The pods of an object may have been deferred from several of its changes. They are resumed as one reload
+		// of its latest change, covering the keys of all of them.
+		byObject := make(map[string][]*corev1.Pod)
+		latest := make(map[string]*deferredPod)
+		keys := make(map[string]map[string]struct{})
+		for _, pod := range allowed {
+			d := deferred[pod.UID]
+			object := referenceKey(d.ref)
+			byObject[object] = append(byObject[object], pod)
+			if last, ok := latest[object]; !ok || d.since.After(last.since) {
+				latest[object] = d
+			}
+			if keys[object] == nil {
+				keys[object] = make(map[string]struct{})
+			}
+			for _, key := range d.keys {
+				keys[object][key] = struct{}{}
+			}
+		}
+
+		for _, object := range sortedKeys(byObject) {
+			d := latest[object]
+			objectKeys := sortedKeys(keys[object])
+			restart := r.breaker.allow(ctx, l, d.ref, objectKeys, d.hash, byObject[object])
+			if len(restart) == 0 {
+				r.notifySkipped(ctx, l, d.ref, objectKeys, byObject[object], "circuit breaker tripped")
+				continue
+			}
+			r.resume(ctx, l, d.ref, objectKeys, d.hash, restart)
+		}
+	}
+
+	p.mut.Lock()
+	deferredPods.Set(float64(len(p.deferred)))
+	p.mut.Unlock()
+}
+
+// pendingReloads returns the deferred reloads, one per object.
+func (p *pauser) pendingReloads() []*reloadRecord {
+	p.mut.Lock()
+	defer p.mut.Unlock()
+
+	byObject := make(map[string]*reloadRecord)
+	for _, d := range p.deferred {
+		object := referenceKey(d.ref)
+		record, ok := byObject[object]
+		if !ok {
+			record = newReloadRecord(object, nil, nil, "paused")
+			record.Started = d.since
+			byObject[object] = record
+		}
+
+		record.Pods = append(record.Pods, d.pod.Name)
+		if d.since.Before(record.Started) {
+			record.Started = d.since
+		}
+	}
+
+	records := make([]*reloadRecord, 0, len(byObject))
+	for _, object := range sortedKeys(byObject) {
+		sort.Strings(byObject[object].Pods)
+		records = append(records, byObject[object])
+	}
+	return records
+}
+
+// reportState logs changes to the global pause state and exports the pause state as metrics. It returns the
+// current global pause state.
+func (p *pauser) reportState(l *slog.Logger, wasPaused bool) bool {
+	paused, err := p.globalPaused()
+	if err != nil {
+		l.Error("failed to read global pause state", slog.String(logging.KeyError, err.Error()))
+		return wasPaused
+	}
+
+	if paused != wasPaused {
+		l.Warn("global pause state changed", slog.Bool(logKeyPaused, paused))
+	}
+
+	if paused {
+		pausedGlobal.Set(1)
+	} else {
+		pausedGlobal.Set(0)
+	}
+
+	namespaces, err := p.namespaceLister.List(labels.Everything())
+	if err != nil {
+		l.Error("failed to list namespaces", slog.String(logging.KeyError, err.Error()))
+		return paused
+	}
+
+	count := 0
+	for _, ns := range namespaces {
+		if ns.Annotations[annotationPaused] == "true" {
+			count++
+		}
+	}
+	pausedNamespaces.Set(float64(count))
+
+	return paused
+}
+
+// watchPause periodically reports the pause state and applies deferred reloads once their pause is lifted.
+func (a *App) watchPause(ctx context.Context) {
+	l := logging.LoggerWithComponent(a.base.Logger(), "pause")
+
+	ticker := time.NewTicker(a.config.PauseResyncInterval)
+	defer ticker.Stop()
+
+	paused := a.pause.reportState(l, false)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			paused = a.pause.reportState(l, paused)
+			a.pause.resumeDeferred(ctx, l, a.reloader, a.base.PodLister())
+		}
+	}
+}
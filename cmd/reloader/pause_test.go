@@ -0,0 +1,263 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/fake"
+
+	"github.com/jacobbrewer1/web/cache"
+)
+
+func testablePauser(t *testing.T, kubeClient kubernetes.Interface, informerFactory informers.SharedInformerFactory) *pauser {
+	t.Helper()
+	return newPauser(
+		pauseModeDrop,
+		"reloader",
+		"reloader-pause",
+		kubeClient,
+		informerFactory.Core().V1().ConfigMaps().Lister(),
+		testableNamespaceLister(t, kubeClient),
+	)
+}
+
+func testablePausedPods(t *testing.T) []*corev1.Pod {
+	t.Helper()
+	return []*corev1.Pod{
+		{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      "pod1",
+				Namespace: "default",
+				UID:       "pod1-uid",
+			},
+		},
+		{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      "pod2",
+				Namespace: "default",
+				UID:       "pod2-uid",
+			},
+		},
+	}
+}
+
+func Test_ParsePauseMode(t *testing.T) {
+	t.Parallel()
+
+	mode, err := parsePauseMode("drop")
+	require.NoError(t, err)
+	require.Equal(t, pauseModeDrop, mode)
+
+	mode, err = parsePauseMode("defer")
+	require.NoError(t, err)
+	require.Equal(t, pauseModeDefer, mode)
+
+	_, err = parsePauseMode("sometimes")
+	require.ErrorIs(t, err, ErrInvalidPauseMode)
+}
+
+func Test_PauserFilter(t *testing.T) {
+	t.Parallel()
+
+	ref := &corev1.ObjectReference{Kind: "ConfigMap", Namespace: "default", Name: "cm"}
+
+	setup := func(t *testing.T, objects ...runtime.Object) (*pauser, kubernetes.Interface) {
+		t.Helper()
+
+		ctx, cancel := context.WithCancel(context.Background())
+		t.Cleanup(cancel)
+
+		kubeClient := fake.NewClientset(objects...)
+		informerFactory := informers.NewSharedInformerFactory(kubeClient, 0)
+		pause := testablePauser(t, kubeClient, informerFactory)
+		informerFactory.Start(ctx.Done())
+		informerFactory.WaitForCacheSync(ctx.Done())
+		return pause, kubeClient
+	}
+
+	t.Run("not paused", func(t *testing.T) {
+		t.Parallel()
+
+		pause, _ := setup(t)
+		pods := testablePausedPods(t)
+
+		got := pause.filter(context.Background(), slog.New(slog.DiscardHandler), ref, nil, "", pods)
+		require.Equal(t, pods, got)
+	})
+
+	t.Run("global pause", func(t *testing.T) {
+		t.Parallel()
+
+		pause, _ := setup(t, &corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Name: "reloader-pause", Namespace: "reloader"},
+			Data:       map[string]string{"paused": "true"},
+		})
+
+		got := pause.filter(context.Background(), slog.New(slog.DiscardHandler), ref, nil, "", testablePausedPods(t))
+		require.Empty(t, got)
+	})
+
+	t.Run("global pause configmap not set", func(t *testing.T) {
+		t.Parallel()
+
+		pause, _ := setup(t, &corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Name: "reloader-pause", Namespace: "reloader"},
+			Data:       map[string]string{"paused": "false"},
+		})
+
+		got := pause.filter(context.Background(), slog.New(slog.DiscardHandler), ref, nil, "", testablePausedPods(t))
+		require.Len(t, got, 2)
+	})
+
+	t.Run("namespace pause", func(t *testing.T) {
+		t.Parallel()
+
+		pause, _ := setup(t, &corev1.Namespace{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:        "default",
+				Annotations: map[string]string{"reloader/paused": "true"},
+			},
+		})
+
+		got := pause.filter(context.Background(), slog.New(slog.DiscardHandler), ref, nil, "", testablePausedPods(t))
+		require.Empty(t, got)
+	})
+
+	t.Run("pod pause", func(t *testing.T) {
+		t.Parallel()
+
+		pause, _ := setup(t)
+		pods := testablePausedPods(t)
+		pods[0].Annotations = map[string]string{"reloader/paused": "true"}
+
+		got := pause.filter(context.Background(), slog.New(slog.DiscardHandler), ref, nil, "", pods)
+		require.Equal(t, []*corev1.Pod{pods[1]}, got)
+	})
+
+	t.Run("workload pause", func(t *testing.T) {
+		t.Parallel()
+
+		controller := true
+		deployment := &appsv1.Deployment{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:        "app",
+				Namespace:   "default",
+				UID:         "deployment-uid",
+				Annotations: map[string]string{"reloader/paused": "true"},
+			},
+		}
+		replicaSet := &appsv1.ReplicaSet{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      "app-123",
+				Namespace: "default",
+				UID:       "replicaset-uid",
+				OwnerReferences: []metav1.OwnerReference{{
+					APIVersion: "apps/v1",
+					Kind:       "Deployment",
+					Name:       deployment.Name,
+					UID:        deployment.UID,
+					Controller: &controller,
+				}},
+			},
+		}
+
+		pause, _ := setup(t, deployment, replicaSet)
+		pods := testablePausedPods(t)
+		pods[0].OwnerReferences = []metav1.OwnerReference{{
+			APIVersion: "apps/v1",
+			Kind:       "ReplicaSet",
+			Name:       replicaSet.Name,
+			UID:        replicaSet.UID,
+			Controller: &controller,
+		}}
+
+		got := pause.filter(context.Background(), slog.New(slog.DiscardHandler), ref, nil, "", pods)
+		require.Equal(t, []*corev1.Pod{pods[1]}, got)
+	})
+
+	t.Run("defer and resume", func(t *testing.T) {
+		t.Parallel()
+
+		ctx, cancel := context.WithCancel(context.Background())
+		t.Cleanup(cancel)
+
+		pods := testablePausedPods(t)
+		pauseConfigMap := &corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Name: "reloader-pause", Namespace: "reloader"},
+			Data:       map[string]string{"paused": "true"},
+		}
+
+		kubeClient := fake.NewClientset(pods[0], pods[1], pauseConfigMap)
+		informerFactory := informers.NewSharedInformerFactory(kubeClient, 0)
+		podLister := informerFactory.Core().V1().Pods().Lister()
+		configMapInformer := informerFactory.Core().V1().ConfigMaps().Informer()
+		pause := testablePauser(t, kubeClient, informerFactory)
+		pause.mode = pauseModeDefer
+		rel := testableReloader(t, cache.NewFixedHashBucket(1), kubeClient, informerFactory)
+		informerFactory.Start(ctx.Done())
+		informerFactory.WaitForCacheSync(ctx.Done())
+
+		logger := slog.New(slog.DiscardHandler)
+		got := pause.filter(ctx, logger, ref, nil, "", pods)
+		require.Empty(t, got)
+		require.Len(t, pause.deferred, 2)
+
+		// Still paused, nothing is restarted.
+		pause.resumeDeferred(ctx, logger, rel, podLister)
+		require.Len(t, pause.deferred, 2)
+
+		// Lift the pause.
+		pauseConfigMap.Data["paused"] = "false"
+		require.NoError(t, configMapInformer.GetStore().Update(pauseConfigMap))
+
+		pause.resumeDeferred(ctx, logger, rel, podLister)
+		require.Empty(t, pause.deferred)
+
+		for _, pod := range pods {
+			_, err := kubeClient.CoreV1().Pods(pod.Namespace).Get(ctx, pod.Name, metav1.GetOptions{})
+			require.EqualError(t, err, "pods \""+pod.Name+"\" not found")
+		}
+	})
+
+	t.Run("resume through circuit breaker", func(t *testing.T) {
+		t.Parallel()
+
+		ctx, cancel := context.WithCancel(context.Background())
+		t.Cleanup(cancel)
+
+		pods := testablePausedPods(t)
+		kubeClient := fake.NewClientset(pods[0], pods[1])
+		informerFactory := informers.NewSharedInformerFactory(kubeClient, 0)
+		podLister := informerFactory.Core().V1().Pods().Lister()
+		pause := testablePauser(t, kubeClient, informerFactory)
+		pause.mode = pauseModeDefer
+		breaker := testableCircuitBreaker(t, 1, kubeClient, informerFactory)
+		rel := testableReloader(t, cache.NewFixedHashBucket(1), kubeClient, informerFactory)
+		rel.breaker = breaker
+		informerFactory.Start(ctx.Done())
+		informerFactory.WaitForCacheSync(ctx.Done())
+
+		// Defer the reload directly, as if it was made while paused.
+		for _, pod := range pods {
+			pause.deferred[pod.UID] = &deferredPod{ref: ref, pod: pod, since: time.Now()}
+		}
+
+		pause.resumeDeferred(ctx, slog.New(slog.DiscardHandler), rel, podLister)
+		require.Empty(t, pause.deferred)
+		require.Len(t, breaker.tripped, 1)
+
+		for _, pod := range pods {
+			_, err := kubeClient.CoreV1().Pods(pod.Namespace).Get(ctx, pod.Name, metav1.GetOptions{})
+			require.NoError(t, err)
+		}
+	})
+}
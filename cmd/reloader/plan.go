@@ -0,0 +1,256 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+const (
+	// skipPaused is the reason given for pods held by a pause.
+	skipPaused = "paused"
+
+	// skipCircuitBreaker is the reason given for pods held by the circuit breaker.
+	skipCircuitBreaker = "circuit breaker tripped"
+
+	// skipInvalidContent is the reason given for pods left alone because the object content is invalid.
+	skipInvalidContent = "invalid content"
+
+	// skipIgnored is the reason given for pods left alone because the object does not trigger reloads.
+	skipIgnored = "object ignored"
+)
+
+var (
+	// errTriggerInvalid is returned when a manually triggered reload is blocked by content validation.
+	errTriggerInvalid = errors.New("reload blocked by invalid content, see the object events")
+
+	// errTriggerIgnored is returned when a manually triggered reload is for an object that does not trigger reloads.
+	errTriggerIgnored = errors.New("object is ignored or, in strict mode, not enabled for reloads")
+)
+
+type (
+	// reloadObject is a ConfigMap or Secret whose dependent pods may be reloaded, as read from the informer caches.
+	reloadObject struct {
+		// ref is the reference to the object.
+		ref *corev1.ObjectReference
+
+		// keys are the data keys of the object, all reported as changed.
+		keys []string
+
+		// hash is the content hash of the object, sent to pods reloaded in place.
+		hash string
+
+		// labels are the labels of the object.
+		labels map[string]string
+
+		// annotations are the annotations of the object.
+		annotations map[string]string
+
+		// data is the content of the object.
+		data map[string][]byte
+	}
+
+	// plannedPod is a pod depending on an object and what a reload would do to it.
+	plannedPod struct {
+		// Name is the name of the pod.
+		Name string `json:"name"`
+
+		// Strategy is how the pod would be reloaded, empty if it would be skipped.
+		Strategy string `json:"strategy,omitempty"`
+
+		// Skipped is the reason the pod would not be reloaded.
+		Skipped string `json:"skipped,omitempty"`
+	}
+
+	// reloadPlan describes what a reload of an object would do, without doing it.
+	reloadPlan struct {
+		// Object is the key of the object.
+		Object string `json:"object"`
+
+		// ChangedKeys are the data keys reported as changed.
+		ChangedKeys []string `json:"changed_keys"`
+
+		// Invalid are the reasons content validation would block the reload, keyed by data key.
+		Invalid map[string]string `json:"invalid,omitempty"`
+
+		// Workloads are the workloads owning the dependent pods.
+		Workloads []string `json:"workloads"`
+
+		// Pods are the dependent pods, sorted by name.
+		Pods []*plannedPod `json:"pods"`
+	}
+)
+
+// resolve reads the object to reload from the informer caches. The kind is matched case-insensitively, as in object
+// keys.
+func (r *reloader) resolve(namespace, kind, name string) (*reloadObject, error) {
+	kind, err := apiKind(kind)
+	if err != nil {
+		return nil, err
+	}
+
+	switch kind {
+	case "ConfigMap":
+		configMap, err := r.configMapLister.ConfigMaps(namespace).Get(name)
+		if err != nil {
+			return nil, err
+		}
+		return &reloadObject{
+			ref:         objectReference(kind, configMap),
+			keys:        configMapKeys(configMap),
+			hash:        configMapHash(configMap),
+			labels:      configMap.Labels,
+			annotations: configMap.Annotations,
+			data:        configMapContent(configMap),
+		}, nil
+	default:
+		secret, err := r.secretLister.Secrets(namespace).Get(name)
+		if err != nil {
+			return nil, err
+		}
+		return &reloadObject{
+			ref:         objectReference(kind, secret),
+			keys:        dataKeys(secret.Data),
+			hash:        secretHash(secret),
+			labels:      secret.Labels,
+			annotations: secret.Annotations,
+			data:        secret.Data,
+		}, nil
+	}
+}
+
+// resolveTrigger reads the object of a manually triggered reload, checks that it triggers reloads and validates its
+// content, like the event handlers do before reloading.
+func (r *reloader) resolveTrigger(
+	ctx context.Context,
+	l *slog.Logger,
+	namespace, kind, name string,
+) (*reloadObject, error) {
+	obj, err := r.resolve(namespace, kind, name)
+	if err != nil {
+		return nil, err
+	}
+
+	if !r.triggers(obj.labels, obj.annotations) {
+		return nil, errTriggerIgnored
+	} else if !r.validator.allow(ctx, l, obj.ref, obj.annotations, obj.data) {
+		return nil, errTriggerInvalid
+	}
+	return obj, nil
+}
+
+// plan works out what a reload of the object would do, going through the same steps as reload without restarting
+// anything, tripping the circuit breaker or recording events.
+func (r *reloader) plan(ctx context.Context, l *slog.Logger, obj *reloadObject) (*reloadPlan, error) {
+	pods, err := r.dependents(obj.ref)
+	if err != nil {
+		return nil, err
+	}
+
+	plan := &reloadPlan{
+		Object:      referenceKey(obj.ref),
+		ChangedKeys: obj.keys,
+		Workloads:   podWorkloads(ctx, r.kubeClient, pods),
+		Pods:        make([]*plannedPod, 0, len(pods)),
+	}
+	add := func(pods []*corev1.Pod, strategy, skipped string) {
+		for _, pod := range pods {
+			plan.Pods = append(plan.Pods, &plannedPod{Name: pod.Name, Strategy: strategy, Skipped: skipped})
+		}
+	}
+	defer func() {
+		sort.Slice(plan.Pods, func(i, j int) bool {
+			return plan.Pods[i].Name < plan.Pods[j].Name
+		})
+	}()
+
+	if !r.triggers(obj.labels, obj.annotations) {
+		add(pods, "", skipIgnored)
+		return plan, nil
+	}
+
+	if invalid := r.validator.check(obj.ref, obj.annotations, obj.data); len(invalid) > 0 {
+		plan.Invalid = make(map[string]string, len(invalid))
+		for key, err := range invalid {
+			plan.Invalid[key] = err.Error()
+		}
+		add(pods, "", skipInvalidContent)
+		return plan, nil
+	}
+
+	allowed, held := r.pause.split(ctx, l, obj.ref.Namespace, pods)
+	add(held, "", skipPaused)
+
+	if r.breaker.exceeds(allowed) {
+		add(allowed, "", skipCircuitBreaker)
+		return plan, nil
+	}
+
+	restart := allowed
+	if obj.hash != "" {
+		inPlace, rest := splitInPlace(allowed)
+		add(inPlace, strategyHTTP, "")
+		restart = rest
+	}
+	for _, group := range r.strategyGroups(ctx, l, restart) {
+		add(group.pods, group.strategy.name, "")
+	}
+
+	return plan, nil
+}
+
+// skipped returns the number of pods the plan would not reload for the given reason.
+func (p *reloadPlan) skipped(reason string) int {
+	count := 0
+	for _, pod := range p.Pods {
+		if pod.Skipped == reason {
+			count++
+		}
+	}
+	return count
+}
+
+// writeText writes the plan as a human readable table.
+func (p *reloadPlan) writeText(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(tw, "Object:\t%s\n", p.Object)
+	fmt.Fprintf(tw, "Changed keys:\t%s\n", strings.Join(p.ChangedKeys, ", "))
+	fmt.Fprintf(tw, "Workloads:\t%s\n", strings.Join(p.Workloads, ", "))
+	for _, key := range sortedKeys(p.Invalid) {
+		fmt.Fprintf(tw, "Invalid %s:\t%s\n", key, p.Invalid[key])
+	}
+
+	fmt.Fprintln(tw)
+	if len(p.Pods) == 0 {
+		fmt.Fprintln(tw, "No pods depend on this object.")
+	} else {
+		fmt.Fprintln(tw, "POD\tSTRATEGY\tSKIPPED")
+		for _, pod := range p.Pods {
+			strategy := pod.Strategy
+			if strategy == strategyHTTP {
+				strategy += " (restart on failure)"
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%s\n", pod.Name, dashIfEmpty(strategy), dashIfEmpty(pod.Skipped))
+		}
+	}
+
+	if err := tw.Flush(); err != nil {
+		return fmt.Errorf("failed to write plan: %w", err)
+	}
+	return nil
+}
+
+// dashIfEmpty returns s, or a dash if s is empty, so that table columns stay aligned.
+func dashIfEmpty(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
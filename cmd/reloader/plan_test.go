@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes/fake"
+
+	"github.com/jacobbrewer1/web/cache"
+)
+
+func testablePlanReloader(t *testing.T, objects ...*corev1.Pod) (*reloader, *fake.Clientset) {
+	t.Helper()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	kubeClient := fake.NewClientset(&corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "app",
+			Namespace:   "default",
+			Annotations: map[string]string{annotationValidate: "config.json=json"},
+		},
+		Data: map[string]string{"config.json": `{"debug": true}`},
+	})
+	for _, pod := range objects {
+		_, err := kubeClient.CoreV1().Pods(pod.Namespace).Create(ctx, pod, metav1.CreateOptions{})
+		require.NoError(t, err)
+	}
+
+	informerFactory := informers.NewSharedInformerFactory(kubeClient, 0)
+	r := testableReloader(t, cache.NewFixedHashBucket(1), kubeClient, informerFactory)
+	informerFactory.Start(ctx.Done())
+	informerFactory.WaitForCacheSync(ctx.Done())
+
+	return r, kubeClient
+}
+
+func Test_ReloaderResolve(t *testing.T) {
+	t.Parallel()
+
+	r, _ := testablePlanReloader(t)
+
+	t.Run("configmap", func(t *testing.T) {
+		t.Parallel()
+
+		obj, err := r.resolve("default", "configmap", "app")
+		require.NoError(t, err)
+		require.Equal(t, "default/configmap/app", referenceKey(obj.ref))
+		require.Equal(t, []string{"config.json"}, obj.keys)
+		require.NotEmpty(t, obj.hash)
+	})
+
+	t.Run("unknown kind", func(t *testing.T) {
+		t.Parallel()
+
+		_, err := r.resolve("default", "deployment", "app")
+		require.ErrorIs(t, err, errUnknownKind)
+	})
+}
+
+func Test_ReloaderPlan(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	l := slog.New(slog.DiscardHandler)
+
+	paused := testableDependentPod(t, "paused", "default", "ConfigMap", "app")
+	paused.Annotations = map[string]string{annotationPaused: "true"}
+
+	pods := []*corev1.Pod{
+		testableDependentPod(t, "restart", "default", "ConfigMap", "app"),
+		testableInPlacePod(t, "in-place", "http://:8080/-/reload"),
+		paused,
+	}
+	r, _ := testablePlanReloader(t, pods...)
+
+	obj, err := r.resolve("default", "ConfigMap", "app")
+	require.NoError(t, err)
+
+	t.Run("strategies", func(t *testing.T) {
+		t.Parallel()
+
+		plan, err := r.plan(ctx, l, obj)
+		require.NoError(t, err)
+		require.Equal(t, "default/configmap/app", plan.Object)
+		require.ElementsMatch(t, []string{"Pod/in-place", "Pod/paused", "Pod/restart"}, plan.Workloads)
+		require.Equal(t, []*plannedPod{
+			{Name: "in-place", Strategy: strategyHTTP},
+			{Name: "paused", Skipped: skipPaused},
+			{Name: "restart", Strategy: strategyDelete},
+		}, plan.Pods)
+
+		buf := new(bytes.Buffer)
+		require.NoError(t, plan.writeText(buf))
+		require.Contains(t, buf.String(), "in-place  http (restart on failure)  -")
+		require.Contains(t, buf.String(), "paused    -                          paused")
+	})
+
+	t.Run("without hash", func(t *testing.T) {
+		t.Parallel()
+
+		plan, err := r.plan(ctx, l, &reloadObject{ref: obj.ref, keys: obj.keys})
+		require.NoError(t, err)
+		require.Equal(t, strategyDelete, plan.Pods[0].Strategy)
+	})
+
+	t.Run("circuit breaker", func(t *testing.T) {
+		t.Parallel()
+
+		limited, _ := testablePlanReloader(t, pods...)
+		limited.breaker = newCircuitBreaker(1, "reloader", "reloader-circuit-breaker", limited.kubeClient, limited.configMapLister)
+
+		plan, err := limited.plan(ctx, l, obj)
+		require.NoError(t, err)
+		require.Equal(t, 2, plan.skipped(skipCircuitBreaker))
+		require.Equal(t, 1, plan.skipped(skipPaused))
+		require.Empty(t, limited.breaker.pendingReloads())
+	})
+
+	t.Run("invalid content", func(t *testing.T) {
+		t.Parallel()
+
+		invalid := &reloadObject{
+			ref:         obj.ref,
+			keys:        obj.keys,
+			hash:        obj.hash,
+			annotations: obj.annotations,
+			data:        map[string][]byte{"config.json": []byte("{")},
+		}
+
+		plan, err := r.plan(ctx, l, invalid)
+		require.NoError(t, err)
+		require.Contains(t, plan.Invalid, "config.json")
+		require.Equal(t, 3, plan.skipped(skipInvalidContent))
+	})
+	t.Run("ignored", func(t *testing.T) {
+		t.Parallel()
+
+		ignored := &reloadObject{
+			ref:         obj.ref,
+			keys:        obj.keys,
+			hash:        obj.hash,
+			annotations: map[string]string{annotationIgnore: "true"},
+			data:        obj.data,
+		}
+
+		plan, err := r.plan(ctx, l, ignored)
+		require.NoError(t, err)
+		require.Equal(t, 3, plan.skipped(skipIgnored))
+	})
+
+	t.Run("strict", func(t *testing.T) {
+		t.Parallel()
+
+		strict, _ := testablePlanReloader(t, pods...)
+		strict.strict = true
+
+		plan, err := strict.plan(ctx, l, obj)
+		require.NoError(t, err)
+		require.Equal(t, 3, plan.skipped(skipIgnored))
+
+		_, err = strict.resolveTrigger(ctx, l, "default", "ConfigMap", "app")
+		require.ErrorIs(t, err, errTriggerIgnored)
+	})
+}
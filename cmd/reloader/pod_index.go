@@ -0,0 +1,105 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	kubecache "k8s.io/client-go/tools/cache"
+)
+
+// indexDependencies is the name of the pod index keyed by the ConfigMaps and Secrets the pods depend on, in the
+// object key form "namespace/kind/name".
+const indexDependencies = "reloader/dependencies"
+
+// addDependencyIndex registers the dependency index on the pod informer and returns the indexer to look pods up in.
+// References in pod specs are only indexed when specReferences is set, as pods otherwise opt in to reloads through
+// their labels and annotations.
+func addDependencyIndex(
+	informer kubecache.SharedIndexInformer,
+	specReferences bool,
+	triggers []*customTrigger,
+) (kubecache.Indexer, error) {
+	if err := informer.AddIndexers(kubecache.Indexers{
+		indexDependencies: dependencyIndexFunc(specReferences, triggers),
+	}); err != nil {
+		return nil, fmt.Errorf("failed to add pod dependency index: %w", err)
+	}
+	return informer.GetIndexer(), nil
+}
+
+// dependencyIndexFunc returns the index function of the dependency index. A pod depends on the objects named by its
+// reloader labels, on the objects of its content hashes annotation, on the custom resources named by the reference keys
+// of the custom triggers, on the Vault secrets of its Vault path annotation and, if specReferences is set, on the
+// objects its volumes and containers use.
+func dependencyIndexFunc(specReferences bool, triggers []*customTrigger) kubecache.IndexFunc {
+	return func(obj any) ([]string, error) {
+		pod, ok := obj.(*corev1.Pod)
+		if !ok {
+			return make([]string, 0), nil
+		}
+
+		keys := make(map[string]bool)
+		for _, kind := range []string{"ConfigMap", "Secret"} {
+			if name, ok := pod.Labels[dependencyLabel(kind)]; ok {
+				keys[objectKey(strings.ToLower(kind), pod.Namespace, name)] = true
+			}
+		}
+
+		if value, ok := pod.Annotations[annotationContentHashes]; ok {
+			hashes := make(map[string]string)
+			// A malformed annotation is reported by the admission webhook and the linter, and only loses its own
+			// dependencies here.
+			if err := json.Unmarshal([]byte(value), &hashes); err == nil {
+				for ref := range hashes {
+					kind, name, ok := strings.Cut(ref, "/")
+					if !ok {
+						continue
+					}
+					if _, err := apiKind(kind); err == nil {
+						keys[objectKey(strings.ToLower(kind), pod.Namespace, name)] = true
+					}
+				}
+			}
+		}
+
+		for _, trigger := range triggers {
+			if name, ok := trigger.podReference(pod); ok {
+				keys[objectKey(strings.ToLower(trigger.config.Kind), pod.Namespace, name)] = true
+			}
+		}
+
+		for _, path := range podVaultPaths(pod) {
+			keys[objectKey(strings.ToLower(kindVaultSecret), pod.Namespace, path)] = true
+		}
+
+		if specReferences {
+			for _, ref := range podReferences(pod) {
+				keys[objectKey(strings.ToLower(ref.kind), pod.Namespace, ref.name)] = true
+			}
+		}
+
+		return sortedKeys(keys), nil
+	}
+}
+
+// indexedPods looks up the pods depending on the given object in the dependency index.
+func indexedPods(indexer kubecache.Indexer, key string) ([]*corev1.Pod, error) {
+	objs, err := indexer.ByIndex(indexDependencies, key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to look up dependent pods: %w", err)
+	}
+
+	pods := make([]*corev1.Pod, 0, len(objs))
+	for _, obj := range objs {
+		if pod, ok := obj.(*corev1.Pod); ok {
+			pods = append(pods, pod)
+		}
+	}
+	sort.Slice(pods, func(i, j int) bool {
+		return pods[i].Name < pods[j].Name
+	})
+	return pods, nil
+}
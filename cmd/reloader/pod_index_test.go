@@ -0,0 +1,159 @@
+package main
+
+import (
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	listersv1 "k8s.io/client-go/listers/core/v1"
+	kubecache "k8s.io/client-go/tools/cache"
+)
+
+func Test_DependencyIndexFunc(t *testing.T) {
+	t.Parallel()
+
+	pod := testableDependentPod(t, "api", "default", "ConfigMap", "app")
+	pod.Labels[dependencyLabel("Secret")] = "db"
+	pod.Annotations = map[string]string{
+		annotationContentHashes: `{"configmap/flags": "abc", "secret/db": "def", "deployment/api": "ghi"}`,
+	}
+	pod.Spec.Volumes = []corev1.Volume{{
+		Name: "tls",
+		VolumeSource: corev1.VolumeSource{
+			Secret: &corev1.SecretVolumeSource{SecretName: "tls"},
+		},
+	}}
+
+	tests := []struct {
+		name           string
+		pod            *corev1.Pod
+		specReferences bool
+		want           []string
+	}{
+		{
+			name: "labels and annotations",
+			pod:  pod,
+			want: []string{"default/configmap/app", "default/configmap/flags", "default/secret/db"},
+		},
+		{
+			name:           "spec references",
+			pod:            pod,
+			specReferences: true,
+			want:           []string{"default/configmap/app", "default/configmap/flags", "default/secret/db", "default/secret/tls"},
+		},
+		{
+			name: "malformed annotation",
+			pod: &corev1.Pod{ObjectMeta: metav1.ObjectMeta{
+				Namespace:   "default",
+				Labels:      map[string]string{dependencyLabel("ConfigMap"): "app"},
+				Annotations: map[string]string{annotationContentHashes: "{"},
+			}},
+			want: []string{"default/configmap/app"},
+		},
+		{
+			name: "vault paths",
+			pod: &corev1.Pod{ObjectMeta: metav1.ObjectMeta{
+				Namespace:   "default",
+				Annotations: map[string]string{annotationVaultPath: "secret/data/app"},
+			}},
+			want: []string{"default/vaultsecret/secret/data/app"},
+		},
+		{
+			name: "no dependencies",
+			pod:  &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: "default"}},
+			want: []string{},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			got, err := dependencyIndexFunc(tt.specReferences, nil)(tt.pod)
+			require.NoError(t, err)
+			require.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func Test_IndexedPods(t *testing.T) {
+	t.Parallel()
+
+	indexer := kubecache.NewIndexer(kubecache.MetaNamespaceKeyFunc, kubecache.Indexers{
+		indexDependencies: dependencyIndexFunc(false, nil),
+	})
+	for _, pod := range []*corev1.Pod{
+		testableDependentPod(t, "web", "default", "Secret", "db"),
+		testableDependentPod(t, "api", "default", "Secret", "db"),
+		testableDependentPod(t, "other", "team-b", "Secret", "db"),
+		testableDependentPod(t, "flags", "default", "ConfigMap", "db"),
+	} {
+		require.NoError(t, indexer.Add(pod))
+	}
+
+	pods, err := indexedPods(indexer, "default/secret/db")
+	require.NoError(t, err)
+	require.Len(t, pods, 2)
+	require.Equal(t, "api", pods[0].Name)
+	require.Equal(t, "web", pods[1].Name)
+
+	pods, err = indexedPods(indexer, "default/secret/missing")
+	require.NoError(t, err)
+	require.Empty(t, pods)
+}
+
+// BenchmarkDependents compares finding the pods depending on an object by scanning a namespace of 10k pods with a
+// label selector and by looking them up in the dependency index.
+func BenchmarkDependents(b *testing.B) {
+	const (
+		pods    = 10000
+		objects = 100
+	)
+
+	indexer := kubecache.NewIndexer(kubecache.MetaNamespaceKeyFunc, kubecache.Indexers{
+		kubecache.NamespaceIndex: kubecache.MetaNamespaceIndexFunc,
+		indexDependencies:        dependencyIndexFunc(false, nil),
+	})
+	for i := range pods {
+		if err := indexer.Add(&corev1.Pod{ObjectMeta: metav1.ObjectMeta{
+			Name:      "pod-" + strconv.Itoa(i),
+			Namespace: "default",
+			Labels: map[string]string{
+				"app":                     "app-" + strconv.Itoa(i%objects),
+				dependencyLabel("Secret"): "secret-" + strconv.Itoa(i%objects),
+			},
+		}}); err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	ref := &corev1.ObjectReference{Kind: "Secret", Namespace: "default", Name: "secret-42"}
+
+	b.Run("selector", func(b *testing.B) {
+		lister := listersv1.NewPodLister(indexer)
+		selector := labels.SelectorFromSet(map[string]string{dependencyLabel(ref.Kind): ref.Name})
+		for b.Loop() {
+			got, err := lister.Pods(ref.Namespace).List(selector)
+			if err != nil {
+				b.Fatal(err)
+			} else if len(got) != pods/objects {
+				b.Fatalf("got %d pods", len(got))
+			}
+		}
+	})
+
+	b.Run("index", func(b *testing.B) {
+		r := &reloader{podIndexer: indexer}
+		for b.Loop() {
+			got, err := r.dependents(ref)
+			if err != nil {
+				b.Fatal(err)
+			} else if len(got) != pods/objects {
+				b.Fatalf("got %d pods", len(got))
+			}
+		}
+	})
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+
+	"go.uber.org/multierr"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+
+	"github.com/jacobbrewer1/workerpool"
+)
+
+type (
+	// podKiller restarts pods by deleting them on a worker pool, within the restart budget of a limiter and with
+	// bounded concurrency, both cluster-wide and per namespace.
+	podKiller struct {
+		// kubeClient is used to delete pods.
+		kubeClient kubernetes.Interface
+
+		// limiter bounds the rate of pod restarts.
+		limiter *restartLimiter
+
+		// pool runs the deletions.
+		pool workerpool.Pool
+
+		// global bounds the number of deletions in flight cluster-wide. Nil means only the pool size bounds them.
+		global semaphore
+
+		// mut guards the per-namespace semaphores.
+		mut *sync.Mutex
+
+		// namespaceConcurrency is the number of deletions that may be in flight in a single namespace. Zero means
+		// unlimited.
+		namespaceConcurrency int
+
+		// namespaces holds the semaphore of each namespace, created on first use.
+		namespaces map[string]semaphore
+	}
+
+	// semaphore bounds the number of holders of a resource. A nil semaphore never blocks.
+	semaphore chan struct{}
+
+	// runnableFunc adapts a function to a workerpool.Runnable.
+	runnableFunc func()
+
+	// podError is the error of a single pod restart.
+	podError struct {
+		// key is the namespace and name of the pod.
+		key string
+
+		// err is the error.
+		err error
+	}
+)
+
+// newPodKiller creates a new podKiller. A concurrency of zero means unlimited, in which case deletions are only bounded
+// by the size of the pool.
+func newPodKiller(
+	kubeClient kubernetes.Interface,
+	limiter *restartLimiter,
+	pool workerpool.Pool,
+	globalConcurrency, namespaceConcurrency int,
+) *podKiller {
+	return &podKiller{
+		kubeClient:           kubeClient,
+		limiter:              limiter,
+		pool:                 pool,
+		global:               newSemaphore(globalConcurrency),
+		mut:                  new(sync.Mutex),
+		namespaceConcurrency: namespaceConcurrency,
+		namespaces:           make(map[string]semaphore),
+	}
+}
+
+// newSemaphore creates a semaphore with the given number of slots, or nil if there are none.
+func newSemaphore(size int) semaphore {
+	if size <= 0 {
+		return nil
+	}
+	return make(semaphore, size)
+}
+
+// acquire blocks until a slot is free or the context is done.
+func (s semaphore) acquire(ctx context.Context) error {
+	if s == nil {
+		return nil
+	}
+
+	select {
+	case s <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// release frees a slot taken by acquire.
+func (s semaphore) release() {
+	if s != nil {
+		<-s
+	}
+}
+
+// Run calls the function.
+func (f runnableFunc) Run() {
+	f()
+}
+
+// namespace returns the semaphore for the given namespace.
+func (k *podKiller) namespace(namespace string) semaphore {
+	k.mut.Lock()
+	defer k.mut.Unlock()
+
+	s, ok := k.namespaces[namespace]
+	if !ok {
+		s = newSemaphore(k.namespaceConcurrency)
+		k.namespaces[namespace] = s
+	}
+	return s
+}
+
+// kill deletes the given pods in parallel with the given options and waits for the deletions to finish. The restart
+// budget and the concurrency slots of each pod are taken before its deletion is handed to the pool, so that workers
+// only ever delete and a throttled namespace cannot hold them from the others. The errors are aggregated per pod,
+// sorted by pod, and the pods not yet deleted when the context is done are given up on.
+func (k *podKiller) kill(ctx context.Context, pods []*corev1.Pod, opts metav1.DeleteOptions) error {
+	results := make(chan *podError, len(pods))
+	errs := make([]*podError, 0)
+
+	scheduled := 0
+	for _, pod := range pods {
+		key := pod.Namespace + "/" + pod.Name
+		release, err := k.acquire(ctx, pod.Namespace)
+		if err != nil {
+			errs = append(errs, &podError{key: key, err: err})
+			continue
+		}
+
+		err = k.pool.BlockingSchedule(runnableFunc(func() {
+			defer release()
+			results <- &podError{key: key, err: k.killPod(ctx, pod, opts)}
+		}))
+		if err != nil {
+			release()
+			errs = append(errs, &podError{key: key, err: err})
+			continue
+		}
+		scheduled++
+	}
+
+	for range scheduled {
+		select {
+		case result := <-results:
+			if result.err != nil {
+				errs = append(errs, result)
+			}
+		case <-ctx.Done():
+			// Deletions left on a stopped pool never report back, so stop waiting for them.
+			return multierr.Append(combinePodErrors(errs), ctx.Err())
+		}
+	}
+
+	return combinePodErrors(errs)
+}
+
+// acquire blocks until the restart budget and a slot in the namespace and cluster-wide allow a pod of the namespace to
+// be deleted. The returned function frees the slots.
+func (k *podKiller) acquire(ctx context.Context, namespace string) (func(), error) {
+	if err := k.limiter.wait(ctx, namespace); err != nil {
+		return nil, err
+	}
+
+	slot := k.namespace(namespace)
+	if err := slot.acquire(ctx); err != nil {
+		return nil, fmt.Errorf("namespace restart concurrency: %w", err)
+	}
+
+	if err := k.global.acquire(ctx); err != nil {
+		slot.release()
+		return nil, fmt.Errorf("global restart concurrency: %w", err)
+	}
+
+	return func() {
+		k.global.release()
+		slot.release()
+	}, nil
+}
+
+// killPod deletes a single pod.
+func (k *podKiller) killPod(ctx context.Context, pod *corev1.Pod, opts metav1.DeleteOptions) error {
+	if err := k.kubeClient.CoreV1().Pods(pod.Namespace).Delete(ctx, pod.Name, opts); err != nil {
+		return err
+	}
+	podsRestarted.WithLabelValues(pod.Namespace).Inc()
+	return nil
+}
+
+// combinePodErrors combines the errors of pod restarts, sorted by pod so that the result does not depend on the
+// order the deletions finished in.
+func combinePodErrors(errs []*podError) error {
+	sort.SliceStable(errs, func(i, j int) bool {
+		return errs[i].key < errs[j].key
+	})
+
+	var combined error
+	for _, e := range errs {
+		combined = multierr.Append(combined, fmt.Errorf("failed to restart pod %s: %w", e.key, e.err))
+	}
+	return combined
+}
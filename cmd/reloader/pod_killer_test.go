@@ -0,0 +1,241 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/fake"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+
+	"github.com/jacobbrewer1/workerpool"
+)
+
+func testablePod(t *testing.T) *corev1.Pod {
+	t.Helper()
+	return &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "test-pod",
+			Namespace: "test-namespace",
+		},
+		Status: corev1.PodStatus{
+			Phase: corev1.PodRunning,
+		},
+	}
+}
+
+func testablePodKiller(t *testing.T, kubeClient kubernetes.Interface) *podKiller {
+	t.Helper()
+
+	pool := workerpool.New(workerpool.WithTotalWorkers(4))
+	t.Cleanup(pool.Stop)
+
+	return newPodKiller(kubeClient, newRestartLimiter(0, 0), pool, 0, 0)
+}
+
+type (
+	// concurrencyClientset records the largest number of pod deletions in flight. The fake clientset serialises
+	// its reactors, so deletions are slowed down before reaching it.
+	concurrencyClientset struct {
+		*fake.Clientset
+
+		mut            *sync.Mutex
+		inFlight       int
+		max            int
+		inNamespace    map[string]int
+		maxInNamespace map[string]int
+	}
+
+	concurrencyCoreV1 struct {
+		typedcorev1.CoreV1Interface
+		c *concurrencyClientset
+	}
+
+	concurrencyPods struct {
+		typedcorev1.PodInterface
+		c         *concurrencyClientset
+		namespace string
+	}
+)
+
+func (c *concurrencyClientset) CoreV1() typedcorev1.CoreV1Interface {
+	return &concurrencyCoreV1{CoreV1Interface: c.Clientset.CoreV1(), c: c}
+}
+
+func (c *concurrencyCoreV1) Pods(namespace string) typedcorev1.PodInterface {
+	return &concurrencyPods{PodInterface: c.CoreV1Interface.Pods(namespace), c: c.c, namespace: namespace}
+}
+
+func (p *concurrencyPods) Delete(ctx context.Context, name string, opts metav1.DeleteOptions) error {
+	p.c.mut.Lock()
+	p.c.inFlight++
+	p.c.inNamespace[p.namespace]++
+	p.c.max = max(p.c.max, p.c.inFlight)
+	p.c.maxInNamespace[p.namespace] = max(p.c.maxInNamespace[p.namespace], p.c.inNamespace[p.namespace])
+	p.c.mut.Unlock()
+
+	time.Sleep(20 * time.Millisecond)
+
+	p.c.mut.Lock()
+	p.c.inFlight--
+	p.c.inNamespace[p.namespace]--
+	p.c.mut.Unlock()
+
+	return p.PodInterface.Delete(ctx, name, opts)
+}
+
+func Test_PodKillerKill(t *testing.T) {
+	t.Parallel()
+
+	t.Run("success", func(t *testing.T) {
+		t.Parallel()
+		pod := testablePod(t)
+		kubeClient := fake.NewClientset(pod)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		t.Cleanup(cancel)
+
+		err := testablePodKiller(t, kubeClient).kill(ctx, []*corev1.Pod{pod}, metav1.DeleteOptions{})
+		require.NoError(t, err)
+	})
+
+	t.Run("pod not found", func(t *testing.T) {
+		t.Parallel()
+		kubeClient := fake.NewClientset()
+
+		ctx, cancel := context.WithCancel(context.Background())
+		t.Cleanup(cancel)
+
+		err := testablePodKiller(t, kubeClient).kill(ctx, []*corev1.Pod{testablePod(t)}, metav1.DeleteOptions{})
+		require.Error(t, err)
+		require.Contains(t, err.Error(), "pods \"test-pod\" not found")
+	})
+
+	t.Run("multiple pods not found", func(t *testing.T) {
+		t.Parallel()
+		pod1 := testablePod(t)
+		pod2 := testablePod(t)
+		pod2.Name = "other-pod"
+		kubeClient := fake.NewClientset()
+
+		ctx, cancel := context.WithCancel(context.Background())
+		t.Cleanup(cancel)
+
+		err := testablePodKiller(t, kubeClient).kill(ctx, []*corev1.Pod{pod1, pod2}, metav1.DeleteOptions{})
+		require.EqualError(t, err, "failed to restart pod test-namespace/other-pod: pods \"other-pod\" not found; "+
+			"failed to restart pod test-namespace/test-pod: pods \"test-pod\" not found")
+	})
+
+	t.Run("cancelled", func(t *testing.T) {
+		t.Parallel()
+		pod := testablePod(t)
+		kubeClient := fake.NewClientset(pod)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		err := testablePodKiller(t, kubeClient).kill(ctx, []*corev1.Pod{pod}, metav1.DeleteOptions{})
+		require.ErrorIs(t, err, context.Canceled)
+	})
+
+	t.Run("throttled namespace", func(t *testing.T) {
+		t.Parallel()
+		throttled1 := testablePod(t)
+		throttled2 := testablePod(t)
+		throttled2.Name = "other-pod"
+		other := testablePod(t)
+		other.Namespace = "other-namespace"
+		kubeClient := fake.NewClientset(throttled1, throttled2, other)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		t.Cleanup(cancel)
+
+		pool := workerpool.New(workerpool.WithTotalWorkers(1))
+		t.Cleanup(pool.Stop)
+		killer := newPodKiller(kubeClient, newRestartLimiter(0, 1), pool, 0, 0)
+
+		// The second pod of the namespace waits a minute for the budget, which must not hold the only worker.
+		go func() {
+			_ = killer.kill(ctx, []*corev1.Pod{throttled1, throttled2}, metav1.DeleteOptions{})
+		}()
+
+		killed, cancelKilled := context.WithTimeout(ctx, 5*time.Second)
+		t.Cleanup(cancelKilled)
+		require.Eventually(t, func() bool {
+			_, err := kubeClient.CoreV1().Pods(throttled1.Namespace).Get(ctx, throttled1.Name, metav1.GetOptions{})
+			return err != nil
+		}, 5*time.Second, 10*time.Millisecond)
+		require.NoError(t, killer.kill(killed, []*corev1.Pod{other}, metav1.DeleteOptions{}))
+	})
+}
+
+func Test_PodKillerConcurrency(t *testing.T) {
+	t.Parallel()
+
+	newPods := func(namespace string, count int) []*corev1.Pod {
+		pods := make([]*corev1.Pod, 0, count)
+		for i := range count {
+			pods = append(pods, &corev1.Pod{ObjectMeta: metav1.ObjectMeta{
+				Name:      "pod-" + string(rune('a'+i)),
+				Namespace: namespace,
+			}})
+		}
+		return pods
+	}
+
+	// run kills the pods and returns the largest number of deletions seen in flight, cluster-wide and per namespace.
+	run := func(t *testing.T, globalConcurrency, namespaceConcurrency int, pods []*corev1.Pod) (int, map[string]int) {
+		t.Helper()
+
+		objects := make([]runtime.Object, 0, len(pods))
+		for _, pod := range pods {
+			objects = append(objects, pod)
+		}
+		kubeClient := &concurrencyClientset{
+			Clientset:      fake.NewClientset(objects...),
+			mut:            new(sync.Mutex),
+			inNamespace:    make(map[string]int),
+			maxInNamespace: make(map[string]int),
+		}
+
+		pool := workerpool.New(workerpool.WithTotalWorkers(8))
+		t.Cleanup(pool.Stop)
+
+		killer := newPodKiller(kubeClient, newRestartLimiter(0, 0), pool, globalConcurrency, namespaceConcurrency)
+		require.NoError(t, killer.kill(context.Background(), pods, metav1.DeleteOptions{}))
+
+		for _, pod := range pods {
+			_, err := kubeClient.CoreV1().Pods(pod.Namespace).Get(context.Background(), pod.Name, metav1.GetOptions{})
+			require.Error(t, err)
+		}
+		return kubeClient.max, kubeClient.maxInNamespace
+	}
+
+	t.Run("parallel", func(t *testing.T) {
+		t.Parallel()
+
+		maxInFlight, _ := run(t, 0, 0, newPods("default", 8))
+		require.Greater(t, maxInFlight, 1)
+	})
+
+	t.Run("global", func(t *testing.T) {
+		t.Parallel()
+
+		maxInFlight, _ := run(t, 2, 0, append(newPods("team-a", 4), newPods("team-b", 4)...))
+		require.LessOrEqual(t, maxInFlight, 2)
+	})
+
+	t.Run("namespace", func(t *testing.T) {
+		t.Parallel()
+
+		maxInFlight, maxInFlightNamespace := run(t, 0, 1, append(newPods("team-a", 4), newPods("team-b", 4)...))
+		require.Equal(t, map[string]int{"team-a": 1, "team-b": 1}, maxInFlightNamespace)
+		require.LessOrEqual(t, maxInFlight, 2)
+	})
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// restartLimiter bounds the number of pods restarted per minute, both cluster-wide and per namespace.
+type restartLimiter struct {
+	// mut guards the per-namespace limiters.
+	mut *sync.Mutex
+
+	// global is the cluster-wide limiter.
+	global *rate.Limiter
+
+	// namespacePerMinute is the number of pods that may be restarted per minute in a single namespace. Zero means
+	// unlimited.
+	namespacePerMinute int
+
+	// namespaces holds the limiter of each namespace, created on first use.
+	namespaces map[string]*rate.Limiter
+}
+
+// newRestartLimiter creates a new restartLimiter. A budget of zero means unlimited.
+func newRestartLimiter(globalPerMinute, namespacePerMinute int) *restartLimiter {
+	return &restartLimiter{
+		mut:                new(sync.Mutex),
+		global:             newPerMinuteLimiter(globalPerMinute),
+		namespacePerMinute: namespacePerMinute,
+		namespaces:         make(map[string]*rate.Limiter),
+	}
+}
+
+// newPerMinuteLimiter creates a limiter allowing the given number of events per minute, with a burst of the same
+// size. A budget of zero or less means unlimited.
+func newPerMinuteLimiter(perMinute int) *rate.Limiter {
+	if perMinute <= 0 {
+		return rate.NewLimiter(rate.Inf, 0)
+	}
+	return rate.NewLimiter(rate.Every(time.Minute/time.Duration(perMinute)), perMinute)
+}
+
+// namespace returns the limiter for the given namespace.
+func (r *restartLimiter) namespace(namespace string) *rate.Limiter {
+	r.mut.Lock()
+	defer r.mut.Unlock()
+
+	limiter, ok := r.namespaces[namespace]
+	if !ok {
+		limiter = newPerMinuteLimiter(r.namespacePerMinute)
+		r.namespaces[namespace] = limiter
+	}
+	return limiter
+}
+
+// wait blocks until a pod in the given namespace may be restarted, or the context is done.
+func (r *restartLimiter) wait(ctx context.Context, namespace string) error {
+	start := time.Now()
+	defer func() {
+		restartThrottle.Observe(time.Since(start).Seconds())
+	}()
+
+	if err := r.namespace(namespace).Wait(ctx); err != nil {
+		return fmt.Errorf("namespace restart budget: %w", err)
+	}
+	if err := r.global.Wait(ctx); err != nil {
+		return fmt.Errorf("global restart budget: %w", err)
+	}
+	return nil
+}
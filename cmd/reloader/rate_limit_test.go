@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func Test_RestartLimiter(t *testing.T) {
+	t.Parallel()
+
+	t.Run("unlimited", func(t *testing.T) {
+		t.Parallel()
+
+		limiter := newRestartLimiter(0, 0)
+		for range 100 {
+			require.NoError(t, limiter.wait(context.Background(), "default"))
+		}
+	})
+
+	t.Run("namespace budget", func(t *testing.T) {
+		t.Parallel()
+
+		limiter := newRestartLimiter(0, 2)
+		require.NoError(t, limiter.wait(context.Background(), "default"))
+		require.NoError(t, limiter.wait(context.Background(), "default"))
+
+		// Other namespaces have their own budget.
+		require.NoError(t, limiter.wait(context.Background(), "other"))
+
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		t.Cleanup(cancel)
+
+		err := limiter.wait(ctx, "default")
+		require.ErrorContains(t, err, "namespace restart budget")
+	})
+
+	t.Run("global budget", func(t *testing.T) {
+		t.Parallel()
+
+		limiter := newRestartLimiter(2, 0)
+		require.NoError(t, limiter.wait(context.Background(), "default"))
+		require.NoError(t, limiter.wait(context.Background(), "other"))
+
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		t.Cleanup(cancel)
+
+		err := limiter.wait(ctx, "another")
+		require.ErrorContains(t, err, "global restart budget")
+	})
+}
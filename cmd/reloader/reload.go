@@ -0,0 +1,370 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sort"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	listersv1 "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/metadata/metadatalister"
+	kubecache "k8s.io/client-go/tools/cache"
+
+	"github.com/jacobbrewer1/web/cache"
+	"github.com/jacobbrewer1/web/logging"
+)
+
+const (
+	// strategyDelete restarts pods by deleting them and letting their controller recreate them.
+	strategyDelete = "delete"
+
+	// labelEnabled opts a ConfigMap or Secret in to triggering reloads in strict mode. It is a label rather than an
+	// annotation so that the informers can select on it.
+	labelEnabled = "reloader/enabled"
+
+	// annotationIgnore stops a ConfigMap or Secret from triggering reloads, whatever its dependent pods declare.
+	annotationIgnore = "reloader/ignore"
+)
+
+// reloader restarts the pods that depend on a changed object. It holds the dependencies shared by the event
+// handlers of every object kind.
+type reloader struct {
+	// bucket decides whether this replica handles a given object.
+	bucket cache.HashBucket
+
+	// kubeClient is used to restart pods.
+	kubeClient kubernetes.Interface
+
+	// podLister is used to list pods.
+	podLister listersv1.PodLister
+
+	// podIndexer is used to find the pods depending on an object, through the dependency index.
+	podIndexer kubecache.Indexer
+
+	// configMapLister is used to read ConfigMaps reloaded on demand.
+	configMapLister listersv1.ConfigMapLister
+
+	// secretLister is used to read Secrets reloaded on demand.
+	secretLister listersv1.SecretLister
+
+	// pause is the kill switch for reloads.
+	pause *pauser
+
+	// breaker holds reloads with a large blast radius until they are confirmed.
+	breaker *circuitBreaker
+
+	// killer restarts pods.
+	killer *podKiller
+
+	// notifier sends reload activity to the configured webhooks.
+	notifier *notifier
+
+	// http reloads pods in place when they declare a reload endpoint.
+	http *httpReloader
+
+	// validator blocks reloads of objects with invalid content.
+	validator *contentValidator
+
+	// tracker keeps the reloads in progress and the recent failures.
+	tracker *reloadTracker
+
+	// tasks runs the restarts off the informer handlers, one at a time per object. Nil runs them inline.
+	tasks *restartTasks
+
+	// customTriggers are the custom resources whose changes reload the pods referencing them.
+	customTriggers []*customTrigger
+
+	// strict only lets objects labelled with labelEnabled trigger reloads.
+	strict bool
+
+	// grace holds deletions of ConfigMaps, Secrets and custom resources, so that objects recreated within the grace
+	// period are handled as updates.
+	grace *deleteGrace
+
+	// namespaceLister is used to tell whether a deleted object went with its namespace.
+	namespaceLister metadatalister.Lister
+
+	// deletePolicy is the delete policy of objects and pods without a delete policy annotation.
+	deletePolicy deletePolicy
+
+	// defaultStrategy is the restart strategy of pods without a strategy annotation on them or their workload.
+	defaultStrategy restartStrategy
+
+	// batchTimeout is how long a batch of deleted pods is given to be replaced before the rest of the restart is
+	// given up on.
+	batchTimeout time.Duration
+
+	// familyRetention is the number of superseded members of a ConfigMap family kept for rollbacks.
+	familyRetention int
+
+	// familyGC deletes the superseded members of ConfigMap families beyond the retention.
+	familyGC bool
+}
+
+// dependencyLabel returns the pod label used to declare a dependency on objects of the given API kind, such as
+// "reloader/configmap" for ConfigMaps.
+func dependencyLabel(kind string) string {
+	return "reloader/" + strings.ToLower(kind)
+}
+
+// triggers reports whether an object with the given labels and annotations may trigger reloads. Objects annotated
+// with annotationIgnore never do, and in strict mode only objects labelled with labelEnabled do.
+func (r *reloader) triggers(labels, annotations map[string]string) bool {
+	if annotations[annotationIgnore] == "true" {
+		return false
+	}
+	return !r.strict || labels[labelEnabled] == "true"
+}
+
+// deleted reports whether the referenced object is gone from the cluster. An informer also delivers a delete event
+// when an object stops matching its selectors, such as when the enabled label is removed in strict mode, which must
+// not be taken for a deletion. The object is assumed deleted if the lookup fails for another reason. Custom resources
+// are watched without selectors, so they are looked up in the cache of their informer.
+func (r *reloader) deleted(ctx context.Context, ref *corev1.ObjectReference) bool {
+	var err error
+	switch ref.Kind {
+	case "ConfigMap":
+		_, err = r.kubeClient.CoreV1().ConfigMaps(ref.Namespace).Get(ctx, ref.Name, metav1.GetOptions{})
+	case "Secret":
+		_, err = r.kubeClient.CoreV1().Secrets(ref.Namespace).Get(ctx, ref.Name, metav1.GetOptions{})
+	default:
+		if trigger := r.customTrigger(ref.Kind); trigger != nil && trigger.lister != nil {
+			_, err = trigger.lister.ByNamespace(ref.Namespace).Get(ref.Name)
+		}
+	}
+	return err != nil
+}
+
+// dependents returns the pods that use the referenced object, sorted by name. This is specified with the label
+// "reloader/<kind>": "<name>" or the content hashes annotation, or found in the pod spec if enabled.
+func (r *reloader) dependents(ref *corev1.ObjectReference) ([]*corev1.Pod, error) {
+	return indexedPods(r.podIndexer, objectKey(strings.ToLower(ref.Kind), ref.Namespace, ref.Name))
+}
+
+// podsStartedBefore returns the pods that started before the given time. Pods that have not started yet or are
+// terminating are left out.
+func podsStartedBefore(pods []*corev1.Pod, t time.Time) []*corev1.Pod {
+	started := make([]*corev1.Pod, 0)
+	for _, pod := range pods {
+		if pod.Status.StartTime == nil || pod.DeletionTimestamp != nil {
+			continue
+		}
+		if pod.Status.StartTime.Time.Before(t) {
+			started = append(started, pod)
+		}
+	}
+	return started
+}
+
+// createdDependents returns the pods depending on a newly created object that started before it existed. They started
+// without it, such as through an optional reference, and never load it by themselves.
+func (r *reloader) createdDependents(ref *corev1.ObjectReference, created time.Time) ([]*corev1.Pod, error) {
+	pods, err := r.dependents(ref)
+	if err != nil {
+		return nil, err
+	}
+	return podsStartedBefore(pods, created), nil
+}
+
+// reloadCreated restarts the pods that started before the referenced object was created. Their content has nothing to
+// reload in place from, so they are always restarted.
+func (r *reloader) reloadCreated(
+	ctx context.Context,
+	l *slog.Logger,
+	ref *corev1.ObjectReference,
+	keys []string,
+	stale []*corev1.Pod,
+) {
+	l.Info("restarting pods started before the object was created",
+		slog.String(logKeyObject, referenceKey(ref)),
+		slog.Int(logKeyPods, len(stale)),
+	)
+	r.reloadPods(ctx, l, ref, keys, "", stale)
+}
+
+// reload restarts the pods depending on the referenced object. The changed keys are reported to the notifier. Pods
+// declaring a reload endpoint are reloaded in place when the content hash of the object is given, and restarted if
+// that fails.
+func (r *reloader) reload(
+	ctx context.Context,
+	l *slog.Logger,
+	ref *corev1.ObjectReference,
+	keys []string,
+	hash string,
+) {
+	pods, err := r.dependents(ref)
+	if err != nil {
+		l.Error("failed to list pods", slog.String(logging.KeyError, err.Error()))
+		return
+	}
+
+	r.reloadPods(ctx, l, ref, keys, hash, pods)
+}
+
+// reloadPods reloads the given pods depending on the referenced object, going through pauses, the circuit breaker,
+// in-place reloads and notifications like reload does for all of them. The pods let through are reloaded by the
+// restart tasks, without holding up the caller.
+func (r *reloader) reloadPods(
+	ctx context.Context,
+	l *slog.Logger,
+	ref *corev1.ObjectReference,
+	keys []string,
+	hash string,
+	pods []*corev1.Pod,
+) {
+	if len(pods) == 0 {
+		return
+	}
+
+	allowed := r.pause.filter(ctx, l, ref, keys, hash, pods)
+	if len(allowed) < len(pods) {
+		r.notifySkipped(ctx, l, ref, keys, podsExcept(pods, allowed), "paused")
+	}
+
+	if len(allowed) > 0 {
+		held := allowed
+		allowed = r.breaker.allow(ctx, l, ref, keys, hash, allowed)
+		if len(allowed) == 0 {
+			r.notifySkipped(ctx, l, ref, keys, held, "circuit breaker tripped")
+		}
+	}
+
+	r.resume(ctx, l, ref, keys, hash, allowed)
+}
+
+// resume restarts the given pods for a change of the referenced object once they are past the pause switch and the
+// circuit breaker, whether right away or after being held back by either. The restart is tracked and runs on the
+// restart task of the object.
+func (r *reloader) resume(
+	ctx context.Context,
+	l *slog.Logger,
+	ref *corev1.ObjectReference,
+	keys []string,
+	hash string,
+	pods []*corev1.Pod,
+) {
+	if len(pods) == 0 {
+		return
+	}
+
+	id := r.tracker.start(ref, keys, pods)
+	r.tasks.run(ctx, referenceKey(ref), func(ctx context.Context) {
+		r.restartAllowed(ctx, l, ref, keys, hash, pods, func(err error) {
+			r.tracker.finish(id, err)
+		})
+	})
+}
+
+// restartAllowed reloads the pods let through by reloadPods, in place where they support it and by restarting them
+// otherwise. Done is called with the restart error once every pod is reloaded.
+func (r *reloader) restartAllowed(
+	ctx context.Context,
+	l *slog.Logger,
+	ref *corev1.ObjectReference,
+	keys []string,
+	hash string,
+	allowed []*corev1.Pod,
+	done func(error),
+) {
+	restart := allowed
+	if hash != "" {
+		inPlace, rest := splitInPlace(allowed)
+		restart = rest
+		if len(inPlace) > 0 {
+			restart = append(restart, r.reloadInPlace(ctx, l, ref, keys, hash, inPlace)...)
+		}
+	}
+
+	if len(restart) == 0 {
+		done(nil)
+		return
+	}
+	r.restartNotified(ctx, l, ref, keys, restart, done)
+}
+
+// notifySkipped notifies the webhooks that the given pods were not restarted for the given reason, with an event per
+// strategy group.
+func (r *reloader) notifySkipped(
+	ctx context.Context,
+	l *slog.Logger,
+	ref *corev1.ObjectReference,
+	keys []string,
+	pods []*corev1.Pod,
+	reason string,
+) {
+	if !r.notifier.enabled() {
+		return
+	}
+
+	for _, group := range r.strategyGroups(ctx, l, pods) {
+		event := r.notifier.newEvent(ctx, ref, keys, group.strategy.name, group.pods)
+		r.notifier.notify(event.with(eventSkipped, reason))
+	}
+}
+
+// podsExcept returns the given pods that are not among the excluded ones, which are a subset of them.
+func podsExcept(pods, excluded []*corev1.Pod) []*corev1.Pod {
+	skip := make(map[*corev1.Pod]bool, len(excluded))
+	for _, pod := range excluded {
+		skip[pod] = true
+	}
+
+	rest := make([]*corev1.Pod, 0, len(pods)-len(excluded))
+	for _, pod := range pods {
+		if !skip[pod] {
+			rest = append(rest, pod)
+		}
+	}
+	return rest
+}
+
+// reloadInPlace calls the reload endpoint of the given pods and returns the pods that must be restarted instead.
+func (r *reloader) reloadInPlace(
+	ctx context.Context,
+	l *slog.Logger,
+	ref *corev1.ObjectReference,
+	keys []string,
+	hash string,
+	pods []*corev1.Pod,
+) []*corev1.Pod {
+	event := r.notifier.newEvent(ctx, ref, keys, strategyHTTP, pods)
+	r.notifier.notify(event.with(eventStarted, ""))
+
+	failed := r.http.reloadPods(ctx, l, ref, hash, pods)
+	if len(failed) > 0 {
+		r.notifier.notify(event.with(eventFailed, fmt.Sprintf("%d of %d pods falling back to restart", len(failed), len(pods))))
+		return failed
+	}
+
+	r.notifier.notify(event.with(eventSucceeded, ""))
+	return nil
+}
+
+// changedKeys returns the sorted keys whose values differ between the two maps, including keys present in only one
+// of them.
+func changedKeys[V string | []byte](oldData, newData map[string]V) []string {
+	keys := make([]string, 0)
+	for k, newValue := range newData {
+		oldValue, ok := oldData[k]
+		if !ok || string(oldValue) != string(newValue) {
+			keys = append(keys, k)
+		}
+	}
+	for k := range oldData {
+		if _, ok := newData[k]; !ok {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// dataKeys returns the sorted keys of the given map.
+func dataKeys[V string | []byte](data map[string]V) []string {
+	return changedKeys(nil, data)
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/fake"
+
+	"github.com/jacobbrewer1/web/cache"
+)
+
+func testableReloader(
+	t *testing.T,
+	bucket cache.HashBucket,
+	kubeClient kubernetes.Interface,
+	informerFactory informers.SharedInformerFactory,
+) *reloader {
+	t.Helper()
+
+	podIndexer, err := addDependencyIndex(informerFactory.Core().V1().Pods().Informer(), false, nil)
+	require.NoError(t, err)
+
+	return &reloader{
+		bucket:          bucket,
+		kubeClient:      kubeClient,
+		podLister:       informerFactory.Core().V1().Pods().Lister(),
+		podIndexer:      podIndexer,
+		configMapLister: informerFactory.Core().V1().ConfigMaps().Lister(),
+		secretLister:    informerFactory.Core().V1().Secrets().Lister(),
+		pause:           testablePauser(t, kubeClient, informerFactory),
+		breaker:         testableCircuitBreaker(t, 0, kubeClient, informerFactory),
+		killer:          testablePodKiller(t, kubeClient),
+		notifier:        newNotifier(kubeClient, nil, 10, 0),
+		http:            testableHTTPReloader(t, time.Second, 0, 0),
+		validator:       newContentValidator(kubeClient, informerFactory.Core().V1().ConfigMaps().Lister()),
+		tracker:         newReloadTracker(10),
+		namespaceLister: testableNamespaceLister(t, kubeClient),
+		deletePolicy:    deletePolicyRestart,
+		defaultStrategy: restartStrategy{name: strategyDelete},
+		batchTimeout:    time.Second,
+	}
+}
+
+func Test_ChangedKeys(t *testing.T) {
+	t.Parallel()
+
+	t.Run("strings", func(t *testing.T) {
+		t.Parallel()
+
+		got := changedKeys(
+			map[string]string{"same": "a", "changed": "b", "removed": "c"},
+			map[string]string{"same": "a", "changed": "B", "added": "d"},
+		)
+		require.Equal(t, []string{"added", "changed", "removed"}, got)
+	})
+
+	t.Run("bytes", func(t *testing.T) {
+		t.Parallel()
+
+		got := changedKeys(
+			map[string][]byte{"same": []byte("a"), "changed": []byte("b")},
+			map[string][]byte{"same": []byte("a"), "changed": []byte("B")},
+		)
+		require.Equal(t, []string{"changed"}, got)
+	})
+
+	t.Run("all keys", func(t *testing.T) {
+		t.Parallel()
+
+		got := dataKeys(map[string]string{"b": "1", "a": "2"})
+		require.Equal(t, []string{"a", "b"}, got)
+	})
+}
+
+func Test_DependencyLabel(t *testing.T) {
+	t.Parallel()
+
+	require.Equal(t, "reloader/configmap", dependencyLabel("ConfigMap"))
+	require.Equal(t, "reloader/secret", dependencyLabel("Secret"))
+}
+
+func Test_PodsStartedBefore(t *testing.T) {
+	t.Parallel()
+
+	created := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	pod := func(name string, started time.Time, terminating bool) *corev1.Pod {
+		p := testableDependentPod(t, name, "default", "Secret", "tls")
+		if !started.IsZero() {
+			p.Status.StartTime = &metav1.Time{Time: started}
+		}
+		if terminating {
+			p.DeletionTimestamp = &metav1.Time{Time: created}
+		}
+		return p
+	}
+
+	started := podsStartedBefore([]*corev1.Pod{
+		pod("old", created.Add(-time.Hour), false),
+		pod("new", created.Add(time.Hour), false),
+		pod("pending", time.Time{}, false),
+		pod("terminating", created.Add(-time.Hour), true),
+	}, created)
+	require.Len(t, started, 1)
+	require.Equal(t, "old", started[0].Name)
+}
+
+func Test_ReloaderTriggers(t *testing.T) {
+	t.Parallel()
+
+	enabled := map[string]string{labelEnabled: "true"}
+	ignored := map[string]string{annotationIgnore: "true"}
+
+	tests := []struct {
+		name        string
+		strict      bool
+		labels      map[string]string
+		annotations map[string]string
+		want        bool
+	}{
+		{name: "default", want: true},
+		{name: "ignored", annotations: ignored, want: false},
+		{name: "ignore false", annotations: map[string]string{annotationIgnore: "false"}, want: true},
+		{name: "strict not enabled", strict: true, want: false},
+		{name: "strict enabled", strict: true, labels: enabled, want: true},
+		{name: "strict enabled and ignored", strict: true, labels: enabled, annotations: ignored, want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			r := &reloader{strict: tt.strict}
+			require.Equal(t, tt.want, r.triggers(tt.labels, tt.annotations))
+		})
+	}
+}
+
+func Test_ReloaderDeleted(t *testing.T) {
+	t.Parallel()
+
+	r := &reloader{kubeClient: fake.NewClientset(&corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "db", Namespace: "default"},
+	})}
+
+	require.False(t, r.deleted(context.Background(), &corev1.ObjectReference{Kind: "Secret", Namespace: "default", Name: "db"}))
+	require.True(t, r.deleted(context.Background(), &corev1.ObjectReference{Kind: "Secret", Namespace: "default", Name: "gone"}))
+	require.True(t, r.deleted(context.Background(), &corev1.ObjectReference{Kind: "ConfigMap", Namespace: "default", Name: "db"}))
+}
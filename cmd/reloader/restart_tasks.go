@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"sync"
+)
+
+// restartTasks runs restarts off the informer handlers, so that a throttled or slow restart does not hold up the
+// events of other objects. The tasks of a key run one at a time, in the order they were submitted. A nil restartTasks
+// runs the tasks inline.
+type restartTasks struct {
+	// mut guards the tails.
+	mut *sync.Mutex
+
+	// tails holds the channel closed when the last task submitted for a key is done, by key.
+	tails map[string]chan struct{}
+
+	// wg tracks the tasks not yet done.
+	wg *sync.WaitGroup
+}
+
+// newRestartTasks creates a new restartTasks.
+func newRestartTasks() *restartTasks {
+	return &restartTasks{
+		mut:   new(sync.Mutex),
+		tails: make(map[string]chan struct{}),
+		wg:    new(sync.WaitGroup),
+	}
+}
+
+// run runs the task in the background once the tasks submitted before it for the same key are done. When the context
+// is done, the task runs without waiting, so that it can give up and report it.
+func (t *restartTasks) run(ctx context.Context, key string, task func(context.Context)) {
+	if t == nil {
+		task(ctx)
+		return
+	}
+
+	done := make(chan struct{})
+	t.mut.Lock()
+	previous := t.tails[key]
+	t.tails[key] = done
+	t.mut.Unlock()
+
+	t.wg.Add(1)
+	go func() {
+		defer t.wg.Done()
+		defer func() {
+			t.mut.Lock()
+			if t.tails[key] == done {
+				delete(t.tails, key)
+			}
+			t.mut.Unlock()
+			close(done)
+		}()
+
+		if previous != nil {
+			select {
+			case <-previous:
+			case <-ctx.Done():
+			}
+		}
+		task(ctx)
+	}()
+}
+
+// wait blocks until all the tasks submitted so far are done.
+func (t *restartTasks) wait() {
+	if t != nil {
+		t.wg.Wait()
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func Test_RestartTasks(t *testing.T) {
+	t.Parallel()
+
+	t.Run("inline", func(t *testing.T) {
+		t.Parallel()
+
+		var tasks *restartTasks
+		ran := false
+		tasks.run(context.Background(), "default/cm", func(context.Context) {
+			ran = true
+		})
+		require.True(t, ran)
+	})
+
+	t.Run("in order per key", func(t *testing.T) {
+		t.Parallel()
+
+		tasks := newRestartTasks()
+		mut := new(sync.Mutex)
+		order := make([]int, 0)
+		for i := range 5 {
+			tasks.run(context.Background(), "default/cm", func(context.Context) {
+				// Later tasks would overtake the earlier ones if they did not wait for them.
+				time.Sleep(time.Duration(5-i) * time.Millisecond)
+				mut.Lock()
+				order = append(order, i)
+				mut.Unlock()
+			})
+		}
+		tasks.wait()
+
+		require.Equal(t, []int{0, 1, 2, 3, 4}, order)
+	})
+
+	t.Run("keys do not wait for each other", func(t *testing.T) {
+		t.Parallel()
+
+		tasks := newRestartTasks()
+		blocked := make(chan struct{})
+		t.Cleanup(func() {
+			close(blocked)
+			tasks.wait()
+		})
+
+		tasks.run(context.Background(), "default/slow", func(context.Context) {
+			<-blocked
+		})
+
+		done := make(chan struct{})
+		tasks.run(context.Background(), "default/fast", func(context.Context) {
+			close(done)
+		})
+
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatal("task waited for another key")
+		}
+	})
+
+	t.Run("cancelled", func(t *testing.T) {
+		t.Parallel()
+
+		tasks := newRestartTasks()
+		blocked := make(chan struct{})
+		t.Cleanup(func() {
+			close(blocked)
+			tasks.wait()
+		})
+
+		ctx, cancel := context.WithCancel(context.Background())
+		tasks.run(ctx, "default/cm", func(context.Context) {
+			<-blocked
+		})
+
+		errs := make(chan error, 1)
+		tasks.run(ctx, "default/cm", func(ctx context.Context) {
+			errs <- ctx.Err()
+		})
+		cancel()
+
+		select {
+		case err := <-errs:
+			require.ErrorIs(t, err, context.Canceled)
+		case <-time.After(5 * time.Second):
+			t.Fatal("task did not run once cancelled")
+		}
+	})
+}
@@ -5,37 +5,31 @@ import (
 	"log/slog"
 
 	corev1 "k8s.io/api/core/v1"
-	"k8s.io/apimachinery/pkg/labels"
-	"k8s.io/client-go/kubernetes"
-	listersv1 "k8s.io/client-go/listers/core/v1"
 	kubecache "k8s.io/client-go/tools/cache"
 
-	"github.com/jacobbrewer1/web/cache"
 	"github.com/jacobbrewer1/web/logging"
 )
 
-// watchSecrets starts watching for secret updates and deletes.
+// watchSecrets starts watching for secret creations, updates and deletes.
 func (a *App) watchSecrets(ctx context.Context) {
 	informer := a.base.SecretInformer()
 
 	handler := kubecache.ResourceEventHandlerFuncs{
+		AddFunc: onSecretAdd(
+			ctx,
+			logging.LoggerWithComponent(a.base.Logger(), "secrets"),
+			a.reloader,
+		),
 		UpdateFunc: onSecretUpdate(
 			ctx,
 			logging.LoggerWithComponent(a.base.Logger(), "secrets"),
-			a.base.ServiceEndpointHashBucket(),
-			a.base.KubeClient(),
-			a.base.PodLister(),
+			a.reloader,
 		),
-	}
-
-	if a.config.KillOnDelete {
-		handler.DeleteFunc = onSecretDelete(
+		DeleteFunc: onSecretDelete(
 			ctx,
 			logging.LoggerWithComponent(a.base.Logger(), "secrets"),
-			a.base.ServiceEndpointHashBucket(),
-			a.base.KubeClient(),
-			a.base.PodLister(),
-		)
+			a.reloader,
+		),
 	}
 
 	_, err := informer.AddEventHandler(handler)
@@ -48,13 +42,58 @@ func (a *App) watchSecrets(ctx context.Context) {
 	<-ctx.Done()
 }
 
+// onSecretAdd is called when a secret is added. A secret recreated within the delete grace period is handled as an
+// update, otherwise the dependent pods that started before the secret was created are restarted. The informer replays
+// every secret as added when it starts, which catches up on secrets created while reloader was down.
+func onSecretAdd(
+	ctx context.Context,
+	l *slog.Logger,
+	r *reloader,
+) func(any) {
+	return func(obj any) {
+		secret, ok := obj.(*corev1.Secret)
+		if !ok {
+			return
+		}
+
+		if !r.bucket.InBucket(secret.Name) {
+			return
+		}
+
+		if !r.triggers(secret.Labels, secret.Annotations) {
+			return
+		}
+
+		ref := objectReference("Secret", secret)
+		if keys, ok := r.recreated(l, ref, secret.Data); ok {
+			if len(keys) == 0 || !r.validator.allow(ctx, l, ref, secret.Annotations, secret.Data) {
+				return
+			}
+			r.reload(ctx, l, ref, keys, secretHash(secret))
+			return
+		}
+
+		stale, err := r.createdDependents(ref, secret.CreationTimestamp.Time)
+		if err != nil {
+			l.Error("failed to list pods", slog.String(logging.KeyError, err.Error()))
+			return
+		} else if len(stale) == 0 {
+			return
+		}
+
+		if !r.validator.allow(ctx, l, ref, secret.Annotations, secret.Data) {
+			return
+		}
+
+		r.reloadCreated(ctx, l, ref, dataKeys(secret.Data), stale)
+	}
+}
+
 // onSecretUpdate is called when a secret is updated. It checks if the secret is in the
 func onSecretUpdate(
 	ctx context.Context,
 	l *slog.Logger,
-	bucket cache.HashBucket,
-	kubeClient kubernetes.Interface,
-	podLister listersv1.PodLister,
+	r *reloader,
 ) func(any, any) {
 	return func(oldObj, newObj any) {
 		secret, ok := newObj.(*corev1.Secret)
@@ -62,24 +101,31 @@ func onSecretUpdate(
 			return
 		}
 
-		if !bucket.InBucket(secret.Name) {
+		// Informer resyncs deliver updates for unchanged objects, which must not restart anything.
+		old, ok := oldObj.(*corev1.Secret)
+		if ok && old.ResourceVersion == secret.ResourceVersion {
 			return
 		}
 
-		// Get all pods that use this secret. This is specified with the label
-		// "reloader/secret": "<secret-name>".
-		pods, err := podLister.Pods(secret.Namespace).List(labels.SelectorFromSet(map[string]string{
-			"reloader/secret": secret.Name,
-		}))
-		if err != nil {
-			l.Error("failed to list pods", slog.String(logging.KeyError, err.Error()))
+		if !r.bucket.InBucket(secret.Name) {
 			return
 		}
 
-		if err := killPods(ctx, kubeClient, pods); err != nil { // nolint:revive // Traditional error handling
-			l.Error("failed to kill pods", slog.String(logging.KeyError, err.Error()))
+		if !r.triggers(secret.Labels, secret.Annotations) {
 			return
 		}
+
+		keys := dataKeys(secret.Data)
+		if ok {
+			keys = changedKeys(old.Data, secret.Data)
+		}
+
+		ref := objectReference("Secret", secret)
+		if !r.validator.allow(ctx, l, ref, secret.Annotations, secret.Data) {
+			return
+		}
+
+		r.reload(ctx, l, ref, keys, secretHash(secret))
 	}
 }
 
@@ -87,9 +133,7 @@ func onSecretUpdate(
 func onSecretDelete(
 	ctx context.Context,
 	l *slog.Logger,
-	bucket cache.HashBucket,
-	kubeClient kubernetes.Interface,
-	podLister listersv1.PodLister,
+	r *reloader,
 ) func(any) {
 	return func(obj any) {
 		secret, ok := obj.(*corev1.Secret)
@@ -97,21 +141,20 @@ func onSecretDelete(
 			return
 		}
 
-		if !bucket.InBucket(secret.Name) {
+		if !r.bucket.InBucket(secret.Name) {
 			return
 		}
 
-		pods, err := podLister.Pods(secret.Namespace).List(labels.SelectorFromSet(map[string]string{
-			"reloader/secret": secret.Name,
-		}))
-		if err != nil {
-			l.Error("failed to list pods", slog.String(logging.KeyError, err.Error()))
+		if !r.triggers(secret.Labels, secret.Annotations) {
 			return
 		}
 
-		if err := killPods(ctx, kubeClient, pods); err != nil { // nolint:revive // Traditional error handling
-			l.Error("failed to kill pods", slog.String(logging.KeyError, err.Error()))
+		ref := objectReference("Secret", secret)
+		if !r.deleted(ctx, ref) {
+			l.Info("object no longer watched, skipping reload", slog.String(logKeyObject, referenceKey(ref)))
 			return
 		}
+
+		r.reloadDeleted(ctx, l, ref, dataKeys(secret.Data), secret.Data, secret.Annotations)
 	}
 }
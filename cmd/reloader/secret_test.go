@@ -9,6 +9,7 @@ import (
 
 	"github.com/stretchr/testify/require"
 	corev1 "k8s.io/api/core/v1"
+	kubeerrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/client-go/informers"
 	"k8s.io/client-go/kubernetes/fake"
@@ -60,21 +61,21 @@ func Test_OnSecretUpdate(t *testing.T) {
 		}
 
 		kubeClient := fake.NewClientset()
-		informerFactory := informers.NewSharedInformerFactory(kubeClient, 5*time.Millisecond)
-		podLister := informerFactory.Core().V1().Pods().Lister()
-		informerFactory.Start(ctx.Done())
-		informerFactory.WaitForCacheSync(ctx.Done())
-
 		for _, pod := range pods {
 			_, err := kubeClient.CoreV1().Pods(pod.Namespace).Create(ctx, pod, metav1.CreateOptions{})
 			require.NoError(t, err)
 		}
 
+		informerFactory := informers.NewSharedInformerFactory(kubeClient, 5*time.Millisecond)
+		rel := testableReloader(t, bucket, kubeClient, informerFactory)
+		informerFactory.Start(ctx.Done())
+		informerFactory.WaitForCacheSync(ctx.Done())
+
 		secret := &corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: "in-bucket", Namespace: "default"}}
 		_, err := kubeClient.CoreV1().Secrets(secret.Namespace).Create(ctx, secret, metav1.CreateOptions{})
 		require.NoError(t, err)
 
-		handler := onSecretUpdate(ctx, logger, bucket, kubeClient, podLister)
+		handler := onSecretUpdate(ctx, logger, rel)
 
 		handler(nil, secret)
 
@@ -112,7 +113,7 @@ func Test_OnSecretUpdate(t *testing.T) {
 
 		kubeClient := fake.NewClientset()
 		informerFactory := informers.NewSharedInformerFactory(kubeClient, 5*time.Millisecond)
-		podLister := informerFactory.Core().V1().Pods().Lister()
+		rel := testableReloader(t, bucket, kubeClient, informerFactory)
 		informerFactory.Start(ctx.Done())
 		informerFactory.WaitForCacheSync(ctx.Done())
 
@@ -121,7 +122,7 @@ func Test_OnSecretUpdate(t *testing.T) {
 			require.NoError(t, err)
 		}
 
-		handler := onSecretUpdate(ctx, logger, bucket, kubeClient, podLister)
+		handler := onSecretUpdate(ctx, logger, rel)
 
 		handler(nil, pods[0])
 
@@ -153,7 +154,7 @@ func Test_OnSecretUpdate(t *testing.T) {
 
 		kubeClient := fake.NewClientset()
 		informerFactory := informers.NewSharedInformerFactory(kubeClient, 5*time.Millisecond)
-		podLister := informerFactory.Core().V1().Pods().Lister()
+		rel := testableReloader(t, bucket, kubeClient, informerFactory)
 		informerFactory.Start(ctx.Done())
 		informerFactory.WaitForCacheSync(ctx.Done())
 
@@ -166,7 +167,7 @@ func Test_OnSecretUpdate(t *testing.T) {
 		_, err := kubeClient.CoreV1().Secrets(secret.Namespace).Create(ctx, secret, metav1.CreateOptions{})
 		require.NoError(t, err)
 
-		handler := onSecretUpdate(ctx, logger, bucket, kubeClient, podLister)
+		handler := onSecretUpdate(ctx, logger, rel)
 
 		handler(nil, secret)
 
@@ -178,3 +179,36 @@ func Test_OnSecretUpdate(t *testing.T) {
 		}
 	})
 }
+
+func Test_OnSecretAdd(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	created := time.Now().Add(-time.Minute)
+	oldPod := testableDependentPod(t, "old", "default", "Secret", "app")
+	oldPod.Status.StartTime = &metav1.Time{Time: created.Add(-time.Hour)}
+	newPod := testableDependentPod(t, "new", "default", "Secret", "app")
+	newPod.Status.StartTime = &metav1.Time{Time: created.Add(time.Second)}
+
+	kubeClient := fake.NewClientset(oldPod, newPod)
+	informerFactory := informers.NewSharedInformerFactory(kubeClient, 0)
+	rel := testableReloader(t, cache.NewFixedHashBucket(1), kubeClient, informerFactory)
+	informerFactory.Start(ctx.Done())
+	informerFactory.WaitForCacheSync(ctx.Done())
+
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:              "app",
+			Namespace:         "default",
+			CreationTimestamp: metav1.NewTime(created),
+		},
+	}
+	onSecretAdd(ctx, slog.New(slog.DiscardHandler), rel)(secret)
+
+	_, err := kubeClient.CoreV1().Pods("default").Get(ctx, "old", metav1.GetOptions{})
+	require.True(t, kubeerrors.IsNotFound(err))
+	_, err = kubeClient.CoreV1().Pods("default").Get(ctx, "new", metav1.GetOptions{})
+	require.NoError(t, err)
+}
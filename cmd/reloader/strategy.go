@@ -0,0 +1,445 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/multierr"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/wait"
+
+	"github.com/jacobbrewer1/web/logging"
+)
+
+const (
+	// annotationStrategy selects how pods are restarted. It is read from the pods, as set in the pod template of their
+	// workload, and from the top level workload owning them, in that order. The value is the name of a strategy,
+	// optionally followed by comma separated options, such as "delete,batch-size=2,grace-period=10s".
+	annotationStrategy = "reloader/strategy"
+
+	// strategyRollout restarts pods by rolling out their top level Deployment, StatefulSet or DaemonSet, as
+	// "kubectl rollout restart" does, so that their controller replaces them within its update strategy.
+	strategyRollout = "rollout"
+
+	// annotationRestartedAt is the pod template annotation changed to roll out a workload.
+	annotationRestartedAt = "kubectl.kubernetes.io/restartedAt"
+
+	// batchPollInterval is how often the replacements of a batch of deleted pods are checked.
+	batchPollInterval = time.Second
+)
+
+// ErrInvalidStrategy is returned when a restart strategy or one of its options is not recognised.
+var ErrInvalidStrategy = errors.New("invalid restart strategy")
+
+type (
+	// restartStrategy is a parsed restart strategy with its options.
+	restartStrategy struct {
+		// name is the strategy, either strategyDelete or strategyRollout.
+		name string
+
+		// gracePeriod overrides the termination grace period of deleted pods. Nil keeps the pod's own.
+		gracePeriod *int64
+
+		// propagation is the propagation policy of the deletions. Nil uses the API server default.
+		propagation *metav1.DeletionPropagation
+
+		// batchSize is the number of pods deleted at once, waiting for each batch to be replaced before the next.
+		// Zero deletes every pod at once.
+		batchSize int
+	}
+
+	// strategyGroup is a set of pods restarted with the same strategy.
+	strategyGroup struct {
+		// strategy is the strategy of the pods.
+		strategy restartStrategy
+
+		// workload is the key of the top level workload of the pods when they are deleted in batches, which are
+		// waited on per workload. It is empty otherwise.
+		workload string
+
+		// pods are the pods to restart.
+		pods []*corev1.Pod
+	}
+)
+
+// parseStrategy parses the value of a strategy annotation, or of the default strategy.
+func parseStrategy(s string) (restartStrategy, error) {
+	fields := strings.Split(s, ",")
+	strategy := restartStrategy{name: strings.TrimSpace(fields[0])}
+	if strategy.name != strategyDelete && strategy.name != strategyRollout {
+		return restartStrategy{}, fmt.Errorf("%w: %q: unknown strategy %q", ErrInvalidStrategy, s, strategy.name)
+	}
+
+	for _, field := range fields[1:] {
+		key, value, ok := strings.Cut(strings.TrimSpace(field), "=")
+		if !ok {
+			return restartStrategy{}, fmt.Errorf("%w: %q: option %q is not key=value", ErrInvalidStrategy, s, field)
+		} else if strategy.name != strategyDelete {
+			return restartStrategy{}, fmt.Errorf("%w: %q: %s takes no options", ErrInvalidStrategy, s, strategy.name)
+		}
+
+		switch key {
+		case "grace-period":
+			d, err := time.ParseDuration(value)
+			if err != nil || d < 0 {
+				return restartStrategy{}, fmt.Errorf("%w: %q: grace-period is not a duration of zero or more", ErrInvalidStrategy, s)
+			}
+			// Grace periods are whole seconds. They are rounded up, so that a short grace period is not turned into an
+			// immediate kill.
+			seconds := int64((d + time.Second - 1) / time.Second)
+			strategy.gracePeriod = &seconds
+		case "propagation":
+			propagation := metav1.DeletionPropagation(value)
+			switch propagation {
+			case metav1.DeletePropagationOrphan, metav1.DeletePropagationBackground, metav1.DeletePropagationForeground:
+				strategy.propagation = &propagation
+			default:
+				return restartStrategy{}, fmt.Errorf("%w: %q: unknown propagation %q", ErrInvalidStrategy, s, value)
+			}
+		case "batch-size":
+			size, err := strconv.Atoi(value)
+			if err != nil || size <= 0 {
+				return restartStrategy{}, fmt.Errorf("%w: %q: batch-size is not a positive integer", ErrInvalidStrategy, s)
+			}
+			strategy.batchSize = size
+		default:
+			return restartStrategy{}, fmt.Errorf("%w: %q: unknown option %q", ErrInvalidStrategy, s, key)
+		}
+	}
+
+	return strategy, nil
+}
+
+// deleteOptions returns the options the pods are deleted with.
+func (s restartStrategy) deleteOptions() metav1.DeleteOptions {
+	return metav1.DeleteOptions{
+		GracePeriodSeconds: s.gracePeriod,
+		PropagationPolicy:  s.propagation,
+	}
+}
+
+// restart restarts the given pods, each with the strategy of its annotation, of its workload's annotation or the
+// default one, in that order.
+func (r *reloader) restart(ctx context.Context, l *slog.Logger, pods []*corev1.Pod) error {
+	var errs error
+	for _, group := range r.strategyGroups(ctx, l, pods) {
+		errs = multierr.Append(errs, r.restartGroup(ctx, l, group))
+	}
+	return errs
+}
+
+// restartGroup restarts the pods of the group with its strategy.
+func (r *reloader) restartGroup(ctx context.Context, l *slog.Logger, group *strategyGroup) error {
+	if group.strategy.name == strategyRollout {
+		return r.rollout(ctx, l, group.pods)
+	}
+	return r.deleteInBatches(ctx, l, group.strategy, group.pods)
+}
+
+// restartNotified restarts the given pods like restart does for a change of the referenced object, notifying an event
+// per strategy group. Groups deleted in batches run on the restart task of their workload, so that waiting for
+// replacements holds up neither the restarts of other workloads nor those of the object. Done is called with the
+// combined error once every group is restarted.
+func (r *reloader) restartNotified(
+	ctx context.Context,
+	l *slog.Logger,
+	ref *corev1.ObjectReference,
+	keys []string,
+	pods []*corev1.Pod,
+	done func(error),
+) {
+	groups := r.strategyGroups(ctx, l, pods)
+
+	mut := new(sync.Mutex)
+	remaining := len(groups)
+	var errs error
+	for _, group := range groups {
+		event := r.notifier.newEvent(ctx, ref, keys, group.strategy.name, group.pods)
+		restart := func(ctx context.Context) {
+			r.notifier.notify(event.with(eventStarted, ""))
+			err := r.restartGroup(ctx, l, group)
+			if err != nil {
+				l.Error("failed to kill pods", slog.String(logging.KeyError, err.Error()))
+				r.notifier.notify(event.with(eventFailed, err.Error()))
+			} else {
+				r.notifier.notify(event.with(eventSucceeded, ""))
+			}
+
+			mut.Lock()
+			errs = multierr.Append(errs, err)
+			remaining--
+			last := remaining == 0
+			mut.Unlock()
+
+			if last {
+				done(errs)
+			}
+		}
+
+		if group.workload != "" {
+			r.tasks.run(ctx, group.workload, restart)
+		} else {
+			restart(ctx)
+		}
+	}
+}
+
+// strategyGroups groups the given pods by restart strategy, in the order the strategies are first seen. Pods deleted
+// in batches are further grouped by top level workload. Invalid annotations are reported by the admission webhook,
+// and fall back to the next strategy in line. Pods whose strategy is rollout but that have no workload to roll out are
+// deleted instead.
+func (r *reloader) strategyGroups(ctx context.Context, l *slog.Logger, pods []*corev1.Pod) []*strategyGroup {
+	groups := make([]*strategyGroup, 0)
+	byValue := make(map[string]*strategyGroup)
+	workloads := make(map[types.UID]metav1.Object)
+
+	for _, pod := range pods {
+		workload := r.podWorkload(ctx, pod, workloads)
+		value := podStrategy(l, pod, workload)
+		strategy, err := parseStrategy(value)
+		if err != nil {
+			// Only the default strategy is left, which is validated on startup.
+			strategy = r.defaultStrategy
+		}
+
+		if strategy.name == strategyRollout && !rollable(workload) {
+			l.Warn("pod has no workload to roll out, deleting it", slog.String(logKeyPod, pod.Name))
+			value, strategy = strategyDelete, restartStrategy{name: strategyDelete}
+		}
+
+		key := ""
+		if strategy.batchSize > 0 {
+			key = workloadKey(pod, workload)
+		}
+
+		group, ok := byValue[value+"\x00"+key]
+		if !ok {
+			group = &strategyGroup{strategy: strategy, workload: key}
+			byValue[value+"\x00"+key] = group
+			groups = append(groups, group)
+		}
+		group.pods = append(group.pods, pod)
+	}
+	return groups
+}
+
+// podStrategy returns the strategy annotation of the pod or of its top level workload, whichever is set first and
+// valid. An empty value stands for the default strategy.
+func podStrategy(l *slog.Logger, pod *corev1.Pod, workload metav1.Object) string {
+	candidates := []map[string]string{pod.Annotations}
+	if workload != nil {
+		candidates = append(candidates, workload.GetAnnotations())
+	}
+
+	for _, annotations := range candidates {
+		value, ok := annotations[annotationStrategy]
+		if !ok {
+			continue
+		}
+
+		_, err := parseStrategy(value)
+		if err == nil {
+			return value
+		}
+		l.Warn("ignoring strategy annotation",
+			slog.String(logKeyPod, pod.Name),
+			slog.String(logging.KeyError, err.Error()),
+		)
+	}
+	return ""
+}
+
+// podWorkload returns the top level workload owning the pod, or nil if it has none. The workloads are memoised by
+// controller, as most pods share theirs.
+func (r *reloader) podWorkload(ctx context.Context, pod *corev1.Pod, workloads map[types.UID]metav1.Object) metav1.Object {
+	controller := metav1.GetControllerOf(pod)
+	if controller == nil {
+		return nil
+	}
+
+	workload, ok := workloads[controller.UID]
+	if !ok {
+		if owners, err := podOwners(ctx, r.kubeClient, pod); err == nil && len(owners) > 0 {
+			workload = owners[len(owners)-1]
+		}
+		workloads[controller.UID] = workload
+	}
+	return workload
+}
+
+// workloadKey returns the key of the restart task of the pod's top level workload, such as
+// "workload/default/Deployment/api". Pods without a workload are keyed by themselves.
+func workloadKey(pod *corev1.Pod, workload metav1.Object) string {
+	if workload == nil {
+		return "workload/" + pod.Namespace + "/Pod/" + pod.Name
+	}
+	return "workload/" + pod.Namespace + "/" + ownerKind(workload) + "/" + workload.GetName()
+}
+
+// rollable reports whether the workload is a Deployment, StatefulSet or DaemonSet, which can be rolled out.
+func rollable(workload metav1.Object) bool {
+	switch ownerKind(workload) {
+	case "Deployment", "StatefulSet", "DaemonSet":
+		return true
+	default:
+		return false
+	}
+}
+
+// rollout rolls out the top level workloads of the given pods, once per workload. Each workload takes the restart
+// budget of the pods it replaces before it is rolled out.
+func (r *reloader) rollout(ctx context.Context, l *slog.Logger, pods []*corev1.Pod) error {
+	patch := fmt.Appendf(nil, `{"spec":{"template":{"metadata":{"annotations":{%q:%q}}}}}`,
+		annotationRestartedAt, time.Now().UTC().Format(time.RFC3339Nano))
+
+	owners := make([]metav1.Object, 0)
+	byOwner := make(map[types.UID][]*corev1.Pod)
+	workloads := make(map[types.UID]metav1.Object)
+	for _, pod := range pods {
+		owner := r.podWorkload(ctx, pod, workloads)
+		if !rollable(owner) {
+			continue
+		}
+
+		if _, ok := byOwner[owner.GetUID()]; !ok {
+			owners = append(owners, owner)
+		}
+		byOwner[owner.GetUID()] = append(byOwner[owner.GetUID()], pod)
+	}
+
+	var errs error
+	for _, owner := range owners {
+		replaced := byOwner[owner.GetUID()]
+		kind := ownerKind(owner)
+
+		var err error
+		for range replaced {
+			if err = r.killer.limiter.wait(ctx, owner.GetNamespace()); err != nil {
+				break
+			}
+		}
+
+		if err == nil {
+			switch kind {
+			case "Deployment":
+				_, err = r.kubeClient.AppsV1().Deployments(owner.GetNamespace()).Patch(
+					ctx, owner.GetName(), types.MergePatchType, patch, metav1.PatchOptions{})
+			case "StatefulSet":
+				_, err = r.kubeClient.AppsV1().StatefulSets(owner.GetNamespace()).Patch(
+					ctx, owner.GetName(), types.MergePatchType, patch, metav1.PatchOptions{})
+			case "DaemonSet":
+				_, err = r.kubeClient.AppsV1().DaemonSets(owner.GetNamespace()).Patch(
+					ctx, owner.GetName(), types.MergePatchType, patch, metav1.PatchOptions{})
+			}
+		}
+		if err != nil {
+			errs = multierr.Append(errs, fmt.Errorf("failed to roll out %s %s/%s: %w",
+				kind, owner.GetNamespace(), owner.GetName(), err))
+			continue
+		}
+
+		podsRestarted.WithLabelValues(owner.GetNamespace()).Add(float64(len(replaced)))
+		l.Info("rolled out workload", slog.String(logKeyWorkload, kind+"/"+owner.GetName()))
+	}
+	return errs
+}
+
+// deleteInBatches deletes the given pods with the options of the strategy. With a batch size, the pods are deleted a
+// batch at a time, and each batch must be replaced by as many ready pods as it held before the next one is deleted.
+func (r *reloader) deleteInBatches(
+	ctx context.Context,
+	l *slog.Logger,
+	strategy restartStrategy,
+	pods []*corev1.Pod,
+) error {
+	opts := strategy.deleteOptions()
+	if strategy.batchSize == 0 {
+		return r.killer.kill(ctx, pods, opts)
+	}
+
+	for start := 0; start < len(pods); start += strategy.batchSize {
+		batch := pods[start:min(start+strategy.batchSize, len(pods))]
+		ready := r.readyPods(batch, nil)
+		if err := r.killer.kill(ctx, batch, opts); err != nil {
+			return err
+		}
+
+		if start+len(batch) == len(pods) {
+			break
+		}
+
+		l.Info("waiting for deleted pods to be replaced", slog.Int(logKeyPods, len(batch)))
+		if err := r.waitReplaced(ctx, batch, ready); err != nil {
+			return fmt.Errorf("deleted pods not replaced, %d pods left: %w", len(pods)-start-len(batch), err)
+		}
+	}
+	return nil
+}
+
+// readyPods counts the ready pods of the controllers of the given pods that are not being deleted, by controller. The
+// excluded pods are not counted. Pods without a controller are never replaced, so are not counted either.
+func (r *reloader) readyPods(pods []*corev1.Pod, excluded map[types.UID]bool) map[types.UID]int {
+	counts := make(map[types.UID]int)
+	for _, pod := range pods {
+		controller := metav1.GetControllerOf(pod)
+		if controller == nil {
+			continue
+		} else if _, ok := counts[controller.UID]; ok {
+			continue
+		}
+
+		counts[controller.UID] = 0
+		siblings, err := r.podLister.Pods(pod.Namespace).List(labels.Everything())
+		if err != nil {
+			continue
+		}
+
+		for _, sibling := range siblings {
+			owner := metav1.GetControllerOf(sibling)
+			if owner == nil || owner.UID != controller.UID || excluded[sibling.UID] {
+				continue
+			} else if sibling.DeletionTimestamp == nil && podReady(sibling) {
+				counts[controller.UID]++
+			}
+		}
+	}
+	return counts
+}
+
+// waitReplaced waits until the controllers of the given deleted pods have as many ready pods as before the deletion,
+// or the batch timeout ends.
+func (r *reloader) waitReplaced(ctx context.Context, deleted []*corev1.Pod, before map[types.UID]int) error {
+	excluded := make(map[types.UID]bool, len(deleted))
+	for _, pod := range deleted {
+		excluded[pod.UID] = true
+	}
+
+	return wait.PollUntilContextTimeout(ctx, batchPollInterval, r.batchTimeout, true, func(context.Context) (bool, error) {
+		after := r.readyPods(deleted, excluded)
+		for controller, count := range before {
+			if after[controller] < count {
+				return false, nil
+			}
+		}
+		return true, nil
+	})
+}
+
+// podReady reports whether the pod has the Ready condition.
+func podReady(pod *corev1.Pod) bool {
+	for _, condition := range pod.Status.Conditions {
+		if condition.Type == corev1.PodReady {
+			return condition.Status == corev1.ConditionTrue
+		}
+	}
+	return false
+}
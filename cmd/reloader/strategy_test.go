@@ -0,0 +1,337 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+
+	"github.com/jacobbrewer1/web/cache"
+)
+
+func Test_ParseStrategy(t *testing.T) {
+	t.Parallel()
+
+	gracePeriod := int64(10)
+	oneSecond := int64(1)
+	zero := int64(0)
+	foreground := metav1.DeletePropagationForeground
+
+	valid := map[string]restartStrategy{
+		"delete":  {name: strategyDelete},
+		"rollout": {name: strategyRollout},
+		"delete, batch-size=2, grace-period=10s, propagation=Foreground": {
+			name:        strategyDelete,
+			gracePeriod: &gracePeriod,
+			propagation: &foreground,
+			batchSize:   2,
+		},
+		"delete,grace-period=500ms": {name: strategyDelete, gracePeriod: &oneSecond},
+		"delete,grace-period=9.5s":  {name: strategyDelete, gracePeriod: &gracePeriod},
+		"delete,grace-period=0s":    {name: strategyDelete, gracePeriod: &zero},
+	}
+	for s, want := range valid {
+		got, err := parseStrategy(s)
+		require.NoError(t, err, s)
+		require.Equal(t, want, got, s)
+	}
+
+	for _, s := range []string{
+		"",
+		"recreate",
+		"delete,batch-size",
+		"delete,batch-size=0",
+		"delete,grace-period=-1s",
+		"delete,propagation=Cascade",
+		"delete,surge=1",
+		"rollout,batch-size=2",
+	} {
+		_, err := parseStrategy(s)
+		require.ErrorIs(t, err, ErrInvalidStrategy, s)
+	}
+}
+
+func Test_ReloaderRestart(t *testing.T) {
+	t.Parallel()
+
+	// testableWorkload returns a Deployment with the given strategy annotation and its ReplicaSet.
+	testableWorkload := func(t *testing.T, strategy string) (*appsv1.Deployment, *appsv1.ReplicaSet) {
+		t.Helper()
+
+		deployment := &appsv1.Deployment{
+			ObjectMeta: metav1.ObjectMeta{Name: "api", Namespace: "default", UID: "deployment"},
+		}
+		if strategy != "" {
+			deployment.Annotations = map[string]string{annotationStrategy: strategy}
+		}
+
+		replicaSet := &appsv1.ReplicaSet{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      "api-abc",
+				Namespace: "default",
+				UID:       "replicaset",
+				OwnerReferences: []metav1.OwnerReference{
+					*metav1.NewControllerRef(deployment, appsv1.SchemeGroupVersion.WithKind("Deployment")),
+				},
+			},
+		}
+		return deployment, replicaSet
+	}
+
+	// testableOwnedPod returns a ready pod of the given ReplicaSet, or a bare pod without one.
+	testableOwnedPod := func(t *testing.T, name string, replicaSet *appsv1.ReplicaSet) *corev1.Pod {
+		t.Helper()
+
+		pod := testableDependentPod(t, name, "default", "ConfigMap", "app")
+		pod.UID = types.UID(name)
+		pod.Status.Conditions = []corev1.PodCondition{{Type: corev1.PodReady, Status: corev1.ConditionTrue}}
+		if replicaSet != nil {
+			pod.OwnerReferences = []metav1.OwnerReference{
+				*metav1.NewControllerRef(replicaSet, appsv1.SchemeGroupVersion.WithKind("ReplicaSet")),
+			}
+		}
+		return pod
+	}
+
+	setup := func(t *testing.T, objects ...runtime.Object) (*reloader, *fake.Clientset) {
+		t.Helper()
+
+		ctx, cancel := context.WithCancel(context.Background())
+		t.Cleanup(cancel)
+
+		kubeClient := fake.NewClientset(objects...)
+		informerFactory := informers.NewSharedInformerFactory(kubeClient, 0)
+		r := testableReloader(t, cache.NewFixedHashBucket(1), kubeClient, informerFactory)
+		informerFactory.Start(ctx.Done())
+		informerFactory.WaitForCacheSync(ctx.Done())
+
+		return r, kubeClient
+	}
+
+	pods := func(t *testing.T, kubeClient *fake.Clientset, names ...string) []*corev1.Pod {
+		t.Helper()
+
+		got := make([]*corev1.Pod, 0, len(names))
+		for _, name := range names {
+			pod, err := kubeClient.CoreV1().Pods("default").Get(context.Background(), name, metav1.GetOptions{})
+			require.NoError(t, err)
+			got = append(got, pod)
+		}
+		return got
+	}
+
+	podExists := func(t *testing.T, kubeClient *fake.Clientset, name string) bool {
+		t.Helper()
+		_, err := kubeClient.CoreV1().Pods("default").Get(context.Background(), name, metav1.GetOptions{})
+		return err == nil
+	}
+
+	restartedAt := func(t *testing.T, kubeClient *fake.Clientset) string {
+		t.Helper()
+
+		deployment, err := kubeClient.AppsV1().Deployments("default").Get(context.Background(), "api", metav1.GetOptions{})
+		require.NoError(t, err)
+		return deployment.Spec.Template.Annotations[annotationRestartedAt]
+	}
+
+	t.Run("workload rollout", func(t *testing.T) {
+		t.Parallel()
+
+		deployment, replicaSet := testableWorkload(t, "rollout")
+		r, kubeClient := setup(t, deployment, replicaSet,
+			testableOwnedPod(t, "api-abc-1", replicaSet),
+			testableOwnedPod(t, "api-abc-2", replicaSet),
+		)
+		err := r.restart(context.Background(), slog.New(slog.DiscardHandler), pods(t, kubeClient, "api-abc-1", "api-abc-2"))
+		require.NoError(t, err)
+
+		require.NotEmpty(t, restartedAt(t, kubeClient))
+		require.True(t, podExists(t, kubeClient, "api-abc-1"))
+		require.True(t, podExists(t, kubeClient, "api-abc-2"))
+	})
+
+	t.Run("pod strategy first", func(t *testing.T) {
+		t.Parallel()
+
+		deployment, replicaSet := testableWorkload(t, "rollout")
+		pod := testableOwnedPod(t, "api-abc-1", replicaSet)
+		pod.Annotations = map[string]string{annotationStrategy: "delete"}
+		r, kubeClient := setup(t, deployment, replicaSet, pod)
+		err := r.restart(context.Background(), slog.New(slog.DiscardHandler), pods(t, kubeClient, "api-abc-1"))
+		require.NoError(t, err)
+
+		require.Empty(t, restartedAt(t, kubeClient))
+		require.False(t, podExists(t, kubeClient, "api-abc-1"))
+	})
+
+	t.Run("default strategy", func(t *testing.T) {
+		t.Parallel()
+
+		deployment, replicaSet := testableWorkload(t, "")
+		invalid := testableOwnedPod(t, "api-abc-1", replicaSet)
+		invalid.Annotations = map[string]string{annotationStrategy: "recreate"}
+		r, kubeClient := setup(t, deployment, replicaSet, invalid, testableOwnedPod(t, "bare", nil))
+		r.defaultStrategy = restartStrategy{name: strategyRollout}
+		err := r.restart(context.Background(), slog.New(slog.DiscardHandler), pods(t, kubeClient, "api-abc-1", "bare"))
+		require.NoError(t, err)
+
+		// Pods without a workload to roll out are deleted instead.
+		require.NotEmpty(t, restartedAt(t, kubeClient))
+		require.True(t, podExists(t, kubeClient, "api-abc-1"))
+		require.False(t, podExists(t, kubeClient, "bare"))
+	})
+
+	t.Run("delete options", func(t *testing.T) {
+		t.Parallel()
+
+		pod := testableOwnedPod(t, "api", nil)
+		pod.Annotations = map[string]string{annotationStrategy: "delete,grace-period=5s,propagation=Orphan"}
+		r, kubeClient := setup(t, pod)
+
+		var opts metav1.DeleteOptions
+		kubeClient.PrependReactor("delete", "pods", func(action k8stesting.Action) (bool, runtime.Object, error) {
+			opts = action.(k8stesting.DeleteActionImpl).DeleteOptions
+			return false, nil, nil
+		})
+		err := r.restart(context.Background(), slog.New(slog.DiscardHandler), pods(t, kubeClient, "api"))
+		require.NoError(t, err)
+
+		require.Equal(t, int64(5), *opts.GracePeriodSeconds)
+		require.Equal(t, metav1.DeletePropagationOrphan, *opts.PropagationPolicy)
+	})
+
+	t.Run("batches", func(t *testing.T) {
+		t.Parallel()
+
+		deployment, replicaSet := testableWorkload(t, "delete,batch-size=1")
+		r, kubeClient := setup(t, deployment, replicaSet,
+			testableOwnedPod(t, "api-abc-1", replicaSet),
+			testableOwnedPod(t, "api-abc-2", replicaSet),
+		)
+		r.batchTimeout = 10 * time.Second
+		restart := pods(t, kubeClient, "api-abc-1", "api-abc-2")
+
+		// Stand in for the ReplicaSet controller, replacing the first pod with a ready one.
+		replaced := new(sync.Once)
+		kubeClient.PrependReactor("delete", "pods", func(k8stesting.Action) (bool, runtime.Object, error) {
+			replaced.Do(func() {
+				require.NoError(t, kubeClient.Tracker().Add(testableOwnedPod(t, "api-abc-3", replicaSet)))
+			})
+			return false, nil, nil
+		})
+		require.NoError(t, r.restart(context.Background(), slog.New(slog.DiscardHandler), restart))
+
+		require.False(t, podExists(t, kubeClient, "api-abc-1"))
+		require.False(t, podExists(t, kubeClient, "api-abc-2"))
+		require.True(t, podExists(t, kubeClient, "api-abc-3"))
+	})
+
+	t.Run("batch not replaced", func(t *testing.T) {
+		t.Parallel()
+
+		deployment, replicaSet := testableWorkload(t, "delete,batch-size=1")
+		r, kubeClient := setup(t, deployment, replicaSet,
+			testableOwnedPod(t, "api-abc-1", replicaSet),
+			testableOwnedPod(t, "api-abc-2", replicaSet),
+		)
+		r.batchTimeout = 10 * time.Millisecond
+		err := r.restart(context.Background(), slog.New(slog.DiscardHandler), pods(t, kubeClient, "api-abc-1", "api-abc-2"))
+		require.ErrorContains(t, err, "deleted pods not replaced, 1 pods left")
+
+		require.False(t, podExists(t, kubeClient, "api-abc-1"))
+		require.True(t, podExists(t, kubeClient, "api-abc-2"))
+	})
+
+	t.Run("rollout budget", func(t *testing.T) {
+		t.Parallel()
+
+		deployment, replicaSet := testableWorkload(t, "rollout")
+		r, kubeClient := setup(t, deployment, replicaSet,
+			testableOwnedPod(t, "api-abc-1", replicaSet),
+			testableOwnedPod(t, "api-abc-2", replicaSet),
+		)
+		r.killer.limiter = newRestartLimiter(0, 1)
+
+		// The namespace budget allows a single pod, and the rollout replaces two.
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		t.Cleanup(cancel)
+		err := r.restart(ctx, slog.New(slog.DiscardHandler), pods(t, kubeClient, "api-abc-1", "api-abc-2"))
+		require.ErrorContains(t, err, "failed to roll out Deployment default/api")
+
+		require.Empty(t, restartedAt(t, kubeClient))
+	})
+
+	t.Run("event per strategy", func(t *testing.T) {
+		t.Parallel()
+
+		deployment, replicaSet := testableWorkload(t, "rollout")
+		r, kubeClient := setup(t, deployment, replicaSet,
+			testableOwnedPod(t, "api-abc-1", replicaSet),
+			testableOwnedPod(t, "bare", nil),
+		)
+		hook, err := newWebhook(&webhookConfig{Name: "test", URL: "http://127.0.0.1"})
+		require.NoError(t, err)
+		r.notifier = newNotifier(kubeClient, []*webhook{hook}, 10, time.Millisecond)
+		r.defaultStrategy = restartStrategy{name: strategyDelete}
+
+		ref := &corev1.ObjectReference{Kind: "ConfigMap", Namespace: "default", Name: "app"}
+		errs := make(chan error, 1)
+		r.restartNotified(context.Background(), slog.New(slog.DiscardHandler), ref, []string{"key"},
+			pods(t, kubeClient, "api-abc-1", "bare"), func(err error) { errs <- err })
+		require.NoError(t, <-errs)
+
+		events := r.notifier.queues[0].events
+		require.Len(t, events, 4)
+		for _, want := range []struct{ eventType, strategy string }{
+			{eventStarted, strategyRollout},
+			{eventSucceeded, strategyRollout},
+			{eventStarted, strategyDelete},
+			{eventSucceeded, strategyDelete},
+		} {
+			event := <-events
+			require.Equal(t, want.eventType, event.Type)
+			require.Equal(t, want.strategy, event.Strategy)
+		}
+	})
+
+	t.Run("batches off the caller", func(t *testing.T) {
+		t.Parallel()
+
+		deployment, replicaSet := testableWorkload(t, "delete,batch-size=1")
+		r, kubeClient := setup(t, deployment, replicaSet,
+			testableOwnedPod(t, "api-abc-1", replicaSet),
+			testableOwnedPod(t, "api-abc-2", replicaSet),
+		)
+		r.batchTimeout = time.Hour
+		r.tasks = newRestartTasks()
+
+		// Nothing replaces the first batch, so the restart waits until cancelled.
+		ctx, cancel := context.WithCancel(context.Background())
+		t.Cleanup(cancel)
+		ref := &corev1.ObjectReference{Kind: "ConfigMap", Namespace: "default", Name: "app"}
+		errs := make(chan error, 1)
+		r.restartNotified(ctx, slog.New(slog.DiscardHandler), ref, []string{"key"},
+			pods(t, kubeClient, "api-abc-1", "api-abc-2"), func(err error) { errs <- err })
+
+		require.Eventually(t, func() bool {
+			return !podExists(t, kubeClient, "api-abc-1")
+		}, 5*time.Second, 10*time.Millisecond)
+		require.True(t, podExists(t, kubeClient, "api-abc-2"))
+		require.Empty(t, errs)
+
+		cancel()
+		r.tasks.wait()
+		require.ErrorIs(t, <-errs, context.Canceled)
+	})
+}
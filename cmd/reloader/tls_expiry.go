@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+
+	"github.com/jacobbrewer1/web/logging"
+)
+
+const (
+	// annotationCachedNotBefore is set on the cached copy of a TLS Secret to the start of the validity of its
+	// certificate, as the certificate itself is replaced by its digest.
+	annotationCachedNotBefore = internalAnnotationPrefix + "tls-not-before"
+
+	// annotationCachedNotAfter is set on the cached copy of a TLS Secret to the end of the validity of its
+	// certificate.
+	annotationCachedNotAfter = internalAnnotationPrefix + "tls-not-after"
+)
+
+// errNoCertificate is returned when the tls.crt key of a Secret holds no PEM encoded certificate.
+var errNoCertificate = errors.New("no certificate found in " + corev1.TLSCertKey)
+
+// certificateValidity returns the validity window of the leaf certificate of a TLS Secret, which comes first in the
+// tls.crt chain. Cached Secrets only hold the digest of the certificate, so the window recorded when they were cached
+// is returned for them.
+func certificateValidity(secret *corev1.Secret) (notBefore, notAfter time.Time, err error) {
+	if before, ok := secret.Annotations[annotationCachedNotBefore]; ok {
+		if notBefore, err = time.Parse(time.RFC3339, before); err != nil {
+			return time.Time{}, time.Time{}, fmt.Errorf("invalid cached certificate validity: %w", err)
+		}
+		if notAfter, err = time.Parse(time.RFC3339, secret.Annotations[annotationCachedNotAfter]); err != nil {
+			return time.Time{}, time.Time{}, fmt.Errorf("invalid cached certificate validity: %w", err)
+		}
+		return notBefore, notAfter, nil
+	}
+
+	rest := secret.Data[corev1.TLSCertKey]
+	for {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			return time.Time{}, time.Time{}, errNoCertificate
+		} else if block.Type != "CERTIFICATE" {
+			continue
+		}
+
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return time.Time{}, time.Time{}, fmt.Errorf("failed to parse certificate: %w", err)
+		}
+		return cert.NotBefore, cert.NotAfter, nil
+	}
+}
+
+// recordCertificateValidity records the validity window of the certificate of a TLS Secret in its annotations, before
+// the cache transform replaces the certificate by its digest. Secrets without a valid certificate are left alone.
+func recordCertificateValidity(secret *corev1.Secret) {
+	if secret.Type != corev1.SecretTypeTLS {
+		return
+	}
+
+	notBefore, notAfter, err := certificateValidity(secret)
+	if err != nil {
+		return
+	}
+
+	if secret.Annotations == nil {
+		secret.Annotations = make(map[string]string, 2)
+	}
+	secret.Annotations[annotationCachedNotBefore] = notBefore.UTC().Format(time.RFC3339)
+	secret.Annotations[annotationCachedNotAfter] = notAfter.UTC().Format(time.RFC3339)
+}
+
+// checkCertificates exports the days left before the certificate of every TLS Secret of this replica with dependent
+// pods expires, and restarts the dependent pods that started before the current certificate became valid. Those were
+// missed by the reload of the renewal, or started with the previous certificate. Secrets with a reload in progress are
+// skipped, as their pods are being restarted already.
+func (r *reloader) checkCertificates(ctx context.Context, l *slog.Logger, now time.Time) error {
+	secrets, err := r.secretLister.List(labels.Everything())
+	if err != nil {
+		return fmt.Errorf("failed to list secrets: %w", err)
+	}
+
+	reloading := make(map[string]bool)
+	for _, record := range r.tracker.queuedReloads() {
+		reloading[record.Object] = true
+	}
+
+	tlsExpiryDays.Reset()
+	for _, secret := range secrets {
+		if secret.Type != corev1.SecretTypeTLS || !r.bucket.InBucket(secret.Name) {
+			continue
+		}
+
+		ref := objectReference("Secret", secret)
+		pods, err := r.dependents(ref)
+		if err != nil {
+			return err
+		} else if len(pods) == 0 {
+			continue
+		}
+
+		notBefore, notAfter, err := certificateValidity(secret)
+		if err != nil {
+			l.Warn("failed to read certificate",
+				slog.String(logKeyObject, referenceKey(ref)),
+				slog.String(logging.KeyError, err.Error()),
+			)
+			continue
+		}
+		tlsExpiryDays.WithLabelValues(secret.Namespace, secret.Name).Set(notAfter.Sub(now).Hours() / 24)
+
+		// A certificate that is not valid yet would restart its pods at every check until it is.
+		if notBefore.After(now) || reloading[referenceKey(ref)] || !r.triggers(secret.Labels, secret.Annotations) {
+			continue
+		}
+
+		// Pods that started before the certificate became valid may still serve the certificate it replaced.
+		stale := podsStartedBefore(pods, notBefore)
+		if len(stale) == 0 {
+			continue
+		}
+
+		l.Info("restarting pods started before the current certificate",
+			slog.String(logKeyObject, referenceKey(ref)),
+			slog.Int(logKeyPods, len(stale)),
+		)
+		r.reloadPods(ctx, l, ref, []string{corev1.TLSCertKey}, "", stale)
+	}
+	return nil
+}
+
+// watchCertificates periodically checks the certificates of the TLS Secrets pods depend on.
+func (a *App) watchCertificates(ctx context.Context) {
+	l := logging.LoggerWithComponent(a.base.Logger(), "tls")
+
+	ticker := time.NewTicker(a.config.TLSCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			if err := a.reloader.checkCertificates(ctx, l, now); err != nil {
+				l.Error("failed to check certificates", slog.String(logging.KeyError, err.Error()))
+			}
+		}
+	}
+}
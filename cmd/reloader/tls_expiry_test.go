@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"log/slog"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes/fake"
+
+	"github.com/jacobbrewer1/web/cache"
+)
+
+// testableTLSSecret returns a TLS Secret holding a self-signed certificate valid from notBefore for 90 days.
+func testableTLSSecret(t *testing.T, name string, notBefore time.Time) *corev1.Secret {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    notBefore,
+		NotAfter:     notBefore.Add(90 * 24 * time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+
+	return &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default"},
+		Type:       corev1.SecretTypeTLS,
+		Data: map[string][]byte{
+			corev1.TLSCertKey:       pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+			corev1.TLSPrivateKeyKey: []byte("key"),
+		},
+	}
+}
+
+func Test_CertificateValidity(t *testing.T) {
+	t.Parallel()
+
+	notBefore := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	t.Run("certificate", func(t *testing.T) {
+		t.Parallel()
+
+		gotBefore, gotAfter, err := certificateValidity(testableTLSSecret(t, "tls", notBefore))
+		require.NoError(t, err)
+		require.Equal(t, notBefore, gotBefore.UTC())
+		require.Equal(t, notBefore.Add(90*24*time.Hour), gotAfter.UTC())
+	})
+
+	t.Run("cached", func(t *testing.T) {
+		t.Parallel()
+
+		secret := testableTLSSecret(t, "tls", notBefore)
+		_, err := cacheTransform(false)(secret)
+		require.NoError(t, err)
+		require.Equal(t, "2024-01-01T00:00:00Z", secret.Annotations[annotationCachedNotBefore])
+
+		gotBefore, gotAfter, err := certificateValidity(secret)
+		require.NoError(t, err)
+		require.Equal(t, notBefore, gotBefore)
+		require.Equal(t, notBefore.Add(90*24*time.Hour), gotAfter)
+	})
+
+	t.Run("no certificate", func(t *testing.T) {
+		t.Parallel()
+
+		secret := testableTLSSecret(t, "tls", notBefore)
+		secret.Data[corev1.TLSCertKey] = pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: []byte("key")})
+
+		_, _, err := certificateValidity(secret)
+		require.ErrorIs(t, err, errNoCertificate)
+	})
+
+	t.Run("invalid certificate", func(t *testing.T) {
+		t.Parallel()
+
+		secret := testableTLSSecret(t, "tls", notBefore)
+		secret.Data[corev1.TLSCertKey] = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: []byte("cert")})
+
+		_, _, err := certificateValidity(secret)
+		require.ErrorContains(t, err, "failed to parse certificate")
+	})
+}
+
+func Test_ReloaderCheckCertificates(t *testing.T) {
+	t.Parallel()
+
+	now := time.Now()
+	renewed := now.Add(-time.Hour)
+
+	// setup returns a reloader caching the Secret and a pod started before and one after the certificate was renewed.
+	setup := func(t *testing.T, secret *corev1.Secret) (*reloader, *fake.Clientset) {
+		t.Helper()
+
+		ctx, cancel := context.WithCancel(context.Background())
+		t.Cleanup(cancel)
+
+		oldPod := testableDependentPod(t, "old", "default", "Secret", secret.Name)
+		oldPod.Status.StartTime = &metav1.Time{Time: renewed.Add(-time.Hour)}
+		newPod := testableDependentPod(t, "new", "default", "Secret", secret.Name)
+		newPod.Status.StartTime = &metav1.Time{Time: renewed.Add(time.Minute)}
+
+		kubeClient := fake.NewClientset(secret, oldPod, newPod)
+		informerFactory := informers.NewSharedInformerFactory(kubeClient, 0)
+		r := testableReloader(t, cache.NewFixedHashBucket(1), kubeClient, informerFactory)
+		informerFactory.Start(ctx.Done())
+		informerFactory.WaitForCacheSync(ctx.Done())
+
+		return r, kubeClient
+	}
+
+	podExists := func(t *testing.T, kubeClient *fake.Clientset, name string) bool {
+		t.Helper()
+		_, err := kubeClient.CoreV1().Pods("default").Get(context.Background(), name, metav1.GetOptions{})
+		return err == nil
+	}
+
+	t.Run("stale pods restarted", func(t *testing.T) {
+		t.Parallel()
+
+		r, kubeClient := setup(t, testableTLSSecret(t, "renewed", renewed))
+		require.NoError(t, r.checkCertificates(context.Background(), slog.New(slog.DiscardHandler), now))
+
+		require.False(t, podExists(t, kubeClient, "old"))
+		require.True(t, podExists(t, kubeClient, "new"))
+	})
+
+	t.Run("not valid yet", func(t *testing.T) {
+		t.Parallel()
+
+		r, kubeClient := setup(t, testableTLSSecret(t, "future", now.Add(time.Hour)))
+		require.NoError(t, r.checkCertificates(context.Background(), slog.New(slog.DiscardHandler), now))
+
+		require.True(t, podExists(t, kubeClient, "old"))
+		require.True(t, podExists(t, kubeClient, "new"))
+	})
+
+	t.Run("ignored", func(t *testing.T) {
+		t.Parallel()
+
+		secret := testableTLSSecret(t, "ignored", renewed)
+		secret.Annotations = map[string]string{annotationIgnore: "true"}
+
+		r, kubeClient := setup(t, secret)
+		require.NoError(t, r.checkCertificates(context.Background(), slog.New(slog.DiscardHandler), now))
+
+		require.True(t, podExists(t, kubeClient, "old"))
+	})
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// reloadRecord describes a reload that is held, in progress or failed.
+type reloadRecord struct {
+	// Object is the key of the object whose change triggered the reload.
+	Object string `json:"object"`
+
+	// ChangedKeys are the data keys that changed, if known.
+	ChangedKeys []string `json:"changed_keys,omitempty"`
+
+	// Pods are the names of the pods being reloaded.
+	Pods []string `json:"pods"`
+
+	// Reason explains why the reload is held, or why it failed.
+	Reason string `json:"reason,omitempty"`
+
+	// Started is when the reload started.
+	Started time.Time `json:"started"`
+}
+
+// reloadTracker keeps the reloads in progress and the most recent failures.
+type reloadTracker struct {
+	// mut guards the tracked reloads.
+	mut *sync.Mutex
+
+	// nextID is the identifier given to the next reload.
+	nextID uint64
+
+	// queued are the reloads in progress, including those waiting for the restart budget.
+	queued map[uint64]*reloadRecord
+
+	// failed are the most recent failed reloads, oldest first.
+	failed []*reloadRecord
+
+	// maxFailed is the number of failed reloads kept.
+	maxFailed int
+}
+
+// newReloadTracker creates a new reloadTracker keeping up to maxFailed failures.
+func newReloadTracker(maxFailed int) *reloadTracker {
+	return &reloadTracker{
+		mut:       new(sync.Mutex),
+		queued:    make(map[uint64]*reloadRecord),
+		failed:    make([]*reloadRecord, 0),
+		maxFailed: maxFailed,
+	}
+}
+
+// newReloadRecord builds the record of a reload of the given pods.
+func newReloadRecord(object string, keys []string, pods []*corev1.Pod, reason string) *reloadRecord {
+	names := make([]string, 0, len(pods))
+	for _, pod := range pods {
+		names = append(names, pod.Name)
+	}
+	sort.Strings(names)
+
+	return &reloadRecord{
+		Object:      object,
+		ChangedKeys: keys,
+		Pods:        names,
+		Reason:      reason,
+		Started:     time.Now(),
+	}
+}
+
+// start tracks a reload of the given pods and returns its identifier.
+func (t *reloadTracker) start(ref *corev1.ObjectReference, keys []string, pods []*corev1.Pod) uint64 {
+	t.mut.Lock()
+	defer t.mut.Unlock()
+
+	t.nextID++
+	t.queued[t.nextID] = newReloadRecord(referenceKey(ref), keys, pods, "")
+	return t.nextID
+}
+
+// finish stops tracking the reload, keeping it as a failure if err is set.
+func (t *reloadTracker) finish(id uint64, err error) {
+	t.mut.Lock()
+	defer t.mut.Unlock()
+
+	record, ok := t.queued[id]
+	if !ok {
+		return
+	}
+	delete(t.queued, id)
+
+	if err == nil || t.maxFailed <= 0 {
+		return
+	}
+
+	record.Reason = err.Error()
+	t.failed = append(t.failed, record)
+	if len(t.failed) > t.maxFailed {
+		t.failed = t.failed[len(t.failed)-t.maxFailed:]
+	}
+}
+
+// queuedReloads returns the reloads in progress, oldest first.
+func (t *reloadTracker) queuedReloads() []*reloadRecord {
+	t.mut.Lock()
+	defer t.mut.Unlock()
+
+	records := make([]*reloadRecord, 0, len(t.queued))
+	for _, record := range t.queued {
+		records = append(records, record)
+	}
+	sort.Slice(records, func(i, j int) bool {
+		return records[i].Started.Before(records[j].Started)
+	})
+	return records
+}
+
+// failedReloads returns the most recent failed reloads, oldest first.
+func (t *reloadTracker) failedReloads() []*reloadRecord {
+	t.mut.Lock()
+	defer t.mut.Unlock()
+
+	return append([]*reloadRecord(nil), t.failed...)
+}
+
+// sortedKeys returns the sorted keys of the given map.
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+
+	"github.com/pelletier/go-toml/v2"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/kubernetes"
+	listersv1 "k8s.io/client-go/listers/core/v1"
+	"k8s.io/kube-openapi/pkg/validation/spec"
+	"k8s.io/kube-openapi/pkg/validation/strfmt"
+	"k8s.io/kube-openapi/pkg/validation/validate"
+	"sigs.k8s.io/yaml"
+
+	"github.com/jacobbrewer1/web/logging"
+)
+
+const (
+	// annotationValidate is the object annotation declaring how its keys are validated before a reload, as a comma
+	// separated list of "<key>=<format>" rules. The key "*" applies to every key. The format is one of json, yaml,
+	// toml or "schema:<configmap>[/<key>]", which parses the content as YAML and matches it against the JSON Schema
+	// stored in the given ConfigMap of the same namespace.
+	annotationValidate = "reloader/validate"
+
+	// reasonInvalidContent is the event reason used when a reload is blocked by invalid content.
+	reasonInvalidContent = "ReloadInvalidContent"
+
+	// formatJSON requires the content to parse as JSON.
+	formatJSON = "json"
+
+	// formatYAML requires the content to parse as YAML.
+	formatYAML = "yaml"
+
+	// formatTOML requires the content to parse as TOML.
+	formatTOML = "toml"
+
+	// formatSchemaPrefix prefixes the format that matches the content against a JSON Schema.
+	formatSchemaPrefix = "schema:"
+
+	// defaultSchemaKey is the key of the schema ConfigMap holding the schema when no key is given.
+	defaultSchemaKey = "schema.json"
+
+	// validateAllKeys is the rule key that applies to every key.
+	validateAllKeys = "*"
+)
+
+var (
+	// ErrInvalidValidationRule is returned when the validation annotation cannot be parsed.
+	ErrInvalidValidationRule = errors.New("invalid validation rule")
+
+	// errInvalidContent is returned when a key does not match its validation rule.
+	errInvalidContent = errors.New("invalid content")
+)
+
+type (
+	// validationRule is a single rule of the validation annotation.
+	validationRule struct {
+		// key is the data key validated, or validateAllKeys.
+		key string
+
+		// format is the format the content must parse as.
+		format string
+
+		// schemaConfigMap is the name of the ConfigMap holding the JSON Schema, for the schema format.
+		schemaConfigMap string
+
+		// schemaKey is the key of the schema ConfigMap holding the JSON Schema.
+		schemaKey string
+	}
+
+	// contentValidator blocks reloads of objects whose content does not match their validation annotation, so that
+	// the running pods keep the last good configuration.
+	contentValidator struct {
+		// kubeClient is used to record events.
+		kubeClient kubernetes.Interface
+
+		// configMapLister is used to read JSON Schemas.
+		configMapLister listersv1.ConfigMapLister
+	}
+)
+
+// newContentValidator creates a new contentValidator.
+func newContentValidator(kubeClient kubernetes.Interface, configMapLister listersv1.ConfigMapLister) *contentValidator {
+	return &contentValidator{
+		kubeClient:      kubeClient,
+		configMapLister: configMapLister,
+	}
+}
+
+// parseValidationRules parses the value of the validation annotation.
+func parseValidationRules(value string) ([]validationRule, error) {
+	rules := make([]validationRule, 0)
+	for _, part := range strings.Split(value, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+
+		key, format, ok := strings.Cut(part, "=")
+		key, format = strings.TrimSpace(key), strings.TrimSpace(format)
+		if !ok || key == "" || format == "" {
+			return nil, fmt.Errorf("%w: %q is not of the form <key>=<format>", ErrInvalidValidationRule, part)
+		}
+
+		rule := validationRule{key: key, format: format}
+		switch {
+		case format == formatJSON, format == formatYAML, format == formatTOML:
+		case strings.HasPrefix(format, formatSchemaPrefix):
+			rule.format = formatSchemaPrefix
+			name, schemaKey, _ := strings.Cut(strings.TrimPrefix(format, formatSchemaPrefix), "/")
+			if name == "" {
+				return nil, fmt.Errorf("%w: %q has no schema ConfigMap", ErrInvalidValidationRule, part)
+			}
+			if schemaKey == "" {
+				schemaKey = defaultSchemaKey
+			}
+			rule.schemaConfigMap, rule.schemaKey = name, schemaKey
+		default:
+			return nil, fmt.Errorf("%w: unknown format %q", ErrInvalidValidationRule, format)
+		}
+
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// allow reports whether the reload of the referenced object may go ahead. Every key matching a rule of the
+// validation annotation is validated, and a Warning event is recorded for each invalid key.
+func (v *contentValidator) allow(
+	ctx context.Context,
+	l *slog.Logger,
+	ref *corev1.ObjectReference,
+	annotations map[string]string,
+	data map[string][]byte,
+) bool {
+	invalid := v.check(ref, annotations, data)
+	for _, key := range sortedKeys(invalid) {
+		v.block(ctx, l, ref, key, validationMetricKey(annotations, key), invalid[key])
+	}
+	return len(invalid) == 0
+}
+
+// check validates every key matching a rule of the validation annotation and returns the errors keyed by data key.
+// A broken annotation is reported under the annotation name.
+func (v *contentValidator) check(
+	ref *corev1.ObjectReference,
+	annotations map[string]string,
+	data map[string][]byte,
+) map[string]error {
+	value, ok := annotations[annotationValidate]
+	if !ok {
+		return nil
+	}
+
+	rules, err := parseValidationRules(value)
+	if err != nil {
+		// The owner asked for validation, so a broken annotation must not let unvalidated content through.
+		return map[string]error{annotationValidate: err}
+	}
+
+	invalid := make(map[string]error)
+	for _, key := range dataKeys(data) {
+		for _, rule := range rules {
+			if rule.key != key && rule.key != validateAllKeys {
+				continue
+			}
+
+			if err := v.validate(ref.Namespace, rule, data[key]); err != nil {
+				invalid[key] = err
+				break
+			}
+		}
+	}
+	return invalid
+}
+
+// validate validates the content of a key against the rule.
+func (v *contentValidator) validate(namespace string, rule validationRule, content []byte) error {
+	var doc any
+	switch rule.format {
+	case formatJSON:
+		if err := json.Unmarshal(content, &doc); err != nil {
+			return fmt.Errorf("%w: not valid JSON: %w", errInvalidContent, err)
+		}
+	case formatYAML:
+		if err := yaml.Unmarshal(content, &doc); err != nil {
+			return fmt.Errorf("%w: not valid YAML: %w", errInvalidContent, err)
+		}
+	case formatTOML:
+		if err := toml.Unmarshal(content, &doc); err != nil {
+			return fmt.Errorf("%w: not valid TOML: %w", errInvalidContent, err)
+		}
+	case formatSchemaPrefix:
+		schema, err := v.schema(namespace, rule)
+		if err != nil {
+			return err
+		}
+
+		if err := yaml.Unmarshal(content, &doc); err != nil {
+			return fmt.Errorf("%w: not valid YAML: %w", errInvalidContent, err)
+		}
+
+		if err := validate.AgainstSchema(schema, doc, strfmt.Default); err != nil {
+			return fmt.Errorf("%w: does not match schema %s/%s: %w",
+				errInvalidContent, rule.schemaConfigMap, rule.schemaKey, err)
+		}
+	}
+	return nil
+}
+
+// schema reads the JSON Schema of the rule. The schema may be written as JSON or YAML.
+func (v *contentValidator) schema(namespace string, rule validationRule) (*spec.Schema, error) {
+	configMap, err := v.configMapLister.ConfigMaps(namespace).Get(rule.schemaConfigMap)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get schema ConfigMap %s: %w", rule.schemaConfigMap, err)
+	}
+
+	content, ok := configMap.Data[rule.schemaKey]
+	if !ok {
+		return nil, fmt.Errorf("schema ConfigMap %s has no key %s", rule.schemaConfigMap, rule.schemaKey)
+	}
+
+	b, err := yaml.YAMLToJSON([]byte(content))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse schema %s/%s: %w", rule.schemaConfigMap, rule.schemaKey, err)
+	}
+
+	schema := new(spec.Schema)
+	if err := json.Unmarshal(b, schema); err != nil {
+		return nil, fmt.Errorf("failed to parse schema %s/%s: %w", rule.schemaConfigMap, rule.schemaKey, err)
+	}
+	return schema, nil
+}
+
+// validationMetricKey returns the key a validation failure of the given key is counted under: the key itself when a
+// rule names it, and the wildcard otherwise.
+func validationMetricKey(annotations map[string]string, key string) string {
+	rules, err := parseValidationRules(annotations[annotationValidate])
+	if err != nil {
+		return annotationValidate
+	}
+
+	for _, rule := range rules {
+		if rule.key == key {
+			return key
+		}
+	}
+	return validateAllKeys
+}
+
+// block reports a reload blocked by the given key, counted under the metric key.
+func (v *contentValidator) block(
+	ctx context.Context,
+	l *slog.Logger,
+	ref *corev1.ObjectReference,
+	key, metricKey string,
+	err error,
+) {
+	l.Warn("reload blocked by invalid content",
+		slog.String(logKeyObject, referenceKey(ref)),
+		slog.String(logKeyKey, key),
+		slog.String(logging.KeyError, err.Error()),
+	)
+	validationFailures.WithLabelValues(ref.Namespace, ref.Kind, metricKey).Inc()
+
+	message := fmt.Sprintf("Reload blocked, key %q is invalid: %v", key, err)
+	if err := recordWarning(ctx, v.kubeClient, ref, reasonInvalidContent, message); err != nil {
+		l.Error("failed to record event", slog.String(logging.KeyError, err.Error()))
+	}
+}
+
+// configMapContent returns the data and binary data of the configMap as a single map.
+func configMapContent(configMap *corev1.ConfigMap) map[string][]byte {
+	data := make(map[string][]byte, len(configMap.Data)+len(configMap.BinaryData))
+	for k, v := range configMap.Data {
+		data[k] = []byte(v)
+	}
+	for k, v := range configMap.BinaryData {
+		data[k] = v
+	}
+	return data
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/fake"
+
+	"github.com/jacobbrewer1/web/cache"
+)
+
+func testableContentValidator(
+	t *testing.T,
+	kubeClient kubernetes.Interface,
+	informerFactory informers.SharedInformerFactory,
+) *contentValidator {
+	t.Helper()
+	return newContentValidator(kubeClient, informerFactory.Core().V1().ConfigMaps().Lister())
+}
+
+func Test_ParseValidationRules(t *testing.T) {
+	t.Parallel()
+
+	t.Run("valid", func(t *testing.T) {
+		t.Parallel()
+
+		rules, err := parseValidationRules("config.yaml=yaml, settings.json = schema:settings, app.toml=toml, *=schema:shared/app.yaml")
+		require.NoError(t, err)
+		require.Equal(t, []validationRule{
+			{key: "config.yaml", format: formatYAML},
+			{key: "settings.json", format: formatSchemaPrefix, schemaConfigMap: "settings", schemaKey: defaultSchemaKey},
+			{key: "app.toml", format: formatTOML},
+			{key: validateAllKeys, format: formatSchemaPrefix, schemaConfigMap: "shared", schemaKey: "app.yaml"},
+		}, rules)
+	})
+
+	for _, value := range []string{"config.yaml", "config.yaml=xml", "=json", "config.yaml=schema:"} {
+		t.Run(value, func(t *testing.T) {
+			t.Parallel()
+
+			_, err := parseValidationRules(value)
+			require.ErrorIs(t, err, ErrInvalidValidationRule)
+		})
+	}
+}
+
+func Test_ContentValidatorValidate(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+
+	schema := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: "settings", Namespace: "default"},
+		Data: map[string]string{
+			defaultSchemaKey: `{
+				"type": "object",
+				"required": ["port"],
+				"properties": {"port": {"type": "integer", "minimum": 1}}
+			}`,
+		},
+	}
+
+	kubeClient := fake.NewClientset(schema)
+	informerFactory := informers.NewSharedInformerFactory(kubeClient, 0)
+	v := testableContentValidator(t, kubeClient, informerFactory)
+	informerFactory.Start(ctx.Done())
+	informerFactory.WaitForCacheSync(ctx.Done())
+
+	schemaRule := validationRule{format: formatSchemaPrefix, schemaConfigMap: "settings", schemaKey: defaultSchemaKey}
+
+	tests := []struct {
+		name    string
+		rule    validationRule
+		content string
+		valid   bool
+	}{
+		{name: "json", rule: validationRule{format: formatJSON}, content: `{"a": 1}`, valid: true},
+		{name: "invalid json", rule: validationRule{format: formatJSON}, content: `{"a": `},
+		{name: "yaml", rule: validationRule{format: formatYAML}, content: "a:\n  b: 1\n", valid: true},
+		{name: "invalid yaml", rule: validationRule{format: formatYAML}, content: "a: [1, 2\n"},
+		{name: "toml", rule: validationRule{format: formatTOML}, content: "[server]\nport = 8080\n", valid: true},
+		{name: "invalid toml", rule: validationRule{format: formatTOML}, content: "[server\n"},
+		{name: "schema", rule: schemaRule, content: "port: 8080\n", valid: true},
+		{name: "schema mismatch", rule: schemaRule, content: "port: zero\n"},
+		{name: "schema missing property", rule: schemaRule, content: "host: localhost\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			err := v.validate("default", tt.rule, []byte(tt.content))
+			if tt.valid {
+				require.NoError(t, err)
+				return
+			}
+			require.ErrorIs(t, err, errInvalidContent)
+		})
+	}
+
+	t.Run("missing schema", func(t *testing.T) {
+		t.Parallel()
+
+		rule := schemaRule
+		rule.schemaConfigMap = "missing"
+		err := v.validate("default", rule, []byte("port: 8080\n"))
+		require.Error(t, err)
+	})
+}
+
+func Test_ValidationMetricKey(t *testing.T) {
+	t.Parallel()
+
+	annotations := map[string]string{annotationValidate: "config.yaml=yaml, *=json"}
+	require.Equal(t, "config.yaml", validationMetricKey(annotations, "config.yaml"))
+	require.Equal(t, validateAllKeys, validationMetricKey(annotations, "generated-7f3a.json"))
+
+	broken := map[string]string{annotationValidate: "config.yaml=xml"}
+	require.Equal(t, annotationValidate, validationMetricKey(broken, annotationValidate))
+}
+
+func Test_OnConfigMapUpdateInvalidContent(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "pod1",
+			Namespace: "default",
+			Labels:    map[string]string{"reloader/configmap": "app"},
+		},
+		Status: corev1.PodStatus{
+			Phase: corev1.PodRunning,
+		},
+	}
+
+	kubeClient := fake.NewClientset(pod)
+	informerFactory := informers.NewSharedInformerFactory(kubeClient, 0)
+	rel := testableReloader(t, cache.NewFixedHashBucket(1), kubeClient, informerFactory)
+	informerFactory.Start(ctx.Done())
+	informerFactory.WaitForCacheSync(ctx.Done())
+
+	old := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:            "app",
+			Namespace:       "default",
+			ResourceVersion: "1",
+			Annotations:     map[string]string{annotationValidate: "config.yaml=yaml"},
+		},
+		Data: map[string]string{"config.yaml": "a: 1\n"},
+	}
+	updated := old.DeepCopy()
+	updated.ResourceVersion = "2"
+	updated.Data["config.yaml"] = "a: [1\n"
+
+	onConfigMapUpdate(ctx, slog.New(slog.DiscardHandler), rel)(old, updated)
+
+	_, err := kubeClient.CoreV1().Pods("default").Get(ctx, pod.Name, metav1.GetOptions{})
+	require.NoError(t, err)
+
+	events, err := kubeClient.CoreV1().Events("default").List(ctx, metav1.ListOptions{})
+	require.NoError(t, err)
+	require.Len(t, events.Items, 1)
+	require.Equal(t, reasonInvalidContent, events.Items[0].Reason)
+	require.Contains(t, events.Items[0].Message, `"config.yaml"`)
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+	"time"
+
+	hashiVault "github.com/hashicorp/vault/api"
+	"github.com/spf13/viper"
+	corev1 "k8s.io/api/core/v1"
+
+	"github.com/jacobbrewer1/web"
+	"github.com/jacobbrewer1/web/logging"
+)
+
+const (
+	// annotationVaultPath declares the Vault KV v2 secrets a pod reads at startup, as comma separated API paths such
+	// as "secret/data/app". The pod is reloaded when a new version of one of them is written.
+	annotationVaultPath = "reloader/vault-path"
+
+	// kindVaultSecret is the kind given to Vault secrets in dependency keys, logs and notifications.
+	kindVaultSecret = "VaultSecret"
+)
+
+// errInvalidVaultPath is returned when a Vault path is not a KV v2 data path.
+var errInvalidVaultPath = errors.New("vault path must be a KV v2 data path, such as secret/data/app")
+
+// vaultWatcher polls the metadata of the Vault secrets pods depend on and reloads the pods when a new version of a
+// secret is written.
+type vaultWatcher struct {
+	// client reads the secret metadata from Vault.
+	client *hashiVault.Client
+
+	// reloader reloads the pods depending on a changed secret.
+	reloader *reloader
+
+	// versions are the current versions of the polled secrets, keyed by path, as of the last poll.
+	versions map[string]int
+}
+
+// newVaultClient creates a Vault client authenticated with the service account of reloader, through the client
+// builder of the base app. An empty address uses the default address of the base app.
+func newVaultClient(ctx context.Context, l *slog.Logger, addr string) (*hashiVault.Client, error) {
+	vip := viper.New()
+	vip.Set("vault.address", addr)
+
+	vc, err := web.VaultClient(ctx, l, vip)
+	if err != nil {
+		return nil, err
+	}
+	return vc.Client(), nil
+}
+
+// newVaultWatcher creates a new vaultWatcher.
+func newVaultWatcher(client *hashiVault.Client, r *reloader) *vaultWatcher {
+	return &vaultWatcher{
+		client:   client,
+		reloader: r,
+		versions: make(map[string]int),
+	}
+}
+
+// parseVaultPath splits a KV v2 data path into its mount and the path of the secret in the mount.
+func parseVaultPath(path string) (mount, secretPath string, err error) {
+	mount, secretPath, ok := strings.Cut(path, "/data/")
+	if !ok || mount == "" || secretPath == "" {
+		return "", "", fmt.Errorf("%w: %q", errInvalidVaultPath, path)
+	}
+	return mount, secretPath, nil
+}
+
+// podVaultPaths returns the valid Vault paths declared by the pod.
+func podVaultPaths(pod *corev1.Pod) []string {
+	value, ok := pod.Annotations[annotationVaultPath]
+	if !ok {
+		return nil
+	}
+
+	paths := make([]string, 0, 1)
+	for _, path := range strings.Split(value, ",") {
+		path = strings.TrimSpace(path)
+		if _, _, err := parseVaultPath(path); err == nil {
+			paths = append(paths, path)
+		}
+	}
+	return paths
+}
+
+// currentVersion reads the current version of the secret at the given path from its metadata.
+func (w *vaultWatcher) currentVersion(ctx context.Context, path string) (int, error) {
+	mount, secretPath, err := parseVaultPath(path)
+	if err != nil {
+		return 0, err
+	}
+
+	metadata, err := w.client.KVv2(mount).GetMetadata(ctx, secretPath)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read metadata of %s: %w", path, err)
+	}
+	return metadata.CurrentVersion, nil
+}
+
+// dependentPaths returns the Vault paths pods depend on, with the namespaces of the pods, from the dependency index.
+func (w *vaultWatcher) dependentPaths() map[string][]string {
+	kind := strings.ToLower(kindVaultSecret)
+
+	paths := make(map[string][]string)
+	for _, key := range w.reloader.podIndexer.ListIndexFuncValues(indexDependencies) {
+		parts := strings.SplitN(key, "/", 3)
+		if len(parts) == 3 && parts[1] == kind {
+			paths[parts[2]] = append(paths[parts[2]], parts[0])
+		}
+	}
+	return paths
+}
+
+// poll reads the current version of every Vault secret of this replica that pods depend on, and reloads the pods of
+// the secrets whose version changed since the last poll. The first version seen of a secret is only recorded.
+// Secrets whose metadata cannot be read keep their last known version.
+func (w *vaultWatcher) poll(ctx context.Context, l *slog.Logger) {
+	paths := w.dependentPaths()
+
+	versions := make(map[string]int, len(paths))
+	for _, path := range sortedKeys(paths) {
+		if !w.reloader.bucket.InBucket(path) {
+			continue
+		}
+
+		previous, seen := w.versions[path]
+		version, err := w.currentVersion(ctx, path)
+		if err != nil {
+			l.Warn("failed to read vault secret version",
+				slog.String(logKeyVaultPath, path),
+				slog.String(logging.KeyError, err.Error()),
+			)
+			if seen {
+				versions[path] = previous
+			}
+			continue
+		}
+
+		versions[path] = version
+		if !seen || version == previous {
+			continue
+		}
+
+		l.Info("vault secret version changed",
+			slog.String(logKeyVaultPath, path),
+			slog.Int(logKeyVersion, version),
+		)
+		for _, namespace := range paths[path] {
+			ref := &corev1.ObjectReference{
+				Kind:            kindVaultSecret,
+				Namespace:       namespace,
+				Name:            path,
+				ResourceVersion: strconv.Itoa(version),
+			}
+			// The content is not read, so the pods cannot be reloaded in place.
+			w.reloader.reload(ctx, l, ref, make([]string, 0), "")
+		}
+	}
+	w.versions = versions
+}
+
+// watchVault periodically polls the versions of the Vault secrets pods depend on.
+func (a *App) watchVault(ctx context.Context) {
+	l := logging.LoggerWithComponent(a.base.Logger(), "vault")
+
+	ticker := time.NewTicker(a.config.VaultPollInterval)
+	defer ticker.Stop()
+
+	a.vault.poll(ctx, l)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			a.vault.poll(ctx, l)
+		}
+	}
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	hashiVault "github.com/hashicorp/vault/api"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes/fake"
+
+	"github.com/jacobbrewer1/web/cache"
+)
+
+// testableVault is a Vault stand-in serving the KV v2 metadata of secrets with the given current versions.
+type testableVault struct {
+	mut      *sync.Mutex
+	versions map[string]int
+}
+
+func (v *testableVault) setVersion(path string, version int) {
+	v.mut.Lock()
+	defer v.mut.Unlock()
+	v.versions[path] = version
+}
+
+func (v *testableVault) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	v.mut.Lock()
+	defer v.mut.Unlock()
+
+	version, ok := v.versions[strings.TrimPrefix(r.URL.Path, "/v1/")]
+	if r.Method != http.MethodGet || !ok {
+		w.WriteHeader(http.StatusNotFound)
+		_, _ = w.Write([]byte(`{"errors": []}`))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write([]byte(`{"data": {"current_version": ` + strconv.Itoa(version) + `}}`))
+}
+
+func testableVaultClient(t *testing.T, versions map[string]int) (*hashiVault.Client, *testableVault) {
+	t.Helper()
+
+	vault := &testableVault{mut: new(sync.Mutex), versions: versions}
+	srv := httptest.NewServer(vault)
+	t.Cleanup(srv.Close)
+
+	cfg := hashiVault.DefaultConfig()
+	cfg.Address = srv.URL
+	cfg.MaxRetries = 0
+
+	client, err := hashiVault.NewClient(cfg)
+	require.NoError(t, err)
+	client.SetToken("test")
+
+	return client, vault
+}
+
+func testableVaultPod(t *testing.T, name, namespace, paths string) *corev1.Pod {
+	t.Helper()
+
+	pod := testablePod(t)
+	pod.Name = name
+	pod.Namespace = namespace
+	pod.Annotations = map[string]string{annotationVaultPath: paths}
+	return pod
+}
+
+func Test_ParseVaultPath(t *testing.T) {
+	t.Parallel()
+
+	mount, secretPath, err := parseVaultPath("secret/data/team/app")
+	require.NoError(t, err)
+	require.Equal(t, "secret", mount)
+	require.Equal(t, "team/app", secretPath)
+
+	for _, path := range []string{"secret/app", "secret/data/", "/data/app", ""} {
+		_, _, err := parseVaultPath(path)
+		require.ErrorIs(t, err, errInvalidVaultPath, path)
+	}
+}
+
+func Test_PodVaultPaths(t *testing.T) {
+	t.Parallel()
+
+	pod := testableVaultPod(t, "api", "default", "secret/data/app, kv/data/db,secret/app")
+	require.Equal(t, []string{"secret/data/app", "kv/data/db"}, podVaultPaths(pod))
+	require.Empty(t, podVaultPaths(testablePod(t)))
+}
+
+func Test_VaultWatcherPoll(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	pods := []*corev1.Pod{
+		testableVaultPod(t, "api", "team-a", "secret/data/app"),
+		testableVaultPod(t, "worker", "team-b", "secret/data/app,secret/data/db"),
+		testableVaultPod(t, "db", "team-b", "secret/data/db"),
+		testableVaultPod(t, "missing", "team-b", "secret/data/missing"),
+	}
+
+	kubeClient := fake.NewClientset()
+	for _, pod := range pods {
+		_, err := kubeClient.CoreV1().Pods(pod.Namespace).Create(ctx, pod, metav1.CreateOptions{})
+		require.NoError(t, err)
+	}
+
+	informerFactory := informers.NewSharedInformerFactory(kubeClient, 0)
+	r := testableReloader(t, cache.NewFixedHashBucket(1), kubeClient, informerFactory)
+	informerFactory.Start(ctx.Done())
+	informerFactory.WaitForCacheSync(ctx.Done())
+
+	client, vault := testableVaultClient(t, map[string]int{
+		"secret/metadata/app": 1,
+		"secret/metadata/db":  3,
+	})
+	w := newVaultWatcher(client, r)
+	l := slog.New(slog.DiscardHandler)
+
+	podExists := func(pod *corev1.Pod) bool {
+		_, err := kubeClient.CoreV1().Pods(pod.Namespace).Get(ctx, pod.Name, metav1.GetOptions{})
+		return err == nil
+	}
+
+	// The first poll only records the current versions.
+	w.poll(ctx, l)
+	require.Equal(t, map[string]int{"secret/data/app": 1, "secret/data/db": 3}, w.versions)
+	for _, pod := range pods {
+		require.True(t, podExists(pod), pod.Name)
+	}
+
+	vault.setVersion("secret/metadata/app", 2)
+	w.poll(ctx, l)
+	require.Equal(t, map[string]int{"secret/data/app": 2, "secret/data/db": 3}, w.versions)
+	require.False(t, podExists(pods[0]))
+	require.False(t, podExists(pods[1]))
+	require.True(t, podExists(pods[2]))
+	require.True(t, podExists(pods[3]))
+
+	// Secrets whose metadata cannot be read keep their last known version.
+	vault.setVersion("secret/metadata/db", 4)
+	require.NoError(t, client.SetAddress("http://127.0.0.1:1"))
+	w.poll(ctx, l)
+	require.Equal(t, 3, w.versions["secret/data/db"])
+	require.True(t, podExists(pods[2]))
+}